@@ -83,6 +83,8 @@ loop:
 func (c *Client) initDataChannel(remoteCfg *uc.AuthResponse) (err error) {
 	port := remoteCfg.DataChannel
 	session := packet.NewSessionCli(remoteCfg.UserId, []byte(remoteCfg.Token))
+	session.SetLoginNonce(remoteCfg.ClientNonce, remoteCfg.Nonce)
+	session.SetVersion(remoteCfg.Version)
 
 	if c.dcCli != nil {
 		c.dcCli.Close()
@@ -132,6 +134,9 @@ func (c *Client) onRelogin(remoteCfg *uc.AuthResponse) error {
 	if err := c.initDataChannel(remoteCfg); err != nil {
 		return logex.Trace(err)
 	}
+	c.ctl.SetPeerVersion(remoteCfg.PacketVersion, packet.Caps(remoteCfg.Caps))
+	// the server may be restarted
+	c.ctl.ResetPeer()
 	c.ctl.RequestNewDC()
 	return nil
 }
@@ -159,6 +164,7 @@ func (c *Client) onFirstLogin(remoteCfg *uc.AuthResponse) error {
 	if err := c.initController(c.dcIn.Send(), c.dcOut.Recv(), tunIn); err != nil {
 		return logex.Trace(err)
 	}
+	c.ctl.SetPeerVersion(remoteCfg.PacketVersion, packet.Caps(remoteCfg.Caps))
 
 	c.initRouteTable()
 
@@ -177,7 +183,13 @@ loop:
 			break loop
 		case data := <-tunOut:
 			p := packet.New(data, packet.DATA)
-			c.ctl.Send(p)
+			p.Classify()
+			if err := c.ctl.Send(p); err != nil {
+				if err == controller.ErrControllerClosed {
+					break loop
+				}
+				logex.Error("send to controller:", err)
+			}
 		}
 	}
 }
@@ -191,6 +203,7 @@ func (c *Client) initRouteTable() {
 
 func (c *Client) initController(toDC packet.SendChan, fromDC packet.RecvChan, toTun chan<- []byte) error {
 	c.ctl = controller.NewClient(c.flow, c, toDC, fromDC, toTun)
+	c.ctl.SetChecksum(c.cfg.Checksum)
 	c.ctl.RequestNewDC()
 	return nil
 }
@@ -1,6 +1,11 @@
 package clish
 
-import "fmt"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
 
 type Controller struct {
 	Stage *ControllerStage `flagly:"handler"`
@@ -13,5 +18,10 @@ func (*ControllerStage) FlaglyHandle(c Client) error {
 	if err != nil {
 		return err
 	}
-	return fmt.Errorf("staging: %v", len(info))
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "staging: %v", len(info))
+	for _, i := range info {
+		fmt.Fprintf(buf, "\n\t%v\t%v\t%v", i.ReqId, i.DataType, i.Age.Truncate(time.Millisecond))
+	}
+	return errors.New(buf.String())
 }
@@ -59,7 +59,10 @@ func (ShellRouteShow) FlaglyHandle(c Client, rl *readline.Instance) error {
 	if len(eis) > 0 {
 		fmt.Fprintln(rl, "EphemeralItem:")
 		for _, ei := range eis {
-			fmt.Fprintf(rl, "\t%v:\t%v\t\t%v\n", ei.Expired, ei.CIDR, ei.Comment)
+			fmt.Fprintf(rl, "\t%v:\t%v\t\t%v\t%v\t%v\n",
+				ei.Remaining.Truncate(time.Second), ei.CIDR, ei.Comment,
+				ei.Source, ei.Status,
+			)
 		}
 
 	}
@@ -78,8 +81,9 @@ func (ShellRouteShow) FlaglyHandle(c Client, rl *readline.Instance) error {
 
 		fmt.Fprintln(rl, "Item:")
 		for _, item := range items {
-			fmt.Fprintf(rl, "\t%v\t%v\n",
-				util.FillString(item.CIDR, max, " "), item.Comment,
+			fmt.Fprintf(rl, "\t%v\t%v\t%v\t%v\n",
+				util.FillString(item.CIDR, max, " "), item.Comment, item.Source,
+				item.Status,
 			)
 		}
 	}
@@ -113,6 +117,7 @@ func (arg *ShellRouteAddDomain) FlaglyHandle(c Client, rl *readline.Instance) er
 	}
 	for _, ip := range ips {
 		cfg.CIDR = ip.String()
+		cfg.source = route.SourceDNS
 		if err := cfg.FlaglyHandle(c); err != nil {
 			if logex.Equal(route.ErrRouteItemExists, err) {
 				fmt.Fprintf(rl, "ip %v is exists! ignore\n", cfg.CIDR)
@@ -132,6 +137,8 @@ type ShellRouteAdd struct {
 	Force   bool   `name:"f" desc:"force execute even comment is missing"`
 	CIDR    string `type:"[0]"`
 	Comment string `type:"[1]"`
+
+	source route.Source
 }
 
 func (arg *ShellRouteAdd) FlaglyHandle(c Client) (err error) {
@@ -141,11 +148,15 @@ func (arg *ShellRouteAdd) FlaglyHandle(c Client) (err error) {
 	if !arg.Force && arg.Comment == "" && arg.Duration == 0 {
 		return flagly.Error("comment is empty")
 	}
+	if arg.source == "" {
+		arg.source = route.SourceManual
+	}
 	if arg.Duration == 0 {
 		item, err := route.NewItemCIDR(arg.CIDR, arg.Comment)
 		if err != nil {
 			return flagly.Error(err.Error())
 		}
+		item.Source = arg.source
 		routeTable, err := c.GetRoute()
 		if err != nil {
 			return err
@@ -164,6 +175,7 @@ func (arg *ShellRouteAdd) FlaglyHandle(c Client) (err error) {
 		if err != nil {
 			return err
 		}
+		item.Source = arg.source
 		ei := &route.EphemeralItem{
 			Item:    item,
 			Expired: time.Now().Add(arg.Duration).Round(time.Second),
@@ -172,10 +184,15 @@ func (arg *ShellRouteAdd) FlaglyHandle(c Client) (err error) {
 		if err != nil {
 			return err
 		}
-		err = routeTable.AddEphemeralItem(ei)
+		result, err := routeTable.AddEphemeralItem(ei)
 		if err != nil {
 			return err
 		}
+		if result == route.EphemeralCovered {
+			return fmt.Errorf("ephemeral item '%v' is covered by persistent route",
+				ei.CIDR,
+			)
+		}
 		err = c.SaveRoute()
 		if err != nil {
 			return err
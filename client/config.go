@@ -20,6 +20,7 @@ type Config struct {
 	AesKey    string `name:"key"`
 	RouteFile string `default:"routes.conf"`
 	Pprof     string `default:":10060"`
+	Checksum  bool   `desc:"checksum the outgoing packets if the server supports"`
 
 	Sock string `desc:"unixsock for interactive with" default:"/tmp/next.sock"`
 
@@ -9,6 +9,7 @@ import (
 
 	"github.com/chzyer/logex"
 	"github.com/chzyer/next/mchan"
+	"github.com/chzyer/next/packet"
 	"github.com/chzyer/next/uc"
 	"github.com/chzyer/next/util"
 	"github.com/chzyer/next/util/clock"
@@ -84,10 +85,14 @@ func (c *HTTP) Login(onLogin func(*uc.AuthResponse) error) error {
 func (c *HTTP) doLogin(username string, password string) (*uc.AuthResponse, error) {
 	req := uc.NewAuthRequest(
 		username, c.clock.Unix(), []byte(password), c.AesKey)
+	req.Version = packet.L2Version
+	req.PacketVersion = packet.MaxVersion
+	req.Caps = uint32(packet.SupportedCaps)
 	var ret uc.AuthResponse
 	if err := c.httpReq(&ret, "/auth", req); err != nil {
 		return nil, err
 	}
+	ret.ClientNonce = req.Nonce
 	return &ret, nil
 }
 
@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chzyer/next/packet"
+)
+
+const (
+	DefaultOutBacklog  = 1024
+	DefaultOutLagAlert = 5 * time.Second
+)
+
+// outBacklog buffer the incoming packets for the consumer of the out chan,
+// so the readLoop is never blocked by a slow consumer and the responses
+// keep being matched. the oldest packets are dropped if it's full.
+type outBacklog struct {
+	size    int
+	n       int
+	batches *list.List
+	notify  chan struct{}
+	m       sync.Mutex
+}
+
+type outBatch struct {
+	ps []*packet.Packet
+	at time.Time
+}
+
+func newOutBacklog(size int) *outBacklog {
+	return &outBacklog{
+		size:    size,
+		batches: list.New(),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// Push returns the packets dropped to make room for ps
+func (b *outBacklog) Push(ps []*packet.Packet, now time.Time) (dropped []*packet.Packet) {
+	b.m.Lock()
+	b.batches.PushBack(&outBatch{ps: ps, at: now})
+	b.n += len(ps)
+	for b.n > b.size {
+		front := b.batches.Front().Value.(*outBatch)
+		over := b.n - b.size
+		if over >= len(front.ps) {
+			b.batches.Remove(b.batches.Front())
+			over = len(front.ps)
+		}
+		dropped = append(dropped, front.ps[:over]...)
+		front.ps = front.ps[over:]
+		b.n -= over
+	}
+	b.m.Unlock()
+
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+	return dropped
+}
+
+// Pop returns nil if it's empty
+func (b *outBacklog) Pop() *outBatch {
+	b.m.Lock()
+	defer b.m.Unlock()
+	front := b.batches.Front()
+	if front == nil {
+		return nil
+	}
+	batch := b.batches.Remove(front).(*outBatch)
+	b.n -= len(batch.ps)
+	return batch
+}
+
+func (b *outBacklog) Len() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.n
+}
+
+// pushOut never blocks, the dropped packets are counted by Stat.OutDropped.
+// the dropped requests are forgotten by the dedup window, so they are
+// handled once retransmitted.
+func (c *Controller) pushOut(ps []*packet.Packet) {
+	dropped := c.backlog.Push(ps, time.Now())
+	if len(dropped) == 0 {
+		return
+	}
+	atomic.AddUint64(&c.outDropped, uint64(len(dropped)))
+	c.logger.Errorf("out chan is full, drop %v oldest packets", len(dropped))
+	for _, p := range dropped {
+		if p.Type.IsReq() && p.Type != packet.DATA {
+			c.dedup.Forget(p.ReqId)
+		}
+	}
+}
+
+// outLoop forward the backlog to the out chan, a warning is logged once if
+// a batch waits longer than Config.OutLagAlert, until the consumer catches
+// up.
+func (c *Controller) outLoop() {
+	c.flow.Add(1)
+	defer c.flow.DoneAndClose()
+
+	lagging := false
+	for {
+		batch := c.backlog.Pop()
+		if batch == nil {
+			select {
+			case <-c.backlog.notify:
+				continue
+			case <-c.flow.IsClose():
+				return
+			}
+		}
+		if batch.ps = c.dropStale(batch.ps, batch.at); len(batch.ps) == 0 {
+			continue
+		}
+
+		timer := time.NewTimer(c.outLagAlert - time.Since(batch.at))
+		select {
+		case c.out <- batch.ps:
+			if time.Since(batch.at) < c.outLagAlert {
+				lagging = false
+			}
+		case <-timer.C:
+			if !lagging {
+				lagging = true
+				c.logger.Errorf("out chan consumer lags more than %v, %v packets are waiting",
+					c.outLagAlert, c.backlog.Len()+len(batch.ps))
+			}
+			select {
+			case c.out <- batch.ps:
+			case <-c.flow.IsClose():
+				return
+			}
+		case <-c.flow.IsClose():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
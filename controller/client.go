@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 
 	"github.com/chzyer/flow"
-	"github.com/chzyer/logex"
 	"github.com/chzyer/next/packet"
 )
 
@@ -37,7 +36,7 @@ func (c *Client) GetFlow() *flow.Flow {
 }
 
 func (c *Client) RequestNewDC() {
-	logex.Info("request new dc")
+	c.logger.Infof("request new dc")
 	select {
 	case c.newDC <- struct{}{}:
 	default:
@@ -52,7 +51,12 @@ loop:
 	for {
 		select {
 		case <-c.newDC:
-			c.Send(packet.New(nil, packet.NEWDC))
+			if err := c.Send(packet.New(nil, packet.NEWDC)); err != nil {
+				if err == ErrControllerClosed {
+					break loop
+				}
+				c.logger.Errorf("request new dc: %v", err)
+			}
 		case <-c.flow.IsClose():
 			break loop
 		}
@@ -75,7 +79,16 @@ func (c *Client) handlePacket(p *packet.Packet) bool {
 		}
 	}
 	if p.Type.IsReq() {
-		c.Send(p.Reply(nil))
+		return c.sendReply(p.Reply(nil))
+	}
+	return true
+}
+
+// sendReply returns false if the controller is closed
+func (c *Client) sendReply(p *packet.Packet) bool {
+	if err := c.Send(p); err != nil {
+		c.logger.Errorf("send %v: %v", p, err)
+		return err != ErrControllerClosed
 	}
 	return true
 }
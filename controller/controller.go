@@ -1,149 +1,1088 @@
 package controller
 
 import (
+	"context"
+	"crypto/cipher"
 	"fmt"
+	"math/rand"
 	"sync/atomic"
 	"time"
 
 	"github.com/chzyer/flow"
 	"github.com/chzyer/logex"
 	"github.com/chzyer/next/packet"
+	"github.com/chzyer/next/util"
 )
 
 var (
-	ErrTimeout = fmt.Errorf("timed out")
+	ErrControllerClosed = fmt.Errorf("controller is closed")
+	ErrSendQueueFull    = fmt.Errorf("send queue is full")
+	ErrRequestTimeout   = fmt.Errorf("request timed out after max retries")
+	ErrNotRequest       = logex.Define("packet type %v is not a request")
+	ErrNoCipher         = logex.Define("no cipher to open the sealed packet")
+	ErrReqIdCollision   = logex.Define("ReqId %v is reused by another request")
+	ErrInvalidConfig    = logex.Define("invalid controller config: %v")
+	ErrTooManyRequests  = fmt.Errorf("too many requests in flight")
+	ErrRequestCanceled  = fmt.Errorf("request is canceled")
+	ErrOutChanInUse     = fmt.Errorf("out chan is consumed by GetOutChan or HandleRequests already")
+	ErrPeerUnsupported  = logex.Define("%v is not supported by the peer")
 )
 
+const (
+	DefaultFragmentTimeout = 10 * time.Second
+	DefaultMaxStageAge     = 5 * time.Minute
+	DefaultBatchWindow     = time.Millisecond
+	DefaultMaxBatchSize    = 64
+	DefaultInQueueSize     = 8
+)
+
+// RetryConfig controls how the staged requests are resent if no reply is
+// received.
+type RetryConfig struct {
+	// wait for the first resend, doubled on each retry
+	Timeout    time.Duration
+	MaxBackoff time.Duration
+	// give up after MaxRetries resends, zero means never
+	MaxRetries int
+	// Jitter add a random part up to Jitter*wait to the wait, so the
+	// retries of many controllers are not synchronized
+	Jitter float64
+	// Rand returns a number in [0, 1), default to math/rand.Float64
+	Rand func() float64
+}
+
+var DefaultRetryConfig = RetryConfig{
+	Timeout:    2 * time.Second,
+	MaxBackoff: 30 * time.Second,
+	MaxRetries: 5,
+	Jitter:     0.2,
+}
+
+// backoff returns the wait before the next resend after n retries, it's
+// never larger than MaxBackoff.
+func (r RetryConfig) backoff(n int) time.Duration {
+	d := r.Timeout
+	for i := 0; i < n && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+	if r.Jitter > 0 {
+		rnd := r.Rand
+		if rnd == nil {
+			rnd = rand.Float64
+		}
+		d += time.Duration(float64(d) * r.Jitter * rnd())
+	}
+	if r.MaxBackoff > 0 && d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	return d
+}
+
+type Config struct {
+	// Retry default to DefaultRetryConfig if it's zero, otherwise the zero
+	// Timeout and MaxBackoff default to the ones of DefaultRetryConfig.
+	Retry RetryConfig
+	// ResendInterval is how often the staging requests are checked for
+	// resending, default to half of Retry.Timeout
+	ResendInterval time.Duration
+	// RequestTimeout limit the total time of Request including the
+	// retries, ErrRequestTimeout is returned if exceeded. zero means it's
+	// only limited by Retry.MaxRetries.
+	RequestTimeout time.Duration
+	// InQueueSize is the buffer of the send queues, default to
+	// DefaultInQueueSize. OutQueueSize is the buffer of GetOutChan, default
+	// to unbuffered.
+	InQueueSize  int
+	OutQueueSize int
+	// OutBacklog limit the incoming packets buffered for a slow consumer of
+	// GetOutChan or HandleRequests, the oldest ones are dropped if it's
+	// full. OutLagAlert is how long a packet waits before a warning is
+	// logged. default to DefaultOutBacklog and DefaultOutLagAlert
+	OutBacklog  int
+	OutLagAlert time.Duration
+	// MaxInFlight limit the requests which are waiting for replies, the
+	// later requests wait for a free slot, or fail with ErrTooManyRequests
+	// if sent by TrySend/TryRequest/RequestAsync/Broadcast. zero means
+	// unlimited.
+	MaxInFlight int
+	// StreamChunkTimeout is how long RequestStream waits for the next
+	// chunk, default to DefaultStreamChunkTimeout
+	StreamChunkTimeout time.Duration
+	// HandlerWorkers limit the concurrent calls of the handlers registered
+	// by Handle, default to DefaultHandlerWorkers
+	HandlerWorkers int
+	// MaxStageAge evict the staging requests which are not replied since
+	// they are sent first time, default to DefaultMaxStageAge
+	MaxStageAge time.Duration
+	// DedupSize and DedupTTL bound how many recent requests from the peer
+	// are remembered to drop the duplicated ones, default to
+	// DefaultDedupSize and DefaultDedupTTL
+	DedupSize int
+	DedupTTL  time.Duration
+	// OnUnmatchedReply is called from readLoop with the response which is
+	// not waited by any staging request, e.g. a late reply or a
+	// misbehaving peer. it can be nil.
+	OnUnmatchedReply func(*packet.Packet)
+	// BatchWindow is how long the writeLoop waits for more requests to
+	// coalesce them into one write to the data channel, MaxBatchSize limit
+	// the packets in one write. default to DefaultBatchWindow and
+	// DefaultMaxBatchSize
+	BatchWindow  time.Duration
+	MaxBatchSize int
+	// PropagateDeadline let the requests sent with a context deadline carry
+	// the remaining time if the peer has packet.CapTimeout. the
+	// incoming requests are dropped without handling if their requester
+	// has given up, with an allowance of DeadlineSkew for the delay on the
+	// way, default to DefaultDeadlineSkew.
+	PropagateDeadline bool
+	DeadlineSkew      time.Duration
+	// Tracer observe the lifecycle of the requests, e.g. LogTracer. nil
+	// means no tracing.
+	Tracer Tracer
+	// Cipher seal the outgoing packets and open the incoming ones, the
+	// packets failed to open are dropped. nil means cleartext. the peer
+	// must have packet.CapSeal, the packets are never sent in cleartext
+	// instead.
+	Cipher cipher.AEAD
+	// Logger default to util.DefaultLogger
+	Logger util.Logger
+}
+
+// Validate rejects the negative sizes and durations, zero means default
+func (c *Config) Validate() error {
+	switch {
+	case c.InQueueSize < 0:
+		return ErrInvalidConfig.Format("negative InQueueSize")
+	case c.OutQueueSize < 0:
+		return ErrInvalidConfig.Format("negative OutQueueSize")
+	case c.OutBacklog < 0:
+		return ErrInvalidConfig.Format("negative OutBacklog")
+	case c.OutLagAlert < 0:
+		return ErrInvalidConfig.Format("negative OutLagAlert")
+	case c.RequestTimeout < 0:
+		return ErrInvalidConfig.Format("negative RequestTimeout")
+	case c.ResendInterval < 0:
+		return ErrInvalidConfig.Format("negative ResendInterval")
+	case c.MaxInFlight < 0:
+		return ErrInvalidConfig.Format("negative MaxInFlight")
+	case c.HandlerWorkers < 0:
+		return ErrInvalidConfig.Format("negative HandlerWorkers")
+	case c.DeadlineSkew < 0:
+		return ErrInvalidConfig.Format("negative DeadlineSkew")
+	case c.StreamChunkTimeout < 0:
+		return ErrInvalidConfig.Format("negative StreamChunkTimeout")
+	case c.Retry.Timeout < 0:
+		return ErrInvalidConfig.Format("negative Retry.Timeout")
+	case c.Retry.MaxRetries < 0:
+		return ErrInvalidConfig.Format("negative Retry.MaxRetries")
+	}
+	return nil
+}
+
+func (c *Config) init() {
+	r := c.Retry
+	if r.Timeout == 0 && r.MaxBackoff == 0 && r.MaxRetries == 0 && r.Jitter == 0 && r.Rand == nil {
+		c.Retry = DefaultRetryConfig
+	}
+	if c.Retry.Timeout <= 0 {
+		c.Retry.Timeout = DefaultRetryConfig.Timeout
+	}
+	if c.Retry.MaxBackoff <= 0 {
+		c.Retry.MaxBackoff = DefaultRetryConfig.MaxBackoff
+	}
+	if c.ResendInterval <= 0 {
+		c.ResendInterval = c.Retry.Timeout / 2
+	}
+	if c.InQueueSize <= 0 {
+		c.InQueueSize = DefaultInQueueSize
+	}
+	if c.OutBacklog <= 0 {
+		c.OutBacklog = DefaultOutBacklog
+	}
+	if c.OutLagAlert <= 0 {
+		c.OutLagAlert = DefaultOutLagAlert
+	}
+	if c.HandlerWorkers <= 0 {
+		c.HandlerWorkers = DefaultHandlerWorkers
+	}
+	if c.DeadlineSkew <= 0 {
+		c.DeadlineSkew = DefaultDeadlineSkew
+	}
+	if c.StreamChunkTimeout <= 0 {
+		c.StreamChunkTimeout = DefaultStreamChunkTimeout
+	}
+	if c.MaxStageAge <= 0 {
+		c.MaxStageAge = DefaultMaxStageAge
+	}
+	if c.DedupSize <= 0 {
+		c.DedupSize = DefaultDedupSize
+	}
+	if c.DedupTTL <= 0 {
+		c.DedupTTL = DefaultDedupTTL
+	}
+	if c.BatchWindow <= 0 {
+		c.BatchWindow = DefaultBatchWindow
+	}
+	if c.MaxBatchSize <= 0 {
+		c.MaxBatchSize = DefaultMaxBatchSize
+	}
+	if c.Logger == nil {
+		c.Logger = util.DefaultLogger
+	}
+}
+
+// how the out chan is consumed
+const (
+	outNone int32 = iota
+	outChan
+	outHandler
+)
+
+type RetryStats struct {
+	Retransmits uint64
+	Failures    uint64
+}
+
+type StagingStats struct {
+	Size      int
+	Evictions uint64
+	OldestAge time.Duration
+}
+
 type Controller struct {
-	timeout time.Duration
-	flow    *flow.Flow
-	in      chan *Request
-	out     packet.Chan
-	toDC    packet.SendChan
-	fromDC  packet.RecvChan
-	reqId   uint32
-	stage   *Stage
+	retry       RetryConfig
+	resendEvery time.Duration
+	reqTimeout  time.Duration
+	streamWait  time.Duration
+	maxStageAge time.Duration
+	batchWindow time.Duration
+	maxBatch    int
+	propagate   bool
+	skew        time.Duration
+	logger      util.Logger
+	flow        *flow.Flow
+	in          chan *Request
+	inHigh      chan *Request
+	inBatch     chan []*Request
+	flushes     []chan struct{}
+	out         packet.Chan
+	outMode     int32
+	shutdown    int32
+	backlog     *outBacklog
+	outLagAlert time.Duration
+	handlers    *handlers
+	toDC        packet.SendChan
+	fromDC      packet.RecvChan
+	reqId       uint32
+	seq         uint64
+	stage       *Stage
+	mtu         int32
+	version     int32
+	peerCaps    uint32
+
+	// compress the outgoing payloads, only enable it if the peer can
+	// decompress them
+	compress int32
+	// checksum the outgoing packets, see SetChecksum
+	checksum int32
+
+	reassembler *packet.Reassembler
+	replay      *packet.ReplayWindow
+	dedup       *dedupWindow
+	aead        cipher.AEAD
+	tracer      *asyncTracer
+
+	onUnmatchedReply func(*packet.Packet)
+
+	// a slot is taken by each request in flight, nil means unlimited
+	inflight chan struct{}
+
+	retransmits uint64
+	failures    uint64
+	evictions   uint64
+	sent        uint64
+	replied     uint64
+	outDropped  uint64
+	stale       uint64
+	rtt         *rttWindow
 
 	cancelBroadcast *flow.Broadcast
 }
 
 func NewController(f *flow.Flow, toDC packet.SendChan, fromDC packet.RecvChan) *Controller {
+	return NewControllerWithConfig(f, toDC, fromDC, nil)
+}
+
+// NewControllerWithConfig panics if the cfg is invalid, see
+// NewControllerWithConfigE.
+func NewControllerWithConfig(f *flow.Flow, toDC packet.SendChan, fromDC packet.RecvChan, cfg *Config) *Controller {
+	ctl, err := NewControllerWithConfigE(f, toDC, fromDC, cfg)
+	if err != nil {
+		panic(err)
+	}
+	return ctl
+}
+
+// NewControllerWithConfigE is like NewControllerWithConfig, but returns
+// the error of Config.Validate instead of panic, nothing is started then.
+func NewControllerWithConfigE(f *flow.Flow, toDC packet.SendChan, fromDC packet.RecvChan, cfg *Config) (*Controller, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	// the defaults are never written back to the caller's
+	copied := *cfg
+	cfg = &copied
+	cfg.init()
 	ctl := &Controller{
-		timeout:         2 * time.Second,
-		in:              make(chan *Request, 8),
-		out:             make(packet.Chan),
+		retry:           cfg.Retry,
+		resendEvery:     cfg.ResendInterval,
+		reqTimeout:      cfg.RequestTimeout,
+		streamWait:      cfg.StreamChunkTimeout,
+		maxStageAge:     cfg.MaxStageAge,
+		batchWindow:     cfg.BatchWindow,
+		maxBatch:        cfg.MaxBatchSize,
+		propagate:       cfg.PropagateDeadline,
+		skew:            cfg.DeadlineSkew,
+		rtt:             newRTTWindow(DefaultRTTWindow),
+		dedup:           newDedupWindow(cfg.DedupSize, cfg.DedupTTL),
+		logger:          cfg.Logger,
+		in:              make(chan *Request, cfg.InQueueSize),
+		inHigh:          make(chan *Request, cfg.InQueueSize),
+		inBatch:         make(chan []*Request),
+		out:             packet.NewChan(cfg.OutQueueSize),
+		backlog:         newOutBacklog(cfg.OutBacklog),
+		outLagAlert:     cfg.OutLagAlert,
+		handlers:        newHandlers(cfg.HandlerWorkers),
 		toDC:            toDC,
 		fromDC:          fromDC,
 		cancelBroadcast: flow.NewBroadcast(),
+		reassembler:     packet.NewReassembler(DefaultFragmentTimeout),
+		replay:          packet.NewReplayWindow(packet.DefaultReplayWindow),
+		aead:            cfg.Cipher,
+
+		onUnmatchedReply: cfg.OnUnmatchedReply,
+	}
+	if cfg.MaxInFlight > 0 {
+		ctl.inflight = make(chan struct{}, cfg.MaxInFlight)
+	}
+	if cfg.Tracer != nil {
+		ctl.tracer = newAsyncTracer(cfg.Tracer, DefaultTraceQueueSize)
 	}
 	f.ForkTo(&ctl.flow, ctl.Close)
 	ctl.stage = newStage()
 	go ctl.readLoop()
 	go ctl.writeLoop()
 	go ctl.resendLoop()
-	return ctl
+	go ctl.outLoop()
+	if ctl.tracer != nil {
+		go ctl.traceLoop()
+	}
+	return ctl, nil
 }
 
 func (c *Controller) CancelAll() {
-	logex.Info("cancel all operation")
+	c.logger.Infof("cancel all operation")
 	c.cancelBroadcast.Notify()
 }
 
+// GetOutChan returns the chan of the incoming packets, it's fed from a
+// backlog so a slow consumer never blocks the replies, but the oldest
+// packets are dropped once Config.OutBacklog is exceeded. it panics if
+// HandleRequests is used.
 func (c *Controller) GetOutChan() packet.RecvChan {
+	atomic.CompareAndSwapInt32(&c.outMode, outNone, outChan)
+	if atomic.LoadInt32(&c.outMode) != outChan {
+		panic(ErrOutChanInUse)
+	}
 	return c.out.Recv()
 }
 
+// HandleRequests call fn with each incoming packet except the responses
+// in a new goroutine, the panic in fn is recovered. it can't be used with
+// GetOutChan and can be called only once.
+func (c *Controller) HandleRequests(fn func(*packet.Packet)) error {
+	if !atomic.CompareAndSwapInt32(&c.outMode, outNone, outHandler) {
+		return ErrOutChanInUse
+	}
+	go c.handleLoop(fn)
+	return nil
+}
+
+func (c *Controller) handleLoop(fn func(*packet.Packet)) {
+	c.flow.Add(1)
+	defer c.flow.Done()
+	for {
+		select {
+		case ps := <-c.out:
+			for _, p := range ps {
+				if !p.Type.IsResp() {
+					c.runHandler(fn, p)
+				}
+			}
+		case <-c.flow.IsClose():
+			return
+		}
+	}
+}
+
+func (c *Controller) runHandler(fn func(*packet.Packet), p *packet.Packet) {
+	defer func() {
+		if e := recover(); e != nil {
+			c.logger.Errorf("request handler panic: %v: %v", p, e)
+		}
+	}()
+	fn(p)
+}
+
+// GetReqId returns the next ReqId, the zero and the ReqIds which are still
+// staging are skipped when the counter wraps around.
 func (c *Controller) GetReqId() uint32 {
-	return atomic.AddUint32(&c.reqId, 1)
+	for {
+		id := atomic.AddUint32(&c.reqId, 1)
+		if id != 0 && !c.stage.Has(id) {
+			return id
+		}
+	}
+}
+
+// RetryStats returns how many packets are resent and how many requests are
+// given up after max retries.
+func (c *Controller) RetryStats() RetryStats {
+	return RetryStats{
+		Retransmits: atomic.LoadUint64(&c.retransmits),
+		Failures:    atomic.LoadUint64(&c.failures),
+	}
+}
+
+// Stat returns the metrics of the requests, the RTT is measured by the
+// requests which are replied without resend.
+func (c *Controller) Stat() Stat {
+	stat := Stat{
+		InFlight:     c.stage.Len(),
+		TotalSent:    atomic.LoadUint64(&c.sent),
+		TotalReplied: atomic.LoadUint64(&c.replied),
+		Retransmits:  atomic.LoadUint64(&c.retransmits),
+		Timeouts:     atomic.LoadUint64(&c.failures) + atomic.LoadUint64(&c.evictions),
+		OutDropped:   atomic.LoadUint64(&c.outDropped),
+		StaleDropped: atomic.LoadUint64(&c.stale),
+	}
+	duplicated, tooOld := c.replay.Rejected()
+	stat.ReplayDropped = duplicated + tooOld
+	stat.RTTMin, stat.RTTAvg, stat.RTTP99 = c.rtt.Summary()
+	return stat
+}
+
+// StagingStats returns the size of staging, how many requests are evicted
+// by age and the age of the oldest one.
+func (c *Controller) StagingStats() StagingStats {
+	size, oldest := c.stage.Stats(time.Now())
+	return StagingStats{
+		Size:      size,
+		Evictions: atomic.LoadUint64(&c.evictions),
+		OldestAge: oldest,
+	}
+}
+
+// SetMTU let the packets larger than mtu be fragmented if the peer has
+// packet.CapFragment, zero means never.
+func (c *Controller) SetMTU(mtu int) {
+	atomic.StoreInt32(&c.mtu, int32(mtu))
+}
+
+// SetPeerVersion set the packet layout and the caps negotiated with the
+// peer, see packet.Negotiate. the incoming packets of any known version are
+// accepted.
+func (c *Controller) SetPeerVersion(version int, caps packet.Caps) {
+	atomic.StoreInt32(&c.version, int32(version))
+	atomic.StoreUint32(&c.peerCaps, uint32(caps))
+}
+
+// PeerCaps returns the caps set by SetPeerVersion
+func (c *Controller) PeerCaps() packet.Caps {
+	return packet.Caps(atomic.LoadUint32(&c.peerCaps))
+}
+
+// SetCompress enable or disable the compression of the outgoing packets,
+// they are compressed only if the peer has packet.CapCompress. the incoming
+// packets are always decompressed.
+func (c *Controller) SetCompress(enable bool) {
+	var n int32
+	if enable {
+		n = 1
+	}
+	atomic.StoreInt32(&c.compress, n)
+}
+
+// SetChecksum enable or disable the checksum of the outgoing packets, it's
+// sent only if the peer has packet.CapChecksum, see SetPeerVersion. the
+// incoming packets are always verified if they have one.
+func (c *Controller) SetChecksum(enable bool) {
+	var n int32
+	if enable {
+		n = 1
+	}
+	atomic.StoreInt32(&c.checksum, n)
+}
+
+// SetReplayWindow change how many recent sequence numbers are remembered
+// to drop the replayed packets.
+func (c *Controller) SetReplayWindow(size int) {
+	c.replay.Reset(size)
+}
+
+// ResetPeer forget the Seqs and the ReqIds received from the peer, it must
+// be called if the peer may be restarted, e.g. it logs in again, otherwise
+// its packets are dropped as replays until its Seq passes the previous one,
+// and its new requests are answered by the cached responses of the old ones.
+func (c *Controller) ResetPeer() {
+	c.replay.Clear()
+	c.dedup.Clear()
 }
 
 func (c *Controller) Close() {
 	c.cancelBroadcast.Close()
 	c.flow.Close()
+	for _, req := range c.stage.Close() {
+		c.fail(req, ErrControllerClosed)
+	}
+	c.drainQueues()
+}
+
+// drainQueues fail the queued requests which are never staged
+func (c *Controller) drainQueues() {
+	for {
+		select {
+		case req := <-c.in:
+			c.fail(req, ErrControllerClosed)
+		case req := <-c.inHigh:
+			c.fail(req, ErrControllerClosed)
+		default:
+			return
+		}
+	}
+}
+
+// enqueue put the request into its queue, returns false if the controller
+// is closed. the request is failed if the controller is closed after it's
+// queued.
+func (c *Controller) enqueue(req *Request) bool {
+	select {
+	case c.queue(req) <- req:
+	case <-c.flow.IsClose():
+		return false
+	}
+	select {
+	case <-c.flow.IsClose():
+		c.drainQueues()
+	default:
+	}
+	return true
 }
 
 func (c *Controller) WriteChan() chan *Request {
 	return c.in
 }
 
+// Priority decide which queue the request is sent through, the high
+// priority requests overtake the queued normal ones, the order in the same
+// priority is preserved.
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+)
+
 type Request struct {
-	Packet  *packet.Packet
+	Packet   *packet.Packet
+	Priority Priority
+	// Reply must be buffered, it receives at most one reply, so the reply
+	// is never dropped even the caller is not receiving yet.
 	Reply   chan *packet.Packet
 	Timeout time.Duration
+
+	ctx      context.Context
+	retries  int
+	deadline time.Time
+	// when it's staged first time
+	created time.Time
+	// used instead of Reply by RequestAsync
+	callback func(*packet.Packet, error)
+	// set before Reply is closed
+	err error
+	// fail with ErrTooManyRequests instead of waiting for a slot
+	noWait bool
+	// slotNone, slotHeld or slotReleased
+	slot int32
+	// used instead of Reply by RequestStream
+	stream *stream
+	// a marker queued by Shutdown, closed once the requests queued before
+	// are written
+	flushed chan struct{}
+	// set once it's queued by sendQueued, see NotSentError
+	queued bool
+}
+
+// Err returns why the Reply channel is closed without a reply
+func (r *Request) Err() error {
+	return r.err
 }
 
 func NewRequest(p *packet.Packet, reply bool) *Request {
 	req := &Request{Packet: p}
 	if reply {
-		req.Reply = make(chan *packet.Packet)
+		req.Reply = make(chan *packet.Packet, 1)
 	}
 	return req
 }
 
-func (c *Controller) send(req *Request) (*packet.Packet, error) {
+// canceled returns whether the caller is no longer waiting for the request
+func (r *Request) canceled() bool {
+	return r.ctx != nil && r.ctx.Err() != nil
+}
+
+const (
+	slotNone int32 = iota
+	slotHeld
+	slotReleased
+)
+
+// acquire take a slot for the request which waits for reply if
+// Config.MaxInFlight is set, it waits for a free slot unless req.noWait.
+func (c *Controller) acquire(ctx context.Context, req *Request) error {
+	if c.inflight == nil || !req.Packet.Type.IsReq() || req.Packet.Type == packet.DATA {
+		return nil
+	}
+	if req.noWait {
+		select {
+		case c.inflight <- struct{}{}:
+		default:
+			return ErrTooManyRequests
+		}
+	} else {
+		select {
+		case c.inflight <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.cancelBroadcast.Wait():
+			return flow.ErrCanceled
+		case <-c.flow.IsClose():
+			return ErrControllerClosed
+		}
+	}
+	atomic.StoreInt32(&req.slot, slotHeld)
+	return nil
+}
+
+// release free the slot of the request, it's safe to call more than once
+func (c *Controller) release(req *Request) {
+	if atomic.CompareAndSwapInt32(&req.slot, slotHeld, slotReleased) {
+		<-c.inflight
+	}
+}
+
+func (c *Controller) send(ctx context.Context, req *Request) (*packet.Packet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.isShuttingDown() {
+		return nil, ErrShuttingDown
+	}
+	select {
+	case <-c.flow.IsClose():
+		return nil, ErrControllerClosed
+	default:
+	}
+	if err := c.checkCaps(req.Packet); err != nil {
+		return nil, err
+	}
+	if err := c.checkSize(req.Packet); err != nil {
+		return nil, err
+	}
 	var timeout <-chan time.Time
 	if req.Timeout > 0 {
 		timeout = time.After(req.Timeout)
 	}
+	if req.Packet.Type.IsReq() {
+		// assign the ReqId early to find the staging entry on cancel
+		req.Packet.SetReqId(c)
+	}
+	req.ctx = ctx
+	if err := c.acquire(ctx, req); err != nil {
+		return nil, err
+	}
+	rep, err := c.sendQueued(ctx, req, timeout)
+	if err != nil {
+		c.release(req)
+	}
+	return rep, err
+}
+
+func (c *Controller) sendQueued(ctx context.Context, req *Request, timeout <-chan time.Time) (*packet.Packet, error) {
 	select {
-	case c.in <- req:
-		logex.Debug(req.Packet.Type.String())
+	case c.queue(req) <- req:
+		req.queued = true
 		if req.Reply != nil {
 			select {
-			case rep := <-req.Reply:
+			case rep, ok := <-req.Reply:
+				if !ok {
+					return nil, req.err
+				}
 				return rep, nil
+			case <-ctx.Done():
+				c.Cancel(req.Packet.ReqId)
+				return nil, ctx.Err()
 			case <-c.flow.IsClose():
+				return nil, ErrControllerClosed
 			}
 		}
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case <-c.cancelBroadcast.Wait():
 		return nil, flow.ErrCanceled
 	case <-timeout:
-		return nil, ErrTimeout
+		return nil, ErrSendQueueFull
 	case <-c.flow.IsClose():
+		return nil, ErrControllerClosed
 	}
-	return nil, nil
 }
 
-func (c *Controller) Request(req *packet.Packet) *packet.Packet {
-	ret, _ := c.send(&Request{
+// Cancel remove the staging request so it's no longer resent, the waiting
+// caller gets ErrRequestCanceled. returns false if the request is not
+// staging, e.g. replied already or not sent yet.
+func (c *Controller) Cancel(reqId uint32) bool {
+	req := c.stage.Remove(reqId)
+	if req == nil {
+		return false
+	}
+	c.fail(req, ErrRequestCanceled)
+	return true
+}
+
+// Request send the request and wait for the reply, returns
+// ErrRequestTimeout if no reply after max retries or Config.RequestTimeout,
+// ErrControllerClosed if the controller is closed before the reply arrives.
+func (c *Controller) Request(req *packet.Packet) (*packet.Packet, error) {
+	rep, err := c.RequestE(req)
+	if e, ok := err.(*NotSentError); ok {
+		err = e.Err
+	}
+	return rep, err
+}
+
+// RequestE send the request and wait for the reply, returns
+// ErrControllerClosed if the flow is closed while waiting, nil with the
+// reply otherwise. a *NotSentError is returned if the request is never
+// queued, so the caller knows it's safe to retry.
+func (c *Controller) RequestE(req *packet.Packet) (*packet.Packet, error) {
+	r := &Request{
 		Packet: req,
-		Reply:  make(chan *packet.Packet),
+		Reply:  make(chan *packet.Packet, 1),
+	}
+	rep, err := c.request(r)
+	return rep, r.notSent(err)
+}
+
+func (c *Controller) request(req *Request) (*packet.Packet, error) {
+	if c.reqTimeout <= 0 {
+		return c.send(context.Background(), req)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
+	defer cancel()
+	rep, err := c.send(ctx, req)
+	if err == context.DeadlineExceeded {
+		err = ErrRequestTimeout
+	}
+	return rep, err
+}
+
+// RequestWithContext send the request and wait for the reply, returns
+// ctx.Err() if the ctx is done before the reply arrives.
+func (c *Controller) RequestWithContext(ctx context.Context, req *packet.Packet) (*packet.Packet, error) {
+	return c.send(ctx, &Request{
+		Packet: req,
+		Reply:  make(chan *packet.Packet, 1),
 	})
-	return ret
 }
 
-func (c *Controller) SendTimeout(req *packet.Packet, timeout time.Duration) bool {
-	_, err := c.send(&Request{Packet: req, Timeout: timeout})
-	return err != ErrTimeout
+// SendTimeout returns ErrSendQueueFull if the packet can't be queued in
+// timeout.
+func (c *Controller) SendTimeout(req *packet.Packet, timeout time.Duration) error {
+	_, err := c.send(context.Background(), &Request{Packet: req, Timeout: timeout})
+	return err
+}
+
+// Send queue the packet without waiting for reply, returns nil if it's
+// queued.
+func (c *Controller) Send(req *packet.Packet) error {
+	_, err := c.send(context.Background(), &Request{Packet: req})
+	return err
+}
+
+// SendE is like Send, but returns a *NotSentError if the packet is never
+// queued.
+func (c *Controller) SendE(req *packet.Packet) error {
+	r := &Request{Packet: req}
+	_, err := c.send(context.Background(), r)
+	return r.notSent(err)
+}
+
+// NotSentError is returned by RequestE and SendE if the packet is never
+// queued, e.g. the controller is closed already. the other errors mean
+// the packet may be sent, retrying it may duplicate.
+type NotSentError struct {
+	Err error
+}
+
+func (e *NotSentError) Error() string {
+	return "packet is not sent: " + e.Err.Error()
+}
+
+func (e *NotSentError) Unwrap() error {
+	return e.Err
+}
+
+// IsNotSent returns whether err is a *NotSentError
+func IsNotSent(err error) bool {
+	_, ok := err.(*NotSentError)
+	return ok
 }
 
-func (c *Controller) Send(req *packet.Packet) {
-	c.send(&Request{Packet: req})
+// notSent wrap err by NotSentError unless the request is queued
+func (r *Request) notSent(err error) error {
+	if err == nil || r.queued {
+		return err
+	}
+	return &NotSentError{Err: err}
+}
+
+// RequestAsync send the request without waiting, cb is called exactly once
+// with the reply or the error (ErrRequestTimeout, ErrControllerClosed). cb
+// runs on the goroutine which finishes the request: readLoop for replies,
+// resendLoop for timeouts or the caller of Close, so it must not block. the
+// panic in cb is recovered.
+func (c *Controller) RequestAsync(req *packet.Packet, cb func(*packet.Packet, error)) {
+	r := &Request{Packet: req, callback: cb, noWait: true}
+	if !req.Type.IsReq() {
+		c.runCallback(r, nil, ErrNotRequest.Format(req.Type))
+		return
+	}
+	if c.isShuttingDown() {
+		c.runCallback(r, nil, ErrShuttingDown)
+		return
+	}
+	req.SetReqId(c)
+	if err := c.acquire(context.Background(), r); err != nil {
+		c.runCallback(r, nil, err)
+		return
+	}
+	if !c.enqueue(r) {
+		c.fail(r, ErrControllerClosed)
+	}
+}
+
+// TrySend is like Send, but returns ErrTooManyRequests instead of waiting
+// if Config.MaxInFlight is reached.
+func (c *Controller) TrySend(req *packet.Packet) error {
+	_, err := c.send(context.Background(), &Request{Packet: req, noWait: true})
+	return err
+}
+
+// TryRequest is like Request, but returns ErrTooManyRequests instead of
+// waiting if Config.MaxInFlight is reached.
+func (c *Controller) TryRequest(req *packet.Packet) (*packet.Packet, error) {
+	return c.send(context.Background(), &Request{
+		Packet: req,
+		Reply:  make(chan *packet.Packet, 1),
+		noWait: true,
+	})
+}
+
+// SendWithPriority is like Send, but the packet is queued by the priority
+func (c *Controller) SendWithPriority(req *packet.Packet, prio Priority) error {
+	_, err := c.send(context.Background(), &Request{Packet: req, Priority: prio})
+	return err
+}
+
+// RequestWithPriority is like RequestWithContext, but the request is queued
+// by the priority
+func (c *Controller) RequestWithPriority(ctx context.Context, req *packet.Packet, prio Priority) (*packet.Packet, error) {
+	return c.send(ctx, &Request{
+		Packet:   req,
+		Reply:    make(chan *packet.Packet, 1),
+		Priority: prio,
+	})
+}
+
+// queue returns the channel for the priority of the request
+func (c *Controller) queue(req *Request) chan *Request {
+	if req.Priority == PriorityHigh {
+		return c.inHigh
+	}
+	return c.in
+}
+
+// SendContext send the packet without waiting for reply, returns ctx.Err()
+// if it can't be queued before ctx is done. the request is no longer
+// resent once ctx is done.
+func (c *Controller) SendContext(ctx context.Context, req *packet.Packet) error {
+	_, err := c.send(ctx, &Request{Packet: req})
+	return err
+}
+
+// Broadcast send all the packets in one batch without waiting for replies,
+// every packet is assigned a fresh ReqId. the packets are checked and the
+// requests take the slots of Config.MaxInFlight like TrySend, nothing is
+// sent if any of them fails, and ErrTooManyRequests is returned if the
+// slots are not enough.
+func (c *Controller) Broadcast(ps []*packet.Packet) error {
+	if c.isShuttingDown() {
+		return ErrShuttingDown
+	}
+	select {
+	case <-c.flow.IsClose():
+		return ErrControllerClosed
+	default:
+	}
+	reqs := make([]*Request, len(ps))
+	slots := 0
+	for idx, p := range ps {
+		if err := c.checkCaps(p); err != nil {
+			return err
+		}
+		if err := c.checkSize(p); err != nil {
+			return err
+		}
+		if p.Type.IsReq() && p.Type != packet.DATA {
+			slots++
+		}
+		// the slots are taken all or nothing, never wait with some of them
+		// held
+		reqs[idx] = &Request{Packet: p, noWait: true}
+	}
+	if c.inflight != nil && slots > cap(c.inflight) {
+		return ErrTooManyRequests
+	}
+	for idx, req := range reqs {
+		req.Packet.ReqId = c.GetReqId()
+		if err := c.acquire(context.Background(), req); err != nil {
+			c.releaseAll(reqs[:idx])
+			return err
+		}
+	}
+	select {
+	case c.inBatch <- reqs:
+		return nil
+	case <-c.flow.IsClose():
+		c.releaseAll(reqs)
+		return ErrControllerClosed
+	}
+}
+
+// releaseAll free the slots of the requests which are never queued
+func (c *Controller) releaseAll(reqs []*Request) {
+	for _, req := range reqs {
+		c.release(req)
+	}
 }
 
 func (c *Controller) handlePacket(ps []*packet.Packet) bool {
 	newPs := make([]*packet.Packet, 0, len(ps))
 	for _, p := range ps {
-		if p.Type.IsResp() {
+		if c.aead != nil || p.IsSealed() {
+			opened, err := c.open(p)
+			if err != nil {
+				c.logger.Errorf("drop packet %v: %v", p, err)
+				continue
+			}
+			p = opened
+		}
+		if p.Seq != 0 && !c.replay.Check(p.Seq) {
+			c.logger.Infof("drop replayed packet: %v", p)
+			continue
+		}
+		if p.Type == packet.FRAGMENT {
+			whole, err := c.reassembler.Feed(p)
+			if err != nil {
+				c.logger.Errorf("drop fragment %v: %v", p, err)
+				continue
+			}
+			if whole == nil {
+				continue
+			}
+			p = whole
+		}
+		if err := p.Decompress(); err != nil {
+			c.logger.Errorf("drop packet %v: %v", p, err)
+			continue
+		}
+		if c.isDuplicated(p) {
+			continue
+		}
+		if p.Type.IsReq() {
+			c.traceInbound(p)
+		}
+		if p.Type.IsResp() && p.IsStream() {
+			c.handleChunk(p)
+		} else if p.Type.IsResp() {
 			req := c.stage.Remove(p.ReqId)
-			if req != nil && req.Reply != nil {
-				select {
-				case req.Reply <- p:
-				default:
+			if req == nil && c.onUnmatchedReply != nil {
+				c.onUnmatchedReply(p)
+			}
+			if req != nil {
+				atomic.AddUint64(&c.replied, 1)
+				if req.retries == 0 {
+					c.rtt.Add(time.Since(req.created))
 				}
 			}
+			if req != nil {
+				c.traceRequest(traceReply, req)
+				c.reply(req, p)
+			}
+		}
+		if c.dispatch(p) {
+			continue
 		}
 		newPs = append(newPs, p)
 	}
+	if len(newPs) > 0 {
+		c.pushOut(newPs)
+	}
+	return true
+}
 
-	select {
-	case c.out <- newPs:
-	case <-c.flow.IsClose():
+// isDuplicated returns true if the request is handled already, the cached
+// response is sent again if any. the DATA packets are never checked.
+func (c *Controller) isDuplicated(p *packet.Packet) bool {
+	if !p.Type.IsReq() || p.Type == packet.DATA {
 		return false
 	}
+	dup, resp := c.dedup.Seen(p.ReqId, time.Now())
+	if !dup {
+		return false
+	}
+	c.logger.Infof("drop duplicated request: %v", p)
+	if resp != nil {
+		// never block the readLoop, the peer will retransmit if dropped
+		select {
+		case c.in <- &Request{Packet: resp}:
+		default:
+		}
+	}
 	return true
 }
 
+func (c *Controller) open(p *packet.Packet) (*packet.Packet, error) {
+	if c.aead == nil {
+		return nil, ErrNoCipher.Trace()
+	}
+	return p.Open(c.aead)
+}
+
 func (c *Controller) readLoop() {
 	c.flow.Add(1)
 	defer c.flow.DoneAndClose()
@@ -153,6 +1092,7 @@ loop:
 		case <-c.flow.IsClose():
 			break loop
 		case ps := <-c.fromDC:
+			packet.Debug("controller", packet.Inbound, ps)
 			if !c.handlePacket(ps) {
 				break loop
 			}
@@ -164,7 +1104,7 @@ func (c *Controller) resendLoop() {
 	c.flow.Add(1)
 	defer c.flow.DoneAndClose()
 
-	ticker := time.NewTicker(c.timeout)
+	ticker := time.NewTicker(c.resendEvery)
 	defer ticker.Stop()
 loop:
 	for {
@@ -172,75 +1112,318 @@ loop:
 		case flow.F_CLOSED:
 			break loop
 		case flow.F_TIMEOUT:
-		repop:
-			req := c.stage.Pop(c.timeout)
-			if req == nil {
-				continue
-			}
-			logex.Debug("pop stage:", req.Packet.ReqId, req.Packet.Type.String())
-			if req.Packet.Type == packet.DATA {
-				continue
-				// logex.Debug("resend:", req.Packet.ReqId, req.Packet.Type.String())
-			} else {
-				logex.Info("resend:", req.Packet.ReqId, req.Packet.Type.String())
+			now := time.Now()
+			for _, req := range c.stage.EvictOlder(now.Add(-c.maxStageAge)) {
+				atomic.AddUint64(&c.evictions, 1)
+				c.logger.Infof("evict stage: %v", req.Packet)
+				c.traceRequest(traceTimeout, req)
+				c.fail(req, ErrRequestTimeout)
 			}
-			select {
-			case c.in <- req:
-				goto repop
-			case <-c.flow.IsClose():
-				break loop
+			for _, req := range c.stage.Expired(now) {
+				c.logger.Infof("pop stage: %v", req.Packet)
+				if req.Packet.Type == packet.DATA || req.canceled() {
+					c.release(req)
+					continue
+				}
+				if req.stream != nil && req.stream.isStarted() {
+					c.traceRequest(traceTimeout, req)
+					c.fail(req, ErrStreamTimeout)
+					continue
+				}
+				if c.retry.MaxRetries > 0 && req.retries >= c.retry.MaxRetries {
+					c.giveUp(req)
+					continue
+				}
+				req.retries++
+				atomic.AddUint64(&c.retransmits, 1)
+				c.logger.Infof("resend: %v #%v", req.Packet, req.retries)
+				c.traceRequest(traceRetransmit, req)
+				if !c.enqueue(req) {
+					c.fail(req, ErrControllerClosed)
+					break loop
+				}
 			}
 		}
 	}
 }
 
+// giveUp notify the waiting caller with ErrRequestTimeout, the request must be
+// removed from stage already.
+func (c *Controller) giveUp(req *Request) {
+	atomic.AddUint64(&c.failures, 1)
+	c.logger.Infof("give up: %v", req.Packet)
+	c.traceRequest(traceTimeout, req)
+	c.fail(req, ErrRequestTimeout)
+}
+
+// fail close the Reply channel with err, the request must be removed from
+// stage already.
+func (c *Controller) fail(req *Request, err error) {
+	c.release(req)
+	if req.stream != nil {
+		c.logger.Errorf("stream %v is closed: %v", req.Packet, err)
+		req.stream.close()
+		return
+	}
+	if req.callback != nil {
+		c.runCallback(req, nil, err)
+		return
+	}
+	if req.Reply != nil {
+		req.err = err
+		close(req.Reply)
+	}
+}
+
+// reply deliver the response to the request, the request must be removed
+// from stage already. the error response fails the request with a
+// *packet.RemoteError.
+func (c *Controller) reply(req *Request, p *packet.Packet) {
+	c.release(req)
+	if p.IsError() {
+		c.fail(req, p.RemoteError())
+		return
+	}
+	if req.stream != nil {
+		req.stream.push(p)
+		req.stream.close()
+		return
+	}
+	if req.callback != nil {
+		c.runCallback(req, p, nil)
+		return
+	}
+	if req.Reply != nil {
+		select {
+		case req.Reply <- p:
+		default:
+		}
+	}
+}
+
+func (c *Controller) runCallback(req *Request, p *packet.Packet, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			c.logger.Errorf("request callback panic: %v: %v", req.Packet, e)
+		}
+	}()
+	req.callback(p, err)
+}
+
 func (c *Controller) writeLoop() {
 	c.flow.Add(1)
 	defer c.flow.DoneAndClose()
 
-	var bufferPackets []*packet.Packet
-	timer := time.NewTimer(time.Millisecond)
+	var high, normal []*packet.Packet
+	timer := time.NewTimer(c.batchWindow)
 	timer.Stop()
 
 loop:
 	for {
+		// the high priority requests are always taken first
 		select {
-		case <-c.flow.IsClose():
-			break loop
-		case req := <-c.in:
-			// add to staging
-			if req.Packet.Type.IsReq() {
-				req.Packet.SetReqId(c)
-				c.stage.Add(req)
-			}
-			bufferPackets = append(bufferPackets, req.Packet)
-
-			timer.Reset(time.Millisecond)
-		buffering:
-			for {
-				select {
-				case req := <-c.in:
-					if req.Packet.Type.IsReq() {
-						req.Packet.SetReqId(c)
-						c.stage.Add(req)
-					}
-					bufferPackets = append(bufferPackets, req.Packet)
-				case <-timer.C:
-					break buffering
-				}
+		case req := <-c.inHigh:
+			high = c.stageRequests(high, req)
+		default:
+			select {
+			case <-c.flow.IsClose():
+				break loop
+			case req := <-c.inHigh:
+				high = c.stageRequests(high, req)
+			case req := <-c.in:
+				normal = c.stageRequests(normal, req)
+			case reqs := <-c.inBatch:
+				normal = c.stageRequests(normal, reqs...)
 			}
+		}
 
-			// do buffer
+		// coalesce the requests within the window into one write
+		timer.Reset(c.batchWindow)
+	buffering:
+		for len(high)+len(normal) < c.maxBatch {
+			select {
+			case req := <-c.inHigh:
+				high = c.stageRequests(high, req)
+				continue
+			default:
+			}
+			select {
+			case req := <-c.inHigh:
+				high = c.stageRequests(high, req)
+			case req := <-c.in:
+				normal = c.stageRequests(normal, req)
+			case reqs := <-c.inBatch:
+				normal = c.stageRequests(normal, reqs...)
+			case <-timer.C:
+				break buffering
+			}
+		}
+		if !timer.Stop() {
 			select {
-			case c.toDC <- bufferPackets:
-				bufferPackets = nil
+			case <-timer.C:
+			default:
+			}
+		}
+
+		// do buffer
+		if len(high)+len(normal) > 0 {
+			ps := append(high, normal...)
+			select {
+			case c.toDC <- ps:
+				packet.Debug("controller", packet.Outbound, ps)
+				high, normal = nil, nil
 			case <-c.flow.IsClose():
 				break loop
 			}
 		}
+		c.releaseFlushes()
+	}
+}
+
+// stageRequests add the request packets to staging and append all the
+// packets (fragmented if needed) to the buffer.
+func (c *Controller) stageRequests(buf []*packet.Packet, reqs ...*Request) []*packet.Packet {
+	mtu := int(atomic.LoadInt32(&c.mtu))
+	compress := atomic.LoadInt32(&c.compress) == 1 && c.PeerCaps().Has(packet.CapCompress)
+	now := time.Now()
+	staged := make([]*Request, 0, len(reqs))
+	for _, req := range reqs {
+		if req.flushed != nil {
+			c.flushes = append(c.flushes, req.flushed)
+			continue
+		}
+		if req.canceled() {
+			c.release(req)
+			continue
+		}
+		if req.Packet.Type.IsReq() {
+			req.Packet.SetReqId(c)
+			req.deadline = now.Add(c.retry.backoff(req.retries))
+			if req.created.IsZero() {
+				req.created = now
+				atomic.AddUint64(&c.sent, 1)
+				c.traceRequest(traceSend, req)
+			}
+			staged = append(staged, req)
+		}
+		if req.Packet.Type.IsResp() && req.Packet.Type != packet.DATA_R {
+			c.dedup.SetResp(req.Packet)
+		}
+		if compress {
+			req.Packet.Compress()
+		}
+		ps, err := c.wirePackets(req.Packet, mtu, c.timeoutOf(req, now))
+		if err != nil {
+			c.logger.Errorf("drop packet %v: %v", req.Packet, err)
+			if req.Packet.Type.IsReq() {
+				staged = staged[:len(staged)-1]
+				c.fail(req, err)
+			}
+			continue
+		}
+		buf = append(buf, ps...)
+	}
+	if len(staged) > 0 {
+		rejected, collided := c.stage.Add(staged...)
+		for _, req := range rejected {
+			c.fail(req, ErrControllerClosed)
+		}
+		for _, req := range collided {
+			c.fail(req, ErrReqIdCollision.Format(req.Packet.ReqId))
+		}
+		for _, req := range staged {
+			// skipped by the stage if canceled meanwhile
+			if req.canceled() {
+				c.release(req)
+			}
+		}
 	}
+	return buf
 }
 
+// checkSize returns packet.ErrPayloadTooLarge if p is too large to be sent
+// unfragmented while it can't be fragmented, see SetMTU.
+func (c *Controller) checkSize(p *packet.Packet) error {
+	if atomic.LoadInt32(&c.mtu) > 0 && c.PeerCaps().Has(packet.CapFragment) {
+		return nil
+	}
+	return p.CheckSize()
+}
+
+// checkCaps returns ErrPeerUnsupported if p can't be sent to the peer, the
+// features which are optional are turned off by wirePackets instead.
+func (c *Controller) checkCaps(p *packet.Packet) error {
+	caps := c.PeerCaps()
+	switch {
+	case c.aead != nil && !caps.Has(packet.CapSeal):
+		return ErrPeerUnsupported.Format("seal")
+	case p.IsStream() && !caps.Has(packet.CapStream):
+		return ErrPeerUnsupported.Format("stream")
+	case (p.Type == packet.PING || p.Type == packet.PONG) && !caps.Has(packet.CapPing):
+		return ErrPeerUnsupported.Format(p.Type)
+	}
+	return nil
+}
+
+// wirePackets fragment the packet to fit the mtu, and seal each of them if
+// the cipher is set. each of them carries the timeout if it's not zero, and
+// a new Seq if the peer has packet.CapSeq. the packet is never fragmented
+// or sealed unless the peer has the cap, so a legacy peer gets the baseline
+// header only.
+func (c *Controller) wirePackets(p *packet.Packet, mtu int, timeout time.Duration) ([]*packet.Packet, error) {
+	caps := c.PeerCaps()
+	if err := c.checkCaps(p); err != nil {
+		return nil, err
+	}
+	if !caps.Has(packet.CapFragment) {
+		mtu = 0
+	}
+	if mtu > 0 && c.aead != nil {
+		mtu -= packet.SealOverhead(c.aead)
+	}
+	ps := []*packet.Packet{p}
+	if mtu > 0 {
+		ps = packet.Fragment(p, mtu)
+	}
+	version := int(atomic.LoadInt32(&c.version))
+	checksum := atomic.LoadInt32(&c.checksum) == 1 && caps.Has(packet.CapChecksum)
+	priority := caps.Has(packet.CapPriority)
+	for idx, p := range ps {
+		// the legacy peer takes FlagSeq as a part of the type
+		p.Seq = 0
+		if caps.Has(packet.CapSeq) {
+			p.Seq = atomic.AddUint64(&c.seq, 1)
+		}
+		p.Timeout = timeout
+		p.Version = version
+		p.Checksum = checksum
+		p.SendPriority = priority
+		if c.aead != nil {
+			sealed, err := p.Seal(c.aead)
+			if err != nil {
+				return nil, err
+			}
+			ps[idx] = sealed
+		}
+		// the sealed one may be grown over the limit
+		if err := ps[idx].CheckSize(); err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// ShowStage returns the ReqId, packet type and age of the staging requests
+// ordered by ReqId, it helps to find out the stuck peers.
 func (c *Controller) ShowStage() []StageInfo {
 	return c.stage.ShowStage()
 }
+
+// PendingReqIds returns a copy of the ReqIds which are waiting for replies
+func (c *Controller) PendingReqIds() []uint32 {
+	return c.stage.ReqIds()
+}
+
+func (c *Controller) PendingCount() int {
+	return c.stage.Len()
+}
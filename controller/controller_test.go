@@ -0,0 +1,1595 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chzyer/flow"
+	"github.com/chzyer/logex"
+	"github.com/chzyer/next/crypto"
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/test"
+)
+
+type testController struct {
+	*Controller
+	toDC   packet.Chan
+	fromDC packet.Chan
+}
+
+func newTestController() *testController {
+	return newTestControllerWithConfig(nil)
+}
+
+func newTestControllerWithConfig(cfg *Config) *testController {
+	toDC := packet.NewChan(0)
+	fromDC := packet.NewChan(0)
+	ctl := NewControllerWithConfig(flow.New(), toDC.Send(), fromDC.Recv(), cfg)
+	return &testController{ctl, toDC, fromDC}
+}
+
+// readDC read n packets sent to the data channel
+func (c *testController) readDC(n int) []*packet.Packet {
+	var ret []*packet.Packet
+	timeout := time.After(time.Second)
+	for len(ret) < n {
+		select {
+		case ps := <-c.toDC:
+			ret = append(ret, ps...)
+		case <-timeout:
+			return ret
+		}
+	}
+	return ret
+}
+
+// negotiate let the controller use all the caps of this build
+func (c *testController) negotiate() {
+	c.SetPeerVersion(packet.Negotiate(packet.MaxVersion, packet.SupportedCaps))
+}
+
+func TestControllerBroadcast(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+
+	ps := make([]*packet.Packet, 5)
+	for idx := range ps {
+		ps[idx] = packet.New(nil, packet.HEARTBEAT)
+	}
+	test.Nil(ctl.Broadcast(ps))
+
+	got := ctl.readDC(len(ps))
+	test.Equal(len(got), len(ps))
+	reqIds := make(map[uint32]bool)
+	for _, p := range got {
+		test.Equal(p.Type, packet.HEARTBEAT)
+		reqIds[p.ReqId] = true
+	}
+	test.Equal(len(reqIds), len(ps))
+
+	packet.AllowFragment = true
+	defer func() { packet.AllowFragment = false }()
+	large := packet.New(make([]byte, packet.MaxPayload+1), packet.HEARTBEAT_R)
+	err := ctl.Broadcast([]*packet.Packet{packet.New(nil, packet.HEARTBEAT), large})
+	test.True(logex.Equal(err, packet.ErrPayloadTooLarge))
+	ctl.Close()
+	test.Equal(ctl.Broadcast(ps[:1]), ErrControllerClosed)
+}
+
+func TestControllerBroadcastInFlight(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{MaxInFlight: 2})
+	defer ctl.Close()
+
+	heartbeats := func(n int) []*packet.Packet {
+		ps := make([]*packet.Packet, n)
+		for idx := range ps {
+			ps[idx] = packet.New(nil, packet.HEARTBEAT)
+		}
+		return ps
+	}
+	test.Equal(ctl.Broadcast(heartbeats(3)), ErrTooManyRequests)
+	test.Nil(ctl.Broadcast(heartbeats(2)))
+	test.Equal(len(ctl.readDC(2)), 2)
+	// the slots are held until replied
+	_, err := ctl.TryRequest(packet.New(nil, packet.HEARTBEAT))
+	test.Equal(err, ErrTooManyRequests)
+	test.Equal(ctl.Broadcast(heartbeats(1)), ErrTooManyRequests)
+	test.Equal(len(ctl.inflight), 2)
+}
+
+// waitFor polling the cond until it's true or timed out
+func waitFor(cond func() bool) bool {
+	timeout := time.Now().Add(time.Second)
+	for time.Now().Before(timeout) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
+
+func TestControllerPending(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+	test.Equal(ctl.PendingCount(), 0)
+
+	// nobody reads toDC, so the requests stay in staging
+	for i := 0; i < 2; i++ {
+		go ctl.Request(packet.New(nil, packet.HEARTBEAT))
+	}
+	test.True(waitFor(func() bool { return ctl.PendingCount() == 2 }))
+	ids := ctl.PendingReqIds()
+	test.Equal(ids, []uint32{1, 2})
+
+	ids[0] = 100
+	test.Equal(ctl.PendingReqIds(), []uint32{1, 2})
+}
+
+func TestControllerFragment(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+	ctl.negotiate()
+	ctl.SetMTU(64)
+
+	p := packet.New(test.RandBytes(200), packet.NEWDC_R)
+	go ctl.Send(p)
+	frags := ctl.readDC(10)
+	test.Equal(len(frags), 10)
+	for _, frag := range frags {
+		test.Equal(frag.Type, packet.FRAGMENT)
+		test.True(frag.TotalSize() <= 64)
+	}
+
+	for idx := len(frags) - 1; idx >= 0; idx-- {
+		ctl.fromDC <- []*packet.Packet{frags[idx]}
+	}
+	select {
+	case ps := <-ctl.GetOutChan():
+		test.Equal(len(ps), 1)
+		test.Equal(ps[0].Type, packet.NEWDC_R)
+		test.Equal(ps[0].Payload(), p.Payload())
+	case <-time.After(time.Second):
+		test.Panic(0, "reassembled packet is not received")
+	}
+}
+
+func TestControllerReplay(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+
+	recv := func(p *packet.Packet) *packet.Packet {
+		ctl.fromDC <- []*packet.Packet{p}
+		select {
+		case ps := <-ctl.GetOutChan():
+			return ps[0]
+		case <-time.After(50 * time.Millisecond):
+			return nil
+		}
+	}
+
+	p := packet.New(nil, packet.NEWDC_R)
+	p.Seq = 5
+	test.Equal(recv(p), p)
+	test.Nil(recv(p))
+
+	fresh := packet.New(nil, packet.NEWDC_R)
+	fresh.Seq = 6
+	test.Equal(recv(fresh), fresh)
+
+	// the packets from legacy peers are not checked
+	legacy := packet.New(nil, packet.NEWDC_R)
+	test.Equal(recv(legacy), legacy)
+	test.Equal(recv(legacy), legacy)
+	test.Equal(ctl.Stat().ReplayDropped, uint64(1))
+
+	// the retransmission carries a new Seq, it's left to the dedup
+	req := packet.New(nil, packet.NEWDC)
+	req.ReqId = 7
+	req.Seq = 7
+	test.Equal(recv(req), req)
+	test.Nil(ctl.Send(req.Reply(nil)))
+	test.Equal(ctl.readDC(1)[0].Type, packet.NEWDC_R)
+	resend := packet.New(nil, packet.NEWDC)
+	resend.ReqId = 7
+	resend.Seq = 8
+	test.Nil(recv(resend))
+	test.Equal(ctl.readDC(1)[0].Type, packet.NEWDC_R)
+	test.Equal(ctl.Stat().ReplayDropped, uint64(1))
+}
+
+func TestControllerSeq(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+
+	// the legacy peer can't read it
+	go ctl.Send(packet.New(nil, packet.NEWDC_R))
+	test.Equal(ctl.readDC(1)[0].Seq, uint64(0))
+
+	ctl.SetPeerVersion(packet.Negotiate(packet.VersionLegacy, packet.CapSeq))
+	go ctl.Send(packet.New(nil, packet.NEWDC_R))
+	go ctl.Send(packet.New(nil, packet.NEWDC_R))
+	ps := ctl.readDC(2)
+	test.Equal(len(ps), 2)
+	test.True(ps[0].Seq != 0)
+	test.True(ps[0].Seq != ps[1].Seq)
+}
+
+func TestControllerCompress(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+	ctl.negotiate()
+	ctl.SetCompress(true)
+
+	payload := bytes.Repeat([]byte(`{"type":"route"}`), 100)
+	go ctl.Send(packet.New(payload, packet.NEWDC_R))
+	ps := ctl.readDC(1)
+	test.Equal(len(ps), 1)
+	test.True(ps[0].IsCompressed())
+	test.True(ps[0].Size() < len(payload))
+
+	ctl.fromDC <- ps
+	select {
+	case ps := <-ctl.GetOutChan():
+		test.Equal(ps[0].Type, packet.NEWDC_R)
+		test.False(ps[0].IsCompressed())
+		test.Equal(ps[0].Payload(), payload)
+	case <-time.After(time.Second):
+		test.Panic(0, "decompressed packet is not received")
+	}
+}
+
+func TestControllerPeerVersion(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+
+	go ctl.Send(packet.New(nil, packet.NEWDC_R))
+	ps := ctl.readDC(1)
+	test.Equal(ps[0].Version, 0)
+
+	ctl.SetPeerVersion(packet.Negotiate(packet.MaxVersion, packet.CapSeq|packet.CapPing))
+	test.True(ctl.PeerCaps().Has(packet.CapPing))
+	test.False(ctl.PeerCaps().Has(packet.CapStream))
+	go ctl.Send(packet.New([]byte("hello"), packet.NEWDC_R))
+	ps = ctl.readDC(1)
+	test.Equal(ps[0].Version, packet.Version2)
+	test.False(ps[0].Checksum)
+
+	// the incoming packets of both layouts are accepted
+	data := make([]byte, ps[0].TotalSize())
+	ps[0].Marshal(data)
+	p, err := packet.Unmarshal(data)
+	test.Nil(err)
+	test.Equal(p.Version, packet.Version2)
+	ctl.fromDC <- []*packet.Packet{p}
+	select {
+	case ps := <-ctl.GetOutChan():
+		test.Equal(ps[0].Payload(), []byte("hello"))
+	case <-time.After(time.Second):
+		test.Panic(0, "versioned packet is not received")
+	}
+}
+
+// the legacy peer gets the baseline 8 bytes header only, whatever is
+// enabled locally
+func TestControllerLegacyLayout(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{PropagateDeadline: true})
+	defer ctl.Close()
+	ctl.SetPeerVersion(packet.Negotiate(packet.VersionLegacy, 0))
+	ctl.SetCompress(true)
+	ctl.SetChecksum(true)
+	ctl.SetMTU(64)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	payload := bytes.Repeat([]byte("a"), 300)
+	p := packet.New(payload, packet.NEWDC)
+	p.ReqId = 0x01020304
+	go ctl.RequestWithContext(ctx, p)
+	ps := ctl.readDC(1)
+	test.Equal(len(ps), 1)
+	data := make([]byte, ps[0].TotalSize())
+	test.Equal(ps[0].Marshal(data), 308)
+	test.Equal(data, append([]byte{1, 2, 3, 4, 0, byte(packet.NEWDC), 1, 44}, payload...))
+
+	test.True(logex.Equal(ctl.Send(packet.NewPing(0)), ErrPeerUnsupported))
+	test.True(logex.Equal(ctl.Send(p.ReplyStream(0, nil, false)), ErrPeerUnsupported))
+	_, err := ctl.RequestStream(packet.New(nil, packet.NEWDC))
+	test.True(logex.Equal(err, ErrPeerUnsupported))
+
+	// never fallback to cleartext
+	aead, err := crypto.NewAEAD(make([]byte, 32))
+	test.Nil(err)
+	sealed := newTestControllerWithConfig(&Config{Cipher: aead})
+	defer sealed.Close()
+	test.True(logex.Equal(sealed.Send(packet.New(nil, packet.NEWDC_R)), ErrPeerUnsupported))
+
+	// the same packet to the peer of this build
+	ctl.negotiate()
+	go ctl.RequestWithContext(ctx, packet.New(payload, packet.NEWDC))
+	ps = ctl.readDC(1)
+	test.Equal(len(ps), 1)
+	test.Equal(ps[0].Version, packet.Version2)
+	test.True(ps[0].Seq != 0)
+	test.True(ps[0].Timeout > 0)
+	test.True(ps[0].Checksum)
+	test.True(ps[0].IsCompressed())
+}
+
+func TestControllerChecksum(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+	ctl.SetChecksum(true)
+
+	// the legacy peer can't verify it
+	go ctl.Send(packet.New(nil, packet.NEWDC_R))
+	test.False(ctl.readDC(1)[0].Checksum)
+
+	ctl.SetPeerVersion(packet.Negotiate(packet.MaxVersion, packet.SupportedCaps))
+	go ctl.Send(packet.New([]byte("hello"), packet.NEWDC_R))
+	p := ctl.readDC(1)[0]
+	test.True(p.Checksum)
+
+	data := make([]byte, p.TotalSize())
+	p.Marshal(data)
+	data[len(data)-1] ^= 1
+	_, err := packet.Unmarshal(data)
+	test.True(logex.Equal(err, packet.ErrChecksumMismatch))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	defer test.New(t)
+
+	r := RetryConfig{Timeout: time.Second, MaxBackoff: 5 * time.Second}
+	test.Equal(r.backoff(0), time.Second)
+	test.Equal(r.backoff(1), 2*time.Second)
+	test.Equal(r.backoff(2), 4*time.Second)
+	test.Equal(r.backoff(3), 5*time.Second)
+	test.Equal(r.backoff(100), 5*time.Second)
+}
+
+func TestRetryBackoffJitter(t *testing.T) {
+	defer test.New(t)
+
+	rnd := 0.5
+	r := RetryConfig{
+		Timeout:    time.Second,
+		MaxBackoff: 10 * time.Second,
+		Jitter:     0.2,
+		Rand:       func() float64 { return rnd },
+	}
+	test.Equal(r.backoff(0), 1100*time.Millisecond)
+	test.Equal(r.backoff(1), 2200*time.Millisecond)
+	test.Equal(r.backoff(2), 4400*time.Millisecond)
+	test.Equal(r.backoff(3), 8800*time.Millisecond)
+	test.Equal(r.backoff(4), 10*time.Second)
+
+	var last time.Duration
+	for n := 0; n < 10; n++ {
+		for _, rnd = range []float64{0, 0.3, 0.999} {
+			d := r.backoff(n)
+			test.True(d >= r.Timeout)
+			test.True(d <= r.MaxBackoff)
+			test.True(d >= last)
+		}
+		rnd = 0
+		last = r.backoff(n)
+	}
+
+	// the default source is bounded too
+	r.Rand = nil
+	for n := 0; n < 10; n++ {
+		test.True(r.backoff(n) <= r.MaxBackoff)
+	}
+}
+
+func TestControllerMaxRetries(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{Retry: RetryConfig{
+		Timeout:    20 * time.Millisecond,
+		MaxRetries: 2,
+	}})
+	defer ctl.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ctl.send(context.Background(), NewRequest(packet.New(nil, packet.HEARTBEAT), true))
+		errCh <- err
+	}()
+
+	// the first send and 2 resends
+	ps := ctl.readDC(3)
+	test.Equal(len(ps), 3)
+	test.Equal(ps[0].ReqId, ps[2].ReqId)
+	select {
+	case err := <-errCh:
+		test.Equal(err, ErrRequestTimeout)
+	case <-time.After(time.Second):
+		test.Panic(0, "request is not failed")
+	}
+	test.Equal(ctl.PendingCount(), 0)
+	test.Equal(ctl.RetryStats(), RetryStats{Retransmits: 2, Failures: 1})
+}
+
+func TestControllerResendReplied(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{Retry: RetryConfig{
+		Timeout:    20 * time.Millisecond,
+		MaxRetries: 5,
+	}})
+	defer ctl.Close()
+
+	replyCh := make(chan *packet.Packet, 1)
+	go func() {
+		reply, err := ctl.Request(packet.New(nil, packet.HEARTBEAT))
+		if err != nil {
+			panic(err)
+		}
+		replyCh <- reply
+	}()
+
+	// lost the first one, reply the resent one
+	ps := ctl.readDC(2)
+	test.Equal(len(ps), 2)
+	ctl.fromDC <- []*packet.Packet{ps[1].Reply(nil)}
+	go func() {
+		for range ctl.GetOutChan() {
+		}
+	}()
+	select {
+	case reply := <-replyCh:
+		test.NotNil(reply)
+		test.Equal(reply.ReqId, ps[0].ReqId)
+	case <-time.After(time.Second):
+		test.Panic(0, "reply is not received")
+	}
+	test.Equal(ctl.PendingCount(), 0)
+	test.Equal(ctl.RetryStats().Failures, uint64(0))
+}
+
+func drainOut(ctl *testController) {
+	go func() {
+		for range ctl.GetOutChan() {
+		}
+	}()
+}
+
+func TestRequestWithContextCancelBeforeSend(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ctl.RequestWithContext(ctx, packet.New(nil, packet.HEARTBEAT))
+	test.Equal(err, context.Canceled)
+	test.Equal(len(ctl.readDC(1)), 0)
+	test.Equal(ctl.PendingCount(), 0)
+}
+
+func TestRequestWithContextCancelStaged(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+	drainOut(ctl)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ctl.RequestWithContext(ctx, packet.New(nil, packet.HEARTBEAT))
+		errCh <- err
+	}()
+	ps := ctl.readDC(1)
+	test.Equal(len(ps), 1)
+	test.Equal(ctl.PendingCount(), 1)
+
+	test.Equal(<-errCh, context.DeadlineExceeded)
+	test.Equal(ctl.PendingCount(), 0)
+
+	// the late reply is dispatched as usual
+	ctl.fromDC <- []*packet.Packet{ps[0].Reply(nil)}
+	test.Equal(ctl.PendingCount(), 0)
+}
+
+func TestRequestWithContextReplyRace(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+	drainOut(ctl)
+
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		type result struct {
+			reply *packet.Packet
+			err   error
+		}
+		resultCh := make(chan result, 1)
+		go func() {
+			reply, err := ctl.RequestWithContext(ctx, packet.New(nil, packet.HEARTBEAT))
+			resultCh <- result{reply, err}
+		}()
+		ps := ctl.readDC(1)
+		test.Equal(len(ps), 1)
+
+		go cancel()
+		ctl.fromDC <- []*packet.Packet{ps[0].Reply(nil)}
+		ret := <-resultCh
+		if ret.err != nil {
+			test.Equal(ret.err, context.Canceled)
+		} else {
+			test.Equal(ret.reply.ReqId, ps[0].ReqId)
+		}
+		test.Equal(ctl.PendingCount(), 0)
+		cancel()
+	}
+}
+
+func TestSendContextBackpressure(t *testing.T) {
+	defer test.New(t)
+
+	// nobody reads from toDC, the in queue will be full soon
+	ctl := newTestController()
+	defer ctl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var err error
+	for err == nil {
+		err = ctl.SendContext(ctx, packet.New(nil, packet.HEARTBEAT))
+	}
+	test.Equal(err, context.DeadlineExceeded)
+
+	now := time.Now()
+	canceled, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+	test.Equal(ctl.SendContext(canceled, packet.New(nil, packet.HEARTBEAT)), context.Canceled)
+	_, err = ctl.RequestWithContext(canceled, packet.New(nil, packet.HEARTBEAT))
+	test.Equal(err, context.Canceled)
+	test.True(time.Since(now) < 10*time.Millisecond)
+}
+
+func TestSendContextNotResent(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{Retry: RetryConfig{
+		Timeout:    20 * time.Millisecond,
+		MaxRetries: 5,
+	}})
+	defer ctl.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	test.Nil(ctl.SendContext(ctx, packet.New(nil, packet.HEARTBEAT)))
+	test.Equal(len(ctl.readDC(1)), 1)
+	cancel()
+
+	// no resend after canceled, and the staging entry is dropped
+	test.Equal(len(ctl.readDC(1)), 0)
+	test.Equal(ctl.PendingCount(), 0)
+	test.Equal(ctl.RetryStats().Retransmits, uint64(0))
+}
+
+func TestControllerErrors(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+
+	// nobody reads from toDC
+	var err error
+	for err == nil {
+		err = ctl.SendTimeout(packet.New(nil, packet.HEARTBEAT), 20*time.Millisecond)
+	}
+	test.Equal(err, ErrSendQueueFull)
+
+	ctl.Close()
+	_, err = ctl.Request(packet.New(nil, packet.HEARTBEAT))
+	test.Equal(err, ErrControllerClosed)
+	test.Equal(ctl.Send(packet.New(nil, packet.HEARTBEAT)), ErrControllerClosed)
+}
+
+func TestControllerNotSent(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ctl.RequestE(packet.New(nil, packet.HEARTBEAT))
+		errCh <- err
+	}()
+	// queued and written, but never replied
+	test.Equal(len(ctl.readDC(1)), 1)
+	ctl.Close()
+	select {
+	case err := <-errCh:
+		test.Equal(err, ErrControllerClosed)
+		test.False(IsNotSent(err))
+	case <-time.After(time.Second):
+		test.Panic(0, "request is not woken up")
+	}
+
+	err := ctl.SendE(packet.New(nil, packet.HEARTBEAT))
+	test.True(IsNotSent(err))
+	test.True(errors.Is(err, ErrControllerClosed))
+	_, err = ctl.RequestE(packet.New(nil, packet.HEARTBEAT))
+	test.True(IsNotSent(err))
+	test.True(errors.Is(err, ErrControllerClosed))
+}
+
+func TestRequestE(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+	drainOut(ctl)
+	go func() {
+		ps := ctl.readDC(1)
+		ctl.fromDC <- []*packet.Packet{ps[0].Reply(nil)}
+	}()
+	rep, err := ctl.RequestE(packet.New(nil, packet.HEARTBEAT))
+	test.Nil(err)
+	test.NotNil(rep)
+	test.Equal(len(rep.Payload()), 0)
+
+	// the flow is closed while waiting for the reply
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ctl.RequestE(packet.New(nil, packet.HEARTBEAT))
+		errCh <- err
+	}()
+	test.Equal(len(ctl.readDC(1)), 1)
+	ctl.flow.Close()
+	select {
+	case err := <-errCh:
+		test.Equal(err, ErrControllerClosed)
+	case <-time.After(time.Second):
+		test.Panic(0, "request is not woken up")
+	}
+}
+
+func TestControllerMaxPayload(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+	ctl.negotiate()
+	large := make([]byte, packet.MaxPayload+1)
+	_, err := packet.NewE(large, packet.NEWDC_R)
+	test.True(logex.Equal(err, packet.ErrPayloadTooLarge))
+
+	// constructed, but the mtu is not set
+	packet.AllowFragment = true
+	defer func() { packet.AllowFragment = false }()
+	err = ctl.SendE(packet.New(large, packet.NEWDC_R))
+	test.True(IsNotSent(err))
+	test.True(logex.Equal(err.(*NotSentError).Err, packet.ErrPayloadTooLarge))
+	_, err = ctl.RequestE(packet.New(large, packet.NEWDC))
+	test.True(IsNotSent(err))
+	test.True(logex.Equal(err.(*NotSentError).Err, packet.ErrPayloadTooLarge))
+
+	// the response is replaced by the error
+	test.Nil(ctl.Handle(packet.NEWDC, func(req *packet.Packet) (*packet.Packet, error) {
+		return packet.New(large, packet.NEWDC_R), nil
+	}))
+	req := packet.New(nil, packet.NEWDC)
+	req.ReqId = 1
+	ctl.fromDC <- []*packet.Packet{req}
+	ps := ctl.readDC(1)
+	test.Equal(len(ps), 1)
+	test.Equal(ps[0].ReqId, uint32(1))
+	test.Equal(ps[0].RemoteError().Code, packet.ErrCodeInternal)
+	test.True(strings.Contains(ps[0].RemoteError().Message, "payload is too large"))
+
+	// fragmented if the mtu is set
+	ctl.SetMTU(1400)
+	go ctl.Send(packet.New(large, packet.NEWDC_R))
+	chunk := 1400 - packet.MaxHeaderSize - packet.FragmentHeaderSize
+	frags := ctl.readDC((len(large) + chunk - 1) / chunk)
+	test.Equal(len(frags), (len(large)+chunk-1)/chunk)
+	for _, frag := range frags {
+		test.Equal(frag.Type, packet.FRAGMENT)
+		test.Nil(frag.CheckSize())
+	}
+}
+
+func TestControllerStalledDC(t *testing.T) {
+	defer test.New(t)
+
+	// nobody reads toDC, the writeLoop is blocked after staging
+	ctl := newTestController()
+	drainOut(ctl)
+
+	replyCh := make(chan *packet.Packet, 1)
+	go func() {
+		reply, _ := ctl.Request(packet.New(nil, packet.HEARTBEAT))
+		replyCh <- reply
+	}()
+	test.True(waitFor(func() bool { return ctl.PendingCount() == 1 }))
+
+	// replies are still handled
+	req := packet.New(nil, packet.HEARTBEAT)
+	req.ReqId = ctl.PendingReqIds()[0]
+	ctl.fromDC <- []*packet.Packet{req.Reply(nil)}
+	select {
+	case reply := <-replyCh:
+		test.Equal(reply.ReqId, req.ReqId)
+	case <-time.After(time.Second):
+		test.Panic(0, "reply is blocked by the stalled data channel")
+	}
+
+	// and shutdown is not blocked
+	done := make(chan struct{})
+	go func() {
+		ctl.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		test.Panic(0, "close is blocked by the stalled data channel")
+	}
+}
+
+func TestControllerCloseWakeRequests(t *testing.T) {
+	defer test.New(t)
+
+	// nobody replies
+	ctl := newTestController()
+	go func() {
+		for range ctl.toDC {
+		}
+	}()
+
+	const n = 5
+	errCh := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := ctl.Request(packet.New(nil, packet.HEARTBEAT))
+			errCh <- err
+		}()
+	}
+	// the raw request via WriteChan only waits on Reply
+	raw := NewRequest(packet.New(nil, packet.HEARTBEAT), true)
+	ctl.WriteChan() <- raw
+	test.True(waitFor(func() bool { return ctl.PendingCount() == n+1 }))
+
+	ctl.Close()
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errCh:
+			test.Equal(err, ErrControllerClosed)
+		case <-time.After(time.Second):
+			test.Panic(0, "request is not woken up")
+		}
+	}
+	select {
+	case p, ok := <-raw.Reply:
+		test.Nil(p)
+		test.False(ok)
+		test.Equal(raw.Err(), ErrControllerClosed)
+	case <-time.After(time.Second):
+		test.Panic(0, "raw request is not woken up")
+	}
+	test.Equal(ctl.PendingCount(), 0)
+}
+
+func TestControllerRequestStress(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+	drainOut(ctl)
+
+	// echo responder
+	go func() {
+		for ps := range ctl.toDC {
+			replies := make([]*packet.Packet, 0, len(ps))
+			for _, p := range ps {
+				replies = append(replies, p.Reply(p.Payload()))
+			}
+			ctl.fromDC <- replies
+		}
+	}()
+
+	const n = 2000
+	var wg sync.WaitGroup
+	var lost int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := []byte(strconv.Itoa(i))
+			reply, err := ctl.Request(packet.New(payload, packet.HEARTBEAT))
+			if err != nil || string(reply.Payload()) != string(payload) {
+				atomic.AddInt32(&lost, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	test.Equal(lost, int32(0))
+	test.Equal(ctl.PendingCount(), 0)
+	test.Equal(ctl.RetryStats().Retransmits, uint64(0))
+
+	stat := ctl.Stat()
+	test.Equal(stat.InFlight, 0)
+	test.Equal(stat.TotalSent, uint64(n))
+	test.Equal(stat.TotalReplied, uint64(n))
+	test.Equal(stat.Timeouts, uint64(0))
+	test.True(stat.RTTMin > 0)
+	test.True(stat.RTTMin <= stat.RTTAvg)
+	test.True(stat.RTTAvg <= stat.RTTP99)
+}
+
+func TestControllerEvictStage(t *testing.T) {
+	defer test.New(t)
+
+	// never give up by retries, but by age
+	ctl := newTestControllerWithConfig(&Config{
+		Retry:       RetryConfig{Timeout: 20 * time.Millisecond, MaxBackoff: 20 * time.Millisecond},
+		MaxStageAge: 100 * time.Millisecond,
+	})
+	defer ctl.Close()
+	go func() {
+		for range ctl.toDC {
+		}
+	}()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ctl.Request(packet.New(nil, packet.HEARTBEAT))
+		errCh <- err
+	}()
+	test.True(waitFor(func() bool { return ctl.PendingCount() == 1 }))
+	info := ctl.ShowStage()
+	test.Equal(len(info), 1)
+	test.Equal(info[0].DataType, packet.HEARTBEAT)
+	test.True(info[0].Age < 100*time.Millisecond)
+
+	select {
+	case err := <-errCh:
+		test.Equal(err, ErrRequestTimeout)
+	case <-time.After(time.Second):
+		test.Panic(0, "request is not evicted")
+	}
+	stats := ctl.StagingStats()
+	test.Equal(stats.Size, 0)
+	test.Equal(stats.Evictions, uint64(1))
+	test.Equal(stats.OldestAge, time.Duration(0))
+	test.True(ctl.RetryStats().Retransmits > 0)
+}
+
+func TestControllerDuplicatedRequest(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{DedupTTL: 100 * time.Millisecond})
+	defer ctl.Close()
+
+	recv := func(p *packet.Packet) *packet.Packet {
+		ctl.fromDC <- []*packet.Packet{p}
+		select {
+		case ps := <-ctl.GetOutChan():
+			return ps[0]
+		case <-time.After(50 * time.Millisecond):
+			return nil
+		}
+	}
+
+	req := packet.New([]byte("add route"), packet.NEWDC)
+	req.ReqId = 7
+	test.Equal(recv(req), req)
+
+	// the retransmit arrives before we reply
+	test.Nil(recv(req))
+
+	resp := req.Reply([]byte("done"))
+	test.Nil(ctl.Send(resp))
+	ps := ctl.readDC(1)
+	test.Equal(len(ps), 1)
+	test.Equal(ps[0], resp)
+
+	// the cached response is sent again
+	test.Nil(recv(req))
+	ps = ctl.readDC(1)
+	test.Equal(len(ps), 1)
+	test.Equal(ps[0].ReqId, uint32(7))
+	test.Equal(ps[0].Payload(), []byte("done"))
+
+	// DATA is never suppressed
+	// avoid the loopback prefix handling of DATA on darwin
+	data := packet.New([]byte("ip"), packet.HEARTBEAT)
+	data.Type = packet.DATA
+	data.ReqId = 8
+	test.Equal(recv(data), data)
+	test.Equal(recv(data), data)
+
+	// forgotten after ttl
+	time.Sleep(100 * time.Millisecond)
+	test.Equal(recv(req), req)
+}
+
+func TestControllerPriority(t *testing.T) {
+	defer test.New(t)
+
+	// nobody reads toDC yet, so the normal requests are backlogged
+	ctl := newTestController()
+	defer ctl.Close()
+
+	const n = 1000
+	go func() {
+		for i := 0; i < n; i++ {
+			ctl.Send(packet.New([]byte(strconv.Itoa(i)), packet.NEWDC_R))
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go ctl.SendWithPriority(packet.New([]byte("high"), packet.NEWDC_R), PriorityHigh)
+	time.Sleep(20 * time.Millisecond)
+
+	var normals []string
+	overtaken := 0
+	for len(normals) < n {
+		ps := ctl.readDC(1)
+		test.True(len(ps) > 0)
+		for idx, p := range ps {
+			if string(p.Payload()) == "high" {
+				// the first one of its batch
+				test.Equal(idx, 0)
+				overtaken = n - len(normals)
+			} else {
+				normals = append(normals, string(p.Payload()))
+			}
+		}
+	}
+	test.True(overtaken > 0)
+	// the order of the normal requests is kept
+	for i := range normals {
+		test.Equal(normals[i], strconv.Itoa(i))
+	}
+}
+
+func TestControllerUnmatchedReply(t *testing.T) {
+	defer test.New(t)
+
+	unmatched := make(chan *packet.Packet, 1)
+	ctl := newTestControllerWithConfig(&Config{
+		OnUnmatchedReply: func(p *packet.Packet) { unmatched <- p },
+	})
+	defer ctl.Close()
+	drainOut(ctl)
+
+	req := packet.New(nil, packet.HEARTBEAT)
+	req.ReqId = 1234
+	reply := req.Reply(nil)
+	ctl.fromDC <- []*packet.Packet{reply}
+	select {
+	case p := <-unmatched:
+		test.Equal(p, reply)
+	case <-time.After(time.Second):
+		test.Panic(0, "hook is not called")
+	}
+
+	// the matched reply doesn't fire the hook
+	go func() {
+		ps := ctl.readDC(1)
+		ctl.fromDC <- []*packet.Packet{ps[0].Reply(nil)}
+	}()
+	_, err := ctl.Request(packet.New(nil, packet.HEARTBEAT))
+	test.Nil(err)
+	select {
+	case p := <-unmatched:
+		test.Nil(p)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+type asyncResult struct {
+	reply *packet.Packet
+	err   error
+}
+
+func TestControllerRequestAsync(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{Retry: RetryConfig{
+		Timeout:    20 * time.Millisecond,
+		MaxRetries: 1,
+	}})
+	drainOut(ctl)
+
+	var calls int32
+	results := make(chan asyncResult, 10)
+	cb := func(p *packet.Packet, err error) {
+		atomic.AddInt32(&calls, 1)
+		results <- asyncResult{p, err}
+	}
+
+	// replied
+	ctl.RequestAsync(packet.New(nil, packet.HEARTBEAT), cb)
+	ps := ctl.readDC(1)
+	test.Equal(len(ps), 1)
+	ctl.fromDC <- []*packet.Packet{ps[0].Reply([]byte("pong"))}
+	ret := <-results
+	test.Nil(ret.err)
+	test.Equal(ret.reply.Payload(), []byte("pong"))
+
+	// timed out, and the panic doesn't kill readLoop or resendLoop
+	ctl.RequestAsync(packet.New(nil, packet.HEARTBEAT), func(p *packet.Packet, err error) {
+		cb(p, err)
+		panic("oops")
+	})
+	test.Equal(len(ctl.readDC(2)), 2)
+	ret = <-results
+	test.Equal(ret.err, ErrRequestTimeout)
+
+	// closed
+	ctl.RequestAsync(packet.New(nil, packet.HEARTBEAT), cb)
+	test.True(waitFor(func() bool { return ctl.PendingCount() == 1 }))
+	ctl.Close()
+	ret = <-results
+	test.Equal(ret.err, ErrControllerClosed)
+	ctl.RequestAsync(packet.New(nil, packet.HEARTBEAT), cb)
+	ret = <-results
+	test.Equal(ret.err, ErrControllerClosed)
+
+	// not a request
+	ctl.RequestAsync(packet.New(nil, packet.HEARTBEAT_R), cb)
+	ret = <-results
+	test.True(logex.Equal(ret.err, ErrNotRequest))
+
+	// exactly once
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(atomic.LoadInt32(&calls), int32(5))
+}
+
+func TestBatchWrite(t *testing.T) {
+	defer test.New(t)
+
+	recvBatch := func(ctl *testController) []*packet.Packet {
+		select {
+		case ps := <-ctl.toDC:
+			return ps
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+
+	// coalesced within the window
+	ctl := newTestControllerWithConfig(&Config{BatchWindow: 100 * time.Millisecond})
+	for i := 0; i < 5; i++ {
+		test.Nil(ctl.Send(packet.New(nil, packet.NEWDC_R)))
+	}
+	test.Equal(len(recvBatch(ctl)), 5)
+
+	// a lone packet waits no longer than the window
+	now := time.Now()
+	test.Nil(ctl.Send(packet.New(nil, packet.NEWDC_R)))
+	test.Equal(len(recvBatch(ctl)), 1)
+	test.True(time.Since(now) < 500*time.Millisecond)
+	ctl.Close()
+
+	// limited by MaxBatchSize
+	ctl = newTestControllerWithConfig(&Config{
+		BatchWindow:  100 * time.Millisecond,
+		MaxBatchSize: 2,
+	})
+	defer ctl.Close()
+	for i := 0; i < 5; i++ {
+		test.Nil(ctl.Send(packet.New(nil, packet.NEWDC_R)))
+	}
+	total := 0
+	for total < 5 {
+		ps := recvBatch(ctl)
+		test.NotNil(ps)
+		test.True(len(ps) <= 2)
+		total += len(ps)
+	}
+	test.Equal(total, 5)
+}
+
+func TestControllerCipher(t *testing.T) {
+	defer test.New(t)
+
+	aead, err := crypto.NewAEAD(make([]byte, 32))
+	test.Nil(err)
+	ctl := newTestControllerWithConfig(&Config{Cipher: aead})
+	defer ctl.Close()
+	ctl.negotiate()
+	drainOut(ctl)
+
+	replyCh := make(chan *packet.Packet, 1)
+	go func() {
+		reply, _ := ctl.Request(packet.New([]byte("hello"), packet.NEWDC))
+		replyCh <- reply
+	}()
+	sent := ctl.readDC(1)[0]
+	test.True(sent.IsSealed())
+	test.False(bytes.Contains(sent.Payload(), []byte("hello")))
+	req, err := sent.Open(aead)
+	test.Nil(err)
+	test.Equal(req.Payload(), []byte("hello"))
+
+	// cleartext and tampered replies are dropped
+	ctl.fromDC <- []*packet.Packet{req.Reply([]byte("world"))}
+	resp := req.Reply([]byte("world"))
+	resp.Seq = 1
+	sealed, err := resp.Seal(aead)
+	test.Nil(err)
+	tampered := *sealed
+	tampered.ReqId++
+	ctl.fromDC <- []*packet.Packet{&tampered}
+	select {
+	case <-replyCh:
+		test.Panic(0, "unauthenticated reply is accepted")
+	case <-time.After(50 * time.Millisecond):
+	}
+	test.Equal(ctl.PendingCount(), 1)
+
+	ctl.fromDC <- []*packet.Packet{sealed}
+	select {
+	case reply := <-replyCh:
+		test.Equal(reply.Payload(), []byte("world"))
+	case <-time.After(time.Second):
+		test.Panic(0, "sealed reply is not accepted")
+	}
+}
+
+func TestReqIdWraparound(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+	drainOut(ctl)
+
+	request := func(payload string) chan *packet.Packet {
+		replyCh := make(chan *packet.Packet, 1)
+		go func() {
+			reply, _ := ctl.Request(packet.New([]byte(payload), packet.NEWDC))
+			replyCh <- reply
+		}()
+		return replyCh
+	}
+
+	// a long-lived request which is never replied
+	oldCh := request("old")
+	old := ctl.readDC(1)[0]
+	test.Equal(old.ReqId, uint32(1))
+
+	atomic.StoreUint32(&ctl.reqId, math.MaxUint32-1)
+	lastCh := request("last")
+	test.Equal(ctl.readDC(1)[0].ReqId, uint32(math.MaxUint32))
+
+	// 0 and the staging 1 are skipped
+	newCh := request("new")
+	req := ctl.readDC(1)[0]
+	test.Equal(req.ReqId, uint32(2))
+
+	ctl.fromDC <- []*packet.Packet{req.Reply([]byte("new"))}
+	select {
+	case reply := <-newCh:
+		test.Equal(reply.Payload(), []byte("new"))
+	case <-time.After(time.Second):
+		test.Panic(0, "reply is not delivered")
+	}
+	ctl.fromDC <- []*packet.Packet{old.Reply([]byte("old"))}
+	select {
+	case reply := <-oldCh:
+		test.Equal(reply.Payload(), []byte("old"))
+	case <-time.After(time.Second):
+		test.Panic(0, "reply is not delivered")
+	}
+	select {
+	case <-lastCh:
+		test.Panic(0, "reply is delivered to the wrong request")
+	default:
+	}
+	test.Equal(ctl.PendingReqIds(), []uint32{math.MaxUint32})
+}
+
+func TestConfigValidate(t *testing.T) {
+	defer test.New(t)
+
+	test.Nil((&Config{}).Validate())
+	for _, cfg := range []*Config{
+		{InQueueSize: -1},
+		{OutQueueSize: -1},
+		{RequestTimeout: -1},
+		{ResendInterval: -1},
+		{Retry: RetryConfig{MaxRetries: -1}},
+	} {
+		test.True(logex.Equal(cfg.Validate(), ErrInvalidConfig))
+	}
+
+	panicked := func() (ret bool) {
+		defer func() { ret = recover() != nil }()
+		newTestControllerWithConfig(&Config{InQueueSize: -1})
+		return false
+	}()
+	test.True(panicked)
+
+	f := flow.New()
+	defer f.Close()
+	ctl, err := NewControllerWithConfigE(f, packet.NewChan(0).Send(), packet.NewChan(0).Recv(), &Config{InQueueSize: -1})
+	test.Nil(ctl)
+	test.True(logex.Equal(err, ErrInvalidConfig))
+}
+
+func TestConfigDefaults(t *testing.T) {
+	defer test.New(t)
+
+	cfg := &Config{Retry: RetryConfig{MaxRetries: 1}}
+	ctl := newTestControllerWithConfig(cfg)
+	defer ctl.Close()
+	// the fields set are kept, and the caller's config is never written
+	test.Equal(ctl.retry.MaxRetries, 1)
+	test.Equal(ctl.retry.Timeout, DefaultRetryConfig.Timeout)
+	test.Equal(ctl.retry.MaxBackoff, DefaultRetryConfig.MaxBackoff)
+	test.Equal(cfg.Retry.Timeout, time.Duration(0))
+	test.Equal(cfg.InQueueSize, 0)
+	test.True(cfg.Logger == nil)
+
+	ctl2 := newTestController()
+	defer ctl2.Close()
+	test.Equal(ctl2.retry.MaxRetries, DefaultRetryConfig.MaxRetries)
+	test.Equal(ctl2.retry.Jitter, DefaultRetryConfig.Jitter)
+}
+
+func TestConfigQueueSize(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{InQueueSize: 32, OutQueueSize: 4})
+	defer ctl.Close()
+	test.Equal(cap(ctl.in), 32)
+	test.Equal(cap(ctl.inHigh), 32)
+
+	// nobody reads the out chan, the replies are still dispatched
+	for i := 0; i < 4; i++ {
+		p := packet.New(nil, packet.HEARTBEAT)
+		p.ReqId = uint32(100 + i)
+		ctl.fromDC <- []*packet.Packet{p}
+	}
+	replyCh := make(chan *packet.Packet, 1)
+	go func() {
+		reply, _ := ctl.Request(packet.New(nil, packet.HEARTBEAT))
+		replyCh <- reply
+	}()
+	req := ctl.readDC(1)[0]
+	ctl.fromDC <- []*packet.Packet{req.Reply(nil)}
+	select {
+	case reply := <-replyCh:
+		test.Equal(reply.ReqId, req.ReqId)
+	case <-time.After(time.Second):
+		test.Panic(0, "reply is blocked by the out chan")
+	}
+}
+
+func TestConfigRequestTimeout(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{
+		RequestTimeout: 50 * time.Millisecond,
+		ResendInterval: 10 * time.Millisecond,
+		Retry:          RetryConfig{Timeout: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+	})
+	defer ctl.Close()
+	go func() {
+		for range ctl.toDC {
+		}
+	}()
+
+	now := time.Now()
+	_, err := ctl.Request(packet.New(nil, packet.HEARTBEAT))
+	test.Equal(err, ErrRequestTimeout)
+	test.True(time.Since(now) < 500*time.Millisecond)
+	// resent by the ResendInterval before timed out
+	test.True(ctl.RetryStats().Retransmits > 0)
+	test.Equal(ctl.PendingCount(), 0)
+}
+
+func TestHandleRequests(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+
+	handled := make(chan *packet.Packet, 4)
+	test.Nil(ctl.HandleRequests(func(p *packet.Packet) {
+		if p.ReqId == 1 {
+			panic("bad request")
+		}
+		handled <- p
+	}))
+	test.Equal(ctl.HandleRequests(func(*packet.Packet) {}), ErrOutChanInUse)
+	func() {
+		defer func() { test.Equal(recover(), ErrOutChanInUse) }()
+		ctl.GetOutChan()
+	}()
+
+	for i := 1; i <= 2; i++ {
+		p := packet.New(nil, packet.NEWDC)
+		p.ReqId = uint32(i)
+		ctl.fromDC <- []*packet.Packet{p}
+	}
+	select {
+	case p := <-handled:
+		test.Equal(p.ReqId, uint32(2))
+	case <-time.After(time.Second):
+		test.Panic(0, "request is not handled")
+	}
+
+	// the replies are dispatched to the callers, not the handler
+	replyCh := make(chan *packet.Packet, 1)
+	go func() {
+		reply, _ := ctl.Request(packet.New(nil, packet.HEARTBEAT))
+		replyCh <- reply
+	}()
+	req := ctl.readDC(1)[0]
+	ctl.fromDC <- []*packet.Packet{req.Reply(nil)}
+	select {
+	case reply := <-replyCh:
+		test.Equal(reply.ReqId, req.ReqId)
+	case <-time.After(time.Second):
+		test.Panic(0, "reply is not dispatched")
+	}
+	test.Equal(len(handled), 0)
+
+	// used by GetOutChan already
+	ctl2 := newTestController()
+	defer ctl2.Close()
+	ctl2.GetOutChan()
+	ctl2.GetOutChan()
+	test.Equal(ctl2.HandleRequests(func(*packet.Packet) {}), ErrOutChanInUse)
+}
+
+func TestMaxInFlight(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{MaxInFlight: 2})
+	defer ctl.Close()
+	drainOut(ctl)
+
+	request := func() chan error {
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := ctl.Request(packet.New(nil, packet.HEARTBEAT))
+			errCh <- err
+		}()
+		return errCh
+	}
+	first := request()
+	reqs := ctl.readDC(1)
+	request()
+	reqs = append(reqs, ctl.readDC(1)...)
+	test.Equal(ctl.PendingCount(), 2)
+
+	// the third one waits for a free slot
+	third := request()
+	select {
+	case <-ctl.toDC:
+		test.Panic(0, "request is sent over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	test.Equal(ctl.TrySend(packet.New(nil, packet.HEARTBEAT)), ErrTooManyRequests)
+	_, err := ctl.TryRequest(packet.New(nil, packet.HEARTBEAT))
+	test.Equal(err, ErrTooManyRequests)
+	asyncErr := make(chan error, 1)
+	ctl.RequestAsync(packet.New(nil, packet.HEARTBEAT), func(_ *packet.Packet, err error) {
+		asyncErr <- err
+	})
+	test.Equal(<-asyncErr, ErrTooManyRequests)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = ctl.RequestWithContext(ctx, packet.New(nil, packet.HEARTBEAT))
+	cancel()
+	test.Equal(err, context.DeadlineExceeded)
+
+	// responses are not limited
+	test.Nil(ctl.Send(reqs[1].Reply(nil)))
+	test.Equal(ctl.readDC(1)[0].Type, packet.HEARTBEAT_R)
+
+	// a reply frees the slot
+	ctl.fromDC <- []*packet.Packet{reqs[0].Reply(nil)}
+	test.Nil(<-first)
+	req := ctl.readDC(1)[0]
+	ctl.fromDC <- []*packet.Packet{req.Reply(nil)}
+	test.Nil(<-third)
+	test.Equal(len(ctl.inflight), 1)
+}
+
+func TestControllerCancel(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{
+		MaxInFlight: 1,
+		Retry:       RetryConfig{Timeout: 20 * time.Millisecond, MaxBackoff: 20 * time.Millisecond},
+	})
+	defer ctl.Close()
+	drainOut(ctl)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ctl.Request(packet.New(nil, packet.HEARTBEAT))
+		errCh <- err
+	}()
+	req := ctl.readDC(1)[0]
+	test.True(ctl.Cancel(req.ReqId))
+	test.False(ctl.Cancel(req.ReqId))
+	select {
+	case err := <-errCh:
+		test.Equal(err, ErrRequestCanceled)
+	case <-time.After(time.Second):
+		test.Panic(0, "cancel is not delivered")
+	}
+	test.Equal(ctl.PendingCount(), 0)
+	test.Equal(len(ctl.inflight), 0)
+
+	// no more retransmits
+	select {
+	case <-ctl.toDC:
+		test.Panic(0, "canceled request is resent")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// async request
+	ctl.RequestAsync(packet.New(nil, packet.HEARTBEAT), func(_ *packet.Packet, err error) {
+		errCh <- err
+	})
+	req = ctl.readDC(1)[0]
+	test.True(ctl.Cancel(req.ReqId))
+	test.Equal(<-errCh, ErrRequestCanceled)
+
+	// ctx cancellation shares the code path
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, err := ctl.RequestWithContext(ctx, packet.New(nil, packet.HEARTBEAT))
+		errCh <- err
+	}()
+	ctl.readDC(1)
+	cancel()
+	test.Equal(<-errCh, context.Canceled)
+	test.True(waitFor(func() bool { return ctl.PendingCount() == 0 }))
+	test.Equal(len(ctl.inflight), 0)
+}
+
+type recordLogger struct {
+	m    sync.Mutex
+	logs []string
+}
+
+func (l *recordLogger) Infof(format string, args ...interface{}) {
+	l.Errorf(format, args...)
+}
+
+func (l *recordLogger) Errorf(format string, args ...interface{}) {
+	l.m.Lock()
+	l.logs = append(l.logs, fmt.Sprintf(format, args...))
+	l.m.Unlock()
+}
+
+func (l *recordLogger) Contains(s string) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, log := range l.logs {
+		if strings.Contains(log, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOutBacklog(t *testing.T) {
+	defer test.New(t)
+
+	logger := &recordLogger{}
+	ctl := newTestControllerWithConfig(&Config{
+		OutBacklog:  4,
+		OutLagAlert: 20 * time.Millisecond,
+		Logger:      logger,
+	})
+	defer ctl.Close()
+	// the consumer is blocked
+	out := ctl.GetOutChan()
+
+	data := func(i int) []*packet.Packet {
+		return []*packet.Packet{packet.New([]byte{byte(i)}, packet.DATA)}
+	}
+	ctl.fromDC <- data(0)
+	test.True(waitFor(func() bool { return ctl.backlog.Len() == 0 }))
+	for i := 1; i < 6; i++ {
+		ctl.fromDC <- data(i)
+	}
+	test.True(waitFor(func() bool { return ctl.Stat().OutDropped == 1 }))
+	test.True(waitFor(func() bool { return logger.Contains("lags more than") }))
+
+	// the replies keep flowing
+	var resp *packet.Packet
+	var err error
+	done := make(chan struct{})
+	go func() {
+		resp, err = ctl.Request(packet.New([]byte("ping"), packet.HEARTBEAT))
+		close(done)
+	}()
+	req := ctl.readDC(1)[0]
+	ctl.fromDC <- []*packet.Packet{req.Reply([]byte("pong"))}
+	<-done
+	test.Nil(err)
+	test.Equal(string(resp.Payload()), "pong")
+	test.Equal(ctl.Stat().OutDropped, uint64(2))
+
+	var got []byte
+	for i := 0; i < 4; i++ {
+		select {
+		case ps := <-out:
+			test.Equal(len(ps), 1)
+			if ps[0].Type == packet.DATA {
+				got = append(got, ps[0].Payload()...)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("out chan is not fed")
+		}
+	}
+	test.Equal(got, []byte{0, 3, 4, 5})
+}
+
+// the retransmission of a request dropped by the backlog is not duplicated
+func TestOutBacklogDedup(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{OutBacklog: 1})
+	defer ctl.Close()
+	out := ctl.GetOutChan()
+
+	newDC := func() []*packet.Packet {
+		p := packet.New(nil, packet.NEWDC)
+		p.ReqId = 7
+		return []*packet.Packet{p}
+	}
+	ctl.fromDC <- []*packet.Packet{packet.New([]byte{0}, packet.DATA)}
+	test.True(waitFor(func() bool { return ctl.backlog.Len() == 0 }))
+	ctl.fromDC <- newDC()
+	ctl.fromDC <- []*packet.Packet{packet.New([]byte{1}, packet.DATA)}
+	test.True(waitFor(func() bool { return ctl.Stat().OutDropped == 1 }))
+	ctl.fromDC <- newDC()
+	test.True(waitFor(func() bool { return ctl.Stat().OutDropped == 2 }))
+
+	var got []packet.Type
+	for i := 0; i < 2; i++ {
+		select {
+		case ps := <-out:
+			got = append(got, ps[0].Type)
+		case <-time.After(time.Second):
+			t.Fatal("out chan is not fed")
+		}
+	}
+	test.Equal(got, []packet.Type{packet.DATA, packet.NEWDC})
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/chzyer/next/packet"
+)
+
+const DefaultDeadlineSkew = 100 * time.Millisecond
+
+// timeoutOf returns the remaining time of the request to be carried by its
+// packets, zero if it's not propagated or the peer hasn't packet.CapTimeout.
+func (c *Controller) timeoutOf(req *Request, now time.Time) time.Duration {
+	if !c.propagate || !c.PeerCaps().Has(packet.CapTimeout) {
+		return 0
+	}
+	if !req.Packet.Type.IsReq() || req.Packet.Type == packet.DATA {
+		return 0
+	}
+	ctx := req.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok || !deadline.After(now) {
+		return 0
+	}
+	return deadline.Sub(now)
+}
+
+// isStale returns true if the requester has given up the request which
+// arrived at the time, a delay up to Config.DeadlineSkew is allowed. the
+// stale requests are dropped without handling and counted by
+// Stat.StaleDropped.
+func (c *Controller) isStale(p *packet.Packet, arrived, now time.Time) bool {
+	if p.Timeout <= 0 || !p.Type.IsReq() {
+		return false
+	}
+	if !now.After(arrived.Add(p.Timeout + c.skew)) {
+		return false
+	}
+	atomic.AddUint64(&c.stale, 1)
+	c.logger.Infof("drop stale request: %v, timed out %v ago",
+		p, now.Sub(arrived.Add(p.Timeout)))
+	return true
+}
+
+// dropStale returns the packets which are not stale, ps is reused
+func (c *Controller) dropStale(ps []*packet.Packet, arrived time.Time) []*packet.Packet {
+	now := time.Now()
+	ret := ps[:0]
+	for _, p := range ps {
+		if !c.isStale(p, arrived, now) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/test"
+)
+
+func TestPropagateDeadline(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{PropagateDeadline: true})
+	defer ctl.Close()
+	ctl.negotiate()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go ctl.RequestWithContext(ctx, packet.New(nil, packet.NEWDC))
+	p := ctl.readDC(1)[0]
+	test.True(p.Timeout > time.Second && p.Timeout <= 2*time.Second)
+
+	// no deadline
+	go ctl.Request(packet.New(nil, packet.NEWDC))
+	test.Equal(ctl.readDC(1)[0].Timeout, time.Duration(0))
+
+	// not enabled
+	legacy := newTestController()
+	defer legacy.Close()
+	go legacy.RequestWithContext(ctx, packet.New(nil, packet.NEWDC))
+	test.Equal(legacy.readDC(1)[0].Timeout, time.Duration(0))
+
+	// the peer can't read it
+	ctl.SetPeerVersion(packet.Negotiate(packet.VersionLegacy, packet.SupportedCaps&^packet.CapTimeout))
+	go ctl.RequestWithContext(ctx, packet.New(nil, packet.NEWDC))
+	test.Equal(ctl.readDC(1)[0].Timeout, time.Duration(0))
+}
+
+func TestDropStaleRequest(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{
+		HandlerWorkers: 1,
+		DeadlineSkew:   10 * time.Millisecond,
+	})
+	defer ctl.Close()
+
+	block := make(chan struct{})
+	var handled int32
+	test.Nil(ctl.Handle(packet.NEWDC, func(req *packet.Packet) (*packet.Packet, error) {
+		if atomic.AddInt32(&handled, 1) == 1 {
+			<-block
+		}
+		return nil, nil
+	}))
+
+	newReq := func(reqId uint32, timeout time.Duration) []*packet.Packet {
+		p := packet.New(nil, packet.NEWDC)
+		p.ReqId = reqId
+		p.Timeout = timeout
+		return []*packet.Packet{p}
+	}
+	// the only worker is busy, the second request waits in the queue
+	ctl.fromDC <- newReq(1, 0)
+	test.True(waitFor(func() bool { return atomic.LoadInt32(&handled) == 1 }))
+	ctl.fromDC <- newReq(2, 20*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(block)
+
+	ctl.fromDC <- newReq(3, 10*time.Second)
+	ps := ctl.readDC(2)
+	test.Equal(len(ps), 2)
+	test.Equal(ps[0].ReqId, uint32(1))
+	test.Equal(ps[1].ReqId, uint32(3))
+	test.Equal(atomic.LoadInt32(&handled), int32(2))
+	test.Equal(ctl.Stat().StaleDropped, uint64(1))
+
+	// by the out chan
+	out := ctl.GetOutChan()
+	ctl.fromDC <- []*packet.Packet{packet.New(nil, packet.SPEED)}
+	test.True(waitFor(func() bool { return ctl.backlog.Len() == 0 }))
+	stale := newReq(4, time.Millisecond)
+	stale[0].Type = packet.SPEED
+	ctl.fromDC <- stale
+	time.Sleep(30 * time.Millisecond)
+	<-out
+	select {
+	case ps := <-out:
+		test.Panic(0, "stale request is forwarded: "+ps[0].Type.String())
+	case <-time.After(50 * time.Millisecond):
+	}
+	test.Equal(ctl.Stat().StaleDropped, uint64(2))
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/chzyer/next/packet"
+)
+
+const (
+	DefaultDedupSize = 1024
+	DefaultDedupTTL  = 30 * time.Second
+)
+
+// dedupWindow remember the ReqIds of the recent requests from the peer and
+// the responses to them, so the retransmitted requests are not handled
+// twice.
+type dedupWindow struct {
+	size    int
+	ttl     time.Duration
+	entries map[uint32]*dedupEntry
+	order   *list.List
+	m       sync.Mutex
+}
+
+type dedupEntry struct {
+	reqId uint32
+	seen  time.Time
+	resp  *packet.Packet
+	elem  *list.Element
+}
+
+func newDedupWindow(size int, ttl time.Duration) *dedupWindow {
+	return &dedupWindow{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[uint32]*dedupEntry),
+		order:   list.New(),
+	}
+}
+
+// Seen returns whether the reqId is seen in the window and the cached
+// response if any, the reqId is recorded if it's new.
+func (w *dedupWindow) Seen(reqId uint32, now time.Time) (bool, *packet.Packet) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.expireLocked(now)
+	if e := w.entries[reqId]; e != nil {
+		return true, e.resp
+	}
+	e := &dedupEntry{reqId: reqId, seen: now}
+	e.elem = w.order.PushBack(e)
+	w.entries[reqId] = e
+	for w.order.Len() > w.size {
+		w.removeLocked(w.order.Front().Value.(*dedupEntry))
+	}
+	return false, nil
+}
+
+// SetResp cache the response of a request in the window
+func (w *dedupWindow) SetResp(p *packet.Packet) {
+	w.m.Lock()
+	if e := w.entries[p.ReqId]; e != nil {
+		e.resp = p
+	}
+	w.m.Unlock()
+}
+
+// Forget remove the reqId from the window, e.g. the request is dropped
+// before handled.
+func (w *dedupWindow) Forget(reqId uint32) {
+	w.m.Lock()
+	if e := w.entries[reqId]; e != nil {
+		w.removeLocked(e)
+	}
+	w.m.Unlock()
+}
+
+// Clear forget all the requests, the peer may reuse the ReqIds after it's
+// restarted.
+func (w *dedupWindow) Clear() {
+	w.m.Lock()
+	w.entries = make(map[uint32]*dedupEntry)
+	w.order.Init()
+	w.m.Unlock()
+}
+
+func (w *dedupWindow) Len() int {
+	w.m.Lock()
+	n := len(w.entries)
+	w.m.Unlock()
+	return n
+}
+
+func (w *dedupWindow) expireLocked(now time.Time) {
+	for elem := w.order.Front(); elem != nil; elem = w.order.Front() {
+		e := elem.Value.(*dedupEntry)
+		if now.Sub(e.seen) < w.ttl {
+			break
+		}
+		w.removeLocked(e)
+	}
+}
+
+func (w *dedupWindow) removeLocked(e *dedupEntry) {
+	w.order.Remove(e.elem)
+	delete(w.entries, e.reqId)
+}
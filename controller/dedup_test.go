@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/test"
+)
+
+func TestDedupWindow(t *testing.T) {
+	defer test.New(t)
+
+	now := time.Now()
+	w := newDedupWindow(2, time.Minute)
+	dup, resp := w.Seen(1, now)
+	test.False(dup)
+	test.Nil(resp)
+
+	dup, resp = w.Seen(1, now)
+	test.True(dup)
+	test.Nil(resp)
+
+	p := packet.New(nil, packet.HEARTBEAT_R)
+	p.ReqId = 1
+	w.SetResp(p)
+	dup, resp = w.Seen(1, now)
+	test.True(dup)
+	test.Equal(resp, p)
+
+	// bounded by size
+	w.Seen(2, now)
+	w.Seen(3, now)
+	test.Equal(w.Len(), 2)
+	dup, _ = w.Seen(1, now)
+	test.False(dup)
+
+	// expired by ttl
+	dup, _ = w.Seen(1, now.Add(time.Minute))
+	test.False(dup)
+	test.Equal(w.Len(), 1)
+
+	w.Clear()
+	test.Equal(w.Len(), 0)
+	dup, _ = w.Seen(1, now.Add(time.Minute))
+	test.False(dup)
+}
@@ -19,6 +19,7 @@ type Group struct {
 	online   map[uint16]*Server
 	toTun    chan<- []byte
 	users    *uc.Users
+	checksum bool // guarded by mutex, see SetChecksum
 	mutex    sync.RWMutex
 }
 
@@ -38,6 +39,7 @@ loop:
 		select {
 		case ipPacket := <-fromTun:
 			d := packet.NewDataPacket(ipPacket)
+			d.Classify()
 			u := c.users.FindByIP(d.DestIP())
 			if u == nil {
 				logex.Errorf("user not found: %v", d.DestIP())
@@ -46,14 +48,27 @@ loop:
 			c.mutex.RLock()
 			ctl := c.online[u.Id]
 			c.mutex.RUnlock()
-			logex.Debugf("send to %v: %v", u.Name, d.Packet.Type)
-			ctl.Send(d.Packet)
+			logex.Debugf("send to %v: %v", u.Name, d.Packet)
+			if err := ctl.Send(d.Packet); err != nil {
+				logex.Errorf("send to %v fail: %v", u.Name, err)
+			}
 		case <-c.flow.IsClose():
 			break loop
 		}
 	}
 }
 
+// SetChecksum enable or disable the checksum of the outgoing packets of all
+// the users, see Controller.SetChecksum.
+func (c *Group) SetChecksum(enable bool) {
+	c.mutex.Lock()
+	c.checksum = enable
+	for _, ctl := range c.online {
+		ctl.SetChecksum(enable)
+	}
+	c.mutex.Unlock()
+}
+
 func (c *Group) OnDchanPortUpdate(port []int) {
 	c.mutex.RLock()
 	for _, ctl := range c.online {
@@ -68,6 +83,7 @@ func (c *Group) UserLogin(u *uc.User) *Server {
 	controller, ok := c.online[u.Id]
 	if !ok {
 		controller = NewServer(c.flow, u, c.toTun)
+		controller.SetChecksum(c.checksum)
 		c.online[u.Id] = controller
 	} else {
 		controller.UserRelogin(u)
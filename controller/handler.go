@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/next/packet"
+)
+
+const DefaultHandlerWorkers = 8
+
+// HandlerFunc returns the response of the request, the ReqId of the
+// response is always set to the request's. a nil response means an empty
+// reply, and an error is sent to the peer as an error response, see
+// packet.ReplyError for its code.
+type HandlerFunc func(req *packet.Packet) (*packet.Packet, error)
+
+// handlers dispatch the incoming requests to the registered HandlerFuncs
+// by a bounded worker pool.
+type handlers struct {
+	workers int
+	funcs   map[packet.Type]HandlerFunc
+	queue   chan inbound
+	once    sync.Once
+	m       sync.RWMutex
+}
+
+// inbound is the request waiting for a worker
+type inbound struct {
+	p       *packet.Packet
+	arrived time.Time
+}
+
+func newHandlers(workers int) *handlers {
+	return &handlers{
+		workers: workers,
+		funcs:   make(map[packet.Type]HandlerFunc),
+		queue:   make(chan inbound, workers),
+	}
+}
+
+func (h *handlers) Get(t packet.Type) (fn HandlerFunc, registered bool) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+	return h.funcs[t], len(h.funcs) > 0
+}
+
+// Handle register the fn for the request type, the previous one is
+// replaced. the requests of the other types are passed to GetOutChan or
+// HandleRequests if any of them is used, otherwise an error response of
+// packet.ErrCodeUnhandled is sent. fn is called concurrently by at most
+// Config.HandlerWorkers goroutines and the panic is recovered.
+func (c *Controller) Handle(t packet.Type, fn HandlerFunc) error {
+	if !t.IsReq() {
+		return ErrNotRequest.Format(t)
+	}
+	c.handlers.m.Lock()
+	c.handlers.funcs[t] = fn
+	c.handlers.m.Unlock()
+	c.handlers.once.Do(func() {
+		for i := 0; i < c.handlers.workers; i++ {
+			go c.handleWorker()
+		}
+	})
+	return nil
+}
+
+// dispatch returns false if the packet is not consumed by the handlers
+func (c *Controller) dispatch(p *packet.Packet) bool {
+	if !p.Type.IsReq() {
+		return false
+	}
+	fn, registered := c.handlers.Get(p.Type)
+	if fn == nil {
+		if !registered || p.Type == packet.DATA || atomic.LoadInt32(&c.outMode) != outNone {
+			return false
+		}
+		resp := p.ReplyError(&packet.RemoteError{
+			Code:    packet.ErrCodeUnhandled,
+			Message: fmt.Sprintf("no handler for packet type %v", p.Type),
+		})
+		// never block the readLoop, the response is cached first, so the
+		// retransmission is answered if it's dropped.
+		c.dedup.SetResp(resp)
+		select {
+		case c.in <- &Request{Packet: resp}:
+		default:
+		}
+		return true
+	}
+	select {
+	case c.handlers.queue <- inbound{p, time.Now()}:
+	case <-c.flow.IsClose():
+	}
+	return true
+}
+
+func (c *Controller) handleWorker() {
+	c.flow.Add(1)
+	defer c.flow.Done()
+	for {
+		select {
+		case in := <-c.handlers.queue:
+			if !c.isStale(in.p, in.arrived, time.Now()) {
+				c.serve(in.p)
+			}
+		case <-c.flow.IsClose():
+			return
+		}
+	}
+}
+
+func (c *Controller) serve(req *packet.Packet) {
+	fn, _ := c.handlers.Get(req.Type)
+	resp, err := c.callHandler(fn, req)
+	if err != nil {
+		resp = req.ReplyError(err)
+	} else if resp == nil {
+		resp = req.Reply(nil)
+	}
+	resp.ReqId = req.ReqId
+	c.sendResponse(req, resp)
+}
+
+func (c *Controller) callHandler(fn HandlerFunc, req *packet.Packet) (resp *packet.Packet, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			c.logger.Errorf("handler panic: %v: %v", req, e)
+			resp, err = nil, fmt.Errorf("handler panic: %v", e)
+		}
+	}()
+	return fn(req)
+}
+
+// sendResponse send the error response instead if resp is too large, so
+// the requester doesn't wait until timeout.
+func (c *Controller) sendResponse(req, resp *packet.Packet) {
+	err := c.Send(resp)
+	if logex.Equal(err, packet.ErrPayloadTooLarge) && !resp.IsError() {
+		c.logger.Errorf("send response %v: %v", resp, err)
+		resp = req.ReplyError(err)
+		err = c.Send(resp)
+	}
+	if err != nil {
+		c.logger.Errorf("send response %v: %v", resp, err)
+	}
+}
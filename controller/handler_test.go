@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/test"
+)
+
+// the application-defined request/response pair of the tests
+const (
+	testType   packet.Type = 210
+	testType_R packet.Type = 211
+)
+
+func init() {
+	if err := packet.RegisterType(byte(testType), "Test", true, false); err != nil {
+		panic(err)
+	}
+	if err := packet.RegisterType(byte(testType_R), "TestResp", false, true); err != nil {
+		panic(err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{HandlerWorkers: 2})
+	defer ctl.Close()
+
+	var running, maxRunning int32
+	test.Nil(ctl.Handle(packet.NEWDC, func(req *packet.Packet) (*packet.Packet, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		switch string(req.Payload()) {
+		case "panic":
+			panic("bad request")
+		case "error":
+			return nil, fmt.Errorf("no port")
+		}
+		// the ReqId is stamped by the controller
+		return packet.New([]byte("[1]"), packet.NEWDC_R), nil
+	}))
+	test.True(logex.Equal(ctl.Handle(packet.NEWDC_R, nil), ErrNotRequest))
+
+	payloads := []string{"ok", "error", "panic", "ok"}
+	for idx, payload := range payloads {
+		p := packet.New([]byte(payload), packet.NEWDC)
+		p.ReqId = uint32(idx + 1)
+		ctl.fromDC <- []*packet.Packet{p}
+	}
+	// unregistered type
+	p := packet.New(nil, packet.SPEED)
+	p.ReqId = 10
+	ctl.fromDC <- []*packet.Packet{p}
+
+	resps := make(map[uint32]*packet.Packet)
+	for _, p := range ctl.readDC(len(payloads) + 1) {
+		test.True(p.Type.IsResp())
+		resps[p.ReqId] = p
+	}
+	test.Equal(len(resps), len(payloads)+1)
+	test.Equal(resps[1].Type, packet.NEWDC_R)
+	test.Equal(resps[1].Payload(), []byte("[1]"))
+	test.False(resps[1].IsError())
+	test.Equal(*resps[2].RemoteError(), packet.RemoteError{Code: packet.ErrCodeInternal, Message: "no port"})
+	test.Equal(resps[3].RemoteError().Code, packet.ErrCodeInternal)
+	test.False(resps[4].IsError())
+	test.Equal(resps[10].RemoteError().Code, packet.ErrCodeUnhandled)
+	test.Equal(resps[10].Type, packet.SPEED_R)
+	test.True(atomic.LoadInt32(&maxRunning) <= 2)
+}
+
+// the unhandled response dropped by the full in chan is cached for the
+// retransmission
+func TestHandleUnhandledDropped(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{InQueueSize: 1})
+	defer ctl.Close()
+	test.Nil(ctl.Handle(packet.NEWDC, func(req *packet.Packet) (*packet.Packet, error) {
+		return req.Reply(nil), nil
+	}))
+	// the sendLoop is blocked since the data channel is not read
+	full := func() bool {
+		select {
+		case ctl.in <- &Request{Packet: packet.New(nil, packet.DATA)}:
+		default:
+		}
+		return len(ctl.in) == cap(ctl.in)
+	}
+	test.True(waitFor(full))
+	time.Sleep(10 * time.Millisecond)
+	test.True(waitFor(full))
+
+	p := packet.New(nil, packet.SPEED)
+	p.ReqId = 10
+	ctl.fromDC <- []*packet.Packet{p}
+	test.True(waitFor(func() bool {
+		ctl.dedup.m.Lock()
+		defer ctl.dedup.m.Unlock()
+		e := ctl.dedup.entries[10]
+		return e != nil && e.resp != nil && e.resp.RemoteError().Code == packet.ErrCodeUnhandled
+	}))
+}
+
+func TestHandleRemoteError(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ctl.Request(packet.New(nil, packet.NEWDC))
+		errCh <- err
+	}()
+	req := ctl.readDC(1)[0]
+	ctl.fromDC <- []*packet.Packet{req.ReplyError(&packet.RemoteError{Code: packet.ErrCodeNotFound, Message: "no port"})}
+	select {
+	case err := <-errCh:
+		remoteErr, ok := err.(*packet.RemoteError)
+		test.True(ok)
+		test.Equal(remoteErr.Code, packet.ErrCodeNotFound)
+		test.Equal(remoteErr.Message, "no port")
+	case <-time.After(time.Second):
+		test.Panic(0, "error response is not delivered")
+	}
+}
+
+func TestHandleWithOutChan(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+	test.Nil(ctl.Handle(packet.NEWDC, func(req *packet.Packet) (*packet.Packet, error) {
+		return nil, nil
+	}))
+	out := ctl.GetOutChan()
+
+	// the unregistered types are passed to the out chan
+	p := packet.New(nil, packet.SPEED)
+	p.ReqId = 1
+	ctl.fromDC <- []*packet.Packet{p}
+	select {
+	case ps := <-out:
+		test.Equal(ps[0].ReqId, uint32(1))
+	case <-time.After(time.Second):
+		test.Panic(0, "request is not passed to out chan")
+	}
+
+	p = packet.New(nil, packet.NEWDC)
+	p.ReqId = 2
+	ctl.fromDC <- []*packet.Packet{p}
+	resp := ctl.readDC(1)[0]
+	test.Equal(resp.ReqId, uint32(2))
+	test.Equal(resp.Type, packet.NEWDC_R)
+	test.Equal(resp.Size(), 0)
+}
+
+func TestHandleRegisteredType(t *testing.T) {
+	defer test.New(t)
+
+	cli := newTestController()
+	defer cli.Close()
+	svr := newTestController()
+	defer svr.Close()
+	// the packets are marshaled as on the wire
+	forward := func(from, to packet.Chan) {
+		for ps := range from {
+			for _, p := range ps {
+				got, err := packet.Unmarshal(p.AppendTo(nil))
+				if err != nil {
+					continue
+				}
+				to <- []*packet.Packet{got}
+			}
+		}
+	}
+	go forward(cli.toDC, svr.fromDC)
+	go forward(svr.toDC, cli.fromDC)
+
+	test.True(logex.Equal(svr.Handle(testType_R, nil), ErrNotRequest))
+	test.True(logex.Equal(svr.Handle(packet.Type(212), nil), ErrNotRequest))
+	test.Nil(svr.Handle(testType, func(req *packet.Packet) (*packet.Packet, error) {
+		return req.Reply(append([]byte("re: "), req.Payload()...)), nil
+	}))
+
+	resp, err := cli.Request(packet.New([]byte("hello"), testType))
+	test.Nil(err)
+	test.Equal(resp.Type, testType_R)
+	test.Equal(resp.Payload(), []byte("re: hello"))
+}
@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/chzyer/flow"
+	"github.com/chzyer/next/packet"
+)
+
+const (
+	DefaultHeartbeatInterval  = 5 * time.Second
+	DefaultHeartbeatMaxMisses = 3
+)
+
+type HeartbeatConfig struct {
+	// Interval between two heartbeats, default to DefaultHeartbeatInterval
+	Interval time.Duration
+	// Timeout of one heartbeat, default to Interval
+	Timeout time.Duration
+	// MaxMisses is how many consecutive misses make the peer unreachable,
+	// default to DefaultHeartbeatMaxMisses
+	MaxMisses int
+	// Payload is carried by every heartbeat request, it can be nil.
+	Payload []byte
+	// OnChange is called from the heartbeat loop when the peer becomes
+	// unreachable or is recovered, it must not block. it can be nil.
+	OnChange func(HeartbeatEvent)
+}
+
+func (c *HeartbeatConfig) init() {
+	if c.Interval <= 0 {
+		c.Interval = DefaultHeartbeatInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = c.Interval
+	}
+	if c.MaxMisses <= 0 {
+		c.MaxMisses = DefaultHeartbeatMaxMisses
+	}
+}
+
+type HeartbeatEvent struct {
+	// Alive is false if the peer becomes unreachable, true if it's recovered
+	Alive bool
+	// Misses before the event
+	Misses int
+	// RTT of the heartbeat which recovers the peer
+	RTT time.Duration
+	// Err of the last missed heartbeat
+	Err error
+}
+
+type HeartbeatStat struct {
+	Alive   bool
+	Misses  int
+	LastRTT time.Duration
+
+	RTTMin time.Duration
+	RTTAvg time.Duration
+	RTTP99 time.Duration
+}
+
+// Heartbeat send HEARTBEAT requests periodically through the controller to
+// find out whether the peer is reachable.
+type Heartbeat struct {
+	ctl  *Controller
+	cfg  HeartbeatConfig
+	flow *flow.Flow
+	rtt  *rttWindow
+
+	m       sync.Mutex
+	alive   bool
+	misses  int
+	lastRTT time.Duration
+	lastErr error
+}
+
+func NewHeartbeat(f *flow.Flow, ctl *Controller, cfg *HeartbeatConfig) *Heartbeat {
+	if cfg == nil {
+		cfg = &HeartbeatConfig{}
+	}
+	h := &Heartbeat{
+		ctl:   ctl,
+		cfg:   *cfg,
+		rtt:   newRTTWindow(DefaultRTTWindow),
+		alive: true,
+	}
+	h.cfg.init()
+	f.ForkTo(&h.flow, h.Close)
+	go h.loop()
+	return h
+}
+
+func (h *Heartbeat) Close() {
+	h.flow.Close()
+}
+
+// Alive reports whether the peer is reachable, it's true before the first
+// MaxMisses heartbeats are missed.
+func (h *Heartbeat) Alive() bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.alive
+}
+
+func (h *Heartbeat) Stat() HeartbeatStat {
+	h.m.Lock()
+	stat := HeartbeatStat{
+		Alive:   h.alive,
+		Misses:  h.misses,
+		LastRTT: h.lastRTT,
+	}
+	h.m.Unlock()
+	stat.RTTMin, stat.RTTAvg, stat.RTTP99 = h.rtt.Summary()
+	return stat
+}
+
+func (h *Heartbeat) loop() {
+	h.flow.Add(1)
+	defer h.flow.DoneAndClose()
+
+	ticker := time.NewTicker(h.cfg.Interval)
+	defer ticker.Stop()
+	for h.flow.Tick(ticker) != flow.F_CLOSED {
+		now := time.Now()
+		err := h.beat()
+		if h.flow.IsClosed() {
+			break
+		}
+		if event := h.record(time.Since(now), err); event != nil && h.cfg.OnChange != nil {
+			h.cfg.OnChange(*event)
+		}
+	}
+}
+
+// beat send one heartbeat and wait for the reply until timeout
+func (h *Heartbeat) beat() error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-h.flow.IsClose():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	_, err := h.ctl.RequestWithContext(ctx, packet.New(h.cfg.Payload, packet.HEARTBEAT))
+	return err
+}
+
+// record returns the event if the liveness is changed
+func (h *Heartbeat) record(rtt time.Duration, err error) *HeartbeatEvent {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if err != nil {
+		h.misses++
+		h.lastErr = err
+		if h.alive && h.misses >= h.cfg.MaxMisses {
+			h.alive = false
+			h.ctl.logger.Errorf("peer is unreachable after %v heartbeats: %v", h.misses, err)
+			return &HeartbeatEvent{Alive: false, Misses: h.misses, Err: err}
+		}
+		return nil
+	}
+
+	h.rtt.Add(rtt)
+	h.lastRTT = rtt
+	misses := h.misses
+	h.misses = 0
+	if !h.alive {
+		h.alive = true
+		h.ctl.logger.Infof("peer is recovered after %v missed heartbeats", misses)
+		return &HeartbeatEvent{Alive: true, Misses: misses, RTT: rtt, Err: h.lastErr}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chzyer/flow"
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/test"
+)
+
+func TestHeartbeat(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	defer ctl.Close()
+	drainOut(ctl)
+
+	// the peer replies the heartbeats only if it's up
+	var up int32 = 1
+	go func() {
+		for {
+			select {
+			case ps := <-ctl.toDC:
+				for _, p := range ps {
+					test.Equal(p.Type, packet.HEARTBEAT)
+					test.Equal(p.Payload(), []byte("ping"))
+					if atomic.LoadInt32(&up) == 1 {
+						ctl.fromDC <- []*packet.Packet{p.Reply(nil)}
+					}
+				}
+			case <-ctl.flow.IsClose():
+				return
+			}
+		}
+	}()
+
+	events := make(chan HeartbeatEvent, 4)
+	f := flow.New()
+	h := NewHeartbeat(f, ctl.Controller, &HeartbeatConfig{
+		Interval:  20 * time.Millisecond,
+		Timeout:   10 * time.Millisecond,
+		MaxMisses: 2,
+		Payload:   []byte("ping"),
+		OnChange:  func(e HeartbeatEvent) { events <- e },
+	})
+	test.True(waitFor(func() bool { return h.Stat().LastRTT > 0 }))
+	test.True(h.Alive())
+
+	atomic.StoreInt32(&up, 0)
+	select {
+	case e := <-events:
+		test.False(e.Alive)
+		test.Equal(e.Misses, 2)
+		test.NotNil(e.Err)
+	case <-time.After(time.Second):
+		test.Panic(0, "unreachable is not reported")
+	}
+	test.False(h.Alive())
+
+	atomic.StoreInt32(&up, 1)
+	select {
+	case e := <-events:
+		test.True(e.Alive)
+		test.True(e.Misses >= 2)
+		test.True(e.RTT > 0)
+	case <-time.After(time.Second):
+		test.Panic(0, "recovered is not reported")
+	}
+	test.True(h.Alive())
+	test.Equal(h.Stat().Misses, 0)
+
+	// stopped by the flow
+	f.Close()
+	h.flow.Wait()
+	sent := atomic.LoadUint64(&ctl.sent)
+	time.Sleep(60 * time.Millisecond)
+	test.Equal(atomic.LoadUint64(&ctl.sent), sent)
+	test.Equal(len(events), 0)
+}
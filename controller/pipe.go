@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"github.com/chzyer/flow"
+	"github.com/chzyer/next/packet"
+)
+
+// Pipe forward the requests arrived at each controller to the other one and
+// route the responses back with the original ReqIds, e.g. for a relay
+// between the upstream and the downstream. the DATA packets are forwarded
+// without waiting for reply. it takes the out chans of both controllers and
+// returns immediately, f is closed once f or either controller is closed.
+func Pipe(a, b *Controller, f *flow.Flow) {
+	outA, outB := a.GetOutChan(), b.GetOutChan()
+	go pipeLoop(a, b, outA, f)
+	go pipeLoop(b, a, outB, f)
+}
+
+// pipeLoop forward the requests from the out chan of src to dst
+func pipeLoop(src, dst *Controller, out packet.RecvChan, f *flow.Flow) {
+	f.Add(1)
+	defer f.DoneAndClose()
+	for {
+		select {
+		case ps := <-out:
+			for _, p := range ps {
+				if !p.Type.IsReq() {
+					continue
+				}
+				if p.Type == packet.DATA {
+					pipeData(src, dst, p)
+				} else {
+					f.Add(1)
+					go pipeRequest(src, dst, p, f)
+				}
+			}
+		case <-src.flow.IsClose():
+			return
+		case <-dst.flow.IsClose():
+			return
+		case <-f.IsClose():
+			return
+		}
+	}
+}
+
+func pipeData(src, dst *Controller, p *packet.Packet) {
+	// the reassembled one may be too large to construct
+	np, err := packet.NewE(p.Payload(), p.Type)
+	if err == nil {
+		err = dst.Send(np)
+	}
+	if err != nil {
+		src.logger.Errorf("pipe data %v: %v", p, err)
+	}
+}
+
+// pipeRequest send the request by dst with a new ReqId, the response or
+// the error is replied to src.
+func pipeRequest(src, dst *Controller, p *packet.Packet, f *flow.Flow) {
+	defer f.Done()
+	req, err := packet.NewE(p.Payload(), p.Type)
+	if err != nil {
+		src.sendResponse(p, p.ReplyError(err))
+		return
+	}
+	var resp *packet.Packet
+	if rep, err := dst.Request(req); err != nil {
+		resp = p.ReplyError(err)
+	} else if resp, err = packet.NewE(rep.Payload(), rep.Type); err != nil {
+		resp = p.ReplyError(err)
+	} else {
+		resp.ReqId = p.ReqId
+	}
+	src.sendResponse(p, resp)
+}
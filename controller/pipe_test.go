@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/chzyer/flow"
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/test"
+)
+
+// newTestLink returns two controllers connected by the fake DCs
+func newTestLink() (*Controller, *Controller) {
+	ab, ba := packet.NewChan(0), packet.NewChan(0)
+	a := NewController(flow.New(), ab.Send(), ba.Recv())
+	b := NewController(flow.New(), ba.Send(), ab.Recv())
+	return a, b
+}
+
+func TestPipe(t *testing.T) {
+	defer test.New(t)
+
+	client, a := newTestLink()
+	b, server := newTestLink()
+	defer client.Close()
+	defer server.Close()
+
+	test.Nil(server.Handle(packet.NEWDC, func(req *packet.Packet) (*packet.Packet, error) {
+		if string(req.Payload()) == "error" {
+			return nil, fmt.Errorf("no port")
+		}
+		return packet.New(append([]byte("re:"), req.Payload()...), packet.NEWDC_R), nil
+	}))
+	pipe := flow.New()
+	Pipe(a, b, pipe)
+
+	for i := 0; i < 3; i++ {
+		payload := []byte(fmt.Sprintf("req%v", i))
+		resp, err := client.Request(packet.New(payload, packet.NEWDC))
+		test.Nil(err)
+		test.Equal(resp.Type, packet.NEWDC_R)
+		test.Equal(string(resp.Payload()), "re:"+string(payload))
+	}
+
+	_, err := client.Request(packet.New([]byte("error"), packet.NEWDC))
+	test.Equal(*err.(*packet.RemoteError), packet.RemoteError{Code: packet.ErrCodeInternal, Message: "no port"})
+
+	// the other direction
+	data := server.GetOutChan()
+	test.Nil(client.Send(packet.New([]byte("data"), packet.DATA)))
+	select {
+	case ps := <-data:
+		test.Equal(string(ps[0].Payload()), "data")
+	case <-time.After(time.Second):
+		test.Panic(0, "data is not piped")
+	}
+
+	// the pipe is closed with either side
+	b.Close()
+	select {
+	case <-pipe.IsClose():
+	case <-time.After(time.Second):
+		test.Panic(0, "pipe is not closed")
+	}
+	a.Close()
+}
@@ -20,6 +20,7 @@ type Server struct {
 func NewServer(f *flow.Flow, u *uc.User, toTun chan<- []byte) *Server {
 	fromDC, toDC := u.GetFromController()
 	ctl := NewController(f, toDC, fromDC)
+	ctl.SetPeerVersion(u.PacketVersion, u.Caps)
 	s := &Server{
 		flow:       ctl.flow,
 		Controller: ctl,
@@ -39,8 +40,7 @@ func (s *Server) handlePacket(p *packet.Packet) bool {
 	switch p.Type {
 	case packet.NEWDC:
 		ret, _ := json.Marshal(s.ports)
-		s.Send(p.Reply(ret))
-		return true
+		return s.sendReply(p.Reply(ret))
 	case packet.DATA:
 		select {
 		case s.toTun <- p.Payload():
@@ -49,7 +49,16 @@ func (s *Server) handlePacket(p *packet.Packet) bool {
 		}
 	}
 	if p.Type.IsReq() {
-		s.Send(p.Reply(nil))
+		return s.sendReply(p.Reply(nil))
+	}
+	return true
+}
+
+// sendReply returns false if the controller is closed
+func (s *Server) sendReply(p *packet.Packet) bool {
+	if err := s.Send(p); err != nil {
+		s.logger.Errorf("send %v: %v", p, err)
+		return err != ErrControllerClosed
 	}
 	return true
 }
@@ -64,7 +73,7 @@ loop:
 		select {
 		case ps := <-out:
 			for _, p := range ps {
-				logex.Debug(p.Type)
+				logex.Debug(p)
 				if !s.handlePacket(p) {
 					return
 				}
@@ -75,6 +84,9 @@ loop:
 	}
 }
 
+// UserRelogin is called if the user logs in again, the client may be
+// restarted, so the state of the previous session is reset.
 func (s *Server) UserRelogin(u *uc.User) {
-
+	s.SetPeerVersion(u.PacketVersion, u.Caps)
+	s.ResetPeer()
 }
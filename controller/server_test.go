@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chzyer/flow"
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/next/uc"
+	"github.com/chzyer/test"
+)
+
+type testSvrDelegate struct{}
+
+func (testSvrDelegate) GetAllDataChannel() []int { return []int{1234} }
+
+func TestServerRelogin(t *testing.T) {
+	defer test.New(t)
+
+	f := flow.New()
+	defer f.Close()
+	g := NewGroup(f, testSvrDelegate{}, uc.NewUsers(), make(chan []byte))
+	u := uc.NewUser(&uc.UserInfo{Id: 1, Name: "user"})
+	fromSvr, toSvr := u.GetFromDataChannel()
+
+	request := func(reqId uint32, seq uint64) *packet.Packet {
+		p := packet.New(nil, packet.NEWDC)
+		p.ReqId = reqId
+		p.Seq = seq
+		toSvr <- []*packet.Packet{p}
+		select {
+		case ps := <-fromSvr:
+			return ps[0]
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+
+	svr := g.UserLogin(u)
+	test.Equal(request(1, 1).ReqId, uint32(1))
+	test.Nil(request(2, 1))
+
+	// the restarted client counts from 1 again
+	test.Equal(g.UserLogin(u), svr)
+	test.Equal(request(3, 1).ReqId, uint32(3))
+	test.Nil(request(4, 1))
+}
+
+func TestServerReloginReqId(t *testing.T) {
+	defer test.New(t)
+
+	f := flow.New()
+	defer f.Close()
+	g := NewGroup(f, testSvrDelegate{}, uc.NewUsers(), make(chan []byte))
+	u := uc.NewUser(&uc.UserInfo{Id: 1, Name: "user"})
+	fromSvr, toSvr := u.GetFromDataChannel()
+
+	request := func(reqId uint32, payload string) *packet.Packet {
+		p := packet.New([]byte(payload), packet.HEARTBEAT)
+		p.ReqId = reqId
+		toSvr <- []*packet.Packet{p}
+		select {
+		case ps := <-fromSvr:
+			return ps[0]
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+
+	svr := g.UserLogin(u)
+	svr.Handle(packet.HEARTBEAT, func(req *packet.Packet) (*packet.Packet, error) {
+		return req.Reply(req.Payload()), nil
+	})
+	test.Equal(request(1, "old").Payload(), []byte("old"))
+	// the retransmission is answered by the cached response
+	test.Equal(request(1, "old").Payload(), []byte("old"))
+
+	// the restarted client reuses the ReqId
+	g.UserLogin(u)
+	test.Equal(request(1, "new").Payload(), []byte("new"))
+}
+
+func TestGroupChecksum(t *testing.T) {
+	defer test.New(t)
+
+	f := flow.New()
+	defer f.Close()
+	g := NewGroup(f, testSvrDelegate{}, uc.NewUsers(), make(chan []byte))
+	g.SetChecksum(true)
+	svr := g.UserLogin(uc.NewUser(&uc.UserInfo{Id: 1, Name: "user"}))
+	test.Equal(atomic.LoadInt32(&svr.checksum), int32(1))
+
+	g.SetChecksum(false)
+	test.Equal(atomic.LoadInt32(&svr.checksum), int32(0))
+}
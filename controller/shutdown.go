@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/chzyer/logex"
+)
+
+var (
+	ErrShuttingDown    = fmt.Errorf("controller is shutting down")
+	ErrShutdownTimeout = logex.Define("%v requests are not replied before shutdown")
+)
+
+// how often the staging requests are checked during Shutdown
+const shutdownPoll = 10 * time.Millisecond
+
+func (c *Controller) isShuttingDown() bool {
+	return atomic.LoadInt32(&c.shutdown) == 1
+}
+
+// Shutdown close the controller gracefully, the later Send/Request returns
+// ErrShuttingDown immediately. the queued packets are written out and the
+// staging requests are waited for the replies up to timeout, then the
+// controller is closed and the rest of them are failed with
+// ErrControllerClosed, which is reported by ErrShutdownTimeout.
+func (c *Controller) Shutdown(timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&c.shutdown, 0, 1) {
+		return ErrShuttingDown
+	}
+	defer c.Close()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	if !c.flush(deadline.C) {
+		return ErrShutdownTimeout.Format(c.stage.Waiting() + len(c.in) + len(c.inHigh))
+	}
+
+	ticker := time.NewTicker(shutdownPoll)
+	defer ticker.Stop()
+	for c.stage.Waiting() > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return ErrShutdownTimeout.Format(c.stage.Waiting())
+		case <-c.flow.IsClose():
+			return ErrControllerClosed
+		}
+	}
+	return nil
+}
+
+// flush wait until the requests queued before are written to the data
+// channel, a marker is queued to each queue and is released by the
+// writeLoop after the batch which contains it is written.
+func (c *Controller) flush(timeout <-chan time.Time) bool {
+	for _, queue := range []chan *Request{c.inHigh, c.in} {
+		marker := &Request{flushed: make(chan struct{})}
+		select {
+		case queue <- marker:
+		case <-timeout:
+			return false
+		case <-c.flow.IsClose():
+			return false
+		}
+		select {
+		case <-marker.flushed:
+		case <-timeout:
+			return false
+		case <-c.flow.IsClose():
+			return false
+		}
+	}
+	return true
+}
+
+// releaseFlushes is called by the writeLoop after a batch is written
+func (c *Controller) releaseFlushes() {
+	for _, ch := range c.flushes {
+		close(ch)
+	}
+	c.flushes = nil
+}
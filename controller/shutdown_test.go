@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/test"
+)
+
+func TestShutdown(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	drainOut(ctl)
+
+	// queued but not written yet, nobody reads toDC
+	for i := 0; i < 3; i++ {
+		test.Nil(ctl.Send(packet.New([]byte{byte(i)}, packet.DATA)))
+	}
+	type result struct {
+		p   *packet.Packet
+		err error
+	}
+	reqDone := make(chan result, 1)
+	go func() {
+		p, err := ctl.Request(packet.New(nil, packet.NEWDC))
+		reqDone <- result{p, err}
+	}()
+	test.True(waitFor(func() bool { return len(ctl.in)+ctl.PendingCount() == 4 }))
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- ctl.Shutdown(time.Second)
+	}()
+	test.True(waitFor(ctl.isShuttingDown))
+	test.Equal(ctl.Send(packet.New(nil, packet.DATA)), ErrShuttingDown)
+	_, err := ctl.Request(packet.New(nil, packet.NEWDC))
+	test.Equal(err, ErrShuttingDown)
+
+	ps := ctl.readDC(4)
+	test.Equal(len(ps), 4)
+	test.Equal(ps[3].Type, packet.NEWDC)
+	ctl.fromDC <- []*packet.Packet{ps[3].Reply([]byte("ok"))}
+
+	ret := <-reqDone
+	test.Nil(ret.err)
+	test.Equal(ret.p.Payload(), []byte("ok"))
+	test.Nil(<-shutdown)
+	test.True(ctl.flow.IsClosed())
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestController()
+	drainOut(ctl)
+
+	reqDone := make(chan error, 1)
+	go func() {
+		_, err := ctl.Request(packet.New(nil, packet.NEWDC))
+		reqDone <- err
+	}()
+	test.Equal(len(ctl.readDC(1)), 1)
+
+	start := time.Now()
+	err := ctl.Shutdown(50 * time.Millisecond)
+	test.True(logex.Equal(err, ErrShutdownTimeout))
+	test.True(time.Since(start) >= 50*time.Millisecond)
+	test.Equal(<-reqDone, ErrControllerClosed)
+	test.Equal(ctl.Shutdown(time.Second), ErrShuttingDown)
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"container/list"
+	"sort"
 	"sync"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 type Stage struct {
 	staging map[uint32]*StageRequest
 	queue   *list.List
+	closed  bool
 	m       sync.Mutex
 }
 
@@ -20,6 +22,15 @@ type StageRequest struct {
 	Elem *list.Element
 }
 
+// age returns how long since the request is staged first time
+func (s *StageRequest) age(now time.Time) time.Duration {
+	created := s.Req.created
+	if created.IsZero() {
+		created = s.Time
+	}
+	return now.Sub(created)
+}
+
 func newStage() *Stage {
 	s := &Stage{
 		staging: make(map[uint32]*StageRequest),
@@ -28,30 +39,100 @@ func newStage() *Stage {
 	return s
 }
 
-func (s *Stage) Add(p *Request) {
-	req := &StageRequest{
-		Req:  p,
-		Time: time.Now(),
+// Add returns the requests which are rejected since the stage is closed,
+// and the other requests which are replaced since their ReqId is reused.
+func (s *Stage) Add(ps ...*Request) (rejected, collided []*Request) {
+	now := time.Now()
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return ps, nil
+	}
+	for _, p := range ps {
+		// checked under lock, so a canceled request is either skipped
+		// here or removed by its caller
+		if p.canceled() {
+			continue
+		}
+		if old := s.removeLocked(p.Packet.ReqId); old != nil && old != p {
+			collided = append(collided, old)
+		}
+		req := &StageRequest{
+			Req:  p,
+			Time: now,
+		}
+		req.Elem = s.queue.PushBack(req)
+		s.staging[p.Packet.ReqId] = req
 	}
+	s.m.Unlock()
+	return nil, collided
+}
+
+// Has returns whether the ReqId is staging
+func (s *Stage) Has(reqId uint32) bool {
 	s.m.Lock()
-	req.Elem = s.queue.PushBack(req)
-	s.staging[p.Packet.ReqId] = req
+	_, ok := s.staging[reqId]
 	s.m.Unlock()
+	return ok
 }
 
-func (s *Stage) Pop(timeout time.Duration) *Request {
+// Close remove and returns all the staging requests, the later requests are
+// rejected by Add.
+func (s *Stage) Close() []*Request {
 	s.m.Lock()
-	elem := s.queue.Front()
-	if elem != nil {
+	ret := make([]*Request, 0, len(s.staging))
+	for elem := s.queue.Front(); elem != nil; elem = elem.Next() {
+		ret = append(ret, elem.Value.(*StageRequest).Req)
+	}
+	s.staging = make(map[uint32]*StageRequest)
+	s.queue.Init()
+	s.closed = true
+	s.m.Unlock()
+	return ret
+}
+
+// EvictOlder remove and returns the requests which are staged first time
+// before t.
+func (s *Stage) EvictOlder(t time.Time) []*Request {
+	var ret []*Request
+	s.m.Lock()
+	for elem := s.queue.Front(); elem != nil; {
 		sreq := elem.Value.(*StageRequest)
-		if time.Now().Sub(sreq.Time) > timeout {
-			req := s.removeLocked(sreq.Req.Packet.ReqId)
-			s.m.Unlock()
-			return req
+		elem = elem.Next()
+		if sreq.Req.created.Before(t) {
+			ret = append(ret, s.removeLocked(sreq.Req.Packet.ReqId))
 		}
 	}
 	s.m.Unlock()
-	return nil
+	return ret
+}
+
+// Stats returns the number of staging requests and the age of the oldest
+func (s *Stage) Stats(now time.Time) (size int, oldest time.Duration) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, sreq := range s.staging {
+		if age := sreq.age(now); age > oldest {
+			oldest = age
+		}
+	}
+	return len(s.staging), oldest
+}
+
+// Expired remove and returns the requests which are not replied before
+// their deadline.
+func (s *Stage) Expired(now time.Time) []*Request {
+	var ret []*Request
+	s.m.Lock()
+	for elem := s.queue.Front(); elem != nil; {
+		sreq := elem.Value.(*StageRequest)
+		elem = elem.Next()
+		if now.After(sreq.Req.deadline) {
+			ret = append(ret, s.removeLocked(sreq.Req.Packet.ReqId))
+		}
+	}
+	s.m.Unlock()
+	return ret
 }
 
 func (s *Stage) removeLocked(reqId uint32) (req *Request) {
@@ -71,17 +152,72 @@ func (s *Stage) Remove(reqId uint32) (req *Request) {
 	return req
 }
 
+// Get returns the staging request without removing it
+func (s *Stage) Get(reqId uint32) *Request {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if sreq := s.staging[reqId]; sreq != nil {
+		return sreq.Req
+	}
+	return nil
+}
+
+// Touch set the deadline of the staging request
+func (s *Stage) Touch(reqId uint32, deadline time.Time) {
+	s.m.Lock()
+	if sreq := s.staging[reqId]; sreq != nil {
+		sreq.Req.deadline = deadline
+	}
+	s.m.Unlock()
+}
+
+func (s *Stage) Len() int {
+	s.m.Lock()
+	n := len(s.staging)
+	s.m.Unlock()
+	return n
+}
+
+// Waiting returns how many staging requests wait for replies, the DATA
+// packets are staged but never replied.
+func (s *Stage) Waiting() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	n := 0
+	for _, req := range s.staging {
+		if req.Req.Packet.Type != packet.DATA {
+			n++
+		}
+	}
+	return n
+}
+
+// ReqIds returns the sorted ReqIds of all the staging requests
+func (s *Stage) ReqIds() []uint32 {
+	s.m.Lock()
+	ret := make([]uint32, 0, len(s.staging))
+	for k := range s.staging {
+		ret = append(ret, k)
+	}
+	s.m.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
 type StageInfo struct {
 	ReqId    uint32
 	DataType packet.Type
+	Age      time.Duration
 }
 
 func (s *Stage) ShowStage() []StageInfo {
 	s.m.Lock()
 	defer s.m.Unlock()
+	now := time.Now()
 	ret := make([]StageInfo, 0, len(s.staging))
 	for k, r := range s.staging {
-		ret = append(ret, StageInfo{k, r.Req.Packet.Type})
+		ret = append(ret, StageInfo{k, r.Req.Packet.Type, r.age(now)})
 	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ReqId < ret[j].ReqId })
 	return ret
 }
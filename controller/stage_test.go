@@ -35,4 +35,39 @@ func TestStage(t *testing.T) {
 
 		test.Equal(len(s.ShowStage()), 0)
 	}
+
+	{
+		s.Add(req)
+		test.Equal(s.Close(), []*Request{req})
+		test.Equal(s.Len(), 0)
+		rejected, _ := s.Add(req)
+		test.Equal(rejected, []*Request{req})
+		test.Equal(s.Len(), 0)
+	}
+}
+
+func TestStageCollision(t *testing.T) {
+	defer test.New(t)
+
+	s := newStage()
+	p := packet.New(nil, packet.HEARTBEAT)
+	p.ReqId = 1
+	old := NewRequest(p, true)
+	_, collided := s.Add(old)
+	test.Equal(len(collided), 0)
+	test.True(s.Has(1))
+
+	// staging the same request again is not a collision
+	_, collided = s.Add(old)
+	test.Equal(len(collided), 0)
+	test.Equal(s.Len(), 1)
+
+	p2 := packet.New(nil, packet.HEARTBEAT)
+	p2.ReqId = 1
+	req := NewRequest(p2, true)
+	_, collided = s.Add(req)
+	test.Equal(collided, []*Request{old})
+	test.Equal(s.Len(), 1)
+	test.Equal(s.Remove(1), req)
+	test.False(s.Has(1))
 }
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultRTTWindow is how many recent RTT samples are kept for Stat
+const DefaultRTTWindow = 256
+
+type Stat struct {
+	InFlight     int
+	TotalSent    uint64
+	TotalReplied uint64
+	Retransmits  uint64
+	// Timeouts count the requests given up by max retries or evicted by age
+	Timeouts uint64
+	// OutDropped count the incoming packets dropped because the consumer
+	// of the out chan is too slow, see Config.OutBacklog
+	OutDropped uint64
+	// StaleDropped count the incoming requests dropped because their
+	// requester has given up, see Config.PropagateDeadline
+	StaleDropped uint64
+	// ReplayDropped count the incoming packets whose Seq is seen already or
+	// too old, see SetReplayWindow. the retransmissions carry new Seqs, so
+	// they are never counted.
+	ReplayDropped uint64
+
+	RTTMin time.Duration
+	RTTAvg time.Duration
+	RTTP99 time.Duration
+}
+
+// rttWindow keep the recent RTT samples in a ring buffer
+type rttWindow struct {
+	samples []time.Duration
+	next    int
+	full    bool
+	m       sync.Mutex
+}
+
+func newRTTWindow(size int) *rttWindow {
+	return &rttWindow{samples: make([]time.Duration, size)}
+}
+
+func (w *rttWindow) Add(d time.Duration) {
+	w.m.Lock()
+	w.samples[w.next] = d
+	w.next++
+	if w.next == len(w.samples) {
+		w.next = 0
+		w.full = true
+	}
+	w.m.Unlock()
+}
+
+// Summary returns zeros if there is no sample
+func (w *rttWindow) Summary() (min, avg, p99 time.Duration) {
+	w.m.Lock()
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, w.samples[:n])
+	w.m.Unlock()
+	if n == 0 {
+		return 0, 0, 0
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	idx := (n*99+99)/100 - 1
+	return sorted[0], sum / time.Duration(n), sorted[idx]
+}
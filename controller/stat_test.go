@@ -0,0 +1,30 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chzyer/test"
+)
+
+func TestRTTWindow(t *testing.T) {
+	defer test.New(t)
+
+	w := newRTTWindow(100)
+	min, avg, p99 := w.Summary()
+	test.Equal([]time.Duration{min, avg, p99}, []time.Duration{0, 0, 0})
+
+	w.Add(3 * time.Millisecond)
+	min, avg, p99 = w.Summary()
+	test.Equal([]time.Duration{min, avg, p99},
+		[]time.Duration{3 * time.Millisecond, 3 * time.Millisecond, 3 * time.Millisecond})
+
+	// the oldest samples are overwritten
+	for i := 200; i > 0; i-- {
+		w.Add(time.Duration(i) * time.Millisecond)
+	}
+	min, avg, p99 = w.Summary()
+	test.Equal(min, time.Millisecond)
+	test.Equal(avg, 50500*time.Microsecond)
+	test.Equal(p99, 99*time.Millisecond)
+}
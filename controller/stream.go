@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chzyer/flow"
+	"github.com/chzyer/next/packet"
+)
+
+const DefaultStreamChunkTimeout = 10 * time.Second
+
+var ErrStreamTimeout = fmt.Errorf("stream timed out waiting for the next chunk")
+
+// stream reorder the chunks of a streaming response and forward them to
+// the caller of RequestStream.
+type stream struct {
+	out    chan *packet.Packet
+	notify chan struct{}
+
+	m       sync.Mutex
+	next    uint32
+	end     int64
+	pending map[uint32]*packet.Packet
+	ready   []*packet.Packet
+	started bool
+	closed  bool
+}
+
+func newStream() *stream {
+	return &stream{
+		out:     make(chan *packet.Packet),
+		notify:  make(chan struct{}, 1),
+		end:     -1,
+		pending: make(map[uint32]*packet.Packet),
+	}
+}
+
+// feed add the chunk, returns whether all the chunks are received, dup is
+// true if the chunk is received already.
+func (s *stream) feed(p *packet.Packet) (done, dup bool) {
+	idx, data, ok := p.StreamChunk()
+	if !ok {
+		return false, true
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed || idx < s.next || s.pending[idx] != nil {
+		return false, true
+	}
+	chunk := packet.New(data, p.Type)
+	chunk.ReqId = p.ReqId
+	s.pending[idx] = chunk
+	if !p.HasMore() {
+		s.end = int64(idx)
+	}
+	s.started = true
+	for chunk := s.pending[s.next]; chunk != nil; chunk = s.pending[s.next] {
+		delete(s.pending, s.next)
+		s.ready = append(s.ready, chunk)
+		s.next++
+	}
+	s.wake()
+	return s.end >= 0 && int64(s.next) > s.end, false
+}
+
+// push add the response which is not a chunk, e.g. the peer doesn't
+// support streaming.
+func (s *stream) push(p *packet.Packet) {
+	s.m.Lock()
+	if !s.closed {
+		s.ready = append(s.ready, p)
+	}
+	s.m.Unlock()
+}
+
+// close the out chan after the ready chunks are forwarded
+func (s *stream) close() {
+	s.m.Lock()
+	s.closed = true
+	s.wake()
+	s.m.Unlock()
+}
+
+func (s *stream) isStarted() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.started
+}
+
+func (s *stream) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *stream) forward(f *flow.Flow) {
+	defer close(s.out)
+	for {
+		s.m.Lock()
+		ready, closed := s.ready, s.closed
+		s.ready = nil
+		s.m.Unlock()
+		for _, p := range ready {
+			select {
+			case s.out <- p:
+			case <-f.IsClose():
+				return
+			}
+		}
+		if closed && len(ready) == 0 {
+			return
+		}
+		if len(ready) > 0 {
+			continue
+		}
+		select {
+		case <-s.notify:
+		case <-f.IsClose():
+			return
+		}
+	}
+}
+
+// RequestStream send the request whose response is a stream of chunks,
+// see packet.ReplyStream. the chunks are delivered in order with the index
+// stripped, and the chan is closed after the last one. it's closed early
+// if no chunk arrives within Config.StreamChunkTimeout since the previous
+// one, or the request is failed or canceled. the peer must have
+// packet.CapStream.
+func (c *Controller) RequestStream(req *packet.Packet) (<-chan *packet.Packet, error) {
+	if !req.Type.IsReq() {
+		return nil, ErrNotRequest.Format(req.Type)
+	}
+	if !c.PeerCaps().Has(packet.CapStream) {
+		return nil, ErrPeerUnsupported.Format("stream")
+	}
+	r := &Request{Packet: req, stream: newStream()}
+	go r.stream.forward(c.flow)
+	if _, err := c.send(context.Background(), r); err != nil {
+		r.stream.close()
+		return nil, err
+	}
+	return r.stream.out, nil
+}
+
+// SendStream reply the request with the chunks as a stream
+func (c *Controller) SendStream(req *packet.Packet, chunks [][]byte) error {
+	if len(chunks) == 0 {
+		chunks = [][]byte{nil}
+	}
+	for idx, data := range chunks {
+		if err := c.Send(req.ReplyStream(uint32(idx), data, idx < len(chunks)-1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleChunk deliver the chunk to the staging stream request, the request
+// is kept staging until the last chunk arrives.
+func (c *Controller) handleChunk(p *packet.Packet) {
+	req := c.stage.Get(p.ReqId)
+	if req == nil || req.stream == nil {
+		if c.onUnmatchedReply != nil {
+			c.onUnmatchedReply(p)
+		}
+		return
+	}
+	done, dup := req.stream.feed(p)
+	if dup {
+		c.logger.Infof("drop duplicated chunk: %v", p)
+		return
+	}
+	if !done {
+		// never resent once the stream is started, see resendLoop
+		c.stage.Touch(p.ReqId, time.Now().Add(c.streamWait))
+		return
+	}
+	if c.stage.Remove(p.ReqId) == req {
+		atomic.AddUint64(&c.replied, 1)
+		c.traceRequest(traceReply, req)
+		c.release(req)
+		req.stream.close()
+	}
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/test"
+)
+
+func recvStream(ch <-chan *packet.Packet) (ret []string, closed bool) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				return ret, true
+			}
+			ret = append(ret, string(p.Payload()))
+		case <-timeout:
+			return ret, false
+		}
+	}
+}
+
+func TestRequestStream(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{MaxInFlight: 1})
+	defer ctl.Close()
+	ctl.negotiate()
+	drainOut(ctl)
+
+	ch, err := ctl.RequestStream(packet.New(nil, packet.NEWDC))
+	test.Nil(err)
+	req := ctl.readDC(1)[0]
+
+	// out of order and duplicated
+	ctl.fromDC <- []*packet.Packet{
+		req.ReplyStream(1, []byte("b"), true),
+		req.ReplyStream(0, []byte("a"), true),
+		req.ReplyStream(1, []byte("b"), true),
+	}
+	ctl.fromDC <- []*packet.Packet{req.ReplyStream(3, []byte("d"), false)}
+	test.True(waitFor(func() bool { return ctl.PendingCount() == 1 }))
+	ctl.fromDC <- []*packet.Packet{
+		req.ReplyStream(2, []byte("c"), true),
+		req.ReplyStream(0, []byte("a"), true),
+	}
+	chunks, closed := recvStream(ch)
+	test.True(closed)
+	test.Equal(chunks, []string{"a", "b", "c", "d"})
+	test.Equal(ctl.PendingCount(), 0)
+	test.Equal(len(ctl.inflight), 0)
+
+	// the responder side
+	test.Nil(ctl.SendStream(req, [][]byte{[]byte("x"), []byte("y")}))
+	ps := ctl.readDC(2)
+	test.Equal(len(ps), 2)
+	test.True(ps[0].HasMore())
+	test.False(ps[1].HasMore())
+
+	// a plain response ends the stream
+	ch, err = ctl.RequestStream(packet.New(nil, packet.NEWDC))
+	test.Nil(err)
+	req = ctl.readDC(1)[0]
+	ctl.fromDC <- []*packet.Packet{req.Reply([]byte("whole"))}
+	chunks, closed = recvStream(ch)
+	test.True(closed)
+	test.Equal(chunks, []string{"whole"})
+
+	_, err = ctl.RequestStream(packet.New(nil, packet.NEWDC_R))
+	test.NotNil(err)
+}
+
+func TestRequestStreamTimeout(t *testing.T) {
+	defer test.New(t)
+
+	ctl := newTestControllerWithConfig(&Config{
+		StreamChunkTimeout: 30 * time.Millisecond,
+		Retry:              RetryConfig{Timeout: 20 * time.Millisecond, MaxBackoff: 20 * time.Millisecond},
+	})
+	defer ctl.Close()
+	ctl.negotiate()
+	drainOut(ctl)
+
+	ch, err := ctl.RequestStream(packet.New(nil, packet.NEWDC))
+	test.Nil(err)
+	req := ctl.readDC(1)[0]
+	ctl.fromDC <- []*packet.Packet{req.ReplyStream(0, []byte("a"), true)}
+	chunks, closed := recvStream(ch)
+	test.True(closed)
+	test.Equal(chunks, []string{"a"})
+	test.Equal(ctl.PendingCount(), 0)
+
+	// the started stream is never resent
+	select {
+	case ps := <-ctl.toDC:
+		test.Equal(len(ps), 0)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
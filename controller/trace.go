@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/next/util"
+)
+
+const DefaultTraceQueueSize = 256
+
+// Tracer observe the lifecycle of the requests, it's set by Config.Tracer.
+// the methods are called one by one from a dedicated goroutine, the events
+// are dropped instead of blocking the loops if it falls behind.
+type Tracer interface {
+	// OnSend is called when the request is sent first time
+	OnSend(reqId uint32, t packet.Type, at time.Time)
+	OnRetransmit(reqId uint32, t packet.Type, retries int, at time.Time)
+	// OnReply is called when the last response of the request arrives,
+	// sent is when it's sent first time.
+	OnReply(reqId uint32, t packet.Type, sent, at time.Time)
+	// OnTimeout is called when the request is given up
+	OnTimeout(reqId uint32, t packet.Type, sent, at time.Time)
+	OnInboundRequest(reqId uint32, t packet.Type, at time.Time)
+}
+
+// LogTracer write the events to the Logger, default to util.DefaultLogger
+type LogTracer struct {
+	Logger util.Logger
+}
+
+func (l LogTracer) logger() util.Logger {
+	if l.Logger == nil {
+		return util.DefaultLogger
+	}
+	return l.Logger
+}
+
+func (l LogTracer) OnSend(reqId uint32, t packet.Type, at time.Time) {
+	l.logger().Infof("trace: send %v %v", reqId, t)
+}
+
+func (l LogTracer) OnRetransmit(reqId uint32, t packet.Type, retries int, at time.Time) {
+	l.logger().Infof("trace: retransmit %v %v #%v", reqId, t, retries)
+}
+
+func (l LogTracer) OnReply(reqId uint32, t packet.Type, sent, at time.Time) {
+	l.logger().Infof("trace: reply %v %v in %v", reqId, t, at.Sub(sent))
+}
+
+func (l LogTracer) OnTimeout(reqId uint32, t packet.Type, sent, at time.Time) {
+	l.logger().Infof("trace: timeout %v %v after %v", reqId, t, at.Sub(sent))
+}
+
+func (l LogTracer) OnInboundRequest(reqId uint32, t packet.Type, at time.Time) {
+	l.logger().Infof("trace: inbound %v %v", reqId, t)
+}
+
+type traceKind int
+
+const (
+	traceSend traceKind = iota
+	traceRetransmit
+	traceReply
+	traceTimeout
+	traceInbound
+)
+
+type traceEvent struct {
+	kind    traceKind
+	reqId   uint32
+	typ     packet.Type
+	retries int
+	sent    time.Time
+	at      time.Time
+}
+
+// asyncTracer queue the events for the Tracer, so a slow Tracer never
+// blocks the loops. the controller keeps it nil if no Tracer is set.
+type asyncTracer struct {
+	tracer Tracer
+	events chan traceEvent
+}
+
+func newAsyncTracer(tracer Tracer, size int) *asyncTracer {
+	return &asyncTracer{
+		tracer: tracer,
+		events: make(chan traceEvent, size),
+	}
+}
+
+func (a *asyncTracer) push(e traceEvent) {
+	select {
+	case a.events <- e:
+	default:
+	}
+}
+
+func (c *Controller) traceRequest(kind traceKind, req *Request) {
+	if c.tracer == nil {
+		return
+	}
+	c.tracer.push(traceEvent{
+		kind:    kind,
+		reqId:   req.Packet.ReqId,
+		typ:     req.Packet.Type,
+		retries: req.retries,
+		sent:    req.created,
+		at:      time.Now(),
+	})
+}
+
+func (c *Controller) traceInbound(p *packet.Packet) {
+	if c.tracer == nil {
+		return
+	}
+	c.tracer.push(traceEvent{
+		kind:  traceInbound,
+		reqId: p.ReqId,
+		typ:   p.Type,
+		at:    time.Now(),
+	})
+}
+
+func (c *Controller) traceLoop() {
+	c.flow.Add(1)
+	defer c.flow.Done()
+	for {
+		select {
+		case e := <-c.tracer.events:
+			c.runTracer(e)
+		case <-c.flow.IsClose():
+			return
+		}
+	}
+}
+
+func (c *Controller) runTracer(e traceEvent) {
+	defer func() {
+		if err := recover(); err != nil {
+			c.logger.Errorf("tracer panic: %v %v: %v", e.reqId, e.typ, err)
+		}
+	}()
+	t := c.tracer.tracer
+	switch e.kind {
+	case traceSend:
+		t.OnSend(e.reqId, e.typ, e.at)
+	case traceRetransmit:
+		t.OnRetransmit(e.reqId, e.typ, e.retries, e.at)
+	case traceReply:
+		t.OnReply(e.reqId, e.typ, e.sent, e.at)
+	case traceTimeout:
+		t.OnTimeout(e.reqId, e.typ, e.sent, e.at)
+	case traceInbound:
+		t.OnInboundRequest(e.reqId, e.typ, e.at)
+	}
+}
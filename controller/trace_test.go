@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/test"
+)
+
+type recordTracer struct {
+	m      sync.Mutex
+	events []string
+	block  chan struct{}
+}
+
+func (r *recordTracer) record(format string, args ...interface{}) {
+	if r.block != nil {
+		<-r.block
+	}
+	r.m.Lock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+	r.m.Unlock()
+}
+
+func (r *recordTracer) Events() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func (r *recordTracer) OnSend(reqId uint32, t packet.Type, at time.Time) {
+	r.record("send %v", reqId)
+}
+
+func (r *recordTracer) OnRetransmit(reqId uint32, t packet.Type, retries int, at time.Time) {
+	r.record("retransmit %v %v", reqId, retries)
+}
+
+func (r *recordTracer) OnReply(reqId uint32, t packet.Type, sent, at time.Time) {
+	r.record("reply %v %v", reqId, !at.Before(sent))
+}
+
+func (r *recordTracer) OnTimeout(reqId uint32, t packet.Type, sent, at time.Time) {
+	r.record("timeout %v", reqId)
+}
+
+func (r *recordTracer) OnInboundRequest(reqId uint32, t packet.Type, at time.Time) {
+	r.record("inbound %v %v", reqId, t)
+}
+
+func TestTracer(t *testing.T) {
+	defer test.New(t)
+
+	tracer := &recordTracer{}
+	ctl := newTestControllerWithConfig(&Config{
+		Tracer: tracer,
+		Retry:  RetryConfig{Timeout: 20 * time.Millisecond, MaxRetries: 1},
+	})
+	defer ctl.Close()
+	drainOut(ctl)
+
+	done := make(chan error)
+	go func() {
+		_, err := ctl.Request(packet.New(nil, packet.NEWDC))
+		done <- err
+	}()
+	req := ctl.readDC(1)[0]
+	ctl.fromDC <- []*packet.Packet{req.Reply(nil)}
+	test.Nil(<-done)
+
+	go func() {
+		_, err := ctl.Request(packet.New(nil, packet.NEWDC))
+		done <- err
+	}()
+	test.Equal(len(ctl.readDC(2)), 2)
+	test.Equal(<-done, ErrRequestTimeout)
+
+	p := packet.New(nil, packet.NEWDC)
+	p.ReqId = 9
+	ctl.fromDC <- []*packet.Packet{p}
+
+	test.True(waitFor(func() bool { return len(tracer.Events()) == 6 }))
+	test.Equal(tracer.Events(), []string{
+		"send 1", "reply 1 true",
+		"send 2", "retransmit 2 1", "timeout 2",
+		"inbound 9 NewDC",
+	})
+}
+
+func TestTracerNeverBlock(t *testing.T) {
+	defer test.New(t)
+
+	tracer := &recordTracer{block: make(chan struct{})}
+	defer close(tracer.block)
+	ctl := newTestControllerWithConfig(&Config{Tracer: tracer})
+	defer ctl.Close()
+
+	for i := 0; i < DefaultTraceQueueSize+10; i++ {
+		go ctl.Request(packet.New(nil, packet.NEWDC))
+		req := ctl.readDC(1)[0]
+		ctl.fromDC <- []*packet.Packet{req.Reply(nil)}
+	}
+	test.True(waitFor(func() bool { return ctl.PendingCount() == 0 }))
+}
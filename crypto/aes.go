@@ -3,7 +3,9 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
 
 	"github.com/klauspost/crc32"
 )
@@ -39,6 +41,23 @@ func DecodeAes(dst, src, key, iv []byte) {
 	cipher.NewCFBDecrypter(block, iv).XORKeyStream(dst, src)
 }
 
+// NewAEAD returns the aes-gcm cipher, the key must be 16, 24 or 32 bytes
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// DeriveKey returns a 32 bytes key for the label from the secret, the keys
+// of different labels are independent.
+func DeriveKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
 func EncodeMD5(data []byte) []byte {
 	sum := md5.Sum(data)
 	return sum[:]
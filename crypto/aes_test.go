@@ -21,3 +21,14 @@ func TestDeEnCode(t *testing.T) {
 	DecodeAes(dst, dst, key, iv)
 	test.Equal(src, dst)
 }
+
+func TestDeriveKey(t *testing.T) {
+	defer test.New(t)
+
+	secret := []byte("secret")
+	key := DeriveKey(secret, "a")
+	test.Equal(len(key), 32)
+	test.Equal(DeriveKey(secret, "a"), key)
+	test.NotEqual(DeriveKey(secret, "b"), key)
+	test.NotEqual(DeriveKey([]byte("other"), "a"), key)
+}
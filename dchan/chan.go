@@ -2,14 +2,152 @@ package dchan
 
 import (
 	"bufio"
+	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/chzyer/flow"
+	"github.com/chzyer/logex"
 	"github.com/chzyer/next/packet"
 	"github.com/chzyer/next/statistic"
 )
 
+// BatchWindow is how long the channels hold the outgoing packets to batch
+// them into one L2 packet, zero means only the packets queued together are
+// batched. see packet.Batcher.
+var BatchWindow time.Duration
+
+// writeBatches write the batches ready in b after ps is added, and returns
+// the timer to flush the rest if it's not running.
+func writeBatches(b *packet.Batcher, ps []*packet.Packet, flush <-chan time.Time,
+	write func([]*packet.Packet) error) (<-chan time.Time, error) {
+	for _, batch := range b.Add(ps) {
+		if err := write(batch); err != nil {
+			return flush, err
+		}
+	}
+	if d, ok := b.Wait(); ok && flush == nil {
+		flush = time.After(d)
+	}
+	return flush, nil
+}
+
+// writeSized write the packets by write, the ones too large to be sent
+// unfragmented are dropped instead of failing the channel, the others of
+// the same batch are written one by one then.
+func writeSized(ps []*packet.Packet, write func([]*packet.Packet) error) error {
+	err := write(ps)
+	if !logex.Equal(err, packet.ErrPayloadTooLarge) {
+		return err
+	}
+	if len(ps) == 1 {
+		logex.Error("drop packet:", ps[0], err)
+		return nil
+	}
+	for _, p := range ps {
+		if err := writeSized([]*packet.Packet{p}, write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the knobs of the priority queue of the channel writers, see
+// packet.PriorityQueue. a high priority packet waits at most a quantum
+// written before it, and the low priority one is written at least once
+// per PriorityMaxStarve packets. the writers stop reading the senders once
+// PriorityMaxQueued packets are queued.
+var (
+	PriorityQuantum   = 16 << 10
+	PriorityMaxStarve = 8
+	PriorityMaxQueued = 1024
+)
+
+// readyChan is always ready, it selects the queued packets
+var readyChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// queueReady returns nil if q is empty, so it's never selected
+func queueReady(q *packet.PriorityQueue) <-chan struct{} {
+	if q.Len() == 0 {
+		return nil
+	}
+	return readyChan
+}
+
+// queueIn returns nil if q is full, so the senders are blocked until the
+// queued packets are written
+func queueIn(q *packet.PriorityQueue, in packet.Chan) packet.RecvChan {
+	if q.Len() >= PriorityMaxQueued {
+		return nil
+	}
+	return in.Recv()
+}
+
+// writeQueued queue the packets pending in in, and write a quantum of q by
+// priority, so the high priority packets arrived meanwhile overtake the
+// backlog.
+func writeQueued(b *packet.Batcher, q *packet.PriorityQueue, in packet.Chan, flush <-chan time.Time,
+	write func([]*packet.Packet) error) (<-chan time.Time, error) {
+drain:
+	for n := len(in); n > 0 && q.Len() < PriorityMaxQueued; n-- {
+		select {
+		case ps := <-in:
+			q.Push(ps...)
+		default:
+			break drain
+		}
+	}
+	return writeBatches(b, q.PopBatch(PriorityQuantum), flush, write)
+}
+
+// KeepaliveInterval is how long a channel can be idle before a keepalive
+// is written to hold its NAT mapping, the heartbeats are not counted as
+// written. zero disables it. see packet.NewKeepaliveL2.
+var KeepaliveInterval = 15 * time.Second
+
+// newKeepaliveTicker returns a nil channel if KeepaliveInterval is zero
+func newKeepaliveTicker() (<-chan time.Time, func()) {
+	if KeepaliveInterval <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(KeepaliveInterval)
+	return t.C, t.Stop
+}
+
+// keepaliveState is embedded by the channels to implement
+// Channel.Keepalives
+type keepaliveState struct {
+	keepalives uint64
+	// the packets of the senders are written since the last keepalive tick,
+	// it's owned by the writeLoop
+	written bool
+}
+
+func (k *keepaliveState) Keepalives() uint64 {
+	return atomic.LoadUint64(&k.keepalives)
+}
+
+// idle returns whether nothing is written since the last tick, it's
+// called by the writeLoop on each keepalive tick.
+func (k *keepaliveState) idle() bool {
+	idle := !k.written
+	k.written = false
+	return idle
+}
+
+// writeKeepalive write the framed keepalive, see packet.NewKeepaliveL2.
+// it's plain so no crypto is spent.
+func writeKeepalive(w io.Writer, speed *statistic.Speed, frame []byte) error {
+	n, err := w.Write(frame)
+	speed.Upload(n)
+	return err
+}
+
 type SvrDelegate interface {
 	SvrAuthDelegate
 	GetUserChannelFromDataChannel(id int) (
@@ -24,7 +162,7 @@ type SvrInitDelegate interface {
 }
 
 type SvrAuthDelegate interface {
-	GetUserToken(id int) ([]byte, error)
+	GetUserLogin(id int) (*packet.Login, error)
 }
 
 type ChannelFactory interface {
@@ -44,6 +182,15 @@ type Channel interface {
 	AddOnClose(func())
 	GetSpeed() *statistic.SpeedInfo
 	ChanWrite() packet.SendChan
+	// Malformed returns how many received packets are dropped because they
+	// can't be decoded, see packet.IsMalformed.
+	Malformed() uint64
+	// Corrupted returns how many received packets are dropped because of
+	// packet.ErrChecksumMismatch, they are not counted by Malformed.
+	Corrupted() uint64
+	// Keepalives returns how many keepalives are received, they are
+	// dropped before the verification.
+	Keepalives() uint64
 	Run()
 
 	ReadL2(*bufio.Reader) (*packet.PacketL2, error)
@@ -0,0 +1,116 @@
+package dchan
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chzyer/flow"
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/next/statistic"
+	"github.com/chzyer/test"
+)
+
+// the writers stop reading the senders once the queue is full
+func TestQueueIn(t *testing.T) {
+	defer test.New(t)
+	defer func(n int) { PriorityMaxQueued = n }(PriorityMaxQueued)
+	PriorityMaxQueued = 2
+
+	in := make(packet.Chan, 4)
+	for i := 0; i < cap(in); i++ {
+		in <- []*packet.Packet{packet.New(nil, packet.DATA)}
+	}
+	q := packet.NewPriorityQueue(PriorityMaxStarve)
+	q.Push(<-queueIn(q, in)...)
+	q.Push(<-queueIn(q, in)...)
+	test.True(queueIn(q, in) == nil)
+
+	var written int
+	batcher := packet.NewBatcher(packet.MaxBatchSize, 0)
+	_, err := writeQueued(batcher, q, in, nil, func(ps []*packet.Packet) error {
+		written += len(ps)
+		return nil
+	})
+	test.Nil(err)
+	test.Equal(len(in), 2)
+	test.Equal(q.Len(), 0)
+	test.Equal(written, 2)
+}
+
+// the packet too large is dropped, the channel keeps writing the others
+func TestWriteSized(t *testing.T) {
+	defer test.New(t)
+
+	packet.AllowFragment = true
+	large := packet.New(make([]byte, packet.MaxPayload+1), packet.DATA)
+	packet.AllowFragment = false
+	small := packet.New([]byte("small"), packet.DATA)
+
+	session := packet.NewSessionCli(3, token)
+	var written [][]*packet.Packet
+	write := func(ps []*packet.Packet) error {
+		l2, err := packet.WrapL2E(session, ps)
+		if err != nil {
+			return err
+		}
+		l2.Release()
+		written = append(written, ps)
+		return nil
+	}
+	test.Nil(writeSized([]*packet.Packet{small, large, small}, write))
+	test.Equal(written, [][]*packet.Packet{{small}, {small}})
+	test.Nil(writeSized([]*packet.Packet{large}, write))
+	test.Equal(len(written), 2)
+}
+
+// the idle channel writes the keepalive though the heartbeats are written
+// meanwhile
+func TestTcpChanKeepalive(t *testing.T) {
+	defer test.New(t)
+	defer func(d time.Duration) { KeepaliveInterval = d }(KeepaliveInterval)
+	KeepaliveInterval = 1500 * time.Millisecond
+
+	f := flow.New()
+	defer f.Close()
+	cliConn, svrConn := net.Pipe()
+	ch := NewTcpChanClient(f, packet.NewSessionCli(3, token), cliConn, packet.NewChan(0).Send()).(*TcpChan)
+	ch.Run()
+
+	buf := bufio.NewReader(svrConn)
+	svrConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	heartbeats := 0
+	for {
+		l2, err := ch.ReadL2(buf)
+		test.Nil(err)
+		if l2.IsKeepalive() {
+			test.Equal(l2.UserId, uint16(3))
+			break
+		}
+		heartbeats++
+	}
+	test.True(heartbeats > 0)
+}
+
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func TestTcpChanKeepaliveAllocs(t *testing.T) {
+	defer test.New(t)
+
+	ch := &TcpChan{
+		conn:    discardConn{},
+		session: packet.NewSessionCli(3, token),
+		speed:   statistic.NewSpeed(),
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		test.Nil(ch.writeKeepalive())
+	})
+	test.Equal(allocs, float64(0))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/chzyer/flow"
@@ -31,6 +32,9 @@ type HttpChan struct {
 	speed     *statistic.Speed
 
 	exitError error
+	malformed uint64
+	corrupted uint64
+	keepaliveState
 
 	in  packet.Chan
 	out packet.SendChan
@@ -78,18 +82,47 @@ func (h *HttpChan) HeartBeatClean(err error) {
 	h.Close()
 }
 
+func (h *HttpChan) Malformed() uint64 {
+	return atomic.LoadUint64(&h.malformed)
+}
+
+func (h *HttpChan) Corrupted() uint64 {
+	return atomic.LoadUint64(&h.corrupted)
+}
+
 func (h *HttpChan) Run() {
 	go h.writeLoop()
 	go h.readLoop()
 }
 
 func (h *HttpChan) rawWrite(p []*packet.Packet) error {
-	l2 := packet.WrapL2(h.session, p)
-	n, err := h.conn.Write(h.WriteL2(l2))
+	packet.Debug("httpchan", packet.Outbound, p)
+	return writeSized(p, h.writeL2)
+}
+
+func (h *HttpChan) writeL2(p []*packet.Packet) error {
+	l2, err := packet.WrapL2E(h.session, p)
+	if err != nil {
+		return err
+	}
+	data := h.WriteL2(l2)
+	l2.Release()
+	n, err := h.conn.Write(data)
 	h.speed.Upload(n)
 	return err
 }
 
+// writeData write the packets of the senders, the heartbeats are not
+// counted as written, so the idle channel still sends the keepalives.
+func (h *HttpChan) writeData(p []*packet.Packet) error {
+	h.written = true
+	return h.rawWrite(p)
+}
+
+func (h *HttpChan) writeKeepalive() error {
+	return writeKeepalive(h.conn, h.speed, h.WriteL2(packet.NewKeepaliveL2(uint16(h.session.UserId()))))
+}
+
 func (h *HttpChan) writeLoop() {
 	h.flow.Add(1)
 	defer h.flow.DoneAndClose()
@@ -100,7 +133,12 @@ func (h *HttpChan) writeLoop() {
 
 	heartBeatTicker := time.NewTicker(1 * time.Second)
 	defer heartBeatTicker.Stop()
+	keepalive, stopKeepalive := newKeepaliveTicker()
+	defer stopKeepalive()
 
+	batcher := packet.NewBatcher(packet.MaxBatchSize, BatchWindow)
+	queue := packet.NewPriorityQueue(PriorityMaxStarve)
+	var flush <-chan time.Time
 	var err error
 loop:
 	for {
@@ -111,8 +149,19 @@ loop:
 			p := h.heartBeat.New()
 			err = h.rawWrite([]*packet.Packet{p})
 			h.heartBeat.Add(p)
-		case p := <-h.in:
-			err = h.rawWrite(p)
+		case <-keepalive:
+			if h.idle() {
+				err = h.writeKeepalive()
+			}
+		case <-flush:
+			flush = nil
+			if batch := batcher.Flush(); batch != nil {
+				err = h.writeData(batch)
+			}
+		case p := <-queueIn(queue, h.in):
+			queue.Push(p...)
+		case <-queueReady(queue):
+			flush, err = writeQueued(batcher, queue, h.in, flush, h.writeData)
 		}
 		if err != nil {
 			if !strings.Contains(err.Error(), "closed") {
@@ -144,7 +193,23 @@ loop:
 			break
 		}
 
+		if l2.IsKeepalive() {
+			// it's not authenticated, so it's counted only
+			atomic.AddUint64(&h.keepalives, 1)
+			continue
+		}
+
 		if err := l2.Verify(h.session); err != nil {
+			if logex.Equal(err, packet.ErrAuthFailed) {
+				// counted by the session, the peer is still trusted
+				logex.Error(err)
+				continue
+			}
+			if packet.IsMalformed(err) {
+				atomic.AddUint64(&h.malformed, 1)
+				logex.Error(err)
+				continue
+			}
 			h.exitError = logex.NewErrorf("verify error: %v", err)
 			break
 		}
@@ -160,6 +225,16 @@ loop:
 		}
 
 		ps, err := l2.Unmarshal()
+		if logex.Equal(err, packet.ErrChecksumMismatch) {
+			atomic.AddUint64(&h.corrupted, 1)
+			logex.Error(err)
+			continue
+		}
+		if packet.IsMalformed(err) {
+			atomic.AddUint64(&h.malformed, 1)
+			logex.Error(err)
+			continue
+		}
 		if err != nil {
 			h.exitError = logex.NewErrorf("client error: %v", err)
 			break
@@ -171,6 +246,7 @@ loop:
 }
 
 func (h *HttpChan) onRecePacket(ps []*packet.Packet) bool {
+	packet.Debug("httpchan", packet.Inbound, ps)
 	buffer := make([]*packet.Packet, 0, len(ps))
 	for _, p := range ps {
 		h.speed.Download(p.Size())
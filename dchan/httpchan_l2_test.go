@@ -31,6 +31,18 @@ func TestHttpChanL2(t *testing.T) {
 	logex.Info(ps)
 }
 
+// the keepalive survives the framing of the channels
+func TestKeepaliveL2(t *testing.T) {
+	defer test.New(t)
+	for _, ch := range []Channel{new(HttpChan), new(TcpChan)} {
+		buf := bytes.NewBuffer(ch.WriteL2(packet.NewKeepaliveL2(3)))
+		l2, err := ch.ReadL2(bufio.NewReader(buf))
+		test.Nil(err)
+		test.True(l2.IsKeepalive())
+		test.Equal(l2.UserId, uint16(3))
+	}
+}
+
 func BenchmarkHttpChanL2(b *testing.B) {
 	defer test.New(b)
 	token := util.RandStr(32)
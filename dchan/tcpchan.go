@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/chzyer/flow"
@@ -32,6 +33,11 @@ type TcpChan struct {
 
 	// runtime
 	exitError error
+	malformed uint64
+	corrupted uint64
+	keepaliveState
+	// keepaliveBuf is owned by the writeLoop
+	keepaliveBuf [packet.PacketL2HeaderSize + packet.KeepaliveSize]byte
 
 	in  packet.Chan
 	out packet.SendChan
@@ -71,6 +77,14 @@ func (c *TcpChan) IsSvrModeAndUninit() bool {
 	return c.out == nil
 }
 
+func (c *TcpChan) Malformed() uint64 {
+	return atomic.LoadUint64(&c.malformed)
+}
+
+func (c *TcpChan) Corrupted() uint64 {
+	return atomic.LoadUint64(&c.corrupted)
+}
+
 func (c *TcpChan) GetSpeed() *statistic.SpeedInfo {
 	return c.speed.GetSpeed()
 }
@@ -86,13 +100,37 @@ func (c *TcpChan) Run() {
 }
 
 func (c *TcpChan) rawWrite(p []*packet.Packet) error {
-	l2 := packet.WrapL2(c.session, p)
-	data := c.WriteL2(l2)
-	n, err := c.conn.Write(data)
+	packet.Debug("tcpchan", packet.Outbound, p)
+	return writeSized(p, c.writeL2)
+}
+
+func (c *TcpChan) writeL2(p []*packet.Packet) error {
+	l2, err := packet.WrapL2E(c.session, p)
+	if err != nil {
+		return err
+	}
+	buf := packet.GetBuffer(packet.PacketL2HeaderSize + len(l2.Payload))
+	encodeL2(buf.B, l2)
+	l2.Release()
+	n, err := c.conn.Write(buf.B)
+	buf.Release()
 	c.speed.Upload(n)
 	return err
 }
 
+// writeData write the packets of the senders, the heartbeats are not
+// counted as written, so the idle channel still sends the keepalives.
+func (c *TcpChan) writeData(p []*packet.Packet) error {
+	c.written = true
+	return c.rawWrite(p)
+}
+
+// writeKeepalive never allocates, the frame is encoded into keepaliveBuf
+func (c *TcpChan) writeKeepalive() error {
+	encodeL2(c.keepaliveBuf[:], packet.NewKeepaliveL2(uint16(c.session.UserId())))
+	return writeKeepalive(c.conn, c.speed, c.keepaliveBuf[:])
+}
+
 func (c *TcpChan) writeLoop() {
 	c.flow.Add(1)
 	defer c.flow.DoneAndClose()
@@ -103,7 +141,12 @@ func (c *TcpChan) writeLoop() {
 
 	heartBeatTicker := time.NewTicker(1 * time.Second)
 	defer heartBeatTicker.Stop()
+	keepalive, stopKeepalive := newKeepaliveTicker()
+	defer stopKeepalive()
 
+	batcher := packet.NewBatcher(packet.MaxBatchSize, BatchWindow)
+	queue := packet.NewPriorityQueue(PriorityMaxStarve)
+	var flush <-chan time.Time
 	var err error
 loop:
 	for {
@@ -114,8 +157,19 @@ loop:
 			p := c.heartBeat.New()
 			err = c.rawWrite([]*packet.Packet{p})
 			c.heartBeat.Add(p)
-		case p := <-c.in:
-			err = c.rawWrite(p)
+		case <-keepalive:
+			if c.idle() {
+				err = c.writeKeepalive()
+			}
+		case <-flush:
+			flush = nil
+			if batch := batcher.Flush(); batch != nil {
+				err = c.writeData(batch)
+			}
+		case p := <-queueIn(queue, c.in):
+			queue.Push(p...)
+		case <-queueReady(queue):
+			flush, err = writeQueued(batcher, queue, c.in, flush, c.writeData)
 		}
 		if err != nil {
 			if !strings.Contains(err.Error(), "closed") {
@@ -147,7 +201,25 @@ loop:
 			break
 		}
 
+		if l2.IsKeepalive() {
+			// it's not authenticated, so it's counted only
+			atomic.AddUint64(&c.keepalives, 1)
+			l2.Release()
+			continue
+		}
+
 		if err := l2.Verify(c.session); err != nil {
+			l2.Release()
+			if logex.Equal(err, packet.ErrAuthFailed) {
+				// counted by the session, the peer is still trusted
+				logex.Error(err)
+				continue
+			}
+			if packet.IsMalformed(err) {
+				atomic.AddUint64(&c.malformed, 1)
+				logex.Error(err)
+				continue
+			}
 			c.exitError = logex.NewErrorf("verify error: %v", err)
 			break
 		}
@@ -162,12 +234,26 @@ loop:
 			c.delegate.OnInited(c)
 		}
 
+		// the packets own their payloads, they are kept by the consumers
 		ps, err := l2.Unmarshal()
+		l2.Release()
+		if logex.Equal(err, packet.ErrChecksumMismatch) {
+			atomic.AddUint64(&c.corrupted, 1)
+			logex.Error(err)
+			continue
+		}
+		if packet.IsMalformed(err) {
+			// the framing is kept by the l2 header, only this one is lost
+			atomic.AddUint64(&c.malformed, 1)
+			logex.Error(err)
+			continue
+		}
 		if err != nil {
 			c.exitError = logex.NewErrorf("packet error: %v", err)
 			break
 		}
 
+		packet.Debug("tcpchan", packet.Inbound, ps)
 		for _, p := range ps {
 			c.speed.Download(p.Size())
 			if !c.onRecePacket(p) {
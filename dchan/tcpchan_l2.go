@@ -3,6 +3,7 @@ package dchan
 import (
 	"bufio"
 	"encoding/binary"
+	"io"
 
 	"github.com/chzyer/logex"
 	"github.com/chzyer/next/packet"
@@ -19,20 +20,26 @@ func (c *TcpChan) ReadL2(r *bufio.Reader) (*packet.PacketL2, error) {
 	userId := binary.BigEndian.Uint16(header[16:18])
 	checksum := binary.BigEndian.Uint32(header[18:22])
 	length := binary.BigEndian.Uint16(header[22:24])
-	payload, err := util.ReadFull(r, int(length))
-	if err != nil {
+	payload := packet.GetBuffer(int(length))
+	if _, err := io.ReadFull(r, payload.B); err != nil {
+		payload.Release()
 		return nil, logex.Trace(err, "read l2 payload")
 	}
 
-	return packet.NewPacketL2(iv, userId, payload, checksum), nil
+	return packet.NewPacketL2Buffer(iv, userId, payload, checksum), nil
 }
 
 func (c *TcpChan) WriteL2(p *packet.PacketL2) []byte {
 	ret := make([]byte, 24+len(p.Payload))
+	encodeL2(ret, p)
+	return ret
+}
+
+// encodeL2 write the l2 packet to ret, which is 24+len(p.Payload) bytes
+func encodeL2(ret []byte, p *packet.PacketL2) {
 	copy(ret[:16], p.IV)
 	binary.BigEndian.PutUint16(ret[16:18], p.UserId)
 	binary.BigEndian.PutUint32(ret[18:22], p.Checksum)
 	binary.BigEndian.PutUint16(ret[22:24], uint16(len(p.Payload)))
 	copy(ret[24:], p.Payload)
-	return ret
 }
@@ -0,0 +1,131 @@
+package packet
+
+import (
+	"math"
+	"time"
+
+	"github.com/chzyer/logex"
+)
+
+// MaxBatchSize is the max size of a batch in one L2 packet, whose length is
+// an uint16 and the AEAD tag is appended.
+const MaxBatchSize = math.MaxUint16 - l2Overhead
+
+var ErrBatchTooLarge = logex.Define("packet of %v bytes is larger than the batch: %v")
+
+// WriteBatch marshal the packets back to back, it's the payload of the L2
+// packet. every packet is prefixed by its header which tells the length, so
+// a batch of one packet is the packet itself and the peers which never
+// batch read it as well.
+func WriteBatch(ps []*Packet) ([]byte, error) {
+	size := 0
+	for _, p := range ps {
+		size += p.TotalSize()
+	}
+	if size > MaxBatchSize {
+		return nil, ErrBatchTooLarge.Format(size, MaxBatchSize)
+	}
+	buf := make([]byte, 0, size)
+	for _, p := range ps {
+		buf = p.AppendTo(buf)
+	}
+	return buf, nil
+}
+
+// ReadBatch returns the packets written by WriteBatch
+func ReadBatch(b []byte) ([]*Packet, error) {
+	return readBatch(b, Unmarshal)
+}
+
+func readBatch(b []byte, unmarshal func([]byte) (*Packet, error)) ([]*Packet, error) {
+	var ret []*Packet
+	for len(b) > 0 {
+		p, err := unmarshal(b)
+		if err != nil {
+			for _, p := range ret {
+				p.Release()
+			}
+			return nil, logex.Trace(err)
+		}
+		ret = append(ret, p)
+		b = b[p.TotalSize():]
+	}
+	return ret, nil
+}
+
+// Batcher group the outgoing packets into the batches no larger than
+// maxSize, it's used by the writer of the data channel:
+//
+//	for ps := range in {
+//		for _, batch := range b.Add(ps) {
+//			write(batch)
+//		}
+//		// and write(b.Flush()) once b.Wait() is passed
+//	}
+//
+// it's not thread safe.
+type Batcher struct {
+	maxSize int
+	window  time.Duration
+
+	pending []*Packet
+	size    int
+	since   time.Time
+}
+
+// NewBatcher returns a Batcher which holds the packets at most window, or
+// until they fill maxSize. zero window means no waiting, the packets added
+// together are still batched. maxSize is limited by MaxBatchSize.
+func NewBatcher(maxSize int, window time.Duration) *Batcher {
+	if maxSize <= 0 || maxSize > MaxBatchSize {
+		maxSize = MaxBatchSize
+	}
+	return &Batcher{maxSize: maxSize, window: window}
+}
+
+// Add append the packets and returns the batches should be written now.
+// the packet larger than maxSize is a batch of its own, it's expected to be
+// fragmented, see Fragment.
+func (b *Batcher) Add(ps []*Packet) [][]*Packet {
+	var ret [][]*Packet
+	for _, p := range ps {
+		size := p.TotalSize()
+		if b.size+size > b.maxSize && len(b.pending) > 0 {
+			ret = append(ret, b.Flush())
+		}
+		if len(b.pending) == 0 {
+			b.since = time.Now()
+		}
+		b.pending = append(b.pending, p)
+		b.size += size
+	}
+	if b.window <= 0 || b.size >= b.maxSize {
+		if batch := b.Flush(); batch != nil {
+			ret = append(ret, batch)
+		}
+	}
+	return ret
+}
+
+// Wait returns how long the pending packets can still wait, ok is false if
+// there is none.
+func (b *Batcher) Wait() (d time.Duration, ok bool) {
+	if len(b.pending) == 0 {
+		return 0, false
+	}
+	d = b.window - time.Since(b.since)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+// Flush returns the pending packets, nil if there is none
+func (b *Batcher) Flush() []*Packet {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	batch := b.pending
+	b.pending, b.size = nil, 0
+	return batch
+}
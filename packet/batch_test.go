@@ -0,0 +1,68 @@
+package packet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/test"
+)
+
+func TestBatch(t *testing.T) {
+	defer test.New(t)
+
+	p := New([]byte("hello"), NEWDC)
+	p.ReqId = 1
+	data, err := WriteBatch([]*Packet{p})
+	test.Nil(err)
+	// a batch of one packet is the packet itself
+	test.Equal(data, marshalPacket(p))
+
+	ps := []*Packet{p, New([]byte("world"), DATA), New([]byte{}, HEARTBEAT)}
+	data, err = WriteBatch(ps)
+	test.Nil(err)
+	got, err := ReadBatch(data)
+	test.Nil(err)
+	test.Equal(got, ps)
+
+	_, err = ReadBatch(data[:len(data)-1])
+	test.True(IsMalformed(err))
+
+	defer allowFragment()()
+	large := New(make([]byte, MaxPayloadLength), DATA)
+	_, err = WriteBatch([]*Packet{large})
+	test.Nil(err)
+	_, err = WriteBatch([]*Packet{large, p})
+	test.True(logex.Equal(err, ErrBatchTooLarge))
+}
+
+func TestBatcher(t *testing.T) {
+	defer test.New(t)
+
+	newPacket := func() *Packet { return New(make([]byte, 92), DATA) } // 100 bytes
+
+	b := NewBatcher(250, 0)
+	batches := b.Add([]*Packet{newPacket(), newPacket(), newPacket()})
+	test.Equal(len(batches), 2)
+	test.Equal(len(batches[0]), 2)
+	test.Equal(len(batches[1]), 1)
+	_, ok := b.Wait()
+	test.False(ok)
+
+	b = NewBatcher(250, 20*time.Millisecond)
+	test.Equal(len(b.Add([]*Packet{newPacket()})), 0)
+	d, ok := b.Wait()
+	test.True(ok)
+	test.True(d > 0 && d <= 20*time.Millisecond)
+	batches = b.Add([]*Packet{newPacket(), newPacket()})
+	test.Equal(len(batches), 1)
+	test.Equal(len(batches[0]), 2)
+	test.Equal(len(b.Flush()), 1)
+	test.Nil(b.Flush())
+
+	// the packet larger than the batch is not held
+	b = NewBatcher(50, time.Second)
+	batches = b.Add([]*Packet{newPacket()})
+	test.Equal(len(batches), 1)
+	test.Nil(b.Flush())
+}
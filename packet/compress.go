@@ -0,0 +1,64 @@
+package packet
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+
+	"github.com/chzyer/logex"
+)
+
+// the payload smaller than it is not worth to compress
+var CompressThreshold = 256
+
+var ErrDecompress = logex.Define("decompress payload failed: %v")
+
+// Compress deflate the payload if it's larger than CompressThreshold and
+// the result is actually smaller, returns whether the payload is compressed.
+func (p *Packet) Compress() bool {
+	if p.compressed || len(p.payload) < CompressThreshold {
+		return p.compressed
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(p.payload)))
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return false
+	}
+	w.Write(p.payload)
+	if err := w.Close(); err != nil {
+		return false
+	}
+	if buf.Len() >= len(p.payload) {
+		return false
+	}
+	p.payload = buf.Bytes()
+	p.size = len(p.payload)
+	p.compressed = true
+	return true
+}
+
+// Decompress inflate the payload if it's compressed, it's a noop otherwise.
+func (p *Packet) Decompress() error {
+	if !p.compressed {
+		return nil
+	}
+	r := flate.NewReader(bytes.NewReader(p.payload))
+	defer r.Close()
+	payload, err := ioutil.ReadAll(io.LimitReader(r, int64(MaxPayloadLength)+1))
+	if err != nil {
+		return ErrDecompress.Format(err)
+	}
+	if len(payload) > MaxPayloadLength {
+		return ErrPayloadTooLarge.Format(len(payload), MaxPayloadLength)
+	}
+	p.payload = payload
+	p.size = len(payload)
+	p.compressed = false
+	return nil
+}
+
+// IsCompressed returns whether the payload need to be decompressed
+func (p *Packet) IsCompressed() bool {
+	return p.compressed
+}
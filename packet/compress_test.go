@@ -0,0 +1,92 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/chzyer/test"
+)
+
+func marshalPacket(p *Packet) []byte {
+	data := make([]byte, p.TotalSize())
+	p.Marshal(data)
+	return data
+}
+
+func TestPacketCompress(t *testing.T) {
+	defer test.New(t)
+
+	payload := bytes.Repeat([]byte(`{"cidr":"10.0.0.1/32","comment":""},`), 50)
+	p := New(payload, NEWDC)
+	p.ReqId = 1
+	test.True(p.Compress())
+	test.True(p.Size() < len(payload))
+	test.True(p.Compress())
+
+	got, err := Unmarshal(marshalPacket(p))
+	test.Nil(err)
+	test.True(got.IsCompressed())
+	test.Nil(got.Decompress())
+	test.False(got.IsCompressed())
+	test.Equal(got.Payload(), payload)
+	test.Equal(got.Size(), len(payload))
+
+	// decompress is noop on the plain packets
+	test.Nil(got.Decompress())
+	test.Equal(got.Payload(), payload)
+}
+
+func TestPacketCompressBelowThreshold(t *testing.T) {
+	defer test.New(t)
+
+	p := New([]byte("hello"), NEWDC)
+	test.False(p.Compress())
+	data := marshalPacket(p)
+	test.Equal(data[4], byte(0))
+
+	got, err := Unmarshal(data)
+	test.Nil(err)
+	test.False(got.IsCompressed())
+	test.Nil(got.Decompress())
+	test.Equal(got.Payload(), []byte("hello"))
+
+	// random data don't shrink
+	p = New(test.RandBytes(1000), NEWDC)
+	test.False(p.Compress())
+	test.Equal(p.Size(), 1000)
+}
+
+func TestPacketDecompressCorrupt(t *testing.T) {
+	defer test.New(t)
+
+	p := New(bytes.Repeat([]byte("a"), 1000), NEWDC)
+	test.True(p.Compress())
+	data := marshalPacket(p)
+	data[len(data)-1] ^= 0xff
+	got, err := Unmarshal(data)
+	test.Nil(err)
+	test.NotNil(got.Decompress())
+}
+
+func TestFragmentCompressed(t *testing.T) {
+	defer test.New(t)
+
+	payload := bytes.Repeat([]byte("0123456789"), 500)
+	p := New(payload, NEWDC)
+	test.True(p.Compress())
+	frags := Fragment(p, 32)
+	test.True(len(frags) > 1)
+
+	r := NewReassembler(time.Second)
+	var got *Packet
+	for _, frag := range frags {
+		var err error
+		got, err = r.Feed(frag)
+		test.Nil(err)
+	}
+	test.NotNil(got)
+	test.True(got.IsCompressed())
+	test.Nil(got.Decompress())
+	test.Equal(got.Payload(), payload)
+}
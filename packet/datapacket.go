@@ -10,10 +10,19 @@ func NewDataPacket(payload []byte) *DataPacket {
 	return &DataPacket{New(payload, DATA)}
 }
 
+// the addresses are zero if the payload is shorter than the ipv4 header
+const ipv4HeaderSize = 20
+
 func (d *DataPacket) SrcIP() ip.IP {
+	if len(d.payload) < ipv4HeaderSize {
+		return ip.IP{}
+	}
 	return ip.NewIP(d.payload[12:16])
 }
 
 func (d *DataPacket) DestIP() ip.IP {
+	if len(d.payload) < ipv4HeaderSize {
+		return ip.IP{}
+	}
 	return ip.NewIP(d.payload[16:20])
 }
@@ -0,0 +1,170 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxDumpPayload is how many bytes of the payload are hexdumped by Dump,
+// the rest is truncated.
+var MaxDumpPayload = 64
+
+// Dump returns the header and a bounded hexdump of the payload for
+// debugging, e.g.
+//
+//	type:    NewDC(7)
+//	reqid:   5
+//	flags:   seq|compress
+//	seq:     3
+//	payload: 24 bytes
+//	00000000  78 9c 8a 36 35 36 36 8d  05 04 00 00 ff ff 0b 3a  |x..6566........:|
+//	...
+//
+// the payload of AUTH and AUTH_R is the token, it's never dumped.
+func (p *Packet) Dump() string {
+	var buf bytes.Buffer
+	p.DumpTo(&buf)
+	return buf.String()
+}
+
+// DumpTo write the Dump to w
+func (p *Packet) DumpTo(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "type:    %v(%v)\n", p.Type, int(p.Type))
+	fmt.Fprintf(&buf, "reqid:   %v\n", p.ReqId)
+	if flags := p.flags(); flags != 0 {
+		fmt.Fprintf(&buf, "flags:   %v\n", flags)
+	}
+	if p.Version >= Version2 {
+		fmt.Fprintf(&buf, "version: %v\n", p.Version)
+		if ext := p.extFlags(); ext != 0 {
+			fmt.Fprintf(&buf, "ext:     %02x\n", uint8(ext))
+		}
+	}
+	if p.Seq != 0 {
+		fmt.Fprintf(&buf, "seq:     %v\n", p.Seq)
+	}
+	if p.Timeout > 0 {
+		fmt.Fprintf(&buf, "timeout: %v\n", p.Timeout)
+	}
+	if p.priority != PriorityNormal {
+		fmt.Fprintf(&buf, "prio:    %v\n", p.priority)
+	}
+	switch {
+	case p.released:
+		fmt.Fprintf(&buf, "payload: released\n")
+	case p.Type == AUTH || p.Type == AUTH_R:
+		fmt.Fprintf(&buf, "payload: %v bytes, redacted\n", len(p.payload))
+	default:
+		fmt.Fprintf(&buf, "payload: %v bytes\n", len(p.payload))
+		dumpPayload(&buf, p.payload)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Dump is like Packet.Dump, the payload is the sealed packets
+func (p *PacketL2) Dump() string {
+	var buf bytes.Buffer
+	p.DumpTo(&buf)
+	return buf.String()
+}
+
+func (p *PacketL2) DumpTo(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "iv:       %x\n", p.IV)
+	fmt.Fprintf(&buf, "userid:   %v\n", p.UserId)
+	fmt.Fprintf(&buf, "checksum: %08x\n", p.Checksum)
+	fmt.Fprintf(&buf, "payload:  %v bytes\n", len(p.Payload))
+	dumpPayload(&buf, p.Payload)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// dumpPayload hexdump at most MaxDumpPayload bytes of b
+func dumpPayload(buf *bytes.Buffer, b []byte) {
+	n := len(b)
+	if n > MaxDumpPayload {
+		n = MaxDumpPayload
+	}
+	if n > 0 {
+		buf.WriteString(hex.Dump(b[:n]))
+	}
+	if n < len(b) {
+		fmt.Fprintf(buf, "... %v bytes truncated\n", len(b)-n)
+	}
+}
+
+// Direction of the packet passed to the DebugHook
+type Direction int
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Outbound {
+		return "out"
+	}
+	return "in"
+}
+
+// DebugHook is called with every packet crossing the controller or the
+// data channels once it's set by SetDebugHook, where is the component,
+// e.g. "controller". it's called by the loops, so it must not block.
+type DebugHook func(at time.Time, where string, dir Direction, p *Packet)
+
+var (
+	debugEnabled int32
+	debugHook    atomic.Value // DebugHook
+)
+
+// SetDebugHook enable the hook, nil disables it
+func SetDebugHook(hook DebugHook) {
+	if hook == nil {
+		atomic.StoreInt32(&debugEnabled, 0)
+		return
+	}
+	debugHook.Store(hook)
+	atomic.StoreInt32(&debugEnabled, 1)
+}
+
+// Debug pass the packets to the DebugHook, it's only an atomic load if the
+// hook is not set.
+func Debug(where string, dir Direction, ps []*Packet) {
+	if atomic.LoadInt32(&debugEnabled) != 0 {
+		debug(where, dir, ps)
+	}
+}
+
+func debug(where string, dir Direction, ps []*Packet) {
+	hook, _ := debugHook.Load().(DebugHook)
+	if hook == nil {
+		return
+	}
+	now := time.Now()
+	for _, p := range ps {
+		hook(now, where, dir, p)
+	}
+}
+
+// DumpHook returns a DebugHook which write the Dump of the packets to w,
+// each one is headed by a line like
+// "15:04:05.000000 controller out NewDC#5 len=24".
+func DumpHook(w io.Writer) DebugHook {
+	var m sync.Mutex
+	return func(at time.Time, where string, dir Direction, p *Packet) {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "%v %v %v %v\n", at.Format("15:04:05.000000"), where, dir, p)
+		p.DumpTo(&buf)
+		m.Lock()
+		w.Write(buf.Bytes())
+		m.Unlock()
+	}
+}
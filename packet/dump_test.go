@@ -0,0 +1,68 @@
+package packet
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chzyer/test"
+)
+
+func TestPacketDump(t *testing.T) {
+	defer test.New(t)
+
+	p := New([]byte("hello"), NEWDC)
+	p.ReqId = 5
+	p.Seq = 3
+	p.Timeout = time.Second
+	test.Equal(p.Dump(), "type:    NewDC(7)\n"+
+		"reqid:   5\n"+
+		"flags:   seq|timeout\n"+
+		"seq:     3\n"+
+		"timeout: 1s\n"+
+		"payload: 5 bytes\n"+
+		"00000000  68 65 6c 6c 6f                                    |hello|\n")
+
+	p = New(bytes.Repeat([]byte{'a'}, MaxDumpPayload+10), DATA)
+	dump := p.Dump()
+	test.True(strings.HasSuffix(dump, "|aaaaaaaaaaaaaaaa|\n... 10 bytes truncated\n"))
+	test.Equal(strings.Count(dump, "\n"), 3+MaxDumpPayload/16+1)
+
+	dump = New([]byte("token"), AUTH).Dump()
+	test.True(strings.Contains(dump, "payload: 5 bytes, redacted\n"))
+	test.False(strings.Contains(dump, "token"))
+
+	l2 := NewPacketL2(make([]byte, 16), 3, []byte("sealed"), 0xabcd)
+	test.Equal(l2.Dump(), "iv:       00000000000000000000000000000000\n"+
+		"userid:   3\n"+
+		"checksum: 0000abcd\n"+
+		"payload:  6 bytes\n"+
+		"00000000  73 65 61 6c 65 64                                 |sealed|\n")
+}
+
+func TestDebugHook(t *testing.T) {
+	defer test.New(t)
+
+	ps := []*Packet{New([]byte("hello"), DATA)}
+	Debug("controller", Outbound, ps)
+
+	var buf bytes.Buffer
+	SetDebugHook(DumpHook(&buf))
+	Debug("controller", Outbound, ps)
+	SetDebugHook(nil)
+	Debug("controller", Inbound, ps)
+
+	lines := strings.Split(buf.String(), "\n")
+	test.True(strings.HasSuffix(lines[0], " controller out Data#0 len=5"))
+	test.Equal(lines[1], "type:    Data(3)")
+	test.Equal(strings.Count(buf.String(), "controller"), 1)
+}
+
+func BenchmarkDebugDisabled(b *testing.B) {
+	ps := []*Packet{New([]byte("hello"), DATA)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Debug("controller", Outbound, ps)
+	}
+}
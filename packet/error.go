@@ -0,0 +1,73 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// the codes carried by the error responses
+const (
+	ErrCodeInternal uint16 = iota + 1
+	ErrCodeUnhandled
+	ErrCodeBadRequest
+	ErrCodeUnauthorized
+	ErrCodeNotFound
+)
+
+// RemoteError is carried by the error response, the payload is
+// Code(2) + Message.
+type RemoteError struct {
+	Code    uint16
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error(%v): %v", e.Code, e.Message)
+}
+
+// CodedError let an error choose the code of its error response
+type CodedError interface {
+	error
+	ErrorCode() uint16
+}
+
+// ReplyError returns the error response of the request, the code is
+// ErrCodeInternal unless err is a CodedError or a *RemoteError.
+func (p *Packet) ReplyError(err error) *Packet {
+	code, msg := ErrCodeInternal, err.Error()
+	switch e := err.(type) {
+	case *RemoteError:
+		code, msg = e.Code, e.Message
+	case CodedError:
+		code = e.ErrorCode()
+	}
+	if len(msg) > MaxPayloadLength-2 {
+		msg = msg[:MaxPayloadLength-2]
+	}
+	payload := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(payload, code)
+	copy(payload[2:], msg)
+	resp := p.Reply(payload)
+	resp.isError = true
+	return resp
+}
+
+// IsError returns whether the response carries an error
+func (p *Packet) IsError() bool {
+	return p.isError
+}
+
+// RemoteError returns the error carried by the response, nil if it's not an
+// error response.
+func (p *Packet) RemoteError() *RemoteError {
+	if !p.isError {
+		return nil
+	}
+	if len(p.payload) < 2 {
+		return &RemoteError{Code: ErrCodeInternal}
+	}
+	return &RemoteError{
+		Code:    binary.BigEndian.Uint16(p.payload[:2]),
+		Message: string(p.payload[2:]),
+	}
+}
@@ -0,0 +1,226 @@
+package packet
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chzyer/logex"
+)
+
+// groupId(4) + offset(4) + total(4) + flag(1) + type(1) + reqId(4)
+const FragmentHeaderSize = 18
+
+// DefaultReassembleLimit is the default of Reassembler.SetLimit
+const DefaultReassembleLimit = 4 << 20
+
+var ErrReassembleLimit = logex.Define("packet of %v bytes exceeds the reassemble limit %v")
+
+var fragmentGroupId uint32
+
+// Fragment split the packet into FRAGMENT packets which TotalSize is not
+// larger than mtu even all the optional header fields are set, the packet is
+// returned as is if it's small enough.
+func Fragment(p *Packet, mtu int) []*Packet {
+	if MaxHeaderSize+p.size <= mtu {
+		return []*Packet{p}
+	}
+	chunk := mtu - MaxHeaderSize - FragmentHeaderSize
+	if chunk <= 0 {
+		chunk = 1
+	}
+	groupId := atomic.AddUint32(&fragmentGroupId, 1)
+	ret := make([]*Packet, 0, (len(p.payload)+chunk-1)/chunk)
+	for off := 0; off < len(p.payload); off += chunk {
+		end := off + chunk
+		if end > len(p.payload) {
+			end = len(p.payload)
+		}
+		payload := make([]byte, FragmentHeaderSize+end-off)
+		binary.BigEndian.PutUint32(payload[0:4], groupId)
+		binary.BigEndian.PutUint32(payload[4:8], uint32(off))
+		binary.BigEndian.PutUint32(payload[8:12], uint32(len(p.payload)))
+		payload[12] = byte(p.flags() & flagPayload)
+		payload[13] = byte(p.Type)
+		binary.BigEndian.PutUint32(payload[14:18], p.ReqId)
+		copy(payload[FragmentHeaderSize:], p.payload[off:end])
+		ret = append(ret, &Packet{
+			ReqId:    p.ReqId,
+			Type:     FRAGMENT,
+			payload:  payload,
+			priority: p.priority,
+			size:     len(payload),
+		})
+	}
+	return ret
+}
+
+type fragmentGroup struct {
+	typ      Type
+	flags    Flag
+	reqId    uint32
+	payload  []byte
+	offsets  map[uint32]bool
+	received int
+	deadline time.Time
+}
+
+// Reassembler collect the fragments and rebuild the original packet, the
+// incomplete packets are dropped after timeout, or when the limit is
+// exceeded.
+type Reassembler struct {
+	timeout time.Duration
+	limit   int
+	pending int
+	dropped uint64
+	groups  map[uint32]*fragmentGroup
+	m       sync.Mutex
+}
+
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		timeout: timeout,
+		limit:   DefaultReassembleLimit,
+		groups:  make(map[uint32]*fragmentGroup),
+	}
+}
+
+// SetLimit limit the bytes buffered for the incomplete packets, the oldest
+// ones are dropped to make room for the new one. zero means unlimited.
+func (r *Reassembler) SetLimit(n int) {
+	r.m.Lock()
+	r.limit = n
+	r.m.Unlock()
+}
+
+// Dropped returns how many incomplete packets are dropped
+func (r *Reassembler) Dropped() uint64 {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.dropped
+}
+
+// Feed returns the original packet once all its fragments are received,
+// otherwise returns nil.
+func (r *Reassembler) Feed(p *Packet) (*Packet, error) {
+	if p.Type != FRAGMENT {
+		return nil, ErrInvalidType.Format(int(p.Type))
+	}
+	if len(p.payload) < FragmentHeaderSize {
+		return nil, ErrPacketTooShort.Format(len(p.payload))
+	}
+	if Type(p.payload[13]).IsInvalid() {
+		return nil, ErrInvalidType.Format(int(p.payload[13]))
+	}
+	groupId := binary.BigEndian.Uint32(p.payload[0:4])
+	offset := binary.BigEndian.Uint32(p.payload[4:8])
+	total := int(binary.BigEndian.Uint32(p.payload[8:12]))
+	data := p.payload[FragmentHeaderSize:]
+	if total > MaxPayloadLength {
+		return nil, ErrPayloadTooLarge.Format(total, MaxPayloadLength)
+	}
+	if int(offset)+len(data) > total {
+		return nil, ErrInvalidLength.Format(total, int(offset)+len(data))
+	}
+
+	now := time.Now()
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.expireLocked(now)
+
+	g := r.groups[groupId]
+	if g == nil {
+		if r.limit > 0 && total > r.limit {
+			return nil, ErrReassembleLimit.Format(total, r.limit)
+		}
+		for r.limit > 0 && r.pending+total > r.limit {
+			r.dropLocked(r.oldestLocked())
+		}
+		r.pending += total
+		g = &fragmentGroup{
+			flags:    Flag(p.payload[12]),
+			typ:      Type(p.payload[13]),
+			reqId:    binary.BigEndian.Uint32(p.payload[14:18]),
+			payload:  make([]byte, total),
+			offsets:  make(map[uint32]bool),
+			deadline: now.Add(r.timeout),
+		}
+		r.groups[groupId] = g
+	}
+	if len(g.payload) != total {
+		return nil, ErrInvalidLength.Format(len(g.payload), total)
+	}
+	if g.offsets[offset] {
+		return nil, nil
+	}
+	g.offsets[offset] = true
+	g.received += copy(g.payload[offset:], data)
+	if g.received < total {
+		return nil, nil
+	}
+
+	delete(r.groups, groupId)
+	r.pending -= total
+	return &Packet{
+		ReqId: g.reqId,
+		Type:  g.typ,
+		// the last fragment is the latest one to tell the timeout
+		Timeout:  p.Timeout,
+		Version:  p.Version,
+		payload:  g.payload,
+		priority: p.priority,
+		size:     len(g.payload),
+
+		compressed: g.flags&FlagCompress != 0,
+		isError:    g.flags&FlagError != 0,
+		stream:     g.flags&FlagStream != 0,
+		more:       g.flags&FlagMore != 0,
+	}, nil
+}
+
+// Expire drop the incomplete packets which are timed out before now,
+// returns how many packets are dropped.
+func (r *Reassembler) Expire(now time.Time) int {
+	r.m.Lock()
+	n := r.expireLocked(now)
+	r.m.Unlock()
+	return n
+}
+
+func (r *Reassembler) expireLocked(now time.Time) int {
+	n := 0
+	for id, g := range r.groups {
+		if now.After(g.deadline) {
+			r.dropLocked(id)
+			n++
+		}
+	}
+	return n
+}
+
+func (r *Reassembler) oldestLocked() (groupId uint32) {
+	var oldest *fragmentGroup
+	for id, g := range r.groups {
+		if oldest == nil || g.deadline.Before(oldest.deadline) {
+			groupId, oldest = id, g
+		}
+	}
+	return groupId
+}
+
+func (r *Reassembler) dropLocked(groupId uint32) {
+	if g := r.groups[groupId]; g != nil {
+		delete(r.groups, groupId)
+		r.pending -= len(g.payload)
+		r.dropped++
+	}
+}
+
+// Pending returns how many packets are waiting for more fragments
+func (r *Reassembler) Pending() int {
+	r.m.Lock()
+	n := len(r.groups)
+	r.m.Unlock()
+	return n
+}
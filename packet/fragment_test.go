@@ -0,0 +1,116 @@
+package packet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/test"
+)
+
+func newFragmentTestPacket() *Packet {
+	p := New(test.RandBytes(1000), NEWDC)
+	p.ReqId = 7
+	return p
+}
+
+func TestFragmentInOrder(t *testing.T) {
+	defer test.New(t)
+
+	p := newFragmentTestPacket()
+	test.Equal(Fragment(p, 2000), []*Packet{p})
+
+	frags := Fragment(p, 128)
+	test.Equal(len(frags), 12)
+	r := NewReassembler(time.Second)
+	for idx, frag := range frags {
+		test.True(frag.TotalSize() <= 128)
+		got, err := r.Feed(frag)
+		test.Nil(err)
+		if idx < len(frags)-1 {
+			test.Nil(got)
+		} else {
+			test.Equal(got, p)
+		}
+	}
+	test.Equal(r.Pending(), 0)
+}
+
+func TestFragmentOutOfOrder(t *testing.T) {
+	defer test.New(t)
+
+	p := newFragmentTestPacket()
+	frags := Fragment(p, 128)
+	r := NewReassembler(time.Second)
+
+	var got *Packet
+	for idx := len(frags) - 1; idx >= 0; idx-- {
+		var err error
+		got, err = r.Feed(frags[idx])
+		test.Nil(err)
+		if idx == len(frags)/2 {
+			// duplicated fragment is ignored
+			dup, err := r.Feed(frags[idx])
+			test.Nil(err)
+			test.Nil(dup)
+		}
+	}
+	test.Equal(got, p)
+}
+
+func TestFragmentIncomplete(t *testing.T) {
+	defer test.New(t)
+
+	p := newFragmentTestPacket()
+	frags := Fragment(p, 128)
+	r := NewReassembler(time.Second)
+
+	for _, frag := range frags[1:] {
+		got, err := r.Feed(frag)
+		test.Nil(err)
+		test.Nil(got)
+	}
+	test.Equal(r.Pending(), 1)
+	test.Equal(r.Expire(time.Now()), 0)
+	test.Equal(r.Expire(time.Now().Add(2*time.Second)), 1)
+	test.Equal(r.Dropped(), uint64(1))
+
+	// the rest fragments can't rebuild the packet anymore
+	got, err := r.Feed(frags[0])
+	test.Nil(err)
+	test.Nil(got)
+
+	_, err = r.Feed(New(nil, DATA_R))
+	test.NotNil(err)
+}
+
+func TestFragmentLimit(t *testing.T) {
+	defer test.New(t)
+
+	r := NewReassembler(time.Second)
+	r.SetLimit(1500)
+
+	first := Fragment(newFragmentTestPacket(), 128)
+	for _, frag := range first[1:] {
+		_, err := r.Feed(frag)
+		test.Nil(err)
+	}
+	second := Fragment(newFragmentTestPacket(), 128)
+	for _, frag := range second[1:] {
+		_, err := r.Feed(frag)
+		test.Nil(err)
+	}
+	// the first one is dropped to make room for the second one
+	test.Equal(r.Pending(), 1)
+	test.Equal(r.Dropped(), uint64(1))
+
+	got, err := r.Feed(second[0])
+	test.Nil(err)
+	test.NotNil(got)
+	test.Equal(r.Pending(), 0)
+
+	r.SetLimit(500)
+	_, err = r.Feed(Fragment(newFragmentTestPacket(), 128)[0])
+	test.True(logex.Equal(err, ErrReassembleLimit))
+	test.Equal(r.Pending(), 0)
+}
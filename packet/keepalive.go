@@ -0,0 +1,41 @@
+package packet
+
+// KeepaliveSize is the size of the payload of a keepalive L2 packet, it's
+// the header of a KEEPALIVE only.
+const KeepaliveSize = 8
+
+var (
+	// keepaliveHeader is the marshaled KEEPALIVE, the reqId is always zero
+	keepaliveHeader = [KeepaliveSize]byte{5: byte(KEEPALIVE)}
+	// keepaliveIV is never used by a sealed packet, see isSealed, and a
+	// CFB one takes a random IV.
+	keepaliveIV [l2IVSize]byte
+)
+
+// NewKeepalive returns the KEEPALIVE, which marshal to its header only
+func NewKeepalive() *Packet {
+	return New(nil, KEEPALIVE)
+}
+
+// NewKeepaliveL2 returns the L2 packet carrying a plain KEEPALIVE with the
+// zero IV, it's neither sealed nor encoded, so sending it costs no crypto
+// and no allocation of the payload. it's shared, don't modify it.
+//
+// it's not authenticated, so the receiver must not do anything but count
+// it, see IsKeepalive.
+func NewKeepaliveL2(userId uint16) *PacketL2 {
+	return &PacketL2{
+		IV:      keepaliveIV[:],
+		UserId:  userId,
+		Payload: keepaliveHeader[:],
+	}
+}
+
+// IsKeepalive tells whether p is made by NewKeepaliveL2, it's expected to
+// be checked before Verify, so the keepalive never reach the crypto and
+// Unmarshal.
+func (p *PacketL2) IsKeepalive() bool {
+	return p.Checksum == 0 &&
+		string(p.Payload) == string(keepaliveHeader[:]) &&
+		string(p.IV) == string(keepaliveIV[:])
+}
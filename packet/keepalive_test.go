@@ -0,0 +1,63 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/chzyer/test"
+)
+
+func TestKeepalive(t *testing.T) {
+	defer test.New(t)
+
+	test.True(KEEPALIVE.IsReq())
+	test.Equal(KEEPALIVE.String(), "KeepAlive")
+	p := NewKeepalive()
+	test.Equal(p.TotalSize(), KeepaliveSize)
+	test.Equal(marshalPacket(p), keepaliveHeader[:])
+
+	l2 := NewKeepaliveL2(3)
+	test.True(l2.IsKeepalive())
+	test.Equal(l2.UserId, uint16(3))
+	got, err := Unmarshal(l2.Payload)
+	test.Nil(err)
+	test.Equal(got.Type, KEEPALIVE)
+	test.Equal(got.ReqId, uint32(0))
+
+	// the wrapped ones are never taken as the keepalive
+	token := test.RandBytes(32)
+	cli := newTestSessionCli(1, token)
+	test.False(WrapL2(cli, []*Packet{p}).IsKeepalive())
+	cli.SetVersion(L2VersionAEAD)
+	test.False(WrapL2(cli, []*Packet{p}).IsKeepalive())
+
+	l2 = NewKeepaliveL2(3)
+	l2.Payload = marshalPacket(New(nil, HEARTBEAT))
+	test.False(l2.IsKeepalive())
+	l2 = NewPacketL2(make([]byte, 8), 3, keepaliveHeader[:], 0)
+	test.False(l2.IsKeepalive())
+}
+
+// the keepalive sent and recognized by the receiver
+func BenchmarkKeepaliveL2(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if !NewKeepaliveL2(1).IsKeepalive() {
+			b.Fatal("not a keepalive")
+		}
+	}
+}
+
+// the heartbeat wrapped, verified and unmarshaled, compared to the
+// BenchmarkKeepaliveL2
+func BenchmarkHeartbeatL2(b *testing.B) {
+	token := []byte("0123456789abcdef")
+	cli := newTestSessionCli(1, token)
+	svr := NewSessionSvr(testAuthDelegate(token))
+	p := New(nil, HEARTBEAT)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := transferL2(cli, svr, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
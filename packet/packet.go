@@ -3,8 +3,12 @@ package packet
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"math"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/chzyer/flow"
 	"github.com/chzyer/logex"
@@ -16,12 +20,57 @@ var (
 	MaxPayloadLength    = math.MaxUint16 - 27 // header(26) + type(1)
 )
 
+// maxDatagramSize is the largest payload of an UDP datagram over ipv4
+const maxDatagramSize = 65507
+
+// MaxPayload is the largest payload which can be sent unfragmented, the
+// default fits the packet with the L2 framing in one UDP datagram. it's
+// capped by MaxPayloadLength. see CheckSize.
+var MaxPayload = maxDatagramSize - PacketL2HeaderSize - l2Overhead - MaxHeaderSize
+
+// AllowFragment lets the constructors accept the payload larger than
+// MaxPayload up to MaxPayloadLength, the controller fragments it if the
+// mtu is set. otherwise they return ErrPayloadTooLarge above MaxPayload.
+var AllowFragment = false
+
+// maxPayload returns MaxPayload capped by MaxPayloadLength
+func maxPayload() int {
+	if MaxPayload > MaxPayloadLength {
+		return MaxPayloadLength
+	}
+	return MaxPayload
+}
+
+// payloadLimit returns the largest payload accepted by the constructors
+func payloadLimit() int {
+	if AllowFragment {
+		return MaxPayloadLength
+	}
+	return maxPayload()
+}
+
+// CheckSize returns ErrPayloadTooLarge with the actual and the allowed
+// sizes if the payload is larger than MaxPayload, so the packet has to be
+// fragmented before sent.
+func (p *Packet) CheckSize() error {
+	if max := maxPayload(); p.size > max {
+		return ErrPayloadTooLarge.Format(p.size, max)
+	}
+	return nil
+}
+
 var (
 	ErrPacketTooShort  = logex.Define("packet too short: %v")
 	ErrInvalidType     = logex.Define("invalid type: %v")
 	ErrInvalidToken    = logex.Define("invalid token")
 	ErrInvalidLength   = logex.Define("invalid length, want:%v, got: %v")
-	ErrPayloadTooLarge = logex.Define("payload is too large: %v")
+	ErrPayloadTooLarge = logex.Define("payload is too large: %v > %v")
+	// ErrMalformed is returned if the header is not the one Marshal writes,
+	// e.g. FlagSeq with a zero sequence number.
+	ErrMalformed = logex.Define("malformed packet: %v")
+	// ErrChecksumMismatch is returned if the packet is corrupted, see
+	// Packet.Checksum.
+	ErrChecksumMismatch = logex.Define("packet checksum mismatch, want: %08x, got: %08x")
 )
 
 type RecvChan <-chan []*Packet
@@ -78,15 +127,100 @@ func (ch Chan) SendSafe(f *flow.Flow, p []*Packet) bool {
 	}
 }
 
-// ReqId + Type + Payload
+// Flag is carried in the high byte of the type field on the wire, the
+// packet without any flag is compatible with the legacy layout.
+type Flag uint8
+
+const (
+	// an uint64 sequence number follows the header
+	FlagSeq Flag = 1 << iota
+	// the payload is compressed by deflate
+	FlagCompress
+	// the payload is sealed by an AEAD cipher, prefixed by the nonce
+	FlagSeal
+	// the response carries an error message instead of the result
+	FlagError
+	// the response is a chunk of a stream, prefixed by the chunk index
+	FlagStream
+	// more chunks of the stream follow
+	FlagMore
+	// an uint32 timeout in milliseconds follows the sequence number
+	FlagTimeout
+	// the version and the extended flags follow the fixed header, see
+	// Version2
+	FlagVersion
+
+	flagKnown = FlagSeq | FlagCompress | FlagSeal | FlagError | FlagStream | FlagMore | FlagTimeout | FlagVersion
+	// the flags describe the payload, they are kept by the fragments
+	flagPayload = FlagCompress | FlagError | FlagStream | FlagMore
+)
+
+var flagNames = []string{"seq", "compress", "seal", "error", "stream", "more", "timeout", "version"}
+
+// String returns the names of the flags joined by '|', e.g. "seq|compress"
+func (f Flag) String() string {
+	var names []string
+	for i, name := range flagNames {
+		if f&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// ExtFlag is carried after the version since Version2
+type ExtFlag uint8
+
+const (
+	// an uint32 CRC32C of the header and the payload ends the header
+	ExtChecksum ExtFlag = 1 << iota
+
+	// the 2 bits of the Priority
+	extPriorityShift = 1
+	extPriorityMask  = ExtFlag(3 << extPriorityShift)
+
+	extKnown = ExtChecksum | extPriorityMask
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// the max size of the header with all the optional fields
+const MaxHeaderSize = 26
+
+// ReqId(4) + Flag(1) + Type(1) + Length(2) + [Version(1) + ExtFlag(1)] +
+// [Seq(8)] + [Timeout(4)] + [Checksum(4)] + Payload
 type Packet struct {
-	ReqId   uint32
-	Type    Type
-	payload []byte
+	ReqId uint32
+	Type  Type
+	Seq   uint64
+	// Timeout is how long the requester still waits for the reply, it's
+	// carried in milliseconds and rounded up. zero means unknown.
+	Timeout time.Duration
+	// Version is the layout on the wire, zero means VersionLegacy
+	Version int
+	// Checksum append a CRC32C of the header and the payload, it's verified
+	// by Unmarshal. it's ignored before Version2, and should be set only if
+	// the peer has CapChecksum.
+	Checksum bool
+	// SendPriority carry the Priority in the header since Version2, it
+	// should be set only if the peer has CapPriority. the local send path
+	// honors the priority regardless.
+	SendPriority bool
+	payload      []byte
+	// buf is set if the payload is borrowed, see UnmarshalBuffer
+	buf      *Buffer
+	released bool
 
-	size int
+	priority   Priority
+	size       int
+	compressed bool
+	sealed     bool
+	isError    bool
+	stream     bool
+	more       bool
 }
 
+// New panics if the type is invalid or the payload is too large, see NewE.
 func New(payload []byte, t Type) *Packet {
 	p, err := newPacket(payload, t)
 	if err != nil {
@@ -95,24 +229,40 @@ func New(payload []byte, t Type) *Packet {
 	return p
 }
 
+// NewE is like New, but returns the error instead of panic. the payload
+// larger than MaxPayload is accepted only if AllowFragment is set, it has
+// to be fragmented to be sent then, see CheckSize.
+func NewE(payload []byte, t Type) (*Packet, error) {
+	return newPacket(payload, t)
+}
+
 func (p *Packet) Reply(payload []byte) *Packet {
+	newP, err := p.ReplyE(payload)
+	if err != nil {
+		panic(err)
+	}
+	return newP
+}
+
+// ReplyE is like Reply, but returns the error instead of panic
+func (p *Packet) ReplyE(payload []byte) (*Packet, error) {
 	if !p.Type.IsReq() {
 		panic("resp can't reply")
 	}
 	newP, err := newPacket(payload, Type(p.Type+1))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	newP.ReqId = p.ReqId
-	return newP
+	return newP, nil
 }
 
 func newPacket(payload []byte, t Type) (*Packet, error) {
 	if t.IsInvalid() {
 		return nil, ErrInvalidType.Format(int(t))
 	}
-	if len(payload) > MaxPayloadLength {
-		return nil, ErrPayloadTooLarge.Format(len(payload))
+	if max := payloadLimit(); len(payload) > max {
+		return nil, ErrPayloadTooLarge.Format(len(payload), max)
 	}
 	if IsHasLoopbackPrefix && t == DATA {
 		payload = payload[len(loopbackPrefix):]
@@ -126,11 +276,54 @@ func newPacket(payload []byte, t Type) (*Packet, error) {
 	return p, nil
 }
 
+// String returns the header of the packet for logging, e.g.
+// "NewDC#5 seq=3 len=24 flags=seq|compress", the payload is never included.
+func (p *Packet) String() string {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, p.Type.String()...)
+	buf = append(buf, '#')
+	buf = strconv.AppendUint(buf, uint64(p.ReqId), 10)
+	if p.Seq != 0 {
+		buf = append(buf, " seq="...)
+		buf = strconv.AppendUint(buf, p.Seq, 10)
+	}
+	buf = append(buf, " len="...)
+	buf = strconv.AppendInt(buf, int64(p.size), 10)
+	if p.Timeout > 0 {
+		buf = append(buf, " timeout="...)
+		buf = append(buf, p.Timeout.String()...)
+	}
+	if p.Version >= Version2 {
+		buf = append(buf, " v="...)
+		buf = strconv.AppendInt(buf, int64(p.Version), 10)
+		if p.Checksum {
+			buf = append(buf, " crc"...)
+		}
+	}
+	if p.priority != PriorityNormal {
+		buf = append(buf, " prio="...)
+		buf = append(buf, p.priority.String()...)
+	}
+	if flags := p.flags() &^ (FlagSeq | FlagTimeout | FlagVersion); flags != 0 {
+		buf = append(buf, " flags="...)
+		buf = append(buf, flags.String()...)
+	}
+	return string(buf)
+}
+
+// GoString is like String, so %#v doesn't dump the payload either
+func (p *Packet) GoString() string {
+	return "packet(" + p.String() + ")"
+}
+
 func (p *Packet) Size() int {
 	return p.size
 }
 
 func (p *Packet) Payload() []byte {
+	if p.released {
+		panic("payload of the released packet")
+	}
 	if IsHasLoopbackPrefix && p.Type == DATA {
 		b := make([]byte, len(p.payload)+len(loopbackPrefix))
 		copy(b, loopbackPrefix)
@@ -150,39 +343,239 @@ func (p *Packet) SetReqId(r Reqider) {
 	}
 }
 
+func (p *Packet) flags() Flag {
+	var f Flag
+	if p.Seq != 0 {
+		f |= FlagSeq
+	}
+	if p.compressed {
+		f |= FlagCompress
+	}
+	if p.sealed {
+		f |= FlagSeal
+	}
+	if p.isError {
+		f |= FlagError
+	}
+	if p.stream {
+		f |= FlagStream
+	}
+	if p.more {
+		f |= FlagMore
+	}
+	if p.timeoutMillis() != 0 {
+		f |= FlagTimeout
+	}
+	if p.Version >= Version2 {
+		f |= FlagVersion
+	}
+	return f
+}
+
+func (p *Packet) timeoutMillis() uint32 {
+	if p.Timeout <= 0 {
+		return 0
+	}
+	ms := (p.Timeout + time.Millisecond - 1) / time.Millisecond
+	if ms > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(ms)
+}
+
+func (p *Packet) extFlags() ExtFlag {
+	var f ExtFlag
+	if p.Checksum {
+		f |= ExtChecksum
+	}
+	if p.SendPriority {
+		f |= ExtFlag(p.priority) << extPriorityShift
+	}
+	return f
+}
+
+func (p *Packet) headerSize() int {
+	size := 8
+	if p.Version >= Version2 {
+		size += 2
+		if p.Checksum {
+			size += 4
+		}
+	}
+	if p.Seq != 0 {
+		size += 8
+	}
+	if p.timeoutMillis() != 0 {
+		size += 4
+	}
+	return size
+}
+
+// MarshalE is like Marshal, but returns ErrPayloadTooLarge instead if the
+// payload is larger than MaxPayload.
+func (p *Packet) MarshalE(ret []byte) (int, error) {
+	if err := p.CheckSize(); err != nil {
+		return 0, err
+	}
+	return p.Marshal(ret), nil
+}
+
 func (p *Packet) Marshal(ret []byte) int {
 	// ret := make([]byte, 8+len(p.payload)) // reqId(4) + type(2) + len(payload)
 	binary.BigEndian.PutUint32(ret[:4], p.ReqId)
-	binary.BigEndian.PutUint16(ret[4:6], uint16(p.Type))
+	binary.BigEndian.PutUint16(ret[4:6], uint16(p.flags())<<8|uint16(p.Type))
 	binary.BigEndian.PutUint16(ret[6:8], uint16(len(p.payload)))
-	n := copy(ret[8:], p.payload)
+	off := 8
+	if p.Version >= Version2 {
+		ret[off], ret[off+1] = byte(p.Version), byte(p.extFlags())
+		off += 2
+	}
+	if p.Seq != 0 {
+		binary.BigEndian.PutUint64(ret[off:off+8], p.Seq)
+		off += 8
+	}
+	if ms := p.timeoutMillis(); ms != 0 {
+		binary.BigEndian.PutUint32(ret[off:off+4], ms)
+		off += 4
+	}
+	if p.Version >= Version2 && p.Checksum {
+		binary.BigEndian.PutUint32(ret[off:off+4], checksum(ret[:off], p.payload))
+		off += 4
+	}
+	n := copy(ret[off:], p.payload)
 	if n != len(p.payload) {
 		panic(fmt.Sprintf("short written: %v, want:%v, bufferSize: %v, totalSize: %v",
 			n, len(p.payload), len(ret), p.TotalSize()))
 	}
-	return n + 8
+	return n + off
+}
+
+// checksum returns the CRC32C of the header without the checksum and the
+// payload
+func checksum(header, payload []byte) uint32 {
+	return crc32.Update(crc32.Checksum(header, castagnoli), castagnoli, payload)
+}
+
+// IsMalformed returns whether the err is returned by decoding the corrupt
+// input, the receivers should drop the input instead of failing.
+func IsMalformed(err error) bool {
+	for _, e := range []error{ErrPacketTooShort, ErrInvalidLength, ErrInvalidType, ErrMalformed, ErrInvalidIV, ErrPeerTooNew, ErrChecksumMismatch} {
+		if logex.Equal(err, e) {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *Packet) TotalSize() int {
-	return 8 + p.size
+	return p.headerSize() + p.size
 }
 
 func Unmarshal(b []byte) (*Packet, error) {
+	p, err := unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, len(p.payload))
+	copy(payload, p.payload)
+	p.payload = payload
+	return p, nil
+}
+
+// unmarshal returns the packet whose payload is a part of b. only the
+// header written by Marshal is accepted, so the TotalSize of the packet is
+// always the bytes consumed.
+func unmarshal(b []byte) (*Packet, error) {
 	if len(b) < 8 {
 		return nil, ErrPacketTooShort.Format(len(b))
 	}
 	reqId := binary.BigEndian.Uint32(b[:4])
 	typ := binary.BigEndian.Uint16(b[4:6])
 	length := binary.BigEndian.Uint16(b[6:8])
-	payload := make([]byte, int(length))
-	if len(b[8:]) < int(length) {
-		return nil, ErrInvalidLength.Format(int(length), len(b[8:]))
+	flags := Flag(typ >> 8)
+	if flags&^flagKnown != 0 || Type(typ&0xff).IsInvalid() {
+		return nil, ErrInvalidType.Format(int(typ))
+	}
+	header := b
+	b = b[8:]
+	var version int
+	var ext ExtFlag
+	if flags&FlagVersion != 0 {
+		if len(b) < 2 {
+			return nil, ErrPacketTooShort.Format(len(b))
+		}
+		version, ext = int(b[0]), ExtFlag(b[1])
+		if version > MaxVersion {
+			return nil, ErrPeerTooNew.Format(version, MaxVersion)
+		}
+		if version < Version2 {
+			return nil, ErrMalformed.Format(fmt.Sprintf("version %v with FlagVersion", version))
+		}
+		if ext&^extKnown != 0 {
+			return nil, ErrMalformed.Format(fmt.Sprintf("unknown ext flags %#x", int(ext&^extKnown)))
+		}
+		b = b[2:]
+	}
+	var seq uint64
+	if flags&FlagSeq != 0 {
+		if len(b) < 8 {
+			return nil, ErrPacketTooShort.Format(len(b))
+		}
+		seq = binary.BigEndian.Uint64(b[:8])
+		if seq == 0 {
+			return nil, ErrMalformed.Format("zero seq")
+		}
+		b = b[8:]
+	}
+	var timeout time.Duration
+	if flags&FlagTimeout != 0 {
+		if len(b) < 4 {
+			return nil, ErrPacketTooShort.Format(len(b))
+		}
+		timeout = time.Duration(binary.BigEndian.Uint32(b[:4])) * time.Millisecond
+		if timeout == 0 {
+			return nil, ErrMalformed.Format("zero timeout")
+		}
+		b = b[4:]
+	}
+	var sum uint32
+	if ext&ExtChecksum != 0 {
+		if len(b) < 4 {
+			return nil, ErrPacketTooShort.Format(len(b))
+		}
+		sum = binary.BigEndian.Uint32(b[:4])
+		header = header[:len(header)-len(b)]
+		b = b[4:]
+	}
+	if len(b) < int(length) {
+		return nil, ErrInvalidLength.Format(int(length), len(b))
+	}
+	payload := b[:length:length]
+	if ext&ExtChecksum != 0 {
+		if got := checksum(header, payload); got != sum {
+			return nil, ErrChecksumMismatch.Format(sum, got)
+		}
+	}
+	priority := Priority(ext&extPriorityMask) >> extPriorityShift
+	if priority >= numPriority {
+		return nil, ErrMalformed.Format("unknown priority")
 	}
-	copy(payload, b[8:])
 	return &Packet{
-		ReqId:   reqId,
-		Type:    Type(typ),
-		payload: payload,
-		size:    int(length),
+		ReqId:        reqId,
+		Type:         Type(typ & 0xff),
+		Seq:          seq,
+		Timeout:      timeout,
+		Version:      version,
+		Checksum:     ext&ExtChecksum != 0,
+		SendPriority: priority != PriorityNormal,
+		payload:      payload,
+		priority:     priority,
+		size:         int(length),
+
+		compressed: flags&FlagCompress != 0,
+		sealed:     flags&FlagSeal != 0,
+		isError:    flags&FlagError != 0,
+		stream:     flags&FlagStream != 0,
+		more:       flags&FlagMore != 0,
 	}, nil
 }
@@ -9,6 +9,14 @@ import (
 
 const PacketL2HeaderSize = 24
 
+// the IV of the L2 packet is always 16 bytes
+const l2IVSize = 16
+
+var ErrInvalidIV = logex.Define("invalid iv size: %v")
+
+// l2Overhead is the tag appended by the AEAD
+const l2Overhead = 16
+
 // to verify auth
 // iv + userid +          // header (18)
 // crc32(payload)         // checksum (4)
@@ -20,6 +28,8 @@ type PacketL2 struct {
 	Checksum uint32
 
 	verifyd *error
+	// buf holds the Payload if it's pooled, see Release
+	buf *Buffer
 }
 
 func NewPacketL2(iv []byte, userId uint16, payload []byte, checksum uint32) *PacketL2 {
@@ -31,6 +41,25 @@ func NewPacketL2(iv []byte, userId uint16, payload []byte, checksum uint32) *Pac
 	}
 }
 
+// NewPacketL2Buffer is like NewPacketL2, but the payload is the pooled buf,
+// which is returned by Release.
+func NewPacketL2Buffer(iv []byte, userId uint16, buf *Buffer, checksum uint32) *PacketL2 {
+	l2 := NewPacketL2(iv, userId, buf.B, checksum)
+	l2.buf = buf
+	return l2
+}
+
+// Release return the pooled payload, the Payload and the packets borrowed
+// by UnmarshalBuffer must not be used afterwards unless they are released.
+func (p *PacketL2) Release() {
+	if p.buf == nil {
+		return
+	}
+	buf := p.buf
+	p.buf, p.Payload = nil, nil
+	buf.Release()
+}
+
 func checkPacket(ps []*Packet) {
 	p := recover()
 	if p == nil {
@@ -51,16 +80,34 @@ func checkPacket(ps []*Packet) {
 	}
 }
 
+// WrapL2 panics if the nonces of the session are exhausted, see WrapL2E
 func WrapL2(s *Session, p []*Packet) *PacketL2 {
+	l2, err := WrapL2E(s, p)
+	if err != nil {
+		panic(err)
+	}
+	return l2
+}
+
+// WrapL2E marshal the packets into a L2 packet encrypted by the session,
+// it returns ErrNonceExhausted if the session can't seal anymore, or
+// ErrPayloadTooLarge if a packet has to be fragmented.
+func WrapL2E(s *Session, p []*Packet) (*PacketL2, error) {
 	defer checkPacket(p)
 	totalSize := 0
 	for _, pp := range p {
 		totalSize += pp.TotalSize()
 	}
-	buf := make([]byte, totalSize)
+	// the room of the AEAD tag is reserved, so it's sealed in place
+	pooled := GetBuffer(totalSize + l2Overhead)
+	buf := pooled.B[:totalSize]
 	off := 0
 	for _, pp := range p {
-		n := pp.Marshal(buf[off:])
+		n, err := pp.MarshalE(buf[off:])
+		if err != nil {
+			pooled.Release()
+			return nil, err
+		}
 		if n != pp.TotalSize() {
 			logex.Struct(pp, n)
 			panic("!!")
@@ -69,14 +116,24 @@ func WrapL2(s *Session, p []*Packet) *PacketL2 {
 	}
 
 	l2 := &PacketL2{
-		IV:      make([]byte, 16),
+		IV:      make([]byte, l2IVSize),
 		UserId:  uint16(s.UserId()),
 		Payload: buf,
+		buf:     pooled,
+	}
+	if s.Version() >= L2VersionAEAD {
+		payload, err := s.Seal(l2.IV, l2.UserId, l2.Payload)
+		if err != nil {
+			l2.Release()
+			return nil, err
+		}
+		l2.Payload = payload
+		return l2, nil
 	}
 	rand.Read(l2.IV)
 	l2.Checksum = crypto.Crc32(l2.Payload)
 	s.Encode(l2.IV, l2.Payload, l2.Payload)
-	return l2
+	return l2, nil
 }
 
 func (p *PacketL2) Verify(s *Session) error {
@@ -86,26 +143,55 @@ func (p *PacketL2) Verify(s *Session) error {
 	}
 
 	// decode in here
-	err := s.Verify(int(p.UserId), p.Checksum, p.IV, p.Payload)
+	err := p.verify(s)
 	p.verifyd = &err
 	return logex.Trace(err)
 }
 
+// verify open the payload if it's sealed by the AEAD, an ErrAuthFailed is
+// not fatal, the packet should be dropped only.
+func (p *PacketL2) verify(s *Session) error {
+	if len(p.IV) != l2IVSize {
+		return ErrInvalidIV.Format(len(p.IV))
+	}
+	if !isSealed(p.IV) {
+		return s.Verify(int(p.UserId), p.Checksum, p.IV, p.Payload)
+	}
+	payload, err := s.Open(int(p.UserId), p.Checksum, p.IV, p.Payload)
+	if err == nil {
+		p.Payload = payload
+		return nil
+	}
+	if logex.Equal(err, ErrAuthFailed) && !s.isPeerAEAD() {
+		// the random IV of a CFB packet may end with the magic
+		if s.Verify(int(p.UserId), p.Checksum, p.IV, p.Payload) == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Unmarshal returns the packets which own their payloads, so it can be
+// released right after.
 func (p *PacketL2) Unmarshal() ([]*Packet, error) {
-	if p.verifyd == nil {
-		panic("packet l2 is not verifyed")
+	return p.unmarshal(Unmarshal)
+}
+
+// UnmarshalBuffer is like Unmarshal, but the payloads of the packets are
+// borrowed from the pooled payload, see UnmarshalBuffer. each packet needs
+// a Release in addition to the PacketL2.
+func (p *PacketL2) UnmarshalBuffer() ([]*Packet, error) {
+	if p.buf == nil {
+		return p.Unmarshal()
 	}
+	return p.unmarshal(func(b []byte) (*Packet, error) {
+		return UnmarshalBuffer(p.buf, b)
+	})
+}
 
-	var ret []*Packet
-	payload := p.Payload
-	for len(payload) > 0 {
-		p, err := Unmarshal(payload)
-		if err != nil {
-			logex.Info(payload)
-			return nil, logex.Trace(err)
-		}
-		ret = append(ret, p)
-		payload = payload[p.TotalSize():]
+func (p *PacketL2) unmarshal(fn func([]byte) (*Packet, error)) ([]*Packet, error) {
+	if p.verifyd == nil {
+		panic("packet l2 is not verifyed")
 	}
-	return ret, nil
+	return readBatch(p.Payload, fn)
 }
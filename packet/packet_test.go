@@ -2,8 +2,12 @@ package packet
 
 import (
 	"crypto/rand"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/chzyer/logex"
 	"github.com/chzyer/test"
 )
 
@@ -27,6 +31,90 @@ func TestPacket(t *testing.T) {
 
 }
 
+// allowFragment set AllowFragment until the returned func is called
+func allowFragment() func() {
+	AllowFragment = true
+	return func() { AllowFragment = false }
+}
+
+func TestPacketMaxPayload(t *testing.T) {
+	defer test.New(t)
+
+	// rejected unless it can be fragmented
+	_, err := NewE(make([]byte, MaxPayload+1), NEWDC)
+	test.True(logex.Equal(err, ErrPayloadTooLarge))
+	test.True(strings.Contains(err.Error(), fmt.Sprintf("%v > %v", MaxPayload+1, MaxPayload)))
+	_, err = New(nil, NEWDC).ReplyE(make([]byte, MaxPayload+1))
+	test.True(logex.Equal(err, ErrPayloadTooLarge))
+
+	defer allowFragment()()
+	_, err = NewE(make([]byte, MaxPayloadLength+1), NEWDC)
+	test.True(logex.Equal(err, ErrPayloadTooLarge))
+	test.True(strings.Contains(err.Error(), fmt.Sprintf("%v > %v", MaxPayloadLength+1, MaxPayloadLength)))
+	_, err = New(nil, NEWDC).ReplyE(make([]byte, MaxPayloadLength+1))
+	test.True(logex.Equal(err, ErrPayloadTooLarge))
+
+	// the one fits in a datagram
+	p, err := NewE(make([]byte, MaxPayload), NEWDC)
+	test.Nil(err)
+	test.Nil(p.CheckSize())
+	test.True(PacketL2HeaderSize+l2Overhead+p.TotalSize() <= maxDatagramSize)
+
+	// constructed, but has to be fragmented
+	p = New(make([]byte, MaxPayload+1), NEWDC)
+	err = p.CheckSize()
+	test.True(logex.Equal(err, ErrPayloadTooLarge))
+	test.True(strings.Contains(err.Error(), fmt.Sprintf("%v > %v", MaxPayload+1, MaxPayload)))
+	_, err = p.MarshalE(make([]byte, p.TotalSize()))
+	test.True(logex.Equal(err, ErrPayloadTooLarge))
+	_, err = WrapL2E(NewSessionCli(1, []byte("0123456789abcdef")), []*Packet{New(nil, DATA), p})
+	test.True(logex.Equal(err, ErrPayloadTooLarge))
+	for _, f := range Fragment(p, 1400) {
+		_, err = f.MarshalE(make([]byte, f.TotalSize()))
+		test.Nil(err)
+	}
+
+	defer func(max int) { MaxPayload = max }(MaxPayload)
+	MaxPayload = MaxPayloadLength + 100
+	test.Nil(New(make([]byte, MaxPayloadLength), NEWDC).CheckSize())
+	MaxPayload = 10
+	test.True(logex.Equal(New(make([]byte, 11), NEWDC).CheckSize(), ErrPayloadTooLarge))
+}
+
+func TestPacketReplyError(t *testing.T) {
+	defer test.New(t)
+
+	req := New(nil, NEWDC)
+	req.ReqId = 5
+	resp := req.ReplyError(fmt.Errorf("no port available"))
+	test.True(resp.IsError())
+	test.Equal(resp.Type, NEWDC_R)
+	test.Equal(resp.ReqId, uint32(5))
+
+	got, err := Unmarshal(marshalPacket(resp))
+	test.Nil(err)
+	test.True(got.IsError())
+	test.Equal(*got.RemoteError(), RemoteError{ErrCodeInternal, "no port available"})
+	test.Nil(req.RemoteError())
+
+	// the code is kept
+	resp = req.ReplyError(&RemoteError{ErrCodeNotFound, "no such route"})
+	got, err = Unmarshal(marshalPacket(resp))
+	test.Nil(err)
+	test.Equal(*got.RemoteError(), RemoteError{ErrCodeNotFound, "no such route"})
+	test.Equal(got.RemoteError().Error(), "remote error(5): no such route")
+
+	// kept by the fragments
+	resp = req.ReplyError(fmt.Errorf("%v", string(make([]byte, 500))))
+	r := NewReassembler(time.Second)
+	for _, frag := range Fragment(resp, 128) {
+		got, err = r.Feed(frag)
+		test.Nil(err)
+	}
+	test.True(got.IsError())
+	test.False(req.Reply(nil).IsError())
+}
+
 func BenchmarkPacketUnmarshal(b *testing.B) {
 	defer test.New(b)
 	payload := make([]byte, 24)
@@ -56,3 +144,191 @@ func BenchmarkPacketMarshal(b *testing.B) {
 		b.SetBytes(int64(len(payload)))
 	}
 }
+
+func TestPacketReplyStream(t *testing.T) {
+	defer test.New(t)
+
+	req := New(nil, NEWDC)
+	req.ReqId = 5
+	resp := req.ReplyStream(3, []byte("chunk"), true)
+	got, err := Unmarshal(marshalPacket(resp))
+	test.Nil(err)
+	test.True(got.IsStream())
+	test.True(got.HasMore())
+	test.Equal(got.ReqId, uint32(5))
+	idx, data, ok := got.StreamChunk()
+	test.True(ok)
+	test.Equal(idx, uint32(3))
+	test.Equal(data, []byte("chunk"))
+
+	got, err = Unmarshal(marshalPacket(req.ReplyStream(4, nil, false)))
+	test.Nil(err)
+	test.True(got.IsStream())
+	test.False(got.HasMore())
+
+	_, _, ok = req.Reply(nil).StreamChunk()
+	test.False(ok)
+}
+
+func TestPacketTimeout(t *testing.T) {
+	defer test.New(t)
+
+	p := New([]byte("hello"), NEWDC)
+	p.ReqId = 3
+	p.Seq = 7
+	p.Timeout = 1500*time.Microsecond + time.Second
+	data := make([]byte, p.TotalSize())
+	test.Equal(p.Marshal(data), 25)
+
+	got, err := Unmarshal(data)
+	test.Nil(err)
+	test.Equal(got.Seq, uint64(7))
+	test.Equal(got.Timeout, 1002*time.Millisecond)
+	test.Equal(got.Payload(), []byte("hello"))
+
+	// the packet without timeout keeps the legacy layout
+	p.Timeout = 0
+	test.Equal(len(marshalPacket(p)), 21)
+
+	// authenticated if sealed
+	aead := newTestAEAD(1)
+	p.Timeout = time.Second
+	sealed, err := p.Seal(aead)
+	test.Nil(err)
+	data = marshalPacket(sealed)
+	data[19] ^= 1
+	got, err = Unmarshal(data)
+	test.Nil(err)
+	_, err = got.Open(aead)
+	test.NotNil(err)
+
+	// the last fragment tells the timeout
+	p = New(make([]byte, 500), NEWDC)
+	r := NewReassembler(time.Second)
+	for _, frag := range Fragment(p, 128) {
+		frag.Timeout = 3 * time.Second
+		got, err = r.Feed(frag)
+		test.Nil(err)
+	}
+	test.Equal(got.Timeout, 3*time.Second)
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	defer test.New(t)
+
+	p := New([]byte("hello"), NEWDC)
+	p.ReqId, p.Seq, p.Timeout, p.Version = 1, 2, time.Second, Version2
+	data := marshalPacket(p)
+
+	for i := 0; i < len(data)-1; i++ {
+		_, err := Unmarshal(data[:i])
+		test.True(IsMalformed(err))
+	}
+
+	cases := map[string]func(b []byte){
+		"unknown type": func(b []byte) { b[5] = byte(InvalidType) },
+		"zero type":    func(b []byte) { b[5] = 0 },
+		"long length":  func(b []byte) { b[7]++ },
+		"old version":  func(b []byte) { b[8] = VersionLegacy },
+		"ext flag":     func(b []byte) { b[9] = 0x80 },
+		"zero seq":     func(b []byte) { copy(b[10:18], make([]byte, 8)) },
+		"zero timeout": func(b []byte) { copy(b[18:22], make([]byte, 4)) },
+	}
+	for name, corrupt := range cases {
+		b := append([]byte(nil), data...)
+		corrupt(b)
+		_, err := Unmarshal(b)
+		if !IsMalformed(err) {
+			test.Panic(0, fmt.Sprintf("%v: %v", name, err))
+		}
+	}
+	test.False(IsMalformed(nil))
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	seeds := []*Packet{New([]byte("hello"), NEWDC), New(nil, HEARTBEAT)}
+	p := New([]byte("world"), NEWDC)
+	p.ReqId, p.Seq, p.Timeout, p.Version = 1, 2, time.Second, Version2
+	seeds = append(seeds, p, p.ReplyError(fmt.Errorf("failed")))
+	for _, p := range seeds {
+		f.Add(marshalPacket(p))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		defer test.New(t)
+		p, err := Unmarshal(data)
+		if err != nil {
+			test.True(IsMalformed(err))
+			return
+		}
+		// the accepted input is the one Marshal writes
+		test.True(p.TotalSize() <= len(data))
+		test.Equal(marshalPacket(p), data[:p.TotalSize()])
+		p.RemoteError()
+		p.StreamChunk()
+		if p.Type == FRAGMENT {
+			NewReassembler(time.Second).Feed(p)
+		}
+		if p.Type == DATA {
+			NewDataPacket(p.payload).DestIP()
+		}
+	})
+}
+
+func TestPacketString(t *testing.T) {
+	defer test.New(t)
+
+	p := New([]byte("secret"), NEWDC)
+	p.ReqId = 5
+	test.Equal(p.String(), "NewDC#5 len=6")
+
+	resp := p.ReplyError(fmt.Errorf("secret"))
+	p = New([]byte(strings.Repeat("secret", 100)), NEWDC)
+	p.ReqId, p.Seq, p.Timeout, p.Version = 5, 3, time.Second, Version2
+	test.True(p.Compress())
+	test.True(strings.HasPrefix(p.String(), "NewDC#5 seq=3 len="))
+	test.True(strings.HasSuffix(p.String(), " timeout=1s v=2 flags=compress"))
+	test.Equal(resp.String(), "NewDCResp#5 len=8 flags=error")
+	test.False(strings.Contains(fmt.Sprintf("%v %#v", resp, resp), "secret"))
+	test.Equal(Flag(FlagSeq|FlagStream|FlagMore).String(), "seq|stream|more")
+}
+
+func TestPacketChecksum(t *testing.T) {
+	defer test.New(t)
+
+	for _, payload := range [][]byte{[]byte("hello"), {}} {
+		p := New(payload, NEWDC)
+		p.ReqId, p.Seq, p.Version, p.Checksum = 5, 3, Version2, true
+		data := marshalPacket(p)
+		test.Equal(len(data), 8+2+8+4+len(payload))
+		got, err := Unmarshal(data)
+		test.Nil(err)
+		test.Equal(got, p)
+
+		// header
+		for _, idx := range []int{0, 4, 10} {
+			b := append([]byte(nil), data...)
+			b[idx] ^= 1
+			_, err = Unmarshal(b)
+			test.True(logex.Equal(err, ErrChecksumMismatch))
+			test.True(IsMalformed(err))
+		}
+		// the checksum itself
+		b := append([]byte(nil), data...)
+		b[18] ^= 0x80
+		_, err = Unmarshal(b)
+		test.True(logex.Equal(err, ErrChecksumMismatch))
+		// payload
+		if len(payload) > 0 {
+			b := append([]byte(nil), data...)
+			b[len(b)-1] ^= 1
+			_, err = Unmarshal(b)
+			test.True(logex.Equal(err, ErrChecksumMismatch))
+		}
+	}
+
+	// it needs the ext flags
+	p := New([]byte("hello"), NEWDC)
+	p.Checksum = true
+	test.Equal(len(marshalPacket(p)), 8+5)
+}
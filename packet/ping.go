@@ -0,0 +1,94 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/chzyer/logex"
+)
+
+// PingHeaderSize is the size of the payload of PING without padding
+const PingHeaderSize = 10
+
+var ErrInvalidPing = logex.Define("invalid ping: %v")
+
+// the monotonic clock of the process, the timestamp in PING is only
+// meaningful to its sender.
+var monoBase = time.Now()
+
+func monoNow() int64 {
+	return int64(time.Since(monoBase))
+}
+
+// Ping is the payload of PING and PONG
+type Ping struct {
+	// Sent is the monotonic nanoseconds when the PING is sent
+	Sent int64
+	// Padding is the length of the zeros after the header
+	Padding int
+}
+
+func (p Ping) Marshal() []byte {
+	b := make([]byte, PingHeaderSize+p.Padding)
+	binary.BigEndian.PutUint64(b[:8], uint64(p.Sent))
+	binary.BigEndian.PutUint16(b[8:10], uint16(p.Padding))
+	return b
+}
+
+// UnmarshalPing returns error if the padding doesn't match its length,
+// e.g. the packet is truncated on the way.
+func UnmarshalPing(b []byte) (Ping, error) {
+	if len(b) < PingHeaderSize {
+		return Ping{}, ErrPacketTooShort.Format(len(b))
+	}
+	p := Ping{
+		Sent:    int64(binary.BigEndian.Uint64(b[:8])),
+		Padding: int(binary.BigEndian.Uint16(b[8:10])),
+	}
+	if len(b)-PingHeaderSize != p.Padding {
+		return Ping{}, ErrInvalidPing.Format(
+			fmt.Sprintf("padding %v, got %v", p.Padding, len(b)-PingHeaderSize))
+	}
+	return p, nil
+}
+
+// NewPing returns a PING which payload is padded to size for the MTU
+// probing, it's never smaller than PingHeaderSize.
+func NewPing(size int) *Packet {
+	padding := size - PingHeaderSize
+	if padding < 0 {
+		padding = 0
+	}
+	if max := MaxPayloadLength - PingHeaderSize; padding > max {
+		padding = max
+	}
+	return New(Ping{Sent: monoNow(), Padding: padding}.Marshal(), PING)
+}
+
+// Pong returns the PONG to the ping which echoes its payload
+func Pong(ping *Packet) (*Packet, error) {
+	if ping.Type != PING {
+		return nil, ErrInvalidType.Format(int(ping.Type))
+	}
+	if _, err := UnmarshalPing(ping.payload); err != nil {
+		return nil, err
+	}
+	return ping.Reply(ping.payload), nil
+}
+
+// ParsePong returns the RTT of the PING which is sent by this process
+func ParsePong(p *Packet) (time.Duration, error) {
+	if p.Type != PONG {
+		return 0, ErrInvalidType.Format(int(p.Type))
+	}
+	ping, err := UnmarshalPing(p.payload)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Duration(monoNow() - ping.Sent)
+	if rtt < 0 {
+		return 0, ErrInvalidPing.Format("sent in the future")
+	}
+	return rtt, nil
+}
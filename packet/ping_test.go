@@ -0,0 +1,59 @@
+package packet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/test"
+)
+
+func TestPing(t *testing.T) {
+	defer test.New(t)
+
+	test.True(PING.IsReq())
+	test.True(PONG.IsResp())
+	test.Equal(PING.String(), "Ping")
+
+	ping := NewPing(100)
+	ping.ReqId = 3
+	test.Equal(ping.Size(), 100)
+	test.Equal(NewPing(0).Size(), PingHeaderSize)
+
+	got, err := Unmarshal(marshalPacket(ping))
+	test.Nil(err)
+	test.Equal(got.Type, PING)
+	pong, err := Pong(got)
+	test.Nil(err)
+	test.Equal(pong.ReqId, uint32(3))
+
+	time.Sleep(time.Millisecond)
+	got, err = Unmarshal(marshalPacket(pong))
+	test.Nil(err)
+	rtt, err := ParsePong(got)
+	test.Nil(err)
+	test.True(rtt >= time.Millisecond && rtt < time.Second)
+
+	_, err = ParsePong(ping)
+	test.True(logex.Equal(err, ErrInvalidType))
+	_, err = Pong(pong)
+	test.True(logex.Equal(err, ErrInvalidType))
+}
+
+func TestPingPadding(t *testing.T) {
+	defer test.New(t)
+
+	ping := NewPing(100)
+	payload := ping.Payload()
+	p, err := UnmarshalPing(payload)
+	test.Nil(err)
+	test.Equal(p.Padding, 90)
+
+	// truncated on the way
+	_, err = Pong(New(payload[:60], PING))
+	test.True(logex.Equal(err, ErrInvalidPing))
+	_, err = ParsePong(New(payload[:60], PONG))
+	test.True(logex.Equal(err, ErrInvalidPing))
+	_, err = UnmarshalPing(payload[:5])
+	test.True(logex.Equal(err, ErrPacketTooShort))
+}
@@ -0,0 +1,131 @@
+package packet
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chzyer/logex"
+)
+
+// DebugPool poison the buffers when they are released and never reuse them,
+// so the use after release reads the poison instead of the next packet. it
+// also panics on the double release, and on reading the released packet.
+var DebugPool = false
+
+// poisonByte fill the released buffers in DebugPool
+const poisonByte = 0xdb
+
+// the smallest capacity of the pooled buffers, most packets are below the
+// MTU.
+const minBufferSize = 2048
+
+var ErrShortBuffer = logex.Define("buffer is too short, want: %v, got: %v")
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(Buffer) },
+}
+
+// Buffer is a pooled byte slice shared by the packets borrowing it, see
+// UnmarshalBuffer. it's returned to the pool once all the holders release
+// it. B can be grown, e.g. by AppendTo, the grown one is pooled instead.
+type Buffer struct {
+	B    []byte
+	data []byte
+	refs int32
+}
+
+// GetBuffer returns a buffer of n bytes from the pool, the content is not
+// zeroed. the caller holds one reference.
+func GetBuffer(n int) *Buffer {
+	b := bufferPool.Get().(*Buffer)
+	if b.data == nil || cap(b.data) < n {
+		size := n
+		if size < minBufferSize {
+			size = minBufferSize
+		}
+		b.data = make([]byte, size)
+	}
+	b.B = b.data[:n]
+	b.refs = 1
+	return b
+}
+
+// Retain add a reference, each one needs a Release
+func (b *Buffer) Retain() {
+	atomic.AddInt32(&b.refs, 1)
+}
+
+// Release drop a reference, the buffer is put back into the pool when it's
+// the last one, and it must not be used afterwards.
+func (b *Buffer) Release() {
+	refs := atomic.AddInt32(&b.refs, -1)
+	if refs > 0 {
+		return
+	}
+	if refs < 0 {
+		if DebugPool {
+			panic(fmt.Sprintf("buffer is released %v times more", -refs))
+		}
+		return
+	}
+	if cap(b.B) > cap(b.data) {
+		// grown by AppendTo
+		b.data = b.B[:cap(b.B)]
+	}
+	if DebugPool {
+		for i := range b.data {
+			b.data[i] = poisonByte
+		}
+		return
+	}
+	b.B = nil
+	bufferPool.Put(b)
+}
+
+// MarshalTo is like Marshal, but returns ErrShortBuffer instead of panic if
+// dst is shorter than TotalSize.
+func (p *Packet) MarshalTo(dst []byte) (int, error) {
+	if size := p.TotalSize(); len(dst) < size {
+		return 0, ErrShortBuffer.Format(size, len(dst))
+	}
+	return p.Marshal(dst), nil
+}
+
+// AppendTo append the packet to dst and returns the extended slice, dst is
+// grown only if its capacity is not enough.
+func (p *Packet) AppendTo(dst []byte) []byte {
+	off := len(dst)
+	size := off + p.TotalSize()
+	if cap(dst) < size {
+		grown := make([]byte, off, size+size/4)
+		copy(grown, dst)
+		dst = grown
+	}
+	p.Marshal(dst[off:size])
+	return dst[:size]
+}
+
+// UnmarshalBuffer is like Unmarshal, but the payload is borrowed from b
+// instead of copied, b must be a part of buf.B. the packet holds a
+// reference of buf until Release.
+func UnmarshalBuffer(buf *Buffer, b []byte) (*Packet, error) {
+	p, err := unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	buf.Retain()
+	p.buf = buf
+	return p, nil
+}
+
+// Release return the borrowed buffer of the packet, the payload must not be
+// used afterwards. it's a no-op if the packet is not borrowed.
+func (p *Packet) Release() {
+	if p.buf == nil {
+		return
+	}
+	buf := p.buf
+	p.buf, p.payload, p.released = nil, nil, DebugPool
+	buf.Release()
+}
@@ -0,0 +1,158 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/test"
+)
+
+func TestPacketAppendTo(t *testing.T) {
+	defer test.New(t)
+
+	p := New([]byte("hello"), NEWDC)
+	p.ReqId = 3
+	p.Seq = 9
+	want := marshalPacket(p)
+
+	_, err := p.MarshalTo(make([]byte, p.TotalSize()-1))
+	test.True(logex.Equal(err, ErrShortBuffer))
+	n, err := p.MarshalTo(make([]byte, p.TotalSize()+1))
+	test.Nil(err)
+	test.Equal(n, p.TotalSize())
+
+	prefix := []byte("xx")
+	got := p.AppendTo(prefix)
+	test.Equal(got[2:], want)
+	got = p.AppendTo(got)
+	test.Equal(got, append(append([]byte("xx"), want...), want...))
+}
+
+func TestUnmarshalBuffer(t *testing.T) {
+	defer test.New(t)
+
+	buf := GetBuffer(0)
+	for _, payload := range []string{"hello", "world"} {
+		buf.B = New([]byte(payload), DATA).AppendTo(buf.B)
+	}
+
+	var ps []*Packet
+	for b := buf.B; len(b) > 0; {
+		p, err := UnmarshalBuffer(buf, b)
+		test.Nil(err)
+		ps = append(ps, p)
+		b = b[p.TotalSize():]
+	}
+	test.Equal(len(ps), 2)
+	buf.Release()
+
+	// the packets still hold the buffer
+	test.Equal(ps[0].Payload(), []byte("hello"))
+	ps[0].Release()
+	ps[0].Release()
+	test.Equal(ps[1].Payload(), []byte("world"))
+	ps[1].Release()
+}
+
+func TestPoolUseAfterRelease(t *testing.T) {
+	defer test.New(t)
+
+	DebugPool = true
+	defer func() { DebugPool = false }()
+
+	buf := GetBuffer(0)
+	buf.B = New([]byte("secret"), DATA).AppendTo(buf.B)
+	p, err := UnmarshalBuffer(buf, buf.B)
+	test.Nil(err)
+	payload := p.Payload()
+	buf.Release()
+	test.Equal(payload, []byte("secret"))
+
+	p.Release()
+	test.Equal(payload, bytes.Repeat([]byte{poisonByte}, len(payload)))
+	test.True(panics(func() { p.Payload() }))
+	test.True(panics(buf.Release))
+}
+
+func TestPacketL2Release(t *testing.T) {
+	defer test.New(t)
+
+	DebugPool = true
+	defer func() { DebugPool = false }()
+
+	s := NewSessionCli(1, []byte("0123456789abcdef"))
+	l2 := WrapL2(s, []*Packet{New([]byte("hello"), DATA)})
+	data := append([]byte(nil), l2.Payload...)
+	buf := GetBuffer(len(data))
+	copy(buf.B, data)
+	l2.Release()
+	test.Nil(l2.Payload)
+
+	l2 = NewPacketL2Buffer(l2.IV, l2.UserId, buf, l2.Checksum)
+	test.Nil(l2.Verify(s))
+	ps, err := l2.UnmarshalBuffer()
+	test.Nil(err)
+	owned, err := l2.Unmarshal()
+	test.Nil(err)
+	l2.Release()
+	test.Equal(ps[0].Payload(), []byte("hello"))
+	ps[0].Release()
+	test.Equal(owned[0].Payload(), []byte("hello"))
+}
+
+func panics(fn func()) (ret bool) {
+	defer func() {
+		ret = recover() != nil
+	}()
+	fn()
+	return false
+}
+
+func BenchmarkPacketAppendTo(b *testing.B) {
+	defer test.New(b)
+	payload := make([]byte, 24)
+	rand.Read(payload)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		packet := New(payload, DATA)
+		packet.ReqId = 1
+		buf := GetBuffer(0)
+		buf.B = packet.AppendTo(buf.B)
+		buf.Release()
+		b.SetBytes(int64(len(payload)))
+	}
+}
+
+func BenchmarkUnmarshalBuffer(b *testing.B) {
+	defer test.New(b)
+	payload := make([]byte, 1400)
+	rand.Read(payload)
+	packet := New(payload, DATA)
+	packet.ReqId = 1
+	buf := GetBuffer(packet.TotalSize())
+	packet.Marshal(buf.B)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		p, err := UnmarshalBuffer(buf, buf.B)
+		test.Nil(err)
+		p.Release()
+		b.SetBytes(int64(len(buf.B)))
+	}
+}
+
+func BenchmarkWrapL2(b *testing.B) {
+	defer test.New(b)
+	s := NewSessionCli(1, []byte("0123456789abcdef"))
+	ps := []*Packet{New(make([]byte, 1400), DATA)}
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		l2 := WrapL2(s, ps)
+		l2.Release()
+		b.SetBytes(1400)
+	}
+}
@@ -0,0 +1,219 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Priority tells the send path which packets go first, it's carried in the
+// ExtFlag since Version2, see Packet.SendPriority.
+type Priority uint8
+
+const (
+	// PriorityNormal is the default, so it's zero on the wire
+	PriorityNormal Priority = iota
+	// PriorityHigh is for the small interactive packets, e.g. DNS and the
+	// keystrokes of SSH
+	PriorityHigh
+	// PriorityLow is for the bulk transfers
+	PriorityLow
+
+	numPriority = 3
+)
+
+func (pr Priority) String() string {
+	switch pr {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	default:
+		return fmt.Sprintf("<unknown priority>:%v", uint8(pr))
+	}
+}
+
+// rank is the order of draining, the highest priority is zero
+func (pr Priority) rank() int {
+	switch pr {
+	case PriorityHigh:
+		return 0
+	case PriorityLow:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Priority returns PriorityNormal unless SetPriority or Classify is called
+func (p *Packet) Priority() Priority {
+	return p.priority
+}
+
+// SetPriority panics if pr is unknown
+func (p *Packet) SetPriority(pr Priority) {
+	if pr >= numPriority {
+		panic("unknown priority: " + pr.String())
+	}
+	p.priority = pr
+}
+
+// Classify set the priority of the DATA packet by ClassifyIP, the other
+// types are kept.
+func (p *Packet) Classify() {
+	if p.Type == DATA {
+		p.priority = ClassifyIP(p.payload)
+	}
+}
+
+// InteractivePorts are the TCP/UDP ports classified as PriorityHigh by
+// ClassifyIP.
+var InteractivePorts = map[uint16]bool{22: true, 53: true}
+
+// the protocols peeked by ClassifyIP
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+const ipv6HeaderSize = 40
+
+// ClassifyIP returns the priority of the ip packet read from the tun by
+// its protocol and ports, the ICMP and the InteractivePorts are high. the
+// size is never looked at, so a flow keeps one priority and is never
+// reordered, except the ip fragments. the packet which can't be parsed is
+// PriorityNormal.
+func ClassifyIP(b []byte) Priority {
+	if len(b) < ipv4HeaderSize {
+		return PriorityNormal
+	}
+	var proto byte
+	var l4 []byte
+	switch b[0] >> 4 {
+	case 4:
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < ipv4HeaderSize || len(b) < ihl {
+			return PriorityNormal
+		}
+		proto = b[9]
+		// only the first fragment has the ports
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff == 0 {
+			l4 = b[ihl:]
+		}
+	case 6:
+		if len(b) < ipv6HeaderSize {
+			return PriorityNormal
+		}
+		// the extension headers are not followed
+		proto, l4 = b[6], b[ipv6HeaderSize:]
+	default:
+		return PriorityNormal
+	}
+	switch proto {
+	case protoICMP, protoICMPv6:
+		return PriorityHigh
+	case protoTCP, protoUDP:
+		if len(l4) < 4 {
+			return PriorityNormal
+		}
+		src, dst := binary.BigEndian.Uint16(l4[0:2]), binary.BigEndian.Uint16(l4[2:4])
+		if InteractivePorts[src] || InteractivePorts[dst] {
+			return PriorityHigh
+		}
+	}
+	return PriorityNormal
+}
+
+// PriorityQueue hold the outgoing packets and drain them by priority, FIFO
+// in the same priority. the lowest priority is served once it's starved
+// for maxStarve pops, so the bulk transfers still make progress. it's not
+// thread safe, see Batcher for its usage.
+type PriorityQueue struct {
+	maxStarve int
+	queues    [numPriority][]*Packet // by rank
+	starved   int
+	n         int
+}
+
+// NewPriorityQueue returns a PriorityQueue, zero maxStarve means the
+// lowest priority can be starved.
+func NewPriorityQueue(maxStarve int) *PriorityQueue {
+	return &PriorityQueue{maxStarve: maxStarve}
+}
+
+// Len returns how many packets are queued
+func (q *PriorityQueue) Len() int {
+	return q.n
+}
+
+func (q *PriorityQueue) Push(ps ...*Packet) {
+	for _, p := range ps {
+		rank := p.priority.rank()
+		q.queues[rank] = append(q.queues[rank], p)
+	}
+	q.n += len(ps)
+}
+
+// next returns the rank of the next packet, -1 if empty
+func (q *PriorityQueue) next() int {
+	lowest := numPriority - 1
+	if q.maxStarve > 0 && q.starved >= q.maxStarve && len(q.queues[lowest]) > 0 {
+		return lowest
+	}
+	for rank := range q.queues {
+		if len(q.queues[rank]) > 0 {
+			return rank
+		}
+	}
+	return -1
+}
+
+func (q *PriorityQueue) pop(rank int) *Packet {
+	lowest := numPriority - 1
+	if rank == lowest {
+		q.starved = 0
+	} else if len(q.queues[lowest]) > 0 {
+		q.starved++
+	}
+	queue := q.queues[rank]
+	p := queue[0]
+	queue[0] = nil
+	if queue = queue[1:]; len(queue) == 0 {
+		queue = nil
+	}
+	q.queues[rank] = queue
+	q.n--
+	return p
+}
+
+// Pop returns nil if the queue is empty
+func (q *PriorityQueue) Pop() *Packet {
+	rank := q.next()
+	if rank < 0 {
+		return nil
+	}
+	return q.pop(rank)
+}
+
+// PopBatch pop the packets in order until their TotalSize reach maxSize,
+// at least one packet is returned unless the queue is empty. it bounds
+// how many bytes are written before a high priority packet arrived later.
+func (q *PriorityQueue) PopBatch(maxSize int) []*Packet {
+	var ret []*Packet
+	size := 0
+	for {
+		rank := q.next()
+		if rank < 0 {
+			return ret
+		}
+		next := q.queues[rank][0].TotalSize()
+		if len(ret) > 0 && size+next > maxSize {
+			return ret
+		}
+		ret = append(ret, q.pop(rank))
+		size += next
+	}
+}
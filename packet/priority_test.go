@@ -0,0 +1,156 @@
+package packet
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/test"
+)
+
+// newIPv4 returns an ipv4 packet of size bytes with the ports
+func newIPv4(proto byte, srcPort, dstPort uint16, size int) []byte {
+	b := make([]byte, size)
+	b[0] = 0x45
+	b[9] = proto
+	binary.BigEndian.PutUint16(b[20:22], srcPort)
+	binary.BigEndian.PutUint16(b[22:24], dstPort)
+	return b
+}
+
+func TestClassifyIP(t *testing.T) {
+	defer test.New(t)
+
+	test.Equal(ClassifyIP(newIPv4(protoUDP, 40000, 53, 300)), PriorityHigh)
+	test.Equal(ClassifyIP(newIPv4(protoTCP, 22, 40000, 300)), PriorityHigh)
+	// the size is never looked at, a flow keeps its order
+	test.Equal(ClassifyIP(newIPv4(protoTCP, 22, 40000, 1400)), PriorityHigh)
+	test.Equal(ClassifyIP(newIPv4(protoTCP, 40000, 443, 1400)), PriorityNormal)
+	test.Equal(ClassifyIP(newIPv4(protoTCP, 40000, 443, 60)), PriorityNormal)
+	test.Equal(ClassifyIP(newIPv4(protoICMP, 0, 0, 1400)), PriorityHigh)
+
+	// the ports of the non-first fragment are payload
+	b := newIPv4(protoUDP, 40000, 53, 300)
+	b[7] = 1
+	test.Equal(ClassifyIP(b), PriorityNormal)
+
+	b = make([]byte, 300)
+	b[0] = 0x60
+	b[6] = protoUDP
+	binary.BigEndian.PutUint16(b[42:44], 53)
+	test.Equal(ClassifyIP(b), PriorityHigh)
+	test.Equal(ClassifyIP([]byte{0x45}), PriorityNormal)
+
+	p := New(newIPv4(protoUDP, 40000, 53, 300), DATA)
+	p.Classify()
+	test.Equal(p.Priority(), PriorityHigh)
+	p = New(make([]byte, 10), NEWDC)
+	p.Classify()
+	test.Equal(p.Priority(), PriorityNormal)
+}
+
+func TestPacketPriority(t *testing.T) {
+	defer test.New(t)
+
+	p := New([]byte("hello"), DATA)
+	p.ReqId = 1
+	p.SetPriority(PriorityLow)
+	test.Equal(p.String(), "Data#1 len=5 prio=low")
+	// not carried until Version2 and SendPriority
+	got, err := Unmarshal(marshalPacket(p))
+	test.Nil(err)
+	test.Equal(got.Priority(), PriorityNormal)
+	p.Version = Version2
+	got, err = Unmarshal(marshalPacket(p))
+	test.Nil(err)
+	test.Equal(got.Priority(), PriorityNormal)
+
+	p.SendPriority = true
+	got, err = Unmarshal(marshalPacket(p))
+	test.Nil(err)
+	test.Equal(got, p)
+	test.Equal(p.TotalSize(), 8+2+5)
+
+	// the fragments keep the priority
+	large := New(make([]byte, 1000), DATA)
+	large.SetPriority(PriorityHigh)
+	r := NewReassembler(time.Minute)
+	for _, f := range Fragment(large, 300) {
+		test.Equal(f.Priority(), PriorityHigh)
+		got, err = r.Feed(f)
+		test.Nil(err)
+	}
+	test.Equal(got.Priority(), PriorityHigh)
+
+	b := marshalPacket(p)
+	b[9] |= byte(3 << extPriorityShift)
+	_, err = Unmarshal(b)
+	test.True(logex.Equal(err, ErrMalformed))
+	test.True(panics(func() { p.SetPriority(3) }))
+}
+
+func TestPriorityQueue(t *testing.T) {
+	defer test.New(t)
+
+	newPacket := func(reqId uint32, pr Priority) *Packet {
+		p := New(make([]byte, 92), DATA) // 100 bytes
+		p.ReqId = reqId
+		p.SetPriority(pr)
+		return p
+	}
+	reqIds := func(ps []*Packet) []uint32 {
+		ret := make([]uint32, len(ps))
+		for i, p := range ps {
+			ret[i] = p.ReqId
+		}
+		return ret
+	}
+
+	q := NewPriorityQueue(0)
+	q.Push(newPacket(1, PriorityLow), newPacket(2, PriorityNormal), newPacket(3, PriorityHigh))
+	q.Push(newPacket(4, PriorityNormal))
+	test.Equal(q.Len(), 4)
+	test.Equal(reqIds(q.PopBatch(1000)), []uint32{3, 2, 4, 1})
+	test.Nil(q.Pop())
+	test.Equal(q.Len(), 0)
+
+	// the lowest one is served once starved
+	q = NewPriorityQueue(2)
+	q.Push(newPacket(1, PriorityLow), newPacket(2, PriorityLow))
+	for i := uint32(0); i < 5; i++ {
+		q.Push(newPacket(10+i, PriorityHigh))
+	}
+	test.Equal(reqIds(q.PopBatch(1000)), []uint32{10, 11, 1, 12, 13, 2, 14})
+}
+
+// a backlog of the low priority packets delays a high priority one by at
+// most the quantum written before it
+func TestPriorityQueueBound(t *testing.T) {
+	defer test.New(t)
+
+	const quantum = 16 << 10
+	q := NewPriorityQueue(8)
+	for i := 0; i < 1000; i++ {
+		p := New(make([]byte, 1400), DATA)
+		p.SetPriority(PriorityLow)
+		q.Push(p)
+	}
+	test.Equal(len(q.PopBatch(quantum)), quantum/(1400+8))
+
+	high := New([]byte("ls\n"), DATA)
+	high.SetPriority(PriorityHigh)
+	q.Push(high)
+	written := 0
+	for {
+		batch := q.PopBatch(quantum)
+		test.True(len(batch) > 0)
+		for _, p := range batch {
+			if p == high {
+				test.True(written <= quantum)
+				return
+			}
+			written += p.TotalSize()
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package packet
+
+import "sync"
+
+const DefaultReplayWindow = 1024
+
+// ReplayWindow is a sliding window of the received sequence numbers, to
+// drop the replayed packets. the sender must use a new sequence number for
+// each retransmission, so they are never taken as replays.
+type ReplayWindow struct {
+	size   uint64
+	top    uint64
+	bitmap []uint64
+	m      sync.Mutex
+
+	duplicated uint64
+	tooOld     uint64
+}
+
+func NewReplayWindow(size int) *ReplayWindow {
+	w := &ReplayWindow{}
+	w.Reset(size)
+	return w
+}
+
+// Reset clear the window and change its size, the counters are kept
+func (w *ReplayWindow) Reset(size int) {
+	if size <= 0 {
+		size = DefaultReplayWindow
+	}
+	w.m.Lock()
+	w.size = uint64(size)
+	w.top = 0
+	w.bitmap = make([]uint64, (size+63)/64)
+	w.m.Unlock()
+}
+
+// Clear forget the seen seqs, the size and the counters are kept. it's
+// used if the sender is restarted and counts from 1 again.
+func (w *ReplayWindow) Clear() {
+	w.m.Lock()
+	w.top = 0
+	for idx := range w.bitmap {
+		w.bitmap[idx] = 0
+	}
+	w.m.Unlock()
+}
+
+func (w *ReplayWindow) bit(seq uint64) (int, uint64) {
+	idx := seq % w.size
+	return int(idx / 64), 1 << (idx % 64)
+}
+
+// Check returns false if the seq is seen or too old, otherwise the seq is
+// marked as seen.
+func (w *ReplayWindow) Check(seq uint64) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if seq > w.top {
+		if seq-w.top >= w.size {
+			for idx := range w.bitmap {
+				w.bitmap[idx] = 0
+			}
+		} else {
+			for s := w.top + 1; s < seq; s++ {
+				idx, mask := w.bit(s)
+				w.bitmap[idx] &^= mask
+			}
+		}
+		w.top = seq
+		idx, mask := w.bit(seq)
+		w.bitmap[idx] |= mask
+		return true
+	}
+
+	if w.top-seq >= w.size {
+		w.tooOld++
+		return false
+	}
+	idx, mask := w.bit(seq)
+	if w.bitmap[idx]&mask != 0 {
+		w.duplicated++
+		return false
+	}
+	w.bitmap[idx] |= mask
+	return true
+}
+
+// Rejected returns how many seqs are rejected by Check, because they are
+// seen already or too far behind the window.
+func (w *ReplayWindow) Rejected() (duplicated, tooOld uint64) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.duplicated, w.tooOld
+}
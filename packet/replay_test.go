@@ -0,0 +1,59 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/chzyer/test"
+)
+
+func TestReplayWindow(t *testing.T) {
+	defer test.New(t)
+
+	w := NewReplayWindow(64)
+	test.True(w.Check(1))
+	test.False(w.Check(1))
+	test.True(w.Check(3))
+	test.True(w.Check(2))
+	test.False(w.Check(2))
+
+	test.True(w.Check(100))
+	// too old
+	test.False(w.Check(30))
+	test.True(w.Check(40))
+	test.False(w.Check(40))
+
+	// jump over the whole window
+	test.True(w.Check(1000))
+	test.False(w.Check(100))
+	test.True(w.Check(999))
+
+	duplicated, tooOld := w.Rejected()
+	test.Equal(duplicated, uint64(3))
+	test.Equal(tooOld, uint64(2))
+
+	// the restarted sender counts from 1 again
+	w.Clear()
+	test.True(w.Check(1))
+	test.False(w.Check(1))
+	duplicated, _ = w.Rejected()
+	test.Equal(duplicated, uint64(4))
+}
+
+func TestPacketSeq(t *testing.T) {
+	defer test.New(t)
+
+	p := New([]byte("hello"), NEWDC)
+	p.ReqId = 3
+	p.Seq = 1 << 40
+	data := make([]byte, p.TotalSize())
+	test.Equal(p.Marshal(data), 21)
+
+	got, err := Unmarshal(data)
+	test.Nil(err)
+	test.Equal(got, p)
+
+	// unknown flags
+	data[4] = 0x80
+	_, err = Unmarshal(data)
+	test.NotNil(err)
+}
@@ -0,0 +1,86 @@
+package packet
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/chzyer/logex"
+)
+
+var (
+	ErrNotSealed = logex.Define("packet is not sealed")
+	ErrOpen      = logex.Define("open payload failed: %v")
+)
+
+// SealOverhead returns the extra bytes added to the payload by Seal
+func SealOverhead(aead cipher.AEAD) int {
+	return aead.NonceSize() + aead.Overhead()
+}
+
+// additional authenticate the header fields which are not encrypted, the
+// version and the extended flags are only included since Version2 and the
+// timeout only if it's set, as they are on the wire. FlagSeal is left out,
+// it's set by Seal itself.
+func (p *Packet) additional() []byte {
+	var ad [20]byte
+	binary.BigEndian.PutUint32(ad[:4], p.ReqId)
+	binary.BigEndian.PutUint16(ad[4:6], uint16(p.flags()&^FlagSeal)<<8|uint16(p.Type))
+	if p.Version >= Version2 {
+		ad[6], ad[7] = byte(p.Version), byte(p.extFlags())
+	}
+	binary.BigEndian.PutUint64(ad[8:16], p.Seq)
+	if ms := p.timeoutMillis(); ms != 0 {
+		binary.BigEndian.PutUint32(ad[16:], ms)
+		return ad[:]
+	}
+	return ad[:16]
+}
+
+// Seal returns a copy of the packet with the payload encrypted by aead,
+// a random IV is used as the nonce and prefixed to the payload. the whole
+// header except the checksum and the length is authenticated, so it must
+// not be changed after sealed.
+func (p *Packet) Seal(aead cipher.AEAD) (*Packet, error) {
+	iv := make([]byte, aead.NonceSize(), aead.NonceSize()+len(p.payload)+aead.Overhead())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, logex.Trace(err)
+	}
+	payload := aead.Seal(iv, iv, p.payload, p.additional())
+	if len(payload) > MaxPayloadLength {
+		return nil, ErrPayloadTooLarge.Format(len(payload), MaxPayloadLength)
+	}
+	sealed := *p
+	sealed.payload = payload
+	sealed.buf = nil
+	sealed.size = len(payload)
+	sealed.sealed = true
+	return &sealed, nil
+}
+
+// Open returns a copy of the packet with the payload decrypted by aead,
+// an error is returned if the packet is not sealed or is tampered.
+func (p *Packet) Open(aead cipher.AEAD) (*Packet, error) {
+	if !p.sealed {
+		return nil, ErrNotSealed.Trace()
+	}
+	if len(p.payload) < aead.NonceSize() {
+		return nil, ErrPacketTooShort.Format(len(p.payload))
+	}
+	iv, data := p.payload[:aead.NonceSize()], p.payload[aead.NonceSize():]
+	payload, err := aead.Open(nil, iv, data, p.additional())
+	if err != nil {
+		return nil, ErrOpen.Format(err)
+	}
+	opened := *p
+	opened.payload = payload
+	opened.buf = nil
+	opened.size = len(payload)
+	opened.sealed = false
+	return &opened, nil
+}
+
+// IsSealed returns whether the payload need to be opened
+func (p *Packet) IsSealed() bool {
+	return p.sealed
+}
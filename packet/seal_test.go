@@ -0,0 +1,111 @@
+package packet
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"testing"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/next/crypto"
+	"github.com/chzyer/test"
+)
+
+func newTestAEAD(key byte) cipher.AEAD {
+	k := make([]byte, 32)
+	k[0] = key
+	aead, err := crypto.NewAEAD(k)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func TestPacketSeal(t *testing.T) {
+	defer test.New(t)
+
+	aead := newTestAEAD(1)
+	payload := []byte("route update")
+	p := New(payload, NEWDC)
+	p.ReqId = 3
+	p.Seq = 10
+
+	sealed, err := p.Seal(aead)
+	test.Nil(err)
+	test.True(sealed.IsSealed())
+	test.False(p.IsSealed())
+	test.Equal(p.Payload(), payload)
+	test.Equal(sealed.Size(), len(payload)+SealOverhead(aead))
+
+	got, err := Unmarshal(marshalPacket(sealed))
+	test.Nil(err)
+	test.True(got.IsSealed())
+	opened, err := got.Open(aead)
+	test.Nil(err)
+	test.False(opened.IsSealed())
+	test.Equal(opened.Payload(), payload)
+	test.Equal(opened.ReqId, uint32(3))
+	test.Equal(opened.Seq, uint64(10))
+
+	_, err = p.Open(aead)
+	test.True(logex.Equal(err, ErrNotSealed))
+}
+
+func TestPacketSealTamper(t *testing.T) {
+	defer test.New(t)
+
+	aead := newTestAEAD(1)
+	p := New([]byte("route update"), NEWDC)
+	p.ReqId = 3
+	p.Seq = 10
+	sealed, err := p.Seal(aead)
+	test.Nil(err)
+
+	// payload
+	data := marshalPacket(sealed)
+	data[len(data)-1] ^= 1
+	got, err := Unmarshal(data)
+	test.Nil(err)
+	_, err = got.Open(aead)
+	test.True(logex.Equal(err, ErrOpen))
+
+	// header
+	data = marshalPacket(sealed)
+	data[3] ^= 1
+	got, err = Unmarshal(data)
+	test.Nil(err)
+	_, err = got.Open(aead)
+	test.True(logex.Equal(err, ErrOpen))
+
+	// flags, a success reply turned into an error
+	resp := p.Reply([]byte("ok"))
+	resp.Seq = 11
+	sealed, err = resp.Seal(aead)
+	test.Nil(err)
+	data = marshalPacket(sealed)
+	data[4] ^= byte(FlagError)
+	got, err = Unmarshal(data)
+	test.Nil(err)
+	test.True(got.IsError())
+	_, err = got.Open(aead)
+	test.True(logex.Equal(err, ErrOpen))
+
+	// extended flags, the checksum is recomputed by the attacker
+	resp.Version = Version2
+	sealed, err = resp.Seal(aead)
+	test.Nil(err)
+	data = marshalPacket(sealed)
+	data[9] ^= byte(ExtChecksum)
+	data = append(data[:18], append(make([]byte, 4), data[18:]...)...)
+	binary.BigEndian.PutUint32(data[18:22], checksum(data[:18], data[22:]))
+	got, err = Unmarshal(data)
+	test.Nil(err)
+	test.True(got.Checksum)
+	_, err = got.Open(aead)
+	test.True(logex.Equal(err, ErrOpen))
+
+	// key
+	got, err = Unmarshal(marshalPacket(sealed))
+	test.Nil(err)
+	_, err = got.Open(newTestAEAD(2))
+	test.True(logex.Equal(err, ErrOpen))
+}
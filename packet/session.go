@@ -1,51 +1,259 @@
 package packet
 
 import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	"sync"
+	"sync/atomic"
+
 	"github.com/chzyer/logex"
 	"github.com/chzyer/next/crypto"
 )
 
 var (
 	ErrUserNotMatch = logex.Define("user %v is not matched")
+	ErrAuthFailed   = logex.Define("packet authentication failed: %v")
+	// ErrNonceExhausted is returned by Seal once the counter of the nonce
+	// reaches its max, the connections have to login again.
+	ErrNonceExhausted = logex.Define("the nonces of the l2 session are exhausted")
+)
+
+// the versions of the L2 encryption, negotiated by the login request, see
+// uc.AuthRequest.
+const (
+	// L2VersionCFB is aes-cfb with a crc32 checksum, it's not authenticated
+	L2VersionCFB = 0
+	// L2VersionAEAD is aes-gcm with a key per direction, the header is
+	// authenticated.
+	L2VersionAEAD = 1
+	// L2Version is the highest version supported
+	L2Version = L2VersionAEAD
+)
+
+// the last 4 bytes of the IV tell the payload is sealed by the AEAD, the
+// first 12 bytes are the nonce. a CFB packet whose random IV happens to end
+// with it just fails to open and falls back to CFB.
+var l2AEADMagic = []byte("NXT1")
+
+const (
+	l2LabelCli = "next l2 client to server"
+	l2LabelSvr = "next l2 server to client"
 )
 
 type AuthDelegate interface {
-	GetUserToken(userId int) ([]byte, error)
+	// GetUserLogin returns the last login of the user
+	GetUserLogin(userId int) (*Login, error)
+}
+
+// LoginNonceSize is the size of the nonces exchanged by the login, see
+// uc.AuthRequest.
+const LoginNonceSize = 16
+
+// NewLoginNonce returns a random nonce for the login
+func NewLoginNonce() []byte {
+	nonce := make([]byte, LoginNonceSize)
+	rand.Read(nonce)
+	return nonce
+}
+
+// Login is shared by the sessions of a login. the AEAD keys are derived from
+// the token and the nonces of both sides, so every login gets its own keys.
+type Login struct {
+	token  []byte
+	secret []byte
+
+	m   sync.Mutex
+	cli cipher.AEAD
+	svr cipher.AEAD
+
+	// conns is the salt of the last session sending by the login, every
+	// connection counts its nonces from 1 with its own salt.
+	conns uint32
+	// recv is the largest counter opened for each salt of the peer, the
+	// packets replayed through another connection are rejected too.
+	recv sync.Map
+}
+
+// NewLogin returns the login of the token, the nonces are the ones of the
+// client and the server. the AEAD is unavailable without the nonces.
+func NewLogin(token, cliNonce, svrNonce []byte) *Login {
+	l := &Login{token: token}
+	if len(cliNonce) > 0 && len(svrNonce) > 0 {
+		l.secret = make([]byte, 0, len(token)+len(cliNonce)+len(svrNonce))
+		l.secret = append(l.secret, token...)
+		l.secret = append(l.secret, cliNonce...)
+		l.secret = append(l.secret, svrNonce...)
+	}
+	return l
+}
+
+// HasNonce tells whether the nonces are exchanged by the login
+func (l *Login) HasNonce() bool {
+	return l.secret != nil
+}
+
+// newNonce returns the nonce of a new connection, it's exhausted once the
+// salts run out.
+func (l *Login) newNonce() *l2Nonce {
+	n := &l2Nonce{}
+	salt := atomic.AddUint32(&l.conns, 1)
+	if salt == 0 {
+		atomic.StoreUint32(&l.conns, math.MaxUint32)
+		n.counter = math.MaxUint64
+	}
+	binary.BigEndian.PutUint32(n.salt[:], salt)
+	return n
+}
+
+// advanceRecvNonce returns false if the counter is not larger than the
+// ones opened with the same salt, e.g. the packet is replayed.
+func (l *Login) advanceRecvNonce(iv []byte) bool {
+	salt := binary.BigEndian.Uint32(iv[:4])
+	last, ok := l.recv.Load(salt)
+	if !ok {
+		last, _ = l.recv.LoadOrStore(salt, new(uint64))
+	}
+	counter := nonceCounter(iv)
+	for {
+		c := atomic.LoadUint64(last.(*uint64))
+		if counter <= c {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(last.(*uint64), c, counter) {
+			return true
+		}
+	}
+}
+
+// ciphers returns the AEADs of both directions
+func (l *Login) ciphers() (cli, svr cipher.AEAD) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.cli == nil {
+		if l.secret == nil {
+			panic("the nonces of the login are not exchanged")
+		}
+		l.cli = newL2AEAD(l.secret, l2LabelCli)
+		l.svr = newL2AEAD(l.secret, l2LabelSvr)
+	}
+	return l.cli, l.svr
 }
 
 type Session struct {
 	delegate AuthDelegate
 
 	userId int
-	token  []byte
+	login  *Login
+
+	// version is the L2 version to send, the server follows the client once
+	// an AEAD packet is received.
+	version  int32
+	isServer bool
+	// peerAEAD is set once an AEAD packet is verified, CFB packets are
+	// rejected afterwards.
+	peerAEAD int32
+	failures uint64
+
+	// nonce is per connection, the clones get their own salts
+	nonce *l2Nonce
+}
+
+// l2Nonce is salt(4) + counter(8), the counter never wraps around
+type l2Nonce struct {
+	salt    [4]byte
+	counter uint64
+}
+
+// Next returns ErrNonceExhausted once the counter reaches its max
+func (n *l2Nonce) Next(iv []byte) error {
+	for {
+		c := atomic.LoadUint64(&n.counter)
+		if c == math.MaxUint64 {
+			return ErrNonceExhausted.Trace()
+		}
+		if atomic.CompareAndSwapUint64(&n.counter, c, c+1) {
+			copy(iv[:4], n.salt[:])
+			binary.BigEndian.PutUint64(iv[4:12], c+1)
+			return nil
+		}
+	}
+}
+
+// nonceCounter returns the counter of the nonce in the iv
+func nonceCounter(iv []byte) uint64 {
+	return binary.BigEndian.Uint64(iv[4:12])
 }
 
 func NewSessionSvr(delegate AuthDelegate) *Session {
 	return &Session{
 		delegate: delegate,
 		userId:   -1,
+		isServer: true,
 	}
 }
 
 func NewSessionCli(userId int, token []byte) *Session {
+	login := NewLogin(token, nil, nil)
 	return &Session{
 		userId: userId,
-		token:  token,
+		login:  login,
+		nonce:  login.newNonce(),
 	}
 }
 
+// SetLoginNonce set the nonces exchanged by the login, see NewLogin. it must
+// be called before the session is cloned.
+func (s *Session) SetLoginNonce(cliNonce, svrNonce []byte) {
+	s.login = NewLogin(s.login.token, cliNonce, svrNonce)
+	s.nonce = s.login.newNonce()
+}
+
 func (s *Session) Clone() *Session {
-	return &Session{
+	c := &Session{
 		delegate: s.delegate,
 		userId:   s.userId,
-		token:    s.token,
+		login:    s.login,
+		version:  atomic.LoadInt32(&s.version),
+		isServer: s.isServer,
+	}
+	if c.login != nil {
+		c.nonce = c.login.newNonce()
 	}
+	return c
+}
+
+// SetVersion set the L2 version to send, it's the version replied by the
+// login of the server, see uc.AuthResponse. the CFB is kept if the nonces
+// are not exchanged by the login.
+func (s *Session) SetVersion(version int) {
+	if version > L2Version {
+		version = L2Version
+	}
+	if !s.login.HasNonce() {
+		version = L2VersionCFB
+	}
+	atomic.StoreInt32(&s.version, int32(version))
+}
+
+func (s *Session) Version() int {
+	return int(atomic.LoadInt32(&s.version))
+}
+
+// AuthFailures returns how many packets are rejected by the AEAD
+func (s *Session) AuthFailures() uint64 {
+	return atomic.LoadUint64(&s.failures)
 }
 
 func (s *Session) Verify(userId int, crc32 uint32, iv, payload []byte) error {
 	if err := s.VerifyUserId(userId); err != nil {
 		return err
 	}
+	if s.isPeerAEAD() {
+		return s.authFailed("downgrade to cfb")
+	}
 	s.Decode(iv, payload, payload)
 	if crypto.Crc32(payload) != crc32 {
 		return ErrInvalidToken.Trace("checksum not match")
@@ -53,6 +261,88 @@ func (s *Session) Verify(userId int, crc32 uint32, iv, payload []byte) error {
 	return nil
 }
 
+// isSealed tells whether the L2 packet is sent by the AEAD
+func isSealed(iv []byte) bool {
+	return len(iv) == 16 && bytes.Equal(iv[12:], l2AEADMagic)
+}
+
+// l2Header is the associated data of the AEAD, the length of the header is
+// implied by the payload.
+func l2Header(iv []byte, userId uint16, checksum uint32) []byte {
+	ad := make([]byte, len(iv)+6)
+	copy(ad, iv)
+	binary.BigEndian.PutUint16(ad[len(iv):], userId)
+	binary.BigEndian.PutUint32(ad[len(iv)+2:], checksum)
+	return ad
+}
+
+// Seal fill the iv and encrypt the payload by the AEAD of the sending
+// direction, the returned payload reuses the space of payload. the nonce
+// is never reused, ErrNonceExhausted is returned instead.
+func (s *Session) Seal(iv []byte, userId uint16, payload []byte) ([]byte, error) {
+	aead, _ := s.ciphers()
+	if err := s.nonce.Next(iv); err != nil {
+		return nil, err
+	}
+	copy(iv[12:], l2AEADMagic)
+	return aead.Seal(payload[:0], iv[:12], payload, l2Header(iv, userId, 0)), nil
+}
+
+// Open verify and decrypt the payload sealed by the peer, it returns
+// ErrAuthFailed if the packet is tampered.
+func (s *Session) Open(userId int, checksum uint32, iv, payload []byte) ([]byte, error) {
+	if err := s.VerifyUserId(userId); err != nil {
+		return nil, err
+	}
+	if !s.login.HasNonce() {
+		return nil, s.authFailed("the login nonces are not exchanged")
+	}
+	_, aead := s.ciphers()
+	// payload is kept if failed, in case it's a CFB packet
+	ret, err := aead.Open(nil, iv[:12], payload, l2Header(iv, uint16(userId), checksum))
+	if err != nil {
+		return nil, s.authFailed(err)
+	}
+	if !s.login.advanceRecvNonce(iv) {
+		return nil, s.authFailed("nonce is not increasing")
+	}
+	atomic.StoreInt32(&s.peerAEAD, 1)
+	if s.isServer {
+		atomic.StoreInt32(&s.version, L2VersionAEAD)
+	}
+	return ret, nil
+}
+
+func (s *Session) isPeerAEAD() bool {
+	return atomic.LoadInt32(&s.peerAEAD) == 1
+}
+
+func (s *Session) authFailed(reason interface{}) error {
+	atomic.AddUint64(&s.failures, 1)
+	return ErrAuthFailed.Format(reason)
+}
+
+// ciphers returns the AEADs for sending and receiving, the login is known
+// after VerifyUserId on the server.
+func (s *Session) ciphers() (seal, open cipher.AEAD) {
+	if s.login == nil {
+		panic("session is not inited, login is nil")
+	}
+	seal, open = s.login.ciphers()
+	if s.isServer {
+		seal, open = open, seal
+	}
+	return seal, open
+}
+
+func newL2AEAD(secret []byte, label string) cipher.AEAD {
+	aead, err := crypto.NewAEAD(crypto.DeriveKey(secret, label))
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
 func (s *Session) UserId() int {
 	if s.userId < 0 {
 		panic("session is not inited")
@@ -69,22 +359,23 @@ func (s *Session) VerifyUserId(userId int) error {
 		return nil
 	}
 
-	token, err := s.delegate.GetUserToken(userId)
+	login, err := s.delegate.GetUserLogin(userId)
 	if err != nil {
 		return err
 	}
 	s.userId = userId
-	s.token = token
+	s.login = login
+	s.nonce = login.newNonce()
 	return nil
 }
 
 func (s *Session) Encode(iv, dst, src []byte) {
-	if s.token == nil {
-		panic("session is not inited, token is nil")
+	if s.login == nil {
+		panic("session is not inited, login is nil")
 	}
-	crypto.EncodeAes(dst, src, s.token, iv)
+	crypto.EncodeAes(dst, src, s.login.token, iv)
 }
 
 func (s *Session) Decode(iv []byte, dst, src []byte) {
-	crypto.DecodeAes(dst, src, s.token, iv)
+	crypto.DecodeAes(dst, src, s.login.token, iv)
 }
@@ -0,0 +1,222 @@
+package packet
+
+import (
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/test"
+)
+
+var (
+	testCliNonce = NewLoginNonce()
+	testSvrNonce = NewLoginNonce()
+)
+
+type testAuthDelegate []byte
+
+func (d testAuthDelegate) GetUserLogin(userId int) (*Login, error) {
+	return NewLogin(d, testCliNonce, testSvrNonce), nil
+}
+
+// newTestSessionCli returns the client of the login of testAuthDelegate
+func newTestSessionCli(userId int, token []byte) *Session {
+	s := NewSessionCli(userId, token)
+	s.SetLoginNonce(testCliNonce, testSvrNonce)
+	return s
+}
+
+// transfer the L2 packet as the dchans do
+func transferL2(from, to *Session, p *Packet) ([]*Packet, error) {
+	l2 := WrapL2(from, []*Packet{p})
+	l2 = NewPacketL2(l2.IV, l2.UserId, l2.Payload, l2.Checksum)
+	if err := l2.Verify(to); err != nil {
+		return nil, err
+	}
+	return l2.Unmarshal()
+}
+
+func TestSessionL2Version(t *testing.T) {
+	defer test.New(t)
+
+	token := test.RandBytes(32)
+	cli := newTestSessionCli(1, token)
+	svr := NewSessionSvr(testAuthDelegate(token))
+	p := New([]byte("hello"), DATA)
+
+	// both are CFB before negotiated
+	ps, err := transferL2(cli, svr, p)
+	test.Nil(err)
+	test.Equal(ps[0].Payload(), p.Payload())
+	_, err = transferL2(svr, cli, p)
+	test.Nil(err)
+	test.Equal(svr.Version(), L2VersionCFB)
+
+	// the server follows the client
+	cli.SetVersion(L2VersionAEAD)
+	l2 := WrapL2(cli, []*Packet{p})
+	test.True(isSealed(l2.IV))
+	test.Nil(l2.Verify(svr))
+	test.Equal(svr.Version(), L2VersionAEAD)
+	ps, err = transferL2(svr, cli, p)
+	test.Nil(err)
+	test.Equal(ps[0].Payload(), p.Payload())
+
+	// the clones never reuse the nonce
+	clone := cli.Clone()
+	test.NotEqual(WrapL2(clone, []*Packet{p}).IV, WrapL2(cli, []*Packet{p}).IV)
+}
+
+func TestSessionL2Tampered(t *testing.T) {
+	defer test.New(t)
+
+	token := test.RandBytes(32)
+	cli := newTestSessionCli(1, token)
+	cli.SetVersion(L2VersionAEAD)
+	svr := NewSessionSvr(testAuthDelegate(token))
+	p := New([]byte("hello"), DATA)
+
+	l2 := WrapL2(cli, []*Packet{p})
+	l2.Payload[0] ^= 1
+	test.True(logex.Equal(l2.Verify(svr), ErrAuthFailed))
+
+	l2 = WrapL2(cli, []*Packet{p})
+	l2.UserId = 2
+	svr2 := NewSessionSvr(testAuthDelegate(token))
+	test.True(logex.Equal(l2.Verify(svr2), ErrAuthFailed))
+
+	// the keys are per direction, a reflected packet is rejected
+	l2 = WrapL2(cli, []*Packet{p})
+	test.True(logex.Equal(l2.Verify(cli), ErrAuthFailed))
+
+	// the failures are not fatal
+	_, err := transferL2(cli, svr, p)
+	test.Nil(err)
+	test.Equal(svr.AuthFailures(), uint64(1))
+
+	// never downgrade once the AEAD is used
+	cfb := newTestSessionCli(1, token)
+	_, err = transferL2(cfb, svr, p)
+	test.True(logex.Equal(err, ErrAuthFailed))
+	test.Equal(svr.AuthFailures(), uint64(2))
+}
+
+// every login gets its own keys, the packets of the last login are rejected
+func TestSessionLoginNonce(t *testing.T) {
+	defer test.New(t)
+
+	token := test.RandBytes(32)
+	cli := newTestSessionCli(1, token)
+	cli.SetVersion(L2VersionAEAD)
+	p := New([]byte("hello"), DATA)
+	l2 := WrapL2(cli, []*Packet{p})
+
+	relogin := NewSessionCli(1, token)
+	relogin.SetLoginNonce(NewLoginNonce(), testSvrNonce)
+	relogin.SetVersion(L2VersionAEAD)
+	_, err := transferL2(relogin, NewSessionSvr(testAuthDelegate(token)), p)
+	test.True(logex.Equal(err, ErrAuthFailed))
+
+	svr := NewSessionSvr(testAuthDelegate(token))
+	test.Nil(l2.Verify(svr))
+
+	// the AEAD is unavailable without the nonces
+	legacy := NewSessionCli(1, token)
+	legacy.SetVersion(L2VersionAEAD)
+	test.Equal(legacy.Version(), L2VersionCFB)
+	l2 = WrapL2(cli, []*Packet{p})
+	test.True(logex.Equal(l2.Verify(NewSessionSvr(loginDelegate{NewLogin(token, nil, nil)})), ErrAuthFailed))
+}
+
+// loginDelegate shares the login through the server sessions
+type loginDelegate struct {
+	*Login
+}
+
+func (d loginDelegate) GetUserLogin(userId int) (*Login, error) {
+	return d.Login, nil
+}
+
+func TestSessionNonce(t *testing.T) {
+	defer test.New(t)
+
+	token := test.RandBytes(32)
+	cli := newTestSessionCli(1, token)
+	cli.SetVersion(L2VersionAEAD)
+	svr := NewSessionSvr(testAuthDelegate(token))
+	p := New([]byte("hello"), DATA)
+
+	// the replayed and the reordered ones are rejected
+	l2s := make([]*PacketL2, 2)
+	for idx := range l2s {
+		l2 := WrapL2(cli, []*Packet{p})
+		l2s[idx] = NewPacketL2(l2.IV, l2.UserId, append([]byte(nil), l2.Payload...), l2.Checksum)
+	}
+	replayed := NewPacketL2(l2s[1].IV, l2s[1].UserId, append([]byte(nil), l2s[1].Payload...), 0)
+	test.Nil(l2s[1].Verify(svr))
+	test.True(logex.Equal(l2s[0].Verify(svr), ErrAuthFailed))
+	test.True(logex.Equal(replayed.Verify(svr), ErrAuthFailed))
+	test.Equal(svr.AuthFailures(), uint64(2))
+
+	// so do the ones replayed through another connection of the login
+	login := NewLogin(token, testCliNonce, testSvrNonce)
+	l2 := WrapL2(cli, []*Packet{p})
+	replayed = NewPacketL2(l2.IV, l2.UserId, append([]byte(nil), l2.Payload...), 0)
+	test.Nil(l2.Verify(NewSessionSvr(loginDelegate{login})))
+	test.True(logex.Equal(replayed.Verify(NewSessionSvr(loginDelegate{login})), ErrAuthFailed))
+
+	// never wraps around
+	cli.nonce = &l2Nonce{counter: math.MaxUint64 - 1}
+	_, err := WrapL2E(cli, []*Packet{p})
+	test.Nil(err)
+	for i := 0; i < 2; i++ {
+		_, err = WrapL2E(cli, []*Packet{p})
+		test.True(logex.Equal(err, ErrNonceExhausted))
+	}
+}
+
+// the connections of a login count from 1 with their own salts, the clones
+// included, so they never share a nonce under the keys of the login.
+func TestSessionNonceUnique(t *testing.T) {
+	defer test.New(t)
+
+	const total = 1000000
+	token := test.RandBytes(32)
+	cli := newTestSessionCli(1, token)
+	d := loginDelegate{NewLogin(token, testCliNonce, testSvrNonce)}
+	sessions := []*Session{cli, cli.Clone(), cli.Clone(), NewSessionSvr(d), NewSessionSvr(d)}
+	for _, s := range sessions[3:] {
+		test.Nil(s.VerifyUserId(1))
+	}
+	nonces := make([][][12]byte, len(sessions))
+	var wg sync.WaitGroup
+	for idx, s := range sessions {
+		wg.Add(1)
+		go func(idx int, s *Session) {
+			defer wg.Done()
+			iv := make([]byte, l2IVSize)
+			ret := make([][12]byte, total/len(sessions))
+			for i := range ret {
+				_, err := s.Seal(iv, 1, nil)
+				test.Nil(err)
+				copy(ret[i][:], iv)
+			}
+			nonces[idx] = ret
+		}(idx, s)
+	}
+	wg.Wait()
+
+	seen := make(map[[12]byte]bool, total)
+	for idx, ret := range nonces {
+		test.Equal(nonceCounter(ret[0][:]), uint64(1))
+		// the directions use their own keys
+		if idx == 3 {
+			seen = make(map[[12]byte]bool, total)
+		}
+		for _, nonce := range ret {
+			test.False(seen[nonce])
+			seen[nonce] = true
+		}
+	}
+}
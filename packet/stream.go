@@ -0,0 +1,37 @@
+package packet
+
+import "encoding/binary"
+
+// StreamIndexSize is the size of the chunk index prefixed to the payload
+const StreamIndexSize = 4
+
+// ReplyStream returns the idx-th chunk of the streaming response, the
+// chunks share the ReqId of the request and the last one has more unset.
+func (p *Packet) ReplyStream(idx uint32, data []byte, more bool) *Packet {
+	payload := make([]byte, StreamIndexSize+len(data))
+	binary.BigEndian.PutUint32(payload, idx)
+	copy(payload[StreamIndexSize:], data)
+	resp := p.Reply(payload)
+	resp.stream = true
+	resp.more = more
+	return resp
+}
+
+// IsStream returns whether the packet is a chunk of a streaming response
+func (p *Packet) IsStream() bool {
+	return p.stream
+}
+
+// HasMore returns whether more chunks follow this one
+func (p *Packet) HasMore() bool {
+	return p.more
+}
+
+// StreamChunk returns the index and the data of the chunk, ok is false if
+// it's not a valid chunk.
+func (p *Packet) StreamChunk() (idx uint32, data []byte, ok bool) {
+	if !p.stream || len(p.payload) < StreamIndexSize {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint32(p.payload), p.payload[StreamIndexSize:], true
+}
@@ -1,6 +1,12 @@
 package packet
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chzyer/logex"
+)
 
 type Type int
 
@@ -27,17 +33,138 @@ const (
 	SPEED_REQ   // 11: payload: byte size(uint64)
 	SPEED_REQ_R // 12:
 
+	FRAGMENT   // 13: payload: fragment header + part of payload
+	FRAGMENT_R // 14: unused
+
+	// probe the liveness, the latency and the path MTU
+	PING // 15: payload: sent(int64) + padding length(uint16) + padding
+	PONG // 16: payload: the same as PING
+
+	// keep the NAT mappings of an idle channel, see NewKeepaliveL2
+	KEEPALIVE   // 17: payload: nil
+	KEEPALIVE_R // 18: unused
+
 	InvalidType
 )
 
+var (
+	ErrTypeBuiltin    = logex.Define("type %v is reserved for the built-in types")
+	ErrTypeRegistered = logex.Define("type %v is registered already as %q")
+	ErrTypeReqResp    = logex.Define("type %v can't be both request and response")
+)
+
+// typeInfo is the application-defined type registered by RegisterType
+type typeInfo struct {
+	name   string
+	isReq  bool
+	isResp bool
+	data   bool
+}
+
+var (
+	typeMutex sync.Mutex
+	// *[256]*typeInfo, it's copied on write so the readers never lock
+	typeRegistry atomic.Value
+)
+
+// RegisterType add an application-defined type, e.g. the control messages
+// of a plugin. it's expected to be called in init, before any packet of
+// the type is sent or received. like the built-ins, the response of a
+// request is the next id, so the pair is registered together:
+//
+//	packet.RegisterType(200, "Stats", true, false)
+//	packet.RegisterType(201, "StatsResp", false, true)
+//
+// the ids up to InvalidType are reserved for the built-in types. the type
+// is a control one, see RegisterDataType.
+func RegisterType(id byte, name string, isReq, isResp bool) error {
+	return registerType(id, &typeInfo{name: name, isReq: isReq, isResp: isResp})
+}
+
+// RegisterDataType is like RegisterType, but the type carries the data
+// plane traffic, see Type.IsData.
+func RegisterDataType(id byte, name string, isReq, isResp bool) error {
+	return registerType(id, &typeInfo{name: name, isReq: isReq, isResp: isResp, data: true})
+}
+
+func registerType(id byte, info *typeInfo) error {
+	t := Type(id)
+	if t <= InvalidType {
+		return ErrTypeBuiltin.Format(int(t))
+	}
+	if info.isReq && info.isResp {
+		return ErrTypeReqResp.Format(int(t))
+	}
+	typeMutex.Lock()
+	defer typeMutex.Unlock()
+	var reg [256]*typeInfo
+	if old, _ := typeRegistry.Load().(*[256]*typeInfo); old != nil {
+		reg = *old
+	}
+	if old := reg[id]; old != nil {
+		return ErrTypeRegistered.Format(int(t), old.name)
+	}
+	reg[id] = info
+	typeRegistry.Store(&reg)
+	return nil
+}
+
+// registered returns nil if t is not registered by RegisterType
+func (t Type) registered() *typeInfo {
+	if t <= InvalidType || t > 0xff {
+		return nil
+	}
+	reg, _ := typeRegistry.Load().(*[256]*typeInfo)
+	if reg == nil {
+		return nil
+	}
+	return reg[t]
+}
+
 func (t Type) IsReq() bool {
+	if t >= InvalidType {
+		info := t.registered()
+		return info != nil && info.isReq
+	}
 	return byte(t)%2 == 1
 }
 
 func (t Type) IsResp() bool {
+	if t >= InvalidType {
+		info := t.registered()
+		return info != nil && info.isResp
+	}
 	return byte(t)%2 == 0
 }
 
+// IsData returns whether the type carries the data plane traffic, i.e.
+// DATA, DATA_R and the types registered by RegisterDataType.
+func (t Type) IsData() bool {
+	switch t {
+	case DATA, DATA_R:
+		return true
+	}
+	info := t.registered()
+	return info != nil && info.data
+}
+
+// IsControl returns whether the type is a control plane message, e.g.
+// AUTH, HEARTBEAT, NEWDC, SPEED, PING and KEEPALIVE with their responses,
+// and the types registered by RegisterType. FRAGMENT is neither control
+// nor data, the category is known once it's reassembled, nor is the
+// invalid type.
+func (t Type) IsControl() bool {
+	switch t {
+	case DATA, DATA_R, FRAGMENT, FRAGMENT_R:
+		return false
+	}
+	if t >= InvalidType {
+		info := t.registered()
+		return info != nil && !info.data
+	}
+	return t != 0
+}
+
 func (t Type) String() string {
 	switch t {
 	case AUTH:
@@ -56,13 +183,30 @@ func (t Type) String() string {
 		return "NewDC"
 	case NEWDC_R:
 		return "NewDCResp"
-	default:
-		return fmt.Sprintf("<unknown type>:%v", int(t))
+	case FRAGMENT:
+		return "Fragment"
+	case FRAGMENT_R:
+		return "FragmentResp"
+	case PING:
+		return "Ping"
+	case PONG:
+		return "Pong"
+	case KEEPALIVE:
+		return "KeepAlive"
+	case KEEPALIVE_R:
+		return "KeepAliveResp"
 	}
+	if info := t.registered(); info != nil {
+		return info.name
+	}
+	return fmt.Sprintf("<unknown type>:%v", int(t))
 }
 
 func (t Type) IsInvalid() bool {
-	return t >= InvalidType || t == 0
+	if t >= InvalidType {
+		return t.registered() == nil
+	}
+	return t == 0
 }
 
 func (t *Type) Marshal(b []byte) error {
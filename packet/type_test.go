@@ -3,9 +3,35 @@ package packet
 import (
 	"testing"
 
+	"github.com/chzyer/logex"
 	"github.com/chzyer/test"
 )
 
+// the application-defined types of the tests, registered in init as the
+// plugins do.
+const (
+	testType   Type = 200
+	testType_R Type = 201
+
+	testDataType   Type = 204
+	testDataType_R Type = 205
+)
+
+func init() {
+	if err := RegisterType(byte(testType), "Test", true, false); err != nil {
+		panic(err)
+	}
+	if err := RegisterType(byte(testType_R), "TestResp", false, true); err != nil {
+		panic(err)
+	}
+	if err := RegisterDataType(byte(testDataType), "TestData", true, false); err != nil {
+		panic(err)
+	}
+	if err := RegisterDataType(byte(testDataType_R), "TestDataResp", false, true); err != nil {
+		panic(err)
+	}
+}
+
 func TestType(t *testing.T) {
 	defer test.New(t)
 
@@ -16,3 +42,59 @@ func TestType(t *testing.T) {
 	test.False(pt.IsInvalid())
 	test.Equal(pt.Bytes(), []byte{1})
 }
+
+func TestRegisterType(t *testing.T) {
+	defer test.New(t)
+
+	test.False(testType.IsInvalid())
+	test.True(testType.IsReq())
+	test.False(testType.IsResp())
+	test.True(testType_R.IsResp())
+	test.Equal(testType.String(), "Test")
+	test.True(Type(202).IsInvalid())
+	test.False(Type(202).IsReq() || Type(202).IsResp())
+	test.True(InvalidType.IsInvalid())
+
+	test.True(logex.Equal(RegisterType(byte(NEWDC), "NewDC2", true, false), ErrTypeBuiltin))
+	test.True(logex.Equal(RegisterType(byte(InvalidType), "Invalid", true, false), ErrTypeBuiltin))
+	test.True(logex.Equal(RegisterType(byte(testType), "Test2", true, false), ErrTypeRegistered))
+	test.True(logex.Equal(RegisterType(202, "Both", true, true), ErrTypeReqResp))
+	test.True(Type(202).IsInvalid())
+
+	req := New([]byte("hello"), testType)
+	req.ReqId = 7
+	got, err := Unmarshal(marshalPacket(req))
+	test.Nil(err)
+	test.Equal(got, req)
+	resp := got.Reply([]byte("world"))
+	test.Equal(resp.Type, testType_R)
+	test.Equal(resp.ReqId, uint32(7))
+
+	b := marshalPacket(New(nil, DATA))
+	b[5] = 202
+	_, err = Unmarshal(b)
+	test.True(logex.Equal(err, ErrInvalidType))
+}
+
+func TestTypeCategory(t *testing.T) {
+	defer test.New(t)
+
+	for _, typ := range []Type{AUTH, AUTH_R, HEARTBEAT, HEARTBEAT_R, NEWDC, NEWDC_R,
+		SPEED, SPEED_R, SPEED_REQ, SPEED_REQ_R, PING, PONG, KEEPALIVE, KEEPALIVE_R,
+		testType, testType_R} {
+		test.True(typ.IsControl())
+		test.False(typ.IsData())
+	}
+	for _, typ := range []Type{DATA, DATA_R, testDataType, testDataType_R} {
+		test.False(typ.IsControl())
+		test.True(typ.IsData())
+	}
+	for _, typ := range []Type{0, FRAGMENT, FRAGMENT_R, InvalidType, 202} {
+		test.False(typ.IsControl())
+		test.False(typ.IsData())
+	}
+	test.True(testDataType.IsReq())
+	test.Equal(testDataType_R.String(), "TestDataResp")
+	test.True(logex.Equal(RegisterDataType(byte(DATA), "Data2", true, false), ErrTypeBuiltin))
+	test.True(logex.Equal(RegisterDataType(byte(testType), "Test2", true, false), ErrTypeRegistered))
+}
@@ -0,0 +1,55 @@
+package packet
+
+import "github.com/chzyer/logex"
+
+// the versions of the packet layout, negotiated by the login request, see
+// uc.AuthRequest.
+const (
+	// VersionLegacy is the layout without the version field
+	VersionLegacy = 1
+	// Version2 set FlagVersion and carry Version(1) + ExtFlag(1) after the
+	// fixed header, so the flags can grow beyond one byte.
+	Version2 = 2
+	// MaxVersion is the highest version supported
+	MaxVersion = Version2
+)
+
+var ErrPeerTooNew = logex.Define("packet version %v is not supported, the peer is too new, max version: %v")
+
+// Caps is the bitmask of the features supported by the peer
+type Caps uint32
+
+const (
+	CapSeq Caps = 1 << iota
+	CapCompress
+	CapSeal
+	CapStream
+	CapTimeout
+	CapFragment
+	CapPing
+	// CapChecksum tells ExtChecksum is understood, see Packet.Checksum
+	CapChecksum
+	// CapPriority tells the Priority bits of ExtFlag are understood, see
+	// Packet.SendPriority
+	CapPriority
+
+	// SupportedCaps are the features supported by this build
+	SupportedCaps = CapSeq | CapCompress | CapSeal | CapStream | CapTimeout | CapFragment | CapPing | CapChecksum | CapPriority
+)
+
+func (c Caps) Has(cap Caps) bool {
+	return c&cap == cap
+}
+
+// Negotiate returns the version and the caps to use with the peer, a zero
+// peerVersion means the peer is legacy.
+func Negotiate(peerVersion int, peerCaps Caps) (version int, caps Caps) {
+	version = peerVersion
+	if version > MaxVersion {
+		version = MaxVersion
+	}
+	if version < VersionLegacy {
+		version = VersionLegacy
+	}
+	return version, peerCaps & SupportedCaps
+}
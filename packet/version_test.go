@@ -0,0 +1,73 @@
+package packet
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/test"
+)
+
+func TestPacketVersionGolden(t *testing.T) {
+	defer test.New(t)
+
+	newPacket := func(version int) *Packet {
+		p := New([]byte("hi"), NEWDC)
+		p.ReqId = 0x01020304
+		p.Seq = 5
+		p.Version = version
+		return p
+	}
+	golden := []struct {
+		version int
+		wire    string
+	}{
+		// ReqId | Flag Type | Length | Seq | Payload
+		{0, "01020304" + "0107" + "0002" + "0000000000000005" + "6869"},
+		// ReqId | Flag Type | Length | Version ExtFlag | Seq | Payload
+		{Version2, "01020304" + "8107" + "0002" + "0200" + "0000000000000005" + "6869"},
+	}
+	for _, g := range golden {
+		p := newPacket(g.version)
+		buf := make([]byte, p.TotalSize())
+		test.Equal(p.Marshal(buf), len(buf))
+		test.Equal(hex.EncodeToString(buf), g.wire)
+
+		got, err := Unmarshal(buf)
+		test.Nil(err)
+		test.Equal(got, p)
+	}
+
+	wire, err := hex.DecodeString("01020304" + "8107" + "0002" + "0300" + "0000000000000005" + "6869")
+	test.Nil(err)
+	_, err = Unmarshal(wire)
+	test.True(logex.Equal(err, ErrPeerTooNew))
+
+	// unknown extended flags
+	wire[9] = 0x80
+	wire[8] = Version2
+	_, err = Unmarshal(wire)
+	test.True(logex.Equal(err, ErrMalformed))
+	test.True(strings.Contains(err.Error(), "unknown ext flags 0x80"))
+
+	wire[9] = 0
+	wire[8] = VersionLegacy
+	_, err = Unmarshal(wire)
+	test.True(logex.Equal(err, ErrMalformed))
+	test.True(strings.Contains(err.Error(), "version 1"))
+}
+
+func TestNegotiate(t *testing.T) {
+	defer test.New(t)
+
+	version, caps := Negotiate(0, 0)
+	test.Equal(version, VersionLegacy)
+	test.Equal(caps, Caps(0))
+
+	version, caps = Negotiate(MaxVersion+1, CapSeq|CapCompress|1<<30)
+	test.Equal(version, MaxVersion)
+	test.Equal(caps, CapSeq|CapCompress)
+	test.True(caps.Has(CapCompress))
+	test.False(caps.Has(CapSeal))
+}
@@ -0,0 +1,215 @@
+package route
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/chzyer/logex"
+)
+
+// ItemStatus tells whether the route of the item is set in the system
+type ItemStatus int
+
+const (
+	StatusApplied ItemStatus = iota
+	StatusPending
+	StatusFailed
+)
+
+func (s ItemStatus) String() string {
+	switch s {
+	case StatusApplied:
+		return "applied"
+	case StatusPending:
+		return "pending"
+	case StatusFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("<unknown status>:%v", int(s))
+	}
+}
+
+type applyOp struct {
+	cidr string
+	path routePath
+	add  bool
+	// added tells the item is new, it's rolled back if its route is not
+	// installed, see rollbackLocked.
+	added bool
+}
+
+// applyQueue keeps the route commands which are waiting to be executed by
+// applyLoop, and the status of each CIDR.
+type applyQueue struct {
+	m       sync.Mutex
+	ops     *list.List
+	pending map[string]*list.Element // the pending add op of CIDR
+	status  map[string]ItemStatus
+	notify  chan struct{}
+}
+
+func newApplyQueue() *applyQueue {
+	return &applyQueue{
+		ops:     list.New(),
+		pending: make(map[string]*list.Element),
+		status:  make(map[string]ItemStatus),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+func (q *applyQueue) Status(cidr string) ItemStatus {
+	q.m.Lock()
+	s := q.status[cidr]
+	q.m.Unlock()
+	return s
+}
+
+func (q *applyQueue) SetStatus(cidr string, s ItemStatus) {
+	q.m.Lock()
+	q.status[cidr] = s
+	q.m.Unlock()
+}
+
+func (q *applyQueue) pushLocked(op *applyOp) *list.Element {
+	elem := q.ops.PushBack(op)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return elem
+}
+
+func (q *applyQueue) Add(cidr string, path routePath, added bool) {
+	q.m.Lock()
+	q.status[cidr] = StatusPending
+	q.pending[cidr] = q.pushLocked(&applyOp{cidr: cidr, path: path, add: true, added: added})
+	q.m.Unlock()
+}
+
+// Delete cancel the pending add op of the cidr if any, otherwise queue a
+// delete op.
+func (q *applyQueue) Delete(cidr string) {
+	q.m.Lock()
+	delete(q.status, cidr)
+	if elem := q.pending[cidr]; elem != nil {
+		q.ops.Remove(elem)
+		delete(q.pending, cidr)
+	} else {
+		q.pushLocked(&applyOp{cidr: cidr})
+	}
+	q.m.Unlock()
+}
+
+func (q *applyQueue) ClearStatus(cidr string) {
+	q.m.Lock()
+	delete(q.status, cidr)
+	q.m.Unlock()
+}
+
+func (q *applyQueue) Pop() *applyOp {
+	q.m.Lock()
+	defer q.m.Unlock()
+	elem := q.ops.Front()
+	if elem == nil {
+		return nil
+	}
+	q.ops.Remove(elem)
+	op := elem.Value.(*applyOp)
+	if op.add {
+		delete(q.pending, op.cidr)
+	}
+	return op
+}
+
+// Done update the status of the CIDR after the op is executed, unless the
+// item is removed meanwhile.
+func (q *applyQueue) Done(op *applyOp, err error) {
+	if !op.add {
+		return
+	}
+	q.m.Lock()
+	if _, ok := q.status[op.cidr]; ok {
+		if err != nil {
+			q.status[op.cidr] = StatusFailed
+		} else if q.status[op.cidr] == StatusPending {
+			q.status[op.cidr] = StatusApplied
+		}
+	}
+	q.m.Unlock()
+}
+
+// applyRoute set the route in the background, or immediately if
+// Config.Sync is set. the route goes by the path, see Item. if added is
+// true, the new item is rolled back in the background when its route is
+// not installed, the caller does it if Config.Sync is set.
+func (r *Route) applyRoute(cidr string, path routePath, added bool) error {
+	if !r.cfg.Sync {
+		r.apply.Add(cidr, path, added)
+		return nil
+	}
+	err := r.setRoute(cidr, path)
+	if err != nil {
+		r.apply.SetStatus(cidr, StatusFailed)
+	} else {
+		r.apply.SetStatus(cidr, StatusApplied)
+	}
+	return err
+}
+
+// unapplyRoute delete the route in the background, or immediately if
+// Config.Sync is set. the pending set of the route is canceled if any.
+func (r *Route) unapplyRoute(cidr string) error {
+	if r.cfg.Sync {
+		r.apply.ClearStatus(cidr)
+		return r.DeleteRoute(cidr)
+	}
+	r.apply.Delete(cidr)
+	return nil
+}
+
+func (r *Route) applyLoop() {
+	defer r.loops.Done()
+	for {
+		op := r.apply.Pop()
+		if op == nil {
+			select {
+			case <-r.apply.notify:
+				continue
+			case <-r.flow.IsClose():
+				return
+			case <-r.done:
+				return
+			}
+		}
+		r.execOp(op)
+	}
+}
+
+// drainApply execute the queued ops in place, it's used once the
+// applyLoop is stopped.
+func (r *Route) drainApply() {
+	for op := r.apply.Pop(); op != nil; op = r.apply.Pop() {
+		r.execOp(op)
+	}
+}
+
+// execOp run the route command of op, and roll back the new item if its
+// route is not installed
+func (r *Route) execOp(op *applyOp) {
+	var err error
+	if op.add {
+		err = r.setRoute(op.cidr, op.path)
+	} else {
+		err = r.DeleteRoute(op.cidr)
+	}
+	if err != nil {
+		r.cfg.Logger.Errorf("apply route fail: %v", err)
+	}
+	r.apply.Done(op, err)
+	if op.added && logex.Equal(err, ErrRouteNotInstalled) {
+		r.mutex.Lock()
+		r.rollbackLocked(op.cidr)
+		r.mutex.Unlock()
+	}
+}
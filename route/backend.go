@@ -0,0 +1,203 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/next/util"
+)
+
+var (
+	ErrInvalidDevName  = logex.Define("invalid device name: %q")
+	ErrInvalidRouteArg = logex.Define("invalid CIDR: %q")
+	ErrInvalidTable    = logex.Define("invalid routing table: %v")
+	ErrRouteConflict   = logex.Define("route '%v' exists but doesn't go to '%v'")
+)
+
+// the interface name is at most 15 chars on linux (IFNAMSIZ-1)
+var devNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+// Backend apply the route changes to the system route table.
+type Backend interface {
+	SetRoute(ctx context.Context, devName, cidr string) error
+	DeleteRoute(ctx context.Context, cidr string) error
+	// ListRoutes returns the CIDRs routed to the device in the system
+	// route table, the routes added by the kernel itself are excluded.
+	ListRoutes(ctx context.Context, devName string) ([]string, error)
+}
+
+// ShellBackend apply the route changes by `ip`/`route` command, the command
+// is executed directly without a shell.
+type ShellBackend struct {
+	// Table is the id of the routing table, zero means the main table.
+	// only linux supports it.
+	Table int
+	// Exec run the command, default to util.ExecContext
+	Exec func(ctx context.Context, argv ...string) error
+	// Output run the command and returns its stdout, default to
+	// util.ExecOutputContext
+	Output func(ctx context.Context, argv ...string) ([]byte, error)
+}
+
+type outputFunc func(ctx context.Context, argv []string) ([]byte, error)
+
+func (b ShellBackend) exec(ctx context.Context, argv []string) error {
+	if b.Exec == nil {
+		return util.ExecContext(ctx, argv...)
+	}
+	return b.Exec(ctx, argv...)
+}
+
+func (b ShellBackend) output(ctx context.Context, argv []string) ([]byte, error) {
+	if b.Output == nil {
+		return util.ExecOutputContext(ctx, argv...)
+	}
+	return b.Output(ctx, argv...)
+}
+
+// SetRoute succeeds if the route to the device exists already, e.g. it's
+// left by an unclean shutdown. ErrRouteConflict is returned if the route
+// exists but goes elsewhere, e.g. another device.
+func (b ShellBackend) SetRoute(ctx context.Context, devName, cidr string) error {
+	argv, err := genAddRouteCmd(devName, cidr, b.Table, nil, 0)
+	if err != nil {
+		return err
+	}
+	err = b.exec(ctx, argv)
+	if IsRouteExists(err) {
+		return b.checkRouteDev(ctx, devName, cidr)
+	}
+	return err
+}
+
+// checkRouteDev returns ErrRouteConflict if the route of cidr is not listed
+// by ListRoutes of the device
+func (b ShellBackend) checkRouteDev(ctx context.Context, devName, cidr string) error {
+	listed, err := b.ListRoutes(ctx, devName)
+	if err != nil {
+		return err
+	}
+	ok, err := containsRoute(listed, cidr)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrRouteConflict.Format(cidr, devName)
+	}
+	return nil
+}
+
+// containsRoute returns whether the routes listed by ListRoutes contain
+// cidr
+func containsRoute(listed []string, cidr string) (bool, error) {
+	want, err := parseRouteDest(cidr)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range listed {
+		if got, err := parseRouteDest(c); err == nil && got == want {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteRoute succeeds if the route doesn't exist
+func (b ShellBackend) DeleteRoute(ctx context.Context, cidr string) error {
+	argv, err := genRemoveRouteCmd(cidr, b.Table)
+	if err != nil {
+		return err
+	}
+	if err := b.exec(ctx, argv); err != nil && !IsRouteNotExists(err) {
+		return err
+	}
+	return nil
+}
+
+func (b ShellBackend) ListRoutes(ctx context.Context, devName string) ([]string, error) {
+	if err := checkValidDevName(devName); err != nil {
+		return nil, err
+	}
+	return listRoutes(ctx, b.output, devName, b.Table)
+}
+
+// the messages of `ip` on linux and `route` on bsd
+var (
+	routeExistsMsgs    = []string{"file exists", "already exists", "already in table"}
+	routeNotExistsMsgs = []string{"no such process", "not in table", "no such route"}
+)
+
+// IsRouteExists returns whether the error of adding a route tells it's
+// in the route table already.
+func IsRouteExists(err error) bool {
+	return errors.Is(err, syscall.EEXIST) || containsAny(err, routeExistsMsgs)
+}
+
+// IsRouteNotExists returns whether the error of deleting a route tells
+// it's not in the route table.
+func IsRouteNotExists(err error) bool {
+	return errors.Is(err, syscall.ESRCH) || containsAny(err, routeNotExistsMsgs)
+}
+
+func containsAny(err error, msgs []string) bool {
+	if err == nil {
+		return false
+	}
+	s := strings.ToLower(err.Error())
+	for _, msg := range msgs {
+		if strings.Contains(s, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalCIDR returns the cidr in the form of net.IPNet.String(), the
+// route commands never see the raw input from network.
+func canonicalCIDR(cidr string) (string, error) {
+	_, ipnet, err := net.ParseCIDR(FormatCIDR(cidr))
+	if err != nil {
+		return "", ErrInvalidRouteArg.Format(cidr)
+	}
+	return ipnet.String(), nil
+}
+
+// parseRouteDest canonicalize the destination listed in the system route
+// table, a single address is a host route in both IPv4 and IPv6.
+func parseRouteDest(dst string) (string, error) {
+	if idx := strings.Index(dst, "%"); idx >= 0 {
+		// the zone of the link-local address, e.g. fe80::%utun0/64
+		zone := dst[idx:]
+		if end := strings.Index(zone, "/"); end >= 0 {
+			zone = zone[:end]
+		}
+		dst = strings.Replace(dst, zone, "", 1)
+	}
+	if !strings.Contains(dst, "/") {
+		ipnet, err := parseIPNet(dst)
+		if err != nil {
+			return "", ErrInvalidRouteArg.Format(dst)
+		}
+		return ipnet.String(), nil
+	}
+	return canonicalCIDR(dst)
+}
+
+func checkValidDevName(devName string) error {
+	if !devNameRegexp.MatchString(devName) || devName[0] == '-' {
+		return ErrInvalidDevName.Format(devName)
+	}
+	return nil
+}
+
+func sanitizeRouteArgs(devName, cidr string) (string, error) {
+	if err := checkValidDevName(devName); err != nil {
+		return "", err
+	}
+	return canonicalCIDR(cidr)
+}
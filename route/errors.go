@@ -0,0 +1,42 @@
+package route
+
+import "github.com/chzyer/logex"
+
+// NotFoundError is returned if the route item of CIDR is not found, it
+// matches ErrRouteItemNotFound by errors.Is.
+type NotFoundError struct {
+	CIDR string
+	err  error
+}
+
+func newNotFoundError(cidr string) *NotFoundError {
+	return &NotFoundError{CIDR: cidr, err: ErrRouteItemNotFound.Format(cidr)}
+}
+
+func (e *NotFoundError) Error() string { return e.err.Error() }
+
+func (e *NotFoundError) Is(target error) bool {
+	return logex.Equal(e.err, target)
+}
+
+// ContainsError is returned if the route item of CIDR is covered by the
+// existing one of Container, it matches ErrRouteItemContains by errors.Is.
+type ContainsError struct {
+	CIDR      string
+	Container string
+	err       error
+}
+
+func newContainsError(cidr, container string) *ContainsError {
+	return &ContainsError{
+		CIDR:      cidr,
+		Container: container,
+		err:       ErrRouteItemContains.Format(cidr, container),
+	}
+}
+
+func (e *ContainsError) Error() string { return e.err.Error() }
+
+func (e *ContainsError) Is(target error) bool {
+	return logex.Equal(e.err, target)
+}
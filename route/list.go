@@ -1,12 +1,11 @@
 package route
 
 import (
+	"bytes"
 	"container/list"
 	"net"
 	"sort"
 	"time"
-
-	"github.com/chzyer/next/ip"
 )
 
 type EphemeralItem struct {
@@ -14,6 +13,27 @@ type EphemeralItem struct {
 	Expired time.Time
 }
 
+// IsExpired reports whether the item is reached its expiry
+func (e EphemeralItem) IsExpired() bool {
+	return e.isExpiredAt(time.Now())
+}
+
+// RemainingTTL returns the duration until expiry, zero if it's expired
+func (e EphemeralItem) RemainingTTL() time.Duration {
+	return e.remainingAt(time.Now())
+}
+
+func (e EphemeralItem) isExpiredAt(now time.Time) bool {
+	return !now.Before(e.Expired)
+}
+
+func (e EphemeralItem) remainingAt(now time.Time) time.Duration {
+	if e.isExpiredAt(now) {
+		return 0
+	}
+	return e.Expired.Sub(now)
+}
+
 type EphemeralItems struct {
 	list *list.List
 }
@@ -56,14 +76,16 @@ func (e *EphemeralItems) Add(i *EphemeralItem) {
 	e.list.PushBack(i)
 }
 
+// Match returns the most specific item which contains the ipnet
 func (e *EphemeralItems) Match(ipnet *net.IPNet) *EphemeralItem {
+	var ret *EphemeralItem
 	for elem := e.list.Front(); elem != nil; elem = elem.Next() {
 		item := elem.Value.(*EphemeralItem)
-		if item.Match(ipnet) {
-			return item
+		if item.Match(ipnet) && (ret == nil || item.Ones() > ret.Ones()) {
+			ret = item
 		}
 	}
-	return nil
+	return ret
 }
 
 func (e *EphemeralItems) GetFront() *EphemeralItem {
@@ -76,29 +98,51 @@ func (e *EphemeralItems) GetFront() *EphemeralItem {
 
 // -----------------------------------------------------------------------------
 
+// Items are kept sorted by Less after every change, which is the order
+// written by Route.Save, so the same set of items always produces the same
+// file.
 type Items []Item
 
+// Match returns a copy of the most specific item which contains the ipnet
 func (is Items) Match(ipnet *net.IPNet) *Item {
-	for _, i := range is {
-		if i.Match(ipnet) {
-			return &i
+	idx := -1
+	for i := range is {
+		if is[i].Match(ipnet) && (idx < 0 || is[i].Ones() > is[idx].Ones()) {
+			idx = i
 		}
 	}
-	return nil
+	if idx < 0 {
+		return nil
+	}
+	item := is[idx]
+	return &item
 }
 
-func (is *Items) Append(i *Item) {
+// Append add the item, if the CIDR is exists, only the comment and source
+// are updated. returns false if the CIDR is exists.
+func (is *Items) Append(i *Item) bool {
+	if idx := is.Find(i.CIDR); idx >= 0 {
+		(*is)[idx].Comment = i.Comment
+		(*is)[idx].Source = i.Source
+		return false
+	}
 	*is = append(*is, *i)
+	return true
 }
 
 func (is *Items) Len() int {
 	return len(*is)
 }
 
+// Less order the items by network address (IPv4 before IPv6 since they are
+// compared in 16 bytes form), then by prefix length (the shorter first). it's
+// a total order for the items with distinct CIDRs.
 func (is Items) Less(i, j int) bool {
-	ni, _ := ip.ParseCIDR(is[i].CIDR)
-	nj, _ := ip.ParseCIDR(is[j].CIDR)
-	return ni.IP.Int() < nj.IP.Int()
+	ni, nj := is[i].IPNet.IP.To16(), is[j].IPNet.IP.To16()
+	if c := bytes.Compare(ni, nj); c != 0 {
+		return c < 0
+	}
+	return is[i].Ones() < is[j].Ones()
 }
 
 func (is Items) Swap(i, j int) {
@@ -129,6 +173,33 @@ func (is *Items) Remove(cidr string) *Item {
 	}
 }
 
+// Sort is stable, see Less for the order.
 func (is *Items) Sort() {
-	sort.Sort(is)
+	sort.Stable(is)
+}
+
+// Diff compare the items by CIDR, returns the items only in b (added), the
+// items only in a (removed) and the items in both but with different comment
+// (changed, taken from b).
+func (is Items) Diff(b Items) (added, removed, changed Items) {
+	idx := make(map[string]*Item, len(is))
+	for i := range is {
+		idx[is[i].CIDR] = &is[i]
+	}
+	seen := make(map[string]bool, len(b))
+	for _, i := range b {
+		seen[i.CIDR] = true
+		old, ok := idx[i.CIDR]
+		if !ok {
+			added = append(added, i)
+		} else if old.Comment != i.Comment {
+			changed = append(changed, i)
+		}
+	}
+	for _, i := range is {
+		if !seen[i.CIDR] {
+			removed = append(removed, i)
+		}
+	}
+	return
 }
@@ -0,0 +1,92 @@
+package route
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chzyer/test"
+)
+
+func newTestItems(cidrAndComments ...string) Items {
+	var ret Items
+	for i := 0; i < len(cidrAndComments); i += 2 {
+		item, err := NewItemCIDR(cidrAndComments[i], cidrAndComments[i+1])
+		if err != nil {
+			panic(err)
+		}
+		ret.Append(item)
+	}
+	return ret
+}
+
+func cidrs(is Items) []string {
+	ret := []string{}
+	for _, i := range is {
+		ret = append(ret, i.CIDR)
+	}
+	return ret
+}
+
+func TestItemsDiff(t *testing.T) {
+	defer test.New(t)
+
+	a := newTestItems(
+		"10.0.0.0/8", "a",
+		"1.1.1.1", "dns",
+		"8.8.8.8", "google",
+	)
+
+	// overlapping
+	b := newTestItems(
+		"1.1.1.1", "dns",
+		"8.8.8.8", "google dns",
+		"9.9.9.9", "quad9",
+	)
+	added, removed, changed := a.Diff(b)
+	test.Equal(cidrs(added), []string{"9.9.9.9/32"})
+	test.Equal(cidrs(removed), []string{"10.0.0.0/8"})
+	test.Equal(cidrs(changed), []string{"8.8.8.8/32"})
+	test.Equal(changed[0].Comment, "google dns")
+
+	// disjoint
+	c := newTestItems("192.168.0.0/16", "")
+	added, removed, changed = a.Diff(c)
+	test.Equal(cidrs(added), []string{"192.168.0.0/16"})
+	test.Equal(cidrs(removed), cidrs(a))
+	test.Equal(len(changed), 0)
+
+	// comment only
+	d := newTestItems(
+		"10.0.0.0/8", "b",
+		"1.1.1.1", "dns",
+		"8.8.8.8", "google",
+	)
+	added, removed, changed = a.Diff(d)
+	test.Equal(len(added), 0)
+	test.Equal(len(removed), 0)
+	test.Equal(cidrs(changed), []string{"10.0.0.0/8"})
+
+	added, removed, changed = a.Diff(a)
+	test.Equal(len(added)+len(removed)+len(changed), 0)
+}
+
+func TestEphemeralItemTTL(t *testing.T) {
+	defer test.New(t)
+
+	now := time.Now()
+	past := EphemeralItem{Expired: now.Add(-time.Second)}
+	test.True(past.isExpiredAt(now))
+	test.Equal(past.remainingAt(now), time.Duration(0))
+	test.True(past.IsExpired())
+	test.Equal(past.RemainingTTL(), time.Duration(0))
+
+	future := EphemeralItem{Expired: now.Add(time.Minute)}
+	test.False(future.isExpiredAt(now))
+	test.Equal(future.remainingAt(now), time.Minute)
+	test.False(future.IsExpired())
+	test.True(future.RemainingTTL() > 59*time.Second)
+
+	exact := EphemeralItem{Expired: now}
+	test.True(exact.isExpiredAt(now))
+	test.Equal(exact.remainingAt(now), time.Duration(0))
+}
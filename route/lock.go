@@ -0,0 +1,74 @@
+package route
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/chzyer/flow"
+	"github.com/chzyer/logex"
+)
+
+var ErrRouteLocked = logex.Define("routes of %q are managed by another process, lock: %v")
+
+// DefaultLockPath returns the lock file of the device used by
+// NewRouteLocked if no lockPath is given.
+func DefaultLockPath(devName string) string {
+	return filepath.Join(os.TempDir(), "next-route-"+devName+".lock")
+}
+
+// NewRouteLocked is like NewRoute, but returns ErrRouteLocked if another
+// Route holds the lock of lockPath, e.g. a second daemon managing the same
+// device. the lock is an advisory flock(2), it's released when the Route or
+// f is closed, or the process exits.
+func NewRouteLocked(f *flow.Flow, devName, lockPath string) (*Route, error) {
+	if lockPath == "" {
+		if err := checkValidDevName(devName); err != nil {
+			return nil, err
+		}
+		lockPath = DefaultLockPath(devName)
+	}
+	lock, err := acquireLock(devName, lockPath)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRoute(f, devName)
+	go func() {
+		select {
+		case <-f.IsClose():
+		case <-r.done:
+		}
+		lock.Release()
+	}()
+	return r, nil
+}
+
+// lockFile is the file holding the flock, the file is kept after released,
+// removing it would let another process lock a different inode.
+type lockFile struct {
+	f *os.File
+}
+
+func acquireLock(devName, fp string) (*lockFile, error) {
+	f, err := os.OpenFile(fp, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrRouteLocked.Format(devName, fp)
+		}
+		return nil, logex.Trace(err)
+	}
+	// the pid is for the humans only
+	f.Truncate(0)
+	fmt.Fprintf(f, "%v\n", os.Getpid())
+	return &lockFile{f: f}, nil
+}
+
+func (l *lockFile) Release() {
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.f.Close()
+}
@@ -0,0 +1,75 @@
+package route
+
+import "sync"
+
+// Metrics receive the changes of the route items, it's called with the
+// route locked, so it must be fast and never call back to the Route.
+type Metrics interface {
+	// IncAdd is called when an item is added
+	IncAdd()
+	// IncRemove is called when an item is removed by the caller
+	IncRemove()
+	// IncExpire is called when an ephemeral item is expired, or evicted by
+	// Config.MaxEphemeral
+	IncExpire()
+	// SetGauges is called with the current number of the items after any
+	// change
+	SetGauges(persistent, ephemeral int)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncAdd()            {}
+func (nopMetrics) IncRemove()         {}
+func (nopMetrics) IncExpire()         {}
+func (nopMetrics) SetGauges(int, int) {}
+
+// MemMetrics keep the metrics in memory
+type MemMetrics struct {
+	added      uint64
+	removed    uint64
+	expired    uint64
+	persistent int
+	ephemeral  int
+	m          sync.Mutex
+}
+
+func (m *MemMetrics) IncAdd() {
+	m.m.Lock()
+	m.added++
+	m.m.Unlock()
+}
+
+func (m *MemMetrics) IncRemove() {
+	m.m.Lock()
+	m.removed++
+	m.m.Unlock()
+}
+
+func (m *MemMetrics) IncExpire() {
+	m.m.Lock()
+	m.expired++
+	m.m.Unlock()
+}
+
+func (m *MemMetrics) SetGauges(persistent, ephemeral int) {
+	m.m.Lock()
+	m.persistent, m.ephemeral = persistent, ephemeral
+	m.m.Unlock()
+}
+
+func (m *MemMetrics) Counters() (added, removed, expired uint64) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.added, m.removed, m.expired
+}
+
+func (m *MemMetrics) Gauges() (persistent, ephemeral int) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.persistent, m.ephemeral
+}
+
+func (r *Route) setGaugesLocked() {
+	r.cfg.Metrics.SetGauges(r.items.Len(), r.ephemeralItems.Len())
+}
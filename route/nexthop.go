@@ -0,0 +1,149 @@
+package route
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/chzyer/logex"
+)
+
+var (
+	ErrNoNextHop            = logex.Define("route '%v' has no next hop")
+	ErrInvalidNextHop       = logex.Define("invalid next hop '%v': %v")
+	ErrMultipathUnsupported = logex.Define("multipath route '%v' is not supported by the backend")
+)
+
+// MaxNextHopWeight is the largest weight accepted by `ip route`
+const MaxNextHopWeight = 256
+
+// NextHop is one path of a multipath (ECMP) route, the traffic is shared
+// among the next hops by their weights.
+type NextHop struct {
+	// Gateway can be nil if the device is point-to-point, e.g. a tun
+	Gateway net.IP
+	// Dev default to the device of the Route
+	Dev string
+	// Weight is relative to the other next hops, zero means the default
+	// weight 1.
+	Weight int
+}
+
+func (h NextHop) String() string {
+	var fields []string
+	if h.Gateway != nil {
+		fields = append(fields, "via", h.Gateway.String())
+	}
+	if h.Dev != "" {
+		fields = append(fields, "dev", h.Dev)
+	}
+	if h.Weight != 0 {
+		fields = append(fields, "weight", fmt.Sprint(h.Weight))
+	}
+	return strings.Join(fields, " ")
+}
+
+func (h NextHop) equal(o NextHop) bool {
+	return h.Gateway.Equal(o.Gateway) && h.Dev == o.Dev && h.Weight == o.Weight
+}
+
+// parseField set the field of NextHop.String, returns false if it's not one
+func (h *NextHop) parseField(key, value string) bool {
+	switch key {
+	case "via":
+		h.Gateway = net.ParseIP(value)
+		return h.Gateway != nil
+	case "dev":
+		h.Dev = value
+		return true
+	case "weight":
+		weight, err := strconv.Atoi(value)
+		h.Weight = weight
+		return err == nil
+	default:
+		return false
+	}
+}
+
+func (h NextHop) check() error {
+	if h.Weight < 0 || h.Weight > MaxNextHopWeight {
+		return ErrInvalidNextHop.Format(h, fmt.Sprintf("weight out of [0, %v]", MaxNextHopWeight))
+	}
+	if h.Dev != "" {
+		if err := checkValidDevName(h.Dev); err != nil {
+			return ErrInvalidNextHop.Format(h, err)
+		}
+	}
+	return nil
+}
+
+// checkNextHops returns ErrNoNextHop if hops is empty, or ErrInvalidGateway
+// if the gateway of a next hop is not in the family of cidr.
+func checkNextHops(cidr string, hops []NextHop) error {
+	if len(hops) == 0 {
+		return ErrNoNextHop.Format(cidr)
+	}
+	for _, h := range hops {
+		if err := h.check(); err != nil {
+			return err
+		}
+		if err := checkReplaceArgs(cidr, h.Gateway, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNextHops is a no-op if the item is not multipath
+func (i Item) checkNextHops() error {
+	if len(i.NextHops) == 0 {
+		return nil
+	}
+	return checkNextHops(i.CIDR, i.NextHops)
+}
+
+// MultipathBackend is implemented by the Backend supports the multipath
+// routes, it's required by the items with NextHops.
+type MultipathBackend interface {
+	Backend
+	// SetMultipathRoute is like SetRoute, but routes the cidr through the
+	// next hops, the empty Dev of a next hop means devName.
+	SetMultipathRoute(ctx context.Context, devName, cidr string, hops []NextHop) error
+}
+
+// SetMultipathRoute returns ErrMultipathUnsupported on bsd
+func (b ShellBackend) SetMultipathRoute(ctx context.Context, devName, cidr string, hops []NextHop) error {
+	if err := checkNextHops(cidr, hops); err != nil {
+		return err
+	}
+	argv, err := genAddRouteCmd(devName, cidr, b.Table, nil, 0, hops...)
+	if err != nil {
+		return err
+	}
+	if err := b.exec(ctx, argv); err != nil && !IsRouteExists(err) {
+		return err
+	}
+	return nil
+}
+
+// setBackendRoute set the multipath route if the path has hops, otherwise
+// the single path one through the gateway if any.
+func setBackendRoute(ctx context.Context, b Backend, devName, cidr string, path routePath) error {
+	if len(path.hops) > 0 {
+		mb, ok := b.(MultipathBackend)
+		if !ok {
+			return ErrMultipathUnsupported.Format(cidr)
+		}
+		return mb.SetMultipathRoute(ctx, devName, cidr, path.hops)
+	}
+	if path.gateway == nil && path.metric == 0 {
+		return b.SetRoute(ctx, devName, cidr)
+	}
+	gb, ok := b.(GatewayBackend)
+	if !ok {
+		return ErrGatewayUnsupported.Format(cidr)
+	}
+	return gb.SetRouteVia(ctx, devName, cidr, path.gateway, path.metric)
+}
@@ -0,0 +1,127 @@
+package route
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/chzyer/logex"
+)
+
+var (
+	ErrInvalidRoutePath   = logex.Define("invalid route path '%v'")
+	ErrGatewayUnsupported = logex.Define("route '%v' with a gateway or a metric is not supported by the backend")
+)
+
+// routePath is how the route of an item goes, see Item.
+type routePath struct {
+	gateway net.IP
+	metric  int
+	hops    []NextHop
+}
+
+// equal tells whether the route has to be set again
+func (p routePath) equal(o routePath) bool {
+	if !p.gateway.Equal(o.gateway) || p.metric != o.metric || len(p.hops) != len(o.hops) {
+		return false
+	}
+	for idx, h := range p.hops {
+		if !h.equal(o.hops[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+// String is the PATH field of the rule file, e.g. "via 192.168.1.1 metric
+// 10" or "nexthop via 10.0.0.1 weight 2 nexthop dev eth1", it's empty if
+// the route goes to the device directly.
+func (p routePath) String() string {
+	var fields []string
+	if p.gateway != nil {
+		fields = append(fields, "via", p.gateway.String())
+	}
+	if p.metric != 0 {
+		fields = append(fields, "metric", strconv.Itoa(p.metric))
+	}
+	for _, h := range p.hops {
+		fields = append(fields, "nexthop")
+		if hop := h.String(); hop != "" {
+			fields = append(fields, hop)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// parseRoutePath reverse routePath.String, the gateway and the metric of
+// a multipath route are not supported.
+func parseRoutePath(s string) (routePath, error) {
+	var p routePath
+	var hop *NextHop
+	fields := strings.Fields(s)
+	for i := 0; i < len(fields); i++ {
+		if fields[i] == "nexthop" {
+			p.hops = append(p.hops, NextHop{})
+			hop = &p.hops[len(p.hops)-1]
+			continue
+		}
+		if i+1 >= len(fields) {
+			return p, ErrInvalidRoutePath.Format(s)
+		}
+		key, value := fields[i], fields[i+1]
+		i++
+		var ok bool
+		if hop != nil {
+			ok = hop.parseField(key, value)
+		} else {
+			ok = p.parseField(key, value)
+		}
+		if !ok {
+			return p, ErrInvalidRoutePath.Format(s)
+		}
+	}
+	if len(p.hops) > 0 && (p.gateway != nil || p.metric != 0) {
+		return p, ErrInvalidRoutePath.Format(s)
+	}
+	return p, nil
+}
+
+func (p *routePath) parseField(key, value string) bool {
+	switch key {
+	case "via":
+		p.gateway = net.ParseIP(value)
+		return p.gateway != nil
+	case "metric":
+		metric, err := strconv.Atoi(value)
+		p.metric = metric
+		return err == nil
+	default:
+		return false
+	}
+}
+
+// GatewayBackend is implemented by the Backend can set the route through a
+// gateway or with a metric, it's required by the items with Gateway or
+// Metric.
+type GatewayBackend interface {
+	Backend
+	// SetRouteVia is like SetRoute, the route goes through the gateway if
+	// it's not nil.
+	SetRouteVia(ctx context.Context, devName, cidr string, gateway net.IP, metric int) error
+}
+
+// SetRouteVia succeeds if the route exists already like SetRoute
+func (b ShellBackend) SetRouteVia(ctx context.Context, devName, cidr string, gateway net.IP, metric int) error {
+	if err := checkReplaceArgs(cidr, gateway, metric); err != nil {
+		return err
+	}
+	argv, err := genAddRouteCmd(devName, cidr, b.Table, gateway, metric)
+	if err != nil {
+		return err
+	}
+	if err := b.exec(ctx, argv); err != nil && !IsRouteExists(err) {
+		return err
+	}
+	return nil
+}
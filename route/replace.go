@@ -0,0 +1,111 @@
+package route
+
+import (
+	"context"
+	"net"
+
+	"github.com/chzyer/logex"
+)
+
+var (
+	ErrInvalidMetric      = logex.Define("invalid metric: %v")
+	ErrInvalidGateway     = logex.Define("gateway '%v' doesn't match the family of '%v'")
+	ErrReplaceUnsupported = logex.Define("replacing route '%v' is not supported by the backend")
+	ErrReplaceMultipath   = logex.Define("multipath route '%v' can't be replaced")
+)
+
+// ReplaceBackend is implemented by the Backend can change the route in
+// place, it's required by ReplaceItem.
+type ReplaceBackend interface {
+	Backend
+	// ReplaceRoute change the gateway and the metric of the route without
+	// deleting it first, so the traffic is never routed elsewhere in
+	// between. the old metric is the one the route is installed with.
+	ReplaceRoute(ctx context.Context, devName, cidr string, gateway net.IP, metric, oldMetric int) error
+}
+
+// ReplaceRoute runs `ip route replace` on linux and `route change` on bsd,
+// the route left with the old metric on linux is deleted afterwards.
+func (b ShellBackend) ReplaceRoute(ctx context.Context, devName, cidr string, gateway net.IP, metric, oldMetric int) error {
+	argv, stale, err := genReplaceRouteCmd(devName, cidr, b.Table, gateway, metric, oldMetric)
+	if err != nil {
+		return err
+	}
+	if err := b.exec(ctx, argv); err != nil {
+		return err
+	}
+	if stale == nil {
+		return nil
+	}
+	if err := b.exec(ctx, stale); err != nil && !IsRouteNotExists(err) {
+		return err
+	}
+	return nil
+}
+
+func checkReplaceArgs(cidr string, gateway net.IP, metric int) error {
+	if metric < 0 {
+		return ErrInvalidMetric.Format(metric)
+	}
+	if gateway == nil {
+		return nil
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ErrInvalidRouteArg.Format(cidr)
+	}
+	if (gateway.To4() == nil) != (ipnet.IP.To4() == nil) {
+		return ErrInvalidGateway.Format(gateway, cidr)
+	}
+	return nil
+}
+
+// ReplaceItem change the gateway and the metric of the persistent or
+// ephemeral item of cidr, the route is updated atomically by the backend
+// and never removed in between. returns ErrRouteItemNotFound if the item
+// doesn't exist.
+func (r *Route) ReplaceItem(cidr string, newGateway net.IP, newMetric int) error {
+	cidr, err := canonicalCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.closedLocked(); err != nil {
+		return err
+	}
+
+	var item *Item
+	if idx := r.items.Find(cidr); idx >= 0 {
+		item = &(*r.items)[idx]
+	} else if elem := r.ephemeralItems.Find(cidr); elem != nil {
+		item = elem.Value.(*EphemeralItem).Item
+	} else {
+		return newNotFoundError(cidr)
+	}
+	if len(item.NextHops) > 0 {
+		return ErrReplaceMultipath.Format(cidr)
+	}
+	if err := checkReplaceArgs(cidr, newGateway, newMetric); err != nil {
+		return err
+	}
+	rb, ok := r.cfg.Backend.(ReplaceBackend)
+	if !ok {
+		return ErrReplaceUnsupported.Format(cidr)
+	}
+
+	err = r.runCmd(cidr, func(ctx context.Context) error {
+		devName, err := r.deviceName()
+		if err != nil {
+			return err
+		}
+		return rb.ReplaceRoute(ctx, devName, cidr, newGateway, newMetric, item.Metric)
+	})
+	if err != nil {
+		return err
+	}
+	item.Gateway = newGateway
+	item.Metric = newMetric
+	return nil
+}
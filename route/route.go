@@ -1,12 +1,19 @@
-// Package route handle route table for darwin/linux.
+// Package route handle route table for linux and darwin/freebsd/netbsd/openbsd.
 package route
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/chzyer/flow"
@@ -19,13 +26,50 @@ var (
 	ErrRouteItemNotFound = logex.Define("route item '%v' not found")
 	ErrRouteItemExists   = logex.Define("route item '%v' is exists")
 	ErrRouteItemContains = logex.Define("route item '%v' contains by '%v'")
+	ErrRouteCmdTimeout   = logex.Define("route command for '%v' timed out after %v: %v")
+	ErrCIDRHostBits      = logex.Define("CIDR '%v' has host bits set, do you mean '%v'?")
+	ErrInvalidTTL        = logex.Define("invalid ttl: %v")
+	ErrDefaultRoute      = logex.Define("default route '%v' is not allowed, use AddDefaultRoute instead")
+	ErrNotDefaultRoute   = logex.Define("'%v' is not a default route")
+	ErrRouteNotInstalled = logex.Define("route '%v' is not in the system route table after set")
+	ErrRouteClosed       = logex.Define("route is closed")
 )
 
-// one line "CIDR\tCOMMENT"
+const (
+	DefaultRouteIPv4 = "0.0.0.0/0"
+	DefaultRouteIPv6 = "::/0"
+)
+
+const DefaultCmdTimeout = 5 * time.Second
+
+// Source tells where the item comes from
+type Source string
+
+const (
+	SourceFile     Source = "file"
+	SourceManual   Source = "manual"
+	SourceDNS      Source = "dns"
+	SourceImported Source = "imported"
+)
+
+// one line "CIDR\tCOMMENT[\tSOURCE[\tPATH]]", the SOURCE is empty or omitted
+// if it's file, the PATH is the Gateway and the Metric, or the NextHops, see
+// routePath.String, it's omitted if the route goes to the device directly. the tab, newline and backslash in
+// the COMMENT are escaped, see escapeComment.
 type Item struct {
 	CIDR    string
 	Comment string
+	Source  Source
 	IPNet   *net.IPNet
+	// NextHops makes the route multipath, it's routed to the device only
+	// if empty.
+	NextHops []NextHop
+	// Gateway and Metric are changed by ReplaceItem, the route goes to the
+	// device directly if Gateway is nil.
+	Gateway net.IP
+	Metric  int
+	// Status is filled by GetItems/GetEphemeralItems
+	Status ItemStatus
 }
 
 func NewItemCIDR(cidr string, comment string) (*Item, error) {
@@ -36,6 +80,21 @@ func NewItemCIDR(cidr string, comment string) (*Item, error) {
 	return NewItem(ipnet, comment), nil
 }
 
+// NewItemCIDRStrict is like NewItemCIDR, but returns error instead of
+// masking off the host bits, e.g. "10.0.0.5/24"
+func NewItemCIDRStrict(cidr string, comment string) (*Item, error) {
+	if strings.Contains(cidr, "/") {
+		ip, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if !ip.Equal(ipnet.IP) {
+			return nil, ErrCIDRHostBits.Format(cidr, ipnet.String())
+		}
+	}
+	return NewItemCIDR(cidr, comment)
+}
+
 func NewItem(ipnet *net.IPNet, comment string) *Item {
 	return &Item{
 		CIDR:    ipnet.String(),
@@ -48,180 +107,1195 @@ func (i Item) Match(target *net.IPNet) bool {
 	return ip.MatchIPNet(target, i.IPNet)
 }
 
+// IsDefault returns whether the item is a default route which matches
+// everything, e.g. 0.0.0.0/0
+func (i Item) IsDefault() bool {
+	return i.Ones() == 0
+}
+
+// Ones returns the prefix length of the item
+func (i Item) Ones() int {
+	ones, _ := i.IPNet.Mask.Size()
+	return ones
+}
+
 func (i Item) String() string {
-	return fmt.Sprintf("%v\t%v", i.CIDR, i.Comment)
+	source := i.Source
+	if source == SourceFile {
+		source = ""
+	}
+	if path := i.path().String(); path != "" {
+		return fmt.Sprintf("%v\t%v\t%v\t%v", i.CIDR, escapeComment(i.Comment), source, path)
+	}
+	if source != "" {
+		return fmt.Sprintf("%v\t%v\t%v", i.CIDR, escapeComment(i.Comment), source)
+	}
+	return fmt.Sprintf("%v\t%v", i.CIDR, escapeComment(i.Comment))
+}
+
+// path returns how the route of the item goes
+func (i Item) path() routePath {
+	return routePath{gateway: i.Gateway, metric: i.Metric, hops: i.NextHops}
+}
+
+var commentEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// escapeComment make the comment fit in one field of the rule file
+func escapeComment(comment string) string {
+	return commentEscaper.Replace(comment)
+}
+
+// unescapeComment reverse escapeComment, the unknown escapes are kept as is,
+// so the comments written before escaping is supported are loaded unchanged
+// unless they contain the escapes.
+func unescapeComment(comment string) string {
+	if strings.IndexByte(comment, '\\') < 0 {
+		return comment
+	}
+	buf := make([]byte, 0, len(comment))
+	for i := 0; i < len(comment); i++ {
+		ch := comment[i]
+		if ch == '\\' && i+1 < len(comment) {
+			switch comment[i+1] {
+			case '\\':
+				ch = '\\'
+			case 't':
+				ch = '\t'
+			case 'n':
+				ch = '\n'
+			case 'r':
+				ch = '\r'
+			default:
+				buf = append(buf, ch)
+				continue
+			}
+			i++
+		}
+		buf = append(buf, ch)
+	}
+	return string(buf)
+}
+
+type Config struct {
+	// Backend apply the route changes, default to ShellBackend
+	Backend Backend
+	// Table is the routing table id the default ShellBackend installs the
+	// routes into, zero means the main table. it's linux only, the route
+	// commands fail with ErrInvalidTable elsewhere.
+	Table int
+	// CmdTimeout limit the time of one route command, default to DefaultCmdTimeout
+	CmdTimeout time.Duration
+	// Sync let the route commands be executed before the item is returned
+	// from AddItem/RemoveItem, otherwise they are executed in background.
+	Sync bool
+	// Backup keep the previous content in "<file>.bak" when saving
+	Backup bool
+	// VerifyAfterSet list the system route table after a route is set, the
+	// item is removed with ErrRouteNotInstalled if the route is not there,
+	// e.g. the command exits 0 because of a conflicting route.
+	VerifyAfterSet bool
+	// MaxEphemeral limit the number of ephemeral items, the item which is
+	// nearest to expire is evicted when exceeded. zero means unlimited.
+	MaxEphemeral int
+	// StrictCIDR reject the CIDRs with host bits set in the rule file
+	// instead of masking them off.
+	StrictCIDR bool
+	// Logger default to util.DefaultLogger
+	Logger util.Logger
+	// AllowDefaultRoute let AddItem and AddEphemeralItem accept the default
+	// routes, otherwise only AddDefaultRoute and the rule file can add them.
+	AllowDefaultRoute bool
+	// IfIndex bind the routes to the interface with this index, the name is
+	// resolved each time a route is set so a renamed interface is followed.
+	// the devName is used if it's zero or the resolving failed.
+	IfIndex int
+	// ResolveIfIndex default to resolve by net.InterfaceByIndex
+	ResolveIfIndex func(index int) (string, error)
+	// Metrics count the changes of the items, e.g. MemMetrics. default to
+	// no-op.
+	Metrics Metrics
+	// ExpiryBatchWindow let the expired items be reaped at most this late,
+	// so the items expiring within the window are reaped in one pass
+	// instead of waking up for each of them. zero means no delay.
+	ExpiryBatchWindow time.Duration
+	// MinTTL round up the ttl of the ephemeral items, zero means no limit.
+	MinTTL time.Duration
+}
+
+func (c *Config) init() {
+	if c.Backend == nil {
+		c.Backend = ShellBackend{Table: c.Table}
+	}
+	if c.CmdTimeout <= 0 {
+		c.CmdTimeout = DefaultCmdTimeout
+	}
+	if c.Logger == nil {
+		c.Logger = util.DefaultLogger
+	}
+	if c.ResolveIfIndex == nil {
+		c.ResolveIfIndex = resolveIfIndex
+	}
+	if c.Metrics == nil {
+		c.Metrics = nopMetrics{}
+	}
+	if c.ExpiryBatchWindow < 0 {
+		c.ExpiryBatchWindow = 0
+	}
+}
+
+func resolveIfIndex(index int) (string, error) {
+	ifi, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return "", err
+	}
+	return ifi.Name, nil
 }
 
 type Route struct {
 	flow             *flow.Flow
+	cfg              Config
 	items            *Items
 	ephemeralItems   *EphemeralItems
+	apply            *applyQueue
 	devName          string
+	devMutex         sync.Mutex
 	newEphemeralItem chan struct{}
+	evicted          uint64
+	expirePasses     uint64
+	running          int32
+	expiryPaused     bool // guarded by mutex, see PauseExpiry
+	mutex            sync.RWMutex
+
+	// done stops the loops without closing the flow, which may be shared,
+	// it's closed under mutex, see Close and closedLocked
+	done      chan struct{}
+	closeOnce sync.Once
+	loops     sync.WaitGroup
+
+	// hits count the matches per CIDR, guarded by hitsMutex
+	hits      map[string]uint64
+	hitsMutex sync.Mutex
 }
 
 func NewRoute(f *flow.Flow, devName string) *Route {
+	return NewRouteWithConfig(f, devName, nil)
+}
+
+// NewRouteByIndex bind the routes to the interface with the index
+func NewRouteByIndex(f *flow.Flow, ifIndex int) *Route {
+	return NewRouteWithConfig(f, "", &Config{IfIndex: ifIndex})
+}
+
+func NewRouteWithConfig(f *flow.Flow, devName string, cfg *Config) *Route {
+	if cfg == nil {
+		cfg = &Config{}
+	}
 	r := &Route{
 		flow:             f,
+		cfg:              *cfg,
 		devName:          devName,
 		items:            &Items{},
 		ephemeralItems:   NewEphemeralItems(),
+		apply:            newApplyQueue(),
 		newEphemeralItem: make(chan struct{}, 1),
+		hits:             make(map[string]uint64),
+		done:             make(chan struct{}),
 	}
+	r.cfg.init()
+	r.loops.Add(2)
 	go r.loop()
+	go r.applyLoop()
 	return r
 }
 
-func (r *Route) GetEphemeralItems() []EphemeralItem {
-	ret := make([]EphemeralItem, 0, r.ephemeralItems.Len())
+// Close stop the expiry loop and the apply loop, and wait for them to
+// exit, the flow is not closed. if flush is true, all the items are
+// removed with their routes first. only the first call takes effect,
+// the others wait for it to return. the methods changing the items return
+// ErrRouteClosed after Close.
+func (r *Route) Close(flush bool) {
+	r.closeOnce.Do(func() {
+		if flush {
+			for _, err := range r.RemoveMatching(func(Item) bool { return true }) {
+				r.cfg.Logger.Errorf("flush route fail: %v", err)
+			}
+		}
+		r.mutex.Lock()
+		close(r.done)
+		r.mutex.Unlock()
+		r.loops.Wait()
+		if flush {
+			// the deletes queued for the stopped apply loop
+			r.drainApply()
+		}
+	})
+}
+
+// closedLocked returns ErrRouteClosed after Close, nothing would apply the
+// routes of the changed items.
+func (r *Route) closedLocked() error {
+	select {
+	case <-r.done:
+		return ErrRouteClosed.Trace()
+	default:
+		return nil
+	}
+}
+
+// EphemeralSnapshot is a copy of an ephemeral item taken under lock
+type EphemeralSnapshot struct {
+	Item
+	Expired   time.Time
+	Remaining time.Duration
+}
+
+// GetEphemeralItems returns the snapshots of all the ephemeral items,
+// ordered by expiry
+func (r *Route) GetEphemeralItems() []EphemeralSnapshot {
+	return r.QueryEphemeralItems(0, -1, nil)
+}
+
+// QueryEphemeralItems returns at most limit (negative means unlimited)
+// snapshots after skipping offset items, filter is applied before paging
+// and can be nil.
+func (r *Route) QueryEphemeralItems(offset, limit int, filter func(*EphemeralSnapshot) bool) []EphemeralSnapshot {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	now := time.Now()
+	var ret []EphemeralSnapshot
 	for elem := r.ephemeralItems.list.Front(); elem != nil; elem = elem.Next() {
+		if limit >= 0 && len(ret) >= limit {
+			break
+		}
 		ei := elem.Value.(*EphemeralItem)
-		ret = append(ret, *ei)
+		snap := EphemeralSnapshot{
+			Item:      *ei.Item,
+			Expired:   ei.Expired,
+			Remaining: ei.remainingAt(now),
+		}
+		if filter != nil && !filter(&snap) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		snap.Status = r.apply.Status(snap.CIDR)
+		ret = append(ret, snap)
 	}
 	return ret
 }
 
+// GetItems returns a copy of the persistent items
 func (r *Route) GetItems() Items {
-	return *r.items
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	ret := make(Items, len(*r.items))
+	copy(ret, *r.items)
+	for idx := range ret {
+		ret[idx].Status = r.apply.Status(ret[idx].CIDR)
+	}
+	return ret
+}
+
+// ForEachItem call fn with a copy of each persistent item in order under the
+// read lock, it stops once fn returns false. fn must not call the methods
+// which change the route.
+func (r *Route) ForEachItem(fn func(Item) bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, item := range *r.items {
+		item.Status = r.apply.Status(item.CIDR)
+		if !fn(item) {
+			return
+		}
+	}
+}
+
+// Healthy reports whether the expiry loop is running
+func (r *Route) Healthy() bool {
+	return atomic.LoadInt32(&r.running) == 1
 }
 
+// loop restart the expiry loop if it panics, until the flow is closed or
+// the route is closed
 func (r *Route) loop() {
-loop:
+	defer r.loops.Done()
+	for !r.runLoop() {
+	}
+}
+
+func (r *Route) runLoop() (closed bool) {
+	atomic.StoreInt32(&r.running, 1)
+	defer func() {
+		atomic.StoreInt32(&r.running, 0)
+		if err := recover(); err != nil {
+			r.cfg.Logger.Errorf("route loop panic, restarting: %v", err)
+			closed = false
+		}
+	}()
+
 	for {
-		i := r.ephemeralItems.GetFront()
-		if i == nil {
-			select {
-			case <-r.newEphemeralItem:
-			case <-r.flow.IsClose():
-				break loop
-			}
-		} else {
-			now := time.Now()
-			if now.After(i.Expired) {
-				logex.Infof("route '%v' is expired", i.CIDR)
-				err := r.RemoveEphemeralItem(i.CIDR)
-				if err != nil {
-					logex.Error("remove route item fail:", err.Error())
-				}
-			} else {
-				select {
-				case <-time.After(i.Expired.Sub(now)):
-				case <-r.newEphemeralItem:
-				case <-r.flow.IsClose():
-					break loop
-				}
+		var wait <-chan time.Time
+		if d, ok := r.expireFront(); ok {
+			if d == 0 {
+				continue
 			}
+			wait = time.After(d)
+		}
+		select {
+		case <-wait:
+		case <-r.newEphemeralItem:
+		case <-r.flow.IsClose():
+			return true
+		case <-r.done:
+			return true
 		}
 	}
 }
 
+// PauseExpiry stop removing the expired ephemeral items until
+// ResumeExpiry, e.g. during a bulk reconfiguration. the items are still
+// added, extended and removed meanwhile.
+func (r *Route) PauseExpiry() {
+	r.mutex.Lock()
+	r.expiryPaused = true
+	r.mutex.Unlock()
+}
+
+// ResumeExpiry remove the items expired while paused, and wait for the
+// next one as usual.
+func (r *Route) ResumeExpiry() {
+	r.mutex.Lock()
+	r.expiryPaused = false
+	r.mutex.Unlock()
+	select {
+	case r.newEphemeralItem <- struct{}{}:
+	default:
+	}
+}
+
+// expireFront remove the expired ephemeral items once the front one is
+// expired for Config.ExpiryBatchWindow, returns the duration to wait for
+// the front item, ok is false if there is no item or the expiry is paused.
+func (r *Route) expireFront() (d time.Duration, ok bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	i := r.ephemeralItems.GetFront()
+	if i == nil || r.expiryPaused {
+		return 0, false
+	}
+	now := time.Now()
+	if wait := i.Expired.Add(r.cfg.ExpiryBatchWindow).Sub(now); wait > 0 {
+		return wait, true
+	}
+	atomic.AddUint64(&r.expirePasses, 1)
+	for ; i != nil && i.isExpiredAt(now); i = r.ephemeralItems.GetFront() {
+		r.cfg.Logger.Infof("route '%v' is expired", i.CIDR)
+		if err := r.removeEphemeralItemLocked(i.CIDR); err != nil {
+			r.cfg.Logger.Errorf("remove route item fail: %v", err)
+		}
+		r.cfg.Metrics.IncExpire()
+	}
+	r.setGaugesLocked()
+	return 0, true
+}
+
+// RemoveItem remove the persistent item of cidr, or the ephemeral one if
+// it's not persistent. a NotFoundError is returned if cidr is neither.
 func (r *Route) RemoveItem(cidr string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.closedLocked(); err != nil {
+		return err
+	}
 	if item := r.items.Remove(cidr); item != nil {
-		return r.DeleteRoute(cidr)
+		r.forgetHits(cidr)
+		r.cfg.Metrics.IncRemove()
+		r.setGaugesLocked()
+		return r.unapplyRoute(cidr)
 	}
-	if err := r.RemoveEphemeralItem(cidr); err != nil {
-		return err
+	err := r.removeEphemeralItemLocked(cidr)
+	if _, notFound := err.(*NotFoundError); !notFound {
+		r.cfg.Metrics.IncRemove()
+		r.setGaugesLocked()
 	}
-	return ErrRouteItemNotFound.Format(cidr)
+	return err
+}
+
+// RemoveMatching remove all the persistent and ephemeral items which pred
+// returns true, pred is called with a copy of the item.
+func (r *Route) RemoveMatching(pred func(Item) bool) []error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.closedLocked(); err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	items := append(Items(nil), *r.items...)
+	for _, item := range items {
+		if !pred(item) || r.items.Remove(item.CIDR) == nil {
+			continue
+		}
+		r.forgetHits(item.CIDR)
+		r.cfg.Metrics.IncRemove()
+		if err := r.unapplyRoute(item.CIDR); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var cidrs []string
+	for elem := r.ephemeralItems.list.Front(); elem != nil; elem = elem.Next() {
+		if ei := elem.Value.(*EphemeralItem); pred(*ei.Item) {
+			cidrs = append(cidrs, ei.CIDR)
+		}
+	}
+	for _, cidr := range cidrs {
+		if err := r.removeEphemeralItemLocked(cidr); err != nil {
+			errs = append(errs, err)
+		}
+		r.cfg.Metrics.IncRemove()
+	}
+	r.setGaugesLocked()
+	return errs
+}
+
+// RemoveBySource remove all the items come from the source
+func (r *Route) RemoveBySource(source Source) []error {
+	return r.RemoveMatching(func(i Item) bool {
+		return i.Source == source
+	})
 }
 
 func (r *Route) RemoveEphemeralItem(cidr string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.closedLocked(); err != nil {
+		return err
+	}
+	err := r.removeEphemeralItemLocked(cidr)
+	if _, notFound := err.(*NotFoundError); !notFound {
+		r.cfg.Metrics.IncRemove()
+		r.setGaugesLocked()
+	}
+	return err
+}
+
+func (r *Route) removeEphemeralItemLocked(cidr string) error {
 	if r.ephemeralItems.Remove(cidr) != nil {
-		return logex.Trace(r.DeleteRoute(cidr))
+		r.forgetHits(cidr)
+		return logex.Trace(r.unapplyRoute(cidr))
 	}
-	return ErrRouteItemNotFound.Format(cidr)
+	return newNotFoundError(cidr)
 }
 
+// PersistEphemeralItem promote the ephemeral item to a persistent one, if the
+// item is already covered by another item, its route is removed and
+// ErrRouteItemContains is returned.
 func (r *Route) PersistEphemeralItem(cidr string) error {
-	if ei := r.ephemeralItems.Remove(cidr); ei != nil {
-		r.items.Append(ei.Item)
-		r.items.Sort()
-		return nil
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.persistEphemeralItemLocked(cidr)
+}
+
+func (r *Route) persistEphemeralItemLocked(cidr string) error {
+	if err := r.closedLocked(); err != nil {
+		return err
+	}
+	ei := r.ephemeralItems.Remove(cidr)
+	if ei == nil {
+		return newNotFoundError(cidr)
+	}
+	defer r.setGaugesLocked()
+	if item := r.matchLocked(ei.IPNet); item != nil && !item.IsDefault() {
+		r.forgetHits(ei.CIDR)
+		if err := r.unapplyRoute(ei.CIDR); err != nil {
+			r.cfg.Logger.Errorf("remove route item fail: %v", err)
+		}
+		return newContainsError(ei.CIDR, item.CIDR)
+	}
+	r.items.Append(ei.Item)
+	r.items.Sort()
+	return nil
+}
+
+// PersistAll promote all the ephemeral items, returns the result of each
+// CIDR, nil means the item is persisted.
+func (r *Route) PersistAll() map[string]error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var cidrs []string
+	for elem := r.ephemeralItems.list.Front(); elem != nil; elem = elem.Next() {
+		cidrs = append(cidrs, elem.Value.(*EphemeralItem).CIDR)
+	}
+	ret := make(map[string]error, len(cidrs))
+	for _, cidr := range cidrs {
+		ret[cidr] = r.persistEphemeralItemLocked(cidr)
+	}
+	return ret
+}
+
+// EphemeralResult describes what AddEphemeralItem did.
+type EphemeralResult int
+
+const (
+	// the item is added and the route is set
+	EphemeralAdded EphemeralResult = iota
+	// the item is covered by a persistent item, nothing changed
+	EphemeralCovered
+	// the same item is exists, its expire time is extended
+	EphemeralExtended
+)
+
+// AddEphemeralCIDR add an ephemeral item which is expired after ttl, use
+// AddEphemeralItem to know whether it's covered or extended.
+func (r *Route) AddEphemeralCIDR(cidr, comment string, ttl time.Duration) (*EphemeralItem, error) {
+	if ttl <= 0 {
+		return nil, ErrInvalidTTL.Format(ttl)
+	}
+	item, err := NewItemCIDR(cidr, comment)
+	if err != nil {
+		return nil, err
 	}
-	return ErrRouteItemNotFound.Format(cidr)
+	ei := &EphemeralItem{Item: item, Expired: time.Now().Add(ttl)}
+	if _, err := r.AddEphemeralItem(ei); err != nil {
+		return nil, err
+	}
+	return ei, nil
 }
 
-func (r *Route) AddEphemeralItem(i *EphemeralItem) error {
+func (r *Route) AddEphemeralItem(i *EphemeralItem) (EphemeralResult, error) {
 	if err := checkValidCIDR(i.CIDR); err != nil {
-		return err
+		return EphemeralAdded, err
+	}
+	if i.IsDefault() && !r.cfg.AllowDefaultRoute {
+		return EphemeralAdded, ErrDefaultRoute.Format(i.CIDR)
+	}
+	if err := i.checkNextHops(); err != nil {
+		return EphemeralAdded, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.closedLocked(); err != nil {
+		return EphemeralAdded, err
+	}
+
+	if r.cfg.MinTTL > 0 {
+		if min := time.Now().Add(r.cfg.MinTTL); i.Expired.Before(min) {
+			i.Expired = min
+		}
+	}
+	if item := r.items.Match(i.IPNet); item != nil && !item.IsDefault() {
+		return EphemeralCovered, nil
+	}
+	if elem := r.ephemeralItems.Find(i.CIDR); elem != nil {
+		old := elem.Value.(*EphemeralItem)
+		if i.Expired.After(old.Expired) {
+			r.ephemeralItems.list.Remove(elem)
+			old.Expired = i.Expired
+			r.ephemeralItems.Add(old)
+		}
+		return EphemeralExtended, nil
+	}
+
+	if r.cfg.MaxEphemeral > 0 {
+		for r.ephemeralItems.Len() >= r.cfg.MaxEphemeral {
+			r.evictEphemeralItemLocked()
+		}
 	}
 
 	r.ephemeralItems.Add(i)
+	r.cfg.Metrics.IncAdd()
+	r.setGaugesLocked()
 	select {
 	case r.newEphemeralItem <- struct{}{}:
 	default:
 	}
-	return logex.Trace(r.SetRoute(i.CIDR))
+	err := r.applyRoute(i.CIDR, i.path(), true)
+	if logex.Equal(err, ErrRouteNotInstalled) {
+		r.rollbackLocked(i.CIDR)
+	}
+	return EphemeralAdded, logex.Trace(err)
+}
+
+func (r *Route) evictEphemeralItemLocked() {
+	i := r.ephemeralItems.GetFront()
+	if i == nil {
+		return
+	}
+	r.cfg.Logger.Infof("route '%v' is evicted", i.CIDR)
+	atomic.AddUint64(&r.evicted, 1)
+	if err := r.removeEphemeralItemLocked(i.CIDR); err != nil {
+		r.cfg.Logger.Errorf("remove route item fail: %v", err)
+	}
+	r.cfg.Metrics.IncExpire()
+}
+
+func (r *Route) EphemeralCount() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.ephemeralItems.Len()
+}
+
+// EphemeralEvicted returns the total number of evicted ephemeral items
+func (r *Route) EphemeralEvicted() uint64 {
+	return atomic.LoadUint64(&r.evicted)
 }
 
+// Match returns the most specific item (longest prefix) which contains the
+// ipnet, the ephemeral item wins if both have the same prefix length. the
+// hit counter of the item is increased.
 func (r *Route) Match(ipnet *net.IPNet) *Item {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	item := r.matchLocked(ipnet)
+	if item != nil {
+		// under the read lock, the item can't be removed meanwhile and
+		// leave the count behind, see forgetHits
+		r.hitsMutex.Lock()
+		r.hits[item.CIDR]++
+		r.hitsMutex.Unlock()
+	}
+	return item
+}
+
+// Stats returns the hit counts of all the current items keyed by CIDR
+func (r *Route) Stats() map[string]uint64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	r.hitsMutex.Lock()
+	defer r.hitsMutex.Unlock()
+
+	ret := make(map[string]uint64, len(*r.items)+r.ephemeralItems.Len())
+	for _, item := range *r.items {
+		ret[item.CIDR] = r.hits[item.CIDR]
+	}
+	for elem := r.ephemeralItems.list.Front(); elem != nil; elem = elem.Next() {
+		cidr := elem.Value.(*EphemeralItem).CIDR
+		ret[cidr] = r.hits[cidr]
+	}
+	return ret
+}
+
+// forgetHits drop the hit count of the item which is removed, a new item of
+// the same CIDR counts from zero.
+func (r *Route) forgetHits(cidr string) {
+	r.hitsMutex.Lock()
+	delete(r.hits, cidr)
+	r.hitsMutex.Unlock()
+}
+
+// ResetStats clear all the hit counts
+func (r *Route) ResetStats() {
+	r.hitsMutex.Lock()
+	r.hits = make(map[string]uint64)
+	r.hitsMutex.Unlock()
+}
+
+func (r *Route) matchLocked(ipnet *net.IPNet) *Item {
+	var ret *Item
 	if item := r.ephemeralItems.Match(ipnet); item != nil {
-		return item.Item
+		copied := *item.Item
+		ret = &copied
 	}
 	if item := r.items.Match(ipnet); item != nil {
-		return item
+		if ret == nil || item.Ones() > ret.Ones() {
+			ret = item
+		}
 	}
-	return nil
+	return ret
+}
+
+// MatchAll returns copies of all the persistent and ephemeral items which
+// contain the ipnet, ordered from the most specific to the least, the hit
+// counters are not changed.
+func (r *Route) MatchAll(ipnet *net.IPNet) []*Item {
+	r.mutex.RLock()
+	var ret []*Item
+	for elem := r.ephemeralItems.list.Front(); elem != nil; elem = elem.Next() {
+		if item := elem.Value.(*EphemeralItem); item.Match(ipnet) {
+			copied := *item.Item
+			ret = append(ret, &copied)
+		}
+	}
+	for _, item := range *r.items {
+		if item.Match(ipnet) {
+			copied := item
+			ret = append(ret, &copied)
+		}
+	}
+	r.mutex.RUnlock()
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Ones() > ret[j].Ones()
+	})
+	return ret
+}
+
+// MatchIP returns the most specific item which contains the ip
+func (r *Route) MatchIP(s string) (*Item, error) {
+	ipnet, err := parseIPNet(s)
+	if err != nil {
+		return nil, err
+	}
+	return r.Match(ipnet), nil
+}
+
+// Contains returns whether the exact cidr is installed as a persistent or
+// ephemeral item
+func (r *Route) Contains(cidr string) bool {
+	cidr, err := canonicalCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.items.Find(cidr) >= 0 || r.ephemeralItems.Find(cidr) != nil
+}
+
+// Covers returns the most specific item which is equal to or a supernet of
+// the cidr, returns nil if not found or the cidr is invalid
+func (r *Route) Covers(cidr string) *Item {
+	_, ipnet, err := net.ParseCIDR(FormatCIDR(cidr))
+	if err != nil {
+		return nil
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.matchLocked(ipnet)
 }
 
 func (r *Route) AddItem(i *Item) error {
-	if item := r.Match(i.IPNet); item != nil {
-		return ErrRouteItemContains.Format(i.CIDR, item.CIDR)
+	if i.IsDefault() && !r.cfg.AllowDefaultRoute {
+		return ErrDefaultRoute.Format(i.CIDR)
+	}
+	if err := i.checkNextHops(); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.addItemLocked(i)
+}
+
+// AddItemPreserveExceptions add the broad item like AddItem, and returns
+// the sorted CIDRs of the narrower items it covers. they are kept as the
+// exceptions: neither the items nor their routes are removed, and Match
+// prefers them by the longest prefix.
+func (r *Route) AddItemPreserveExceptions(i *Item) ([]string, error) {
+	if i.IsDefault() && !r.cfg.AllowDefaultRoute {
+		return nil, ErrDefaultRoute.Format(i.CIDR)
+	}
+	if err := i.checkNextHops(); err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.addItemLocked(i); err != nil {
+		return nil, err
+	}
+	return r.exceptionsLocked(i), nil
+}
+
+// exceptionsLocked returns the CIDRs of the items inside i except itself
+func (r *Route) exceptionsLocked(i *Item) []string {
+	var ret []string
+	for _, item := range *r.items {
+		if item.CIDR != i.CIDR && i.Match(item.IPNet) {
+			ret = append(ret, item.CIDR)
+		}
+	}
+	for elem := r.ephemeralItems.list.Front(); elem != nil; elem = elem.Next() {
+		item := elem.Value.(*EphemeralItem)
+		if item.CIDR != i.CIDR && i.Match(item.IPNet) {
+			ret = append(ret, item.CIDR)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// AddDefaultRoute add the default route DefaultRouteIPv4 or
+// DefaultRouteIPv6 regardless of Config.AllowDefaultRoute
+func (r *Route) AddDefaultRoute(cidr, comment string) error {
+	item, err := newDefaultItem(cidr, comment)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.addItemLocked(item)
+}
+
+// RemoveDefaultRoute remove the default route added by AddDefaultRoute
+func (r *Route) RemoveDefaultRoute(cidr string) error {
+	item, err := newDefaultItem(cidr, "")
+	if err != nil {
+		return err
 	}
-	r.items.Append(i)
+	return r.RemoveItem(item.CIDR)
+}
+
+func newDefaultItem(cidr, comment string) (*Item, error) {
+	item, err := NewItemCIDR(cidr, comment)
+	if err != nil {
+		return nil, err
+	}
+	if !item.IsDefault() {
+		return nil, ErrNotDefaultRoute.Format(cidr)
+	}
+	return item, nil
+}
+
+// addItemLocked returns ErrRouteItemContains if the item is covered by
+// another item except the default route.
+func (r *Route) addItemLocked(i *Item) error {
+	if err := r.closedLocked(); err != nil {
+		return err
+	}
+	if item := r.matchLocked(i.IPNet); item != nil && !item.IsDefault() {
+		return newContainsError(i.CIDR, item.CIDR)
+	}
+	added := r.items.Append(i)
 	r.items.Sort()
-	return logex.Trace(r.SetRoute(i.CIDR))
+	r.cfg.Metrics.IncAdd()
+	r.setGaugesLocked()
+	err := r.applyRoute(i.CIDR, i.path(), added)
+	if added && logex.Equal(err, ErrRouteNotInstalled) {
+		r.rollbackLocked(i.CIDR)
+	}
+	return logex.Trace(err)
 }
 
 func (r *Route) DeleteRoute(cidr string) error {
-	sh := genRemoveRouteCmd(cidr)
-	return logex.Trace(util.Shell(sh))
+	return r.runCmd(cidr, func(ctx context.Context) error {
+		return r.cfg.Backend.DeleteRoute(ctx, cidr)
+	})
 }
 
 func (r *Route) SetRoute(cidr string) error {
-	sh := genAddRouteCmd(r.devName, cidr)
-	return logex.Trace(util.Shell(sh))
+	return r.setRoute(cidr, routePath{})
+}
+
+func (r *Route) setRoute(cidr string, path routePath) error {
+	return r.runCmd(cidr, func(ctx context.Context) error {
+		devName, err := r.deviceName()
+		if err != nil {
+			return err
+		}
+		if err := setBackendRoute(ctx, r.cfg.Backend, devName, cidr, path); err != nil {
+			return err
+		}
+		if r.cfg.VerifyAfterSet {
+			return r.verifyRoute(ctx, devName, cidr)
+		}
+		return nil
+	})
+}
+
+// verifyRoute returns ErrRouteNotInstalled if the cidr is not routed to the
+// device.
+func (r *Route) verifyRoute(ctx context.Context, devName, cidr string) error {
+	listed, err := r.cfg.Backend.ListRoutes(ctx, devName)
+	if err != nil {
+		return err
+	}
+	ok, err := containsRoute(listed, cidr)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrRouteNotInstalled.Format(cidr)
+	}
+	return nil
+}
+
+// rollbackLocked remove the item whose route is not installed, see
+// Config.VerifyAfterSet.
+func (r *Route) rollbackLocked(cidr string) {
+	if r.items.Remove(cidr) == nil && r.ephemeralItems.Remove(cidr) == nil {
+		return
+	}
+	r.cfg.Logger.Errorf("route '%v' is not installed, the item is removed", cidr)
+	r.apply.ClearStatus(cidr)
+	r.forgetHits(cidr)
+	r.cfg.Metrics.IncRemove()
+	r.setGaugesLocked()
+}
+
+// Audit compare the items with the system route table of the device,
+// missing are the CIDRs of the items not in the table, the items still
+// pending to apply are skipped. unknown are the CIDRs in the table which are
+// not any item, e.g. left by another process.
+func (r *Route) Audit() (missing, unknown []string, err error) {
+	devName, err := r.deviceName()
+	if err != nil {
+		return nil, nil, err
+	}
+	var listed []string
+	err = r.runCmd(devName, func(ctx context.Context) error {
+		listed, err = r.cfg.Backend.ListRoutes(ctx, devName)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	kernel := make(map[string]bool, len(listed))
+	for _, cidr := range listed {
+		if c, err := parseRouteDest(cidr); err == nil {
+			cidr = c
+		}
+		kernel[cidr] = true
+	}
+
+	known := make(map[string]bool)
+	r.mutex.RLock()
+	cidrs := make([]string, 0, r.items.Len()+r.ephemeralItems.Len())
+	for _, item := range *r.items {
+		cidrs = append(cidrs, item.CIDR)
+	}
+	for elem := r.ephemeralItems.list.Front(); elem != nil; elem = elem.Next() {
+		cidrs = append(cidrs, elem.Value.(*EphemeralItem).CIDR)
+	}
+	r.mutex.RUnlock()
+	for _, cidr := range cidrs {
+		known[cidr] = true
+		if !kernel[cidr] && r.apply.Status(cidr) != StatusPending {
+			missing = append(missing, cidr)
+		}
+	}
+	for cidr := range kernel {
+		if !known[cidr] {
+			unknown = append(unknown, cidr)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(unknown)
+	return missing, unknown, nil
+}
+
+// deviceName resolve the interface name if bound by index, the last known
+// name is used if the interface can't be resolved.
+func (r *Route) deviceName() (string, error) {
+	r.devMutex.Lock()
+	defer r.devMutex.Unlock()
+	if r.cfg.IfIndex <= 0 {
+		return r.devName, nil
+	}
+	name, err := r.cfg.ResolveIfIndex(r.cfg.IfIndex)
+	if err != nil {
+		if r.devName == "" {
+			return "", logex.Trace(err)
+		}
+		r.cfg.Logger.Errorf("resolve interface %v error: %v, fallback to %v",
+			r.cfg.IfIndex, err, r.devName)
+		return r.devName, nil
+	}
+	if name != r.devName {
+		if r.devName != "" {
+			r.cfg.Logger.Infof("interface %v is renamed from %v to %v",
+				r.cfg.IfIndex, r.devName, name)
+		}
+		r.devName = name
+	}
+	return name, nil
 }
 
+func (r *Route) runCmd(cidr string, cmd func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.CmdTimeout)
+	defer cancel()
+	err := cmd(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return ErrRouteCmdTimeout.Format(cidr, r.cfg.CmdTimeout, err)
+	}
+	return logex.Trace(err)
+}
+
+// Load read the rule file, one item per line. empty lines and lines start
+// with '#' or ';' are ignored, the same CIDR appeared more than once is
+// merged and the last comment wins, only the conflicts between different
+// CIDRs are logged. the backup file is used if the rule file is unreadable.
 func (r *Route) Load(fp string) error {
-	rule, err := ioutil.ReadFile(fp)
+	conflicts, err := r.load(fp)
+	if err != nil {
+		return err
+	}
+	r.logConflicts(conflicts)
+	return nil
+}
+
+// LoadReader is like Load but read the rules from rd, there is no backup to
+// fallback.
+func (r *Route) LoadReader(rd io.Reader) error {
+	items, err := parseRules(rd, r.cfg.StrictCIDR)
+	if err != nil {
+		return err
+	}
+	r.logConflicts(r.loadItems(items))
+	return nil
+}
+
+func (r *Route) logConflicts(conflicts []error) {
+	for _, err := range conflicts {
+		r.cfg.Logger.Errorf("load item fail: %v", err)
+	}
+}
+
+// load returns the errors of the items which can't be added
+func (r *Route) load(fp string) ([]error, error) {
+	items, err := parseRuleFile(fp, r.cfg.StrictCIDR)
+	if err != nil {
+		bakItems, bakErr := parseRuleFile(fp+".bak", r.cfg.StrictCIDR)
+		if bakErr != nil {
+			return nil, logex.Trace(err)
+		}
+		r.cfg.Logger.Errorf("load %v fail, fallback to backup: %v", fp, err)
+		items = bakItems
+	}
+	return r.loadItems(items), nil
+}
+
+// loadItems returns the errors of the items which can't be added
+func (r *Route) loadItems(items []*Item) []error {
+	var conflicts []error
+	for _, item := range items {
+		if err := r.loadItem(item); err != nil {
+			conflicts = append(conflicts, err)
+		}
+	}
+	return conflicts
+}
+
+// loadItem add the item like AddItem, but the exists CIDR is only updated
+// in memory, so loading the same file again is a no-op.
+func (r *Route) loadItem(i *Item) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.closedLocked(); err != nil {
+		return err
+	}
+	if r.items.Find(i.CIDR) >= 0 {
+		r.items.Append(i)
+		return nil
+	}
+	return r.addItemLocked(i)
+}
+
+// parseRuleFile returns error if the file can't be read, or it's not empty
+// but no any item can be parsed.
+func parseRuleFile(fp string, strict bool) ([]*Item, error) {
+	f, err := os.Open(fp)
 	if err != nil {
-		return logex.Trace(err)
+		return nil, logex.Trace(err)
 	}
-	reader := bytes.NewBuffer(rule)
+	defer f.Close()
+	return parseRules(f, strict)
+}
+
+// parseRules is like parseRuleFile but read the rules from rd
+func parseRules(rd io.Reader, strict bool) ([]*Item, error) {
+	var items []*Item
+	var lastErr error
+	seen := make(map[string]*Item)
+	reader := bufio.NewReader(rd)
 	for {
 		line, err := reader.ReadBytes('\n')
 		if len(line) > 0 {
-			cmd := strings.TrimSpace(string(line))
-			sp := strings.Split(cmd, "\t")
-			cidr, comment := sp[0], ""
-			if len(sp) >= 2 {
-				comment = sp[1]
-			}
-			item, err := NewItemCIDR(cidr, comment)
+			item, err := parseRuleLine(string(line), strict)
 			if err != nil {
 				logex.Error(err)
-				continue
-			}
-			if err := r.AddItem(item); err != nil {
-				logex.Error("add item", cidr, "fail:", err.Error())
+				lastErr = err
+			} else if item == nil {
+				// skip
+			} else if old, ok := seen[item.CIDR]; ok {
+				old.Comment = item.Comment
+			} else {
+				seen[item.CIDR] = item
+				items = append(items, item)
 			}
 		}
-		if err != nil {
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
 	}
-	r.items.Sort()
+	if len(items) == 0 && lastErr != nil {
+		return nil, logex.Trace(lastErr)
+	}
+	return items, nil
+}
 
-	return nil
+// parseRuleLine returns nil item if the line is empty or a comment
+func parseRuleLine(line string, strict bool) (*Item, error) {
+	cmd := strings.TrimSpace(line)
+	if cmd == "" || cmd[0] == '#' || cmd[0] == ';' {
+		return nil, nil
+	}
+	sp := strings.Split(cmd, "\t")
+	cidr, comment, source := sp[0], "", SourceFile
+	if len(sp) >= 2 {
+		comment = unescapeComment(sp[1])
+	}
+	if len(sp) >= 3 && sp[2] != "" {
+		source = Source(sp[2])
+	}
+	var path routePath
+	if len(sp) >= 4 {
+		var err error
+		if path, err = parseRoutePath(sp[3]); err != nil {
+			return nil, err
+		}
+	}
+	newItem := NewItemCIDR
+	if strict {
+		newItem = NewItemCIDRStrict
+	}
+	item, err := newItem(cidr, comment)
+	if err != nil {
+		return nil, err
+	}
+	item.Source = source
+	if err := checkReplaceArgs(item.CIDR, path.gateway, path.metric); err != nil {
+		return nil, err
+	}
+	item.Gateway, item.Metric, item.NextHops = path.gateway, path.metric, path.hops
+	if err := item.checkNextHops(); err != nil {
+		return nil, err
+	}
+	return item, nil
 }
 
+// Save write the items to fp atomically.
 func (r *Route) Save(fp string) error {
 	buf := bytes.NewBuffer(nil)
+	if err := r.SaveWriter(buf); err != nil {
+		return err
+	}
+	if r.cfg.Backup {
+		old, err := ioutil.ReadFile(fp)
+		if err == nil {
+			err = util.WriteFileAtomic(fp+".bak", old, 0644)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return logex.Trace(err)
+		}
+	}
+	return logex.Trace(util.WriteFileAtomic(fp, buf.Bytes(), 0644))
+}
+
+// SaveWriter write the items to w in the format of the rule file, the
+// ephemeral items are not included. w is written without holding the lock.
+func (r *Route) SaveWriter(w io.Writer) error {
+	buf := bytes.NewBuffer(nil)
+	r.mutex.RLock()
 	for _, item := range *r.items {
 		fmt.Fprintln(buf, item)
 	}
-	return logex.Trace(ioutil.WriteFile(fp, buf.Bytes(), 0644))
+	r.mutex.RUnlock()
+	_, err := buf.WriteTo(w)
+	return logex.Trace(err)
 }
 
 func FormatCIDR(cidr string) string {
@@ -237,6 +1311,18 @@ func FormatCIDR(cidr string) string {
 	return cidr
 }
 
+// parseIPNet convert a single ip to a host route
+func parseIPNet(s string) (*net.IPNet, error) {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP: %v", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
 func checkValidCIDR(cidr string) error {
 	_, _, err := net.ParseCIDR(cidr)
 	if err != nil {
@@ -0,0 +1,158 @@
+//go:build darwin || freebsd || netbsd || openbsd
+// +build darwin freebsd netbsd openbsd
+
+package route
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// genAddRouteCmd returns ErrInvalidTable if table is not zero, the routing
+// tables are only supported on linux, so are the multipath routes. the
+// metric is the hopcount.
+func genAddRouteCmd(devName, cidr string, table int, gateway net.IP, metric int, hops ...NextHop) ([]string, error) {
+	cidr, err := sanitizeRouteArgs(devName, cidr)
+	if err != nil {
+		return nil, err
+	}
+	if table != 0 {
+		return nil, ErrInvalidTable.Format(table)
+	}
+	if len(hops) > 0 {
+		return nil, ErrMultipathUnsupported.Format(cidr)
+	}
+	argv := []string{"route", "add", "-net", cidr}
+	if gateway != nil {
+		argv = append(argv, gateway.String())
+	} else {
+		argv = append(argv, "-interface", devName)
+	}
+	if metric != 0 {
+		argv = append(argv, "-hopcount", strconv.Itoa(metric))
+	}
+	return argv, nil
+}
+
+// genReplaceRouteCmd change the gateway and the metric (hopcount) of the
+// route in place by `route change`, nothing is left stale.
+func genReplaceRouteCmd(devName, cidr string, table int, gateway net.IP, metric, oldMetric int) (argv, stale []string, err error) {
+	cidr, err = sanitizeRouteArgs(devName, cidr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if table != 0 {
+		return nil, nil, ErrInvalidTable.Format(table)
+	}
+	if err := checkReplaceArgs(cidr, gateway, metric); err != nil {
+		return nil, nil, err
+	}
+	argv = []string{"route", "change", "-net", cidr}
+	if gateway != nil {
+		argv = append(argv, gateway.String())
+	} else {
+		argv = append(argv, "-interface", devName)
+	}
+	if metric != 0 {
+		argv = append(argv, "-hopcount", strconv.Itoa(metric))
+	}
+	return argv, nil, nil
+}
+
+func genRemoveRouteCmd(cidr string, table int) ([]string, error) {
+	cidr, err := canonicalCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if table != 0 {
+		return nil, ErrInvalidTable.Format(table)
+	}
+	return []string{"route", "delete", "-net", cidr}, nil
+}
+
+// listRoutes read the static routes of the device by `netstat -rn`
+func listRoutes(ctx context.Context, output outputFunc, devName string, table int) ([]string, error) {
+	if table != 0 {
+		return nil, ErrInvalidTable.Format(table)
+	}
+	out, err := output(ctx, []string{"netstat", "-rn"})
+	if err != nil {
+		return nil, err
+	}
+	return parseNetstat(out, devName), nil
+}
+
+// parseNetstat returns the destinations of the static routes (flag S) of
+// the device, the columns are located by the header of each section.
+func parseNetstat(out []byte, devName string) []string {
+	var cidrs []string
+	ipv6 := false
+	flagsIdx, netifIdx := -1, -1
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case fields[0] == "Internet:":
+			ipv6 = false
+			continue
+		case fields[0] == "Internet6:":
+			ipv6 = true
+			continue
+		case fields[0] == "Destination":
+			flagsIdx, netifIdx = indexOf(fields, "Flags"), indexOf(fields, "Netif")
+			continue
+		}
+		if flagsIdx < 0 || netifIdx < 0 || len(fields) <= netifIdx {
+			continue
+		}
+		flags := fields[flagsIdx]
+		if fields[netifIdx] != devName || !strings.Contains(flags, "S") {
+			continue
+		}
+		dst := fields[0]
+		if dst == "default" {
+			dst = "0.0.0.0/0"
+			if ipv6 {
+				dst = "::/0"
+			}
+		} else if !ipv6 {
+			dst = expandNetstatDest(dst, strings.Contains(flags, "H"))
+		}
+		if cidr, err := parseRouteDest(dst); err == nil {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return cidrs
+}
+
+// expandNetstatDest complete the abbreviated IPv4 destination of darwin,
+// e.g. "10/8" or "192.168.1" for 192.168.1.0/24.
+func expandNetstatDest(dst string, host bool) string {
+	addr, bits := dst, ""
+	if idx := strings.Index(dst, "/"); idx >= 0 {
+		addr, bits = dst[:idx], dst[idx+1:]
+	}
+	octets := strings.Count(addr, ".") + 1
+	if bits == "" && !host {
+		bits = strconv.Itoa(8 * octets)
+	}
+	for ; octets < 4; octets++ {
+		addr += ".0"
+	}
+	if bits == "" {
+		return addr
+	}
+	return addr + "/" + bits
+}
+
+func indexOf(fields []string, s string) int {
+	for idx, f := range fields {
+		if f == s {
+			return idx
+		}
+	}
+	return -1
+}
@@ -0,0 +1,94 @@
+//go:build darwin || freebsd || netbsd || openbsd
+// +build darwin freebsd netbsd openbsd
+
+package route
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/test"
+)
+
+func TestGenRouteCmd(t *testing.T) {
+	defer test.New(t)
+
+	argv, err := genAddRouteCmd("tun0", "10.0.0.1/8", 0, nil, 0)
+	test.Nil(err)
+	test.Equal(argv, []string{"route", "add", "-net", "10.0.0.0/8", "-interface", "tun0"})
+	argv, err = genAddRouteCmd("tun0", "10.0.0.0/8", 0, net.ParseIP("192.168.1.1"), 10)
+	test.Nil(err)
+	test.Equal(argv, []string{"route", "add", "-net", "10.0.0.0/8", "192.168.1.1", "-hopcount", "10"})
+	argv, err = genRemoveRouteCmd("8.8.8.8", 0)
+	test.Nil(err)
+	test.Equal(argv, []string{"route", "delete", "-net", "8.8.8.8/32"})
+}
+
+func TestGenRouteCmdTable(t *testing.T) {
+	defer test.New(t)
+
+	_, err := genAddRouteCmd("tun0", "10.0.0.0/8", 100, nil, 0)
+	test.NotNil(err)
+	_, err = genRemoveRouteCmd("10.0.0.0/8", 100)
+	test.NotNil(err)
+}
+
+func TestGenRouteCmdMultipath(t *testing.T) {
+	defer test.New(t)
+
+	_, err := genAddRouteCmd("tun0", "10.0.0.0/8", 0, nil, 0, NextHop{Weight: 1})
+	test.True(logex.Equal(err, ErrMultipathUnsupported))
+}
+
+func TestGenReplaceRouteCmd(t *testing.T) {
+	defer test.New(t)
+
+	argv, stale, err := genReplaceRouteCmd("tun0", "10.0.0.1/8", 0, net.ParseIP("192.168.1.1"), 0, 0)
+	test.Nil(err)
+	test.Equal(argv, []string{"route", "change", "-net", "10.0.0.0/8", "192.168.1.1"})
+	test.Nil(stale)
+	argv, stale, err = genReplaceRouteCmd("tun0", "10.0.0.0/8", 0, nil, 10, 5)
+	test.Nil(err)
+	test.Equal(argv, []string{"route", "change", "-net", "10.0.0.0/8", "-interface", "tun0", "-hopcount", "10"})
+	test.Nil(stale)
+
+	_, _, err = genReplaceRouteCmd("tun0", "10.0.0.0/8", 100, nil, 0, 0)
+	test.True(logex.Equal(err, ErrInvalidTable))
+}
+
+func TestParseNetstat(t *testing.T) {
+	defer test.New(t)
+
+	out := `Routing tables
+
+Internet:
+Destination        Gateway            Flags        Netif Expire
+default            192.168.1.1        UGScg          en0
+10/8               utun3              USc          utun3
+10.8.0.2           10.8.0.1           UH           utun3
+172.16             utun3              USc          utun3
+8.8.8.8            utun3              UGHS         utun3
+
+Internet6:
+Destination                             Gateway                         Flags         Netif Expire
+default                                 fe80::%utun3                    UGcIg         utun3
+2001:db8::/32                           utun3                           USc           utun3
+fe80::%utun3/64                         fe80::1%utun3                   UcI           utun3
+`
+	test.Equal(parseNetstat([]byte(out), "utun3"), []string{
+		"10.0.0.0/8", "172.16.0.0/16", "8.8.8.8/32", "2001:db8::/32",
+	})
+}
+
+// listOutput fakes ShellBackend.Output, the cidrs are routed to devName
+func listOutput(devName string, cidrs ...string) func(ctx context.Context, argv ...string) ([]byte, error) {
+	return func(ctx context.Context, argv ...string) ([]byte, error) {
+		out := []byte("Routing tables\n\nInternet:\nDestination        Gateway            Flags        Netif Expire\n")
+		for _, cidr := range cidrs {
+			out = append(out, cidr+"    "+devName+"    USc    "+devName+"\n"...)
+		}
+		return out, nil
+	}
+}
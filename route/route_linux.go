@@ -1,14 +1,158 @@
 package route
 
-import "fmt"
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
 
-func genAddRouteCmd(devName, cidr string) string {
-	return fmt.Sprintf(
-		"ip route add %v dev %v",
-		FormatCIDR(cidr), devName,
-	)
+// genAddRouteCmd install the route into the routing table, zero means the
+// main table. the route goes through the gateway if it's not nil, or it's
+// multipath if hops are given, the nexthop arguments must be the last ones.
+func genAddRouteCmd(devName, cidr string, table int, gateway net.IP, metric int, hops ...NextHop) ([]string, error) {
+	cidr, err := sanitizeRouteArgs(devName, cidr)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkValidTable(table); err != nil {
+		return nil, err
+	}
+	argv := []string{"ip", "route", "add", cidr}
+	if len(hops) == 0 {
+		if gateway != nil {
+			argv = append(argv, "via", gateway.String())
+		}
+		argv = append(argv, "dev", devName)
+	}
+	if metric != 0 {
+		argv = append(argv, "metric", strconv.Itoa(metric))
+	}
+	argv = withTable(argv, table)
+	for _, h := range hops {
+		if err := h.check(); err != nil {
+			return nil, err
+		}
+		argv = append(argv, "nexthop")
+		if h.Gateway != nil {
+			argv = append(argv, "via", h.Gateway.String())
+		}
+		dev := h.Dev
+		if dev == "" {
+			dev = devName
+		}
+		argv = append(argv, "dev", dev)
+		if h.Weight != 0 {
+			argv = append(argv, "weight", strconv.Itoa(h.Weight))
+		}
+	}
+	return argv, nil
 }
 
-func genRemoveRouteCmd(cidr string) string {
-	return fmt.Sprintf("ip route delete %v", FormatCIDR(cidr))
+// genReplaceRouteCmd change the gateway and the metric of the route in
+// place by `ip route replace`. the routes are keyed by the metric as well,
+// so the one of oldMetric is left if the metric is changed, stale is the
+// command to delete it after replaced.
+func genReplaceRouteCmd(devName, cidr string, table int, gateway net.IP, metric, oldMetric int) (argv, stale []string, err error) {
+	cidr, err = sanitizeRouteArgs(devName, cidr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkValidTable(table); err != nil {
+		return nil, nil, err
+	}
+	if err := checkReplaceArgs(cidr, gateway, metric); err != nil {
+		return nil, nil, err
+	}
+	argv = []string{"ip", "route", "replace", cidr}
+	if gateway != nil {
+		argv = append(argv, "via", gateway.String())
+	}
+	argv = append(argv, "dev", devName)
+	if metric != 0 {
+		argv = append(argv, "metric", strconv.Itoa(metric))
+	}
+	if metric != oldMetric {
+		// the metric 0 is explicit, otherwise the first route of cidr is
+		// deleted whatever its metric is, e.g. the one just replaced.
+		stale = withTable([]string{"ip", "route", "delete", cidr, "metric", strconv.Itoa(oldMetric)}, table)
+	}
+	return withTable(argv, table), stale, nil
+}
+
+func genRemoveRouteCmd(cidr string, table int) ([]string, error) {
+	cidr, err := canonicalCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkValidTable(table); err != nil {
+		return nil, err
+	}
+	return withTable([]string{"ip", "route", "delete", cidr}, table), nil
+}
+
+func checkValidTable(table int) error {
+	if table < 0 || int64(table) > 1<<32-1 {
+		return ErrInvalidTable.Format(table)
+	}
+	return nil
+}
+
+func withTable(argv []string, table int) []string {
+	if table == 0 {
+		return argv
+	}
+	return append(argv, "table", strconv.Itoa(table))
+}
+
+// listRoutes read the IPv4 and IPv6 routes of the device by `ip route show`
+func listRoutes(ctx context.Context, output outputFunc, devName string, table int) ([]string, error) {
+	if err := checkValidTable(table); err != nil {
+		return nil, err
+	}
+	var cidrs []string
+	for _, family := range []string{"-4", "-6"} {
+		argv := withTable([]string{"ip", family, "route", "show", "dev", devName}, table)
+		out, err := output(ctx, argv)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, parseIPRouteShow(out, family == "-6")...)
+	}
+	return cidrs, nil
+}
+
+// parseIPRouteShow returns the destinations of the output of `ip route
+// show dev`, one route per line like "10.0.0.0/8 scope link".
+func parseIPRouteShow(out []byte, ipv6 bool) []string {
+	var cidrs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || isKernelRoute(fields) {
+			continue
+		}
+		dst := fields[0]
+		if dst == "unicast" && len(fields) > 1 {
+			dst = fields[1]
+		}
+		if dst == "default" {
+			dst = "0.0.0.0/0"
+			if ipv6 {
+				dst = "::/0"
+			}
+		}
+		if cidr, err := parseRouteDest(dst); err == nil {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return cidrs
+}
+
+func isKernelRoute(fields []string) bool {
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "proto" && fields[i+1] == "kernel" {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,184 @@
+package route
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/chzyer/flow"
+	"github.com/chzyer/logex"
+	"github.com/chzyer/test"
+)
+
+func TestGenRouteCmd(t *testing.T) {
+	defer test.New(t)
+
+	argv, err := genAddRouteCmd("tun0", "10.0.0.1/8", 0, nil, 0)
+	test.Nil(err)
+	test.Equal(argv, []string{"ip", "route", "add", "10.0.0.0/8", "dev", "tun0"})
+	argv, err = genAddRouteCmd("tun0", "10.0.0.0/8", 0, net.ParseIP("192.168.1.1"), 10)
+	test.Nil(err)
+	test.Equal(argv, []string{"ip", "route", "add", "10.0.0.0/8", "via", "192.168.1.1", "dev", "tun0", "metric", "10"})
+	argv, err = genRemoveRouteCmd("8.8.8.8", 0)
+	test.Nil(err)
+	test.Equal(argv, []string{"ip", "route", "delete", "8.8.8.8/32"})
+}
+
+func TestGenRouteCmdTable(t *testing.T) {
+	defer test.New(t)
+
+	argv, err := genAddRouteCmd("tun0", "10.0.0.0/8", 100, nil, 0)
+	test.Nil(err)
+	test.Equal(argv, []string{"ip", "route", "add", "10.0.0.0/8", "dev", "tun0", "table", "100"})
+	argv, err = genRemoveRouteCmd("10.0.0.0/8", 100)
+	test.Nil(err)
+	test.Equal(argv, []string{"ip", "route", "delete", "10.0.0.0/8", "table", "100"})
+
+	_, err = genAddRouteCmd("tun0", "10.0.0.0/8", -1, nil, 0)
+	test.NotNil(err)
+}
+
+func TestGenRouteCmdMultipath(t *testing.T) {
+	defer test.New(t)
+
+	hops := []NextHop{
+		{Gateway: net.ParseIP("192.168.1.1"), Dev: "eth0", Weight: 1},
+		{Gateway: net.ParseIP("192.168.2.1"), Dev: "eth1", Weight: 3},
+		{},
+	}
+	argv, err := genAddRouteCmd("tun0", "10.0.0.0/8", 100, nil, 0, hops...)
+	test.Nil(err)
+	test.Equal(argv, []string{"ip", "route", "add", "10.0.0.0/8", "table", "100",
+		"nexthop", "via", "192.168.1.1", "dev", "eth0", "weight", "1",
+		"nexthop", "via", "192.168.2.1", "dev", "eth1", "weight", "3",
+		"nexthop", "dev", "tun0",
+	})
+
+	// single path
+	argv, err = genAddRouteCmd("tun0", "10.0.0.0/8", 0, nil, 0, []NextHop{}...)
+	test.Nil(err)
+	test.Equal(argv, []string{"ip", "route", "add", "10.0.0.0/8", "dev", "tun0"})
+
+	_, err = genAddRouteCmd("tun0", "10.0.0.0/8", 0, nil, 0, NextHop{Weight: -1})
+	test.True(logex.Equal(err, ErrInvalidNextHop))
+	_, err = genAddRouteCmd("tun0", "10.0.0.0/8", 0, nil, 0, NextHop{Dev: "-eth0"})
+	test.True(logex.Equal(err, ErrInvalidNextHop))
+}
+
+func TestRouteMultipath(t *testing.T) {
+	defer test.New(t)
+
+	var cmds [][]string
+	backend := ShellBackend{Exec: func(ctx context.Context, argv ...string) error {
+		cmds = append(cmds, argv)
+		return nil
+	}}
+	r := NewRouteWithConfig(flow.New(), "tun0", &Config{Backend: backend, Sync: true})
+	defer r.flow.Close()
+
+	item, err := NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	item, err = NewItemCIDR("172.16.0.0/12", "")
+	test.Nil(err)
+	item.NextHops = []NextHop{{Weight: 2}, {Dev: "tun1", Weight: 1}}
+	test.Nil(r.AddItem(item))
+	test.Equal(cmds, [][]string{
+		{"ip", "route", "add", "10.0.0.0/8", "dev", "tun0"},
+		{"ip", "route", "add", "172.16.0.0/12",
+			"nexthop", "dev", "tun0", "weight", "2",
+			"nexthop", "dev", "tun1", "weight", "1"},
+	})
+
+	test.True(logex.Equal(backend.SetMultipathRoute(context.Background(), "tun0", "10.0.0.0/8", nil), ErrNoNextHop))
+}
+
+func TestGenReplaceRouteCmd(t *testing.T) {
+	defer test.New(t)
+
+	gw := net.ParseIP("192.168.1.1")
+	argv, stale, err := genReplaceRouteCmd("tun0", "10.0.0.1/8", 0, gw, 0, 0)
+	test.Nil(err)
+	test.Equal(argv, []string{"ip", "route", "replace", "10.0.0.0/8", "via", "192.168.1.1", "dev", "tun0"})
+	test.Nil(stale)
+
+	argv, stale, err = genReplaceRouteCmd("tun0", "10.0.0.0/8", 100, nil, 10, 5)
+	test.Nil(err)
+	test.Equal(argv, []string{"ip", "route", "replace", "10.0.0.0/8", "dev", "tun0", "metric", "10", "table", "100"})
+	test.Equal(stale, []string{"ip", "route", "delete", "10.0.0.0/8", "metric", "5", "table", "100"})
+
+	_, _, err = genReplaceRouteCmd("tun0", "10.0.0.0/8", 0, nil, -1, 0)
+	test.True(logex.Equal(err, ErrInvalidMetric))
+	_, _, err = genReplaceRouteCmd("tun0", "10.0.0.0/8", 0, net.ParseIP("2001:db8::1"), 0, 0)
+	test.True(logex.Equal(err, ErrInvalidGateway))
+}
+
+func TestRouteReplaceItemShell(t *testing.T) {
+	defer test.New(t)
+
+	var cmds [][]string
+	backend := ShellBackend{Exec: func(ctx context.Context, argv ...string) error {
+		cmds = append(cmds, argv)
+		return nil
+	}}
+	r := NewRouteWithConfig(flow.New(), "tun0", &Config{Backend: backend, Sync: true})
+	defer r.flow.Close()
+
+	item, err := NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	test.Nil(r.ReplaceItem("10.0.0.0/8", net.ParseIP("192.168.1.1"), 0))
+	test.Nil(r.ReplaceItem("10.0.0.0/8", nil, 10))
+	// the route is never deleted before replaced, only the stale one of
+	// the old metric is deleted after
+	test.Equal(cmds, [][]string{
+		{"ip", "route", "add", "10.0.0.0/8", "dev", "tun0"},
+		{"ip", "route", "replace", "10.0.0.0/8", "via", "192.168.1.1", "dev", "tun0"},
+		{"ip", "route", "replace", "10.0.0.0/8", "dev", "tun0", "metric", "10"},
+		{"ip", "route", "delete", "10.0.0.0/8", "metric", "0"},
+	})
+	items := r.GetItems()
+	test.Nil(items[0].Gateway)
+	test.Equal(items[0].Metric, 10)
+}
+
+func TestShellBackendListRoutes(t *testing.T) {
+	defer test.New(t)
+
+	var cmds [][]string
+	backend := ShellBackend{Table: 100, Output: func(ctx context.Context, argv ...string) ([]byte, error) {
+		cmds = append(cmds, argv)
+		if argv[1] == "-6" {
+			return []byte("2001:db8::1 metric 1024 pref medium\n" +
+				"fe80::/64 proto kernel metric 256 pref medium\n"), nil
+		}
+		return []byte("default scope link\n" +
+			"10.0.0.0/8 scope link\n" +
+			"10.8.0.0/24 proto kernel scope link src 10.8.0.1\n" +
+			"8.8.8.8 scope link\n"), nil
+	}}
+	cidrs, err := backend.ListRoutes(context.Background(), "tun0")
+	test.Nil(err)
+	test.Equal(cidrs, []string{"0.0.0.0/0", "10.0.0.0/8", "8.8.8.8/32", "2001:db8::1/128"})
+	test.Equal(cmds, [][]string{
+		{"ip", "-4", "route", "show", "dev", "tun0", "table", "100"},
+		{"ip", "-6", "route", "show", "dev", "tun0", "table", "100"},
+	})
+
+	_, err = backend.ListRoutes(context.Background(), "-tun0")
+	test.NotNil(err)
+}
+
+// listOutput fakes ShellBackend.Output, the cidrs are routed to devName
+func listOutput(devName string, cidrs ...string) func(ctx context.Context, argv ...string) ([]byte, error) {
+	return func(ctx context.Context, argv ...string) ([]byte, error) {
+		var out []byte
+		if argv[len(argv)-1] != devName || argv[1] == "-6" {
+			return out, nil
+		}
+		for _, cidr := range cidrs {
+			out = append(out, cidr+" scope link\n"...)
+		}
+		return out, nil
+	}
+}
@@ -0,0 +1,1834 @@
+package route
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/chzyer/flow"
+	"github.com/chzyer/logex"
+	"github.com/chzyer/test"
+)
+
+type fakeBackend struct {
+	delay    time.Duration
+	onSet    func(cidr string) error
+	onDelete func(cidr string)
+
+	mutex    sync.Mutex
+	added    []string
+	deleted  []string
+	replaced []string
+	via      []string
+	devs     []string
+	// kernel is returned by ListRoutes
+	kernel []string
+}
+
+func (b *fakeBackend) wait(ctx context.Context) error {
+	if b.delay == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(b.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *fakeBackend) SetRoute(ctx context.Context, devName, cidr string) error {
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	if b.onSet != nil {
+		if err := b.onSet(cidr); err != nil {
+			return err
+		}
+	}
+	b.mutex.Lock()
+	b.added = append(b.added, cidr)
+	b.devs = append(b.devs, devName)
+	b.mutex.Unlock()
+	return nil
+}
+
+func (b *fakeBackend) DeleteRoute(ctx context.Context, cidr string) error {
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	if b.onDelete != nil {
+		b.onDelete(cidr)
+	}
+	b.mutex.Lock()
+	b.deleted = append(b.deleted, cidr)
+	b.mutex.Unlock()
+	return nil
+}
+
+func (b *fakeBackend) ReplaceRoute(ctx context.Context, devName, cidr string, gateway net.IP, metric, oldMetric int) error {
+	if err := b.wait(ctx); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	b.replaced = append(b.replaced, fmt.Sprintf("%v %v %v", cidr, gateway, metric))
+	b.mutex.Unlock()
+	return nil
+}
+
+func (b *fakeBackend) SetRouteVia(ctx context.Context, devName, cidr string, gateway net.IP, metric int) error {
+	if err := b.SetRoute(ctx, devName, cidr); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	b.via = append(b.via, fmt.Sprintf("%v %v %v", cidr, gateway, metric))
+	b.mutex.Unlock()
+	return nil
+}
+
+func (b *fakeBackend) ListRoutes(ctx context.Context, devName string) ([]string, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string(nil), b.kernel...), nil
+}
+
+func (b *fakeBackend) Added() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string(nil), b.added...)
+}
+
+func (b *fakeBackend) Via() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string(nil), b.via...)
+}
+
+func (b *fakeBackend) Devs() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string(nil), b.devs...)
+}
+
+func (b *fakeBackend) Deleted() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string(nil), b.deleted...)
+}
+
+func (b *fakeBackend) Replaced() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string(nil), b.replaced...)
+}
+
+// newTestRoute returns a Route executing the route commands synchronously
+func newTestRoute(cfg *Config) (*Route, *fakeBackend) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	cfg.Sync = true
+	b, ok := cfg.Backend.(*fakeBackend)
+	if !ok {
+		b = &fakeBackend{}
+		cfg.Backend = b
+	}
+	return NewRouteWithConfig(flow.New(), "utun0", cfg), b
+}
+
+func TestRouteCmdTimeout(t *testing.T) {
+	defer test.New(t)
+
+	r, _ := newTestRoute(&Config{
+		Backend:    &fakeBackend{delay: time.Second},
+		CmdTimeout: 20 * time.Millisecond,
+	})
+	defer r.flow.Close()
+
+	now := time.Now()
+	err := r.SetRoute("10.0.0.0/8")
+	test.True(time.Since(now) < 500*time.Millisecond)
+	test.True(logex.Equal(err, ErrRouteCmdTimeout))
+	test.True(strings.Contains(err.Error(), "10.0.0.0/8"))
+
+	err = r.DeleteRoute("10.0.0.0/8")
+	test.True(logex.Equal(err, ErrRouteCmdTimeout))
+}
+
+func TestRouteLoadMessy(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+
+	test.Nil(r.Load("testdata/messy.rules"))
+	items := r.GetItems()
+	test.Equal(len(items), 4)
+	test.Equal(items[0].CIDR, "8.8.8.8/32")
+	test.Equal(items[0].Comment, "google dns")
+	test.Equal(items[1].CIDR, "10.1.0.0/16")
+	test.Equal(items[1].Comment, "office-hq")
+	test.Equal(items[2].CIDR, "172.16.0.0/12")
+	test.Equal(items[2].Comment, "")
+	test.Equal(items[3].CIDR, "192.168.100.0/24")
+	test.Equal(len(b.Added()), 4)
+}
+
+func newTestEphemeralItem(cidr string, ttl time.Duration) *EphemeralItem {
+	item, err := NewItemCIDR(cidr, "")
+	if err != nil {
+		panic(err)
+	}
+	return &EphemeralItem{Item: item, Expired: time.Now().Add(ttl)}
+}
+
+func TestRouteAddEphemeralItem(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+
+	item, err := NewItemCIDR("1.2.3.0/24", "persist")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+
+	result, err := r.AddEphemeralItem(newTestEphemeralItem("1.2.3.4", time.Hour))
+	test.Nil(err)
+	test.Equal(result, EphemeralCovered)
+	test.Equal(len(r.GetEphemeralItems()), 0)
+
+	result, err = r.AddEphemeralItem(newTestEphemeralItem("4.3.2.1", time.Hour))
+	test.Nil(err)
+	test.Equal(result, EphemeralAdded)
+
+	ei := newTestEphemeralItem("4.3.2.1", 2*time.Hour)
+	result, err = r.AddEphemeralItem(ei)
+	test.Nil(err)
+	test.Equal(result, EphemeralExtended)
+	eis := r.GetEphemeralItems()
+	test.Equal(len(eis), 1)
+	test.Equal(eis[0].Expired, ei.Expired)
+
+	// shorter ttl never shrink the existing one
+	result, err = r.AddEphemeralItem(newTestEphemeralItem("4.3.2.1", time.Minute))
+	test.Nil(err)
+	test.Equal(result, EphemeralExtended)
+	test.Equal(r.GetEphemeralItems()[0].Expired, ei.Expired)
+
+	test.Equal(b.Added(), []string{"1.2.3.0/24", "4.3.2.1/32"})
+}
+
+func TestRoutePersistEphemeralItem(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+
+	_, err := r.AddEphemeralItem(newTestEphemeralItem("1.2.3.4", time.Hour))
+	test.Nil(err)
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("4.3.2.1", time.Hour))
+	test.Nil(err)
+	item, err := NewItemCIDR("1.2.3.0/24", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+
+	err = r.PersistEphemeralItem("1.2.3.4/32")
+	test.True(errors.Is(err, ErrRouteItemContains))
+	test.True(strings.Contains(err.Error(), "1.2.3.0/24"))
+	test.Equal(b.Deleted(), []string{"1.2.3.4/32"})
+
+	err = r.PersistEphemeralItem("1.2.3.4/32")
+	test.True(errors.Is(err, ErrRouteItemNotFound))
+
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("5.6.7.8", time.Hour))
+	test.Nil(err)
+	result := r.PersistAll()
+	test.Equal(result, map[string]error{"4.3.2.1/32": nil, "5.6.7.8/32": nil})
+	test.Equal(len(r.GetEphemeralItems()), 0)
+	test.Equal(len(r.GetItems()), 3)
+}
+
+func TestRouteMaxEphemeral(t *testing.T) {
+	defer test.New(t)
+
+	r, _ := newTestRoute(&Config{MaxEphemeral: 3})
+	defer r.flow.Close()
+
+	for i := 1; i <= 5; i++ {
+		ei := newTestEphemeralItem(fmt.Sprintf("10.0.0.%v", i), time.Duration(i)*time.Hour)
+		_, err := r.AddEphemeralItem(ei)
+		test.Nil(err)
+	}
+	test.Equal(r.EphemeralCount(), 3)
+	test.Equal(r.EphemeralEvicted(), uint64(2))
+}
+
+func TestRouteMaxEphemeralEvictOldest(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(&Config{MaxEphemeral: 2})
+	defer r.flow.Close()
+
+	for _, cidr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		_, err := r.AddEphemeralItem(newTestEphemeralItem(cidr, time.Hour))
+		test.Nil(err)
+	}
+	test.Equal(b.Deleted(), []string{"10.0.0.1/32"})
+	eis := r.GetEphemeralItems()
+	test.Equal(len(eis), 2)
+	test.Equal(eis[0].CIDR, "10.0.0.2/32")
+	test.Equal(eis[1].CIDR, "10.0.0.3/32")
+
+	// zero means unbounded
+	r2, b2 := newTestRoute(nil)
+	defer r2.flow.Close()
+	for i := 0; i < 10; i++ {
+		_, err := r2.AddEphemeralItem(newTestEphemeralItem(fmt.Sprintf("10.0.1.%v", i), time.Hour))
+		test.Nil(err)
+	}
+	test.Equal(r2.EphemeralCount(), 10)
+	test.Equal(len(b2.Deleted()), 0)
+}
+
+func TestRouteMatchIP(t *testing.T) {
+	defer test.New(t)
+
+	r, _ := newTestRoute(nil)
+	defer r.flow.Close()
+
+	for _, cidr := range []string{"10.1.2.3/32", "10.1.0.0/16"} {
+		item, err := NewItemCIDR(cidr, "")
+		test.Nil(err)
+		test.Nil(r.AddItem(item))
+	}
+	_, err := r.AddEphemeralItem(newTestEphemeralItem("10.0.0.0/8", time.Hour))
+	test.Nil(err)
+
+	for ip, cidr := range map[string]string{
+		"10.1.2.3": "10.1.2.3/32",
+		"10.1.9.9": "10.1.0.0/16",
+		"10.9.9.9": "10.0.0.0/8",
+	} {
+		item, err := r.MatchIP(ip)
+		test.Nil(err)
+		test.NotNil(item)
+		test.Equal(item.CIDR, cidr)
+	}
+
+	item, err := r.MatchIP("11.0.0.1")
+	test.Nil(err)
+	test.Nil(item)
+
+	_, err = r.MatchIP("10.1.2.3/32")
+	test.NotNil(err)
+	_, err = r.MatchIP("bad")
+	test.NotNil(err)
+}
+
+func TestRouteSaveBackup(t *testing.T) {
+	defer test.New(t)
+
+	dir, err := ioutil.TempDir("", "route")
+	test.Nil(err)
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "route.rules")
+
+	r, _ := newTestRoute(&Config{Backup: true})
+	defer r.flow.Close()
+	item, err := NewItemCIDR("10.0.0.0/8", "first")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	test.Nil(r.Save(fp))
+	_, err = os.Stat(fp + ".bak")
+	test.True(os.IsNotExist(err))
+
+	item, err = NewItemCIDR("8.8.8.8", "second")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	test.Nil(r.Save(fp))
+	bak, err := ioutil.ReadFile(fp + ".bak")
+	test.Nil(err)
+	test.Equal(string(bak), "10.0.0.0/8\tfirst\n")
+
+	// simulate a partial write of the rule file
+	test.Nil(ioutil.WriteFile(fp, []byte("10.0."), 0644))
+	r2, _ := newTestRoute(nil)
+	defer r2.flow.Close()
+	test.Nil(r2.Load(fp))
+	test.Equal(cidrs(r2.GetItems()), []string{"10.0.0.0/8"})
+
+	// no temp file is left
+	files, err := ioutil.ReadDir(dir)
+	test.Nil(err)
+	test.Equal(len(files), 2)
+}
+
+// waitFor polling the cond until it's true or timed out
+func waitFor(cond func() bool) bool {
+	timeout := time.Now().Add(time.Second)
+	for time.Now().Before(timeout) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
+
+func TestRouteLoopRecover(t *testing.T) {
+	defer test.New(t)
+
+	b := &fakeBackend{onDelete: func(cidr string) {
+		if cidr == "10.0.0.1/32" {
+			panic("boom")
+		}
+	}}
+	r, _ := newTestRoute(&Config{Backend: b})
+	test.True(waitFor(r.Healthy))
+
+	_, err := r.AddEphemeralItem(newTestEphemeralItem("10.0.0.1", 10*time.Millisecond))
+	test.Nil(err)
+	test.True(waitFor(func() bool { return r.EphemeralCount() == 0 }))
+	test.True(waitFor(r.Healthy))
+
+	// the loop still reaps the expired items
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("10.0.0.2", 10*time.Millisecond))
+	test.Nil(err)
+	test.True(waitFor(func() bool { return len(b.Deleted()) == 1 }))
+	test.Equal(b.Deleted(), []string{"10.0.0.2/32"})
+
+	r.flow.Close()
+	test.True(waitFor(func() bool { return !r.Healthy() }))
+}
+
+func TestRouteSource(t *testing.T) {
+	defer test.New(t)
+
+	dir, err := ioutil.TempDir("", "route")
+	test.Nil(err)
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "route.rules")
+	test.Nil(ioutil.WriteFile(fp, []byte(
+		"10.0.0.0/8\tlegacy\n"+
+			"8.8.8.8/32\t\tdns\n"+
+			"9.9.9.9/32\tquad9\tmanual\n",
+	), 0644))
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+	test.Nil(r.Load(fp))
+	items := r.GetItems()
+	test.Equal(items[0].Source, SourceDNS)
+	test.Equal(items[1].Source, SourceManual)
+	test.Equal(items[2].Source, SourceFile)
+
+	ei := newTestEphemeralItem("1.1.1.1", time.Hour)
+	ei.Source = SourceDNS
+	_, err = r.AddEphemeralItem(ei)
+	test.Nil(err)
+
+	test.Nil(r.Save(fp))
+	data, err := ioutil.ReadFile(fp)
+	test.Nil(err)
+	test.Equal(string(data), "8.8.8.8/32\t\tdns\n"+
+		"9.9.9.9/32\tquad9\tmanual\n"+
+		"10.0.0.0/8\tlegacy\n")
+
+	test.Equal(len(r.RemoveBySource(SourceDNS)), 0)
+	test.Equal(b.Deleted(), []string{"8.8.8.8/32", "1.1.1.1/32"})
+	test.Equal(cidrs(r.GetItems()), []string{"9.9.9.9/32", "10.0.0.0/8"})
+	test.Equal(r.EphemeralCount(), 0)
+}
+
+func TestRouteApplyQueue(t *testing.T) {
+	defer test.New(t)
+
+	gate := make(chan struct{})
+	b := &fakeBackend{onSet: func(cidr string) error {
+		if cidr == "10.0.0.1/32" {
+			<-gate
+		}
+		if cidr == "10.0.0.3/32" {
+			return fmt.Errorf("rejected")
+		}
+		return nil
+	}}
+	r := NewRouteWithConfig(flow.New(), "utun0", &Config{Backend: b})
+	defer r.flow.Close()
+
+	for _, cidr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		item, err := NewItemCIDR(cidr, "")
+		test.Nil(err)
+		test.Nil(r.AddItem(item))
+	}
+	items := r.GetItems()
+	test.Equal(items[0].Status, StatusPending)
+	test.Equal(items[1].Status, StatusPending)
+
+	// 10.0.0.1 is executing, 10.0.0.2 is still pending
+	test.Nil(r.RemoveItem("10.0.0.2/32"))
+	close(gate)
+
+	test.True(waitFor(func() bool {
+		items := r.GetItems()
+		return items[0].Status == StatusApplied && items[1].Status == StatusFailed
+	}))
+	test.Equal(cidrs(r.GetItems()), []string{"10.0.0.1/32", "10.0.0.3/32"})
+	test.Equal(b.Added(), []string{"10.0.0.1/32"})
+	test.Equal(len(b.Deleted()), 0)
+
+	test.Nil(r.RemoveItem("10.0.0.1/32"))
+	test.True(waitFor(func() bool { return len(b.Deleted()) == 1 }))
+}
+
+func TestRouteRemoveMatching(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+
+	for cidr, comment := range map[string]string{
+		"10.0.0.1": "peer-7",
+		"10.0.0.2": "peer-8",
+		"10.0.0.3": "peer-7",
+	} {
+		item, err := NewItemCIDR(cidr, comment)
+		test.Nil(err)
+		test.Nil(r.AddItem(item))
+	}
+	for cidr, comment := range map[string]string{
+		"10.0.1.1": "peer-7",
+		"10.0.1.2": "peer-8",
+	} {
+		ei := newTestEphemeralItem(cidr, time.Hour)
+		ei.Comment = comment
+		_, err := r.AddEphemeralItem(ei)
+		test.Nil(err)
+	}
+
+	errs := r.RemoveMatching(func(i Item) bool { return i.Comment == "peer-7" })
+	test.Equal(len(errs), 0)
+	test.Equal(cidrs(r.GetItems()), []string{"10.0.0.2/32"})
+	eis := r.GetEphemeralItems()
+	test.Equal(len(eis), 1)
+	test.Equal(eis[0].CIDR, "10.0.1.2/32")
+	test.Equal(len(b.Deleted()), 3)
+}
+
+func TestRouteLoadIdempotent(t *testing.T) {
+	defer test.New(t)
+
+	dir, err := ioutil.TempDir("", "route")
+	test.Nil(err)
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "route.rules")
+	test.Nil(ioutil.WriteFile(fp, []byte(
+		"10.0.0.0/16\tb\n"+
+			"10.0.0.0/8\ta\n"+
+			"1.1.1.1\tdns\n",
+	), 0644))
+
+	r1, b1 := newTestRoute(nil)
+	defer r1.flow.Close()
+	test.Nil(r1.Load(fp))
+	once := filepath.Join(dir, "once.rules")
+	test.Nil(r1.Save(once))
+
+	r2, b2 := newTestRoute(nil)
+	defer r2.flow.Close()
+	test.Nil(r2.Load(fp))
+	test.Nil(r2.Load(fp))
+	twice := filepath.Join(dir, "twice.rules")
+	test.Nil(r2.Save(twice))
+
+	data1, err := ioutil.ReadFile(once)
+	test.Nil(err)
+	data2, err := ioutil.ReadFile(twice)
+	test.Nil(err)
+	test.Equal(string(data1), string(data2))
+	test.Equal(string(data1), "1.1.1.1/32\tdns\n10.0.0.0/8\ta\n10.0.0.0/16\tb\n")
+	test.Equal(b1.Added(), b2.Added())
+}
+
+func TestRouteQueryEphemeralItems(t *testing.T) {
+	defer test.New(t)
+
+	r, _ := newTestRoute(nil)
+	defer r.flow.Close()
+
+	for idx, cidr := range []string{"10.0.0.1", "10.0.0.2", "10.0.1.1", "10.0.1.2"} {
+		ei := newTestEphemeralItem(cidr, time.Duration(idx+1)*time.Hour)
+		_, err := r.AddEphemeralItem(ei)
+		test.Nil(err)
+	}
+
+	eis := r.GetEphemeralItems()
+	test.Equal(len(eis), 4)
+	test.True(eis[0].Remaining > 59*time.Minute)
+	test.True(eis[0].Remaining <= time.Hour)
+
+	eis = r.QueryEphemeralItems(1, 2, nil)
+	test.Equal(len(eis), 2)
+	test.Equal(eis[0].CIDR, "10.0.0.2/32")
+	test.Equal(eis[1].CIDR, "10.0.1.1/32")
+
+	eis = r.QueryEphemeralItems(1, -1, func(s *EphemeralSnapshot) bool {
+		return strings.HasPrefix(s.CIDR, "10.0.1.")
+	})
+	test.Equal(len(eis), 1)
+	test.Equal(eis[0].CIDR, "10.0.1.2/32")
+
+	test.Equal(len(r.QueryEphemeralItems(10, -1, nil)), 0)
+}
+
+func TestGenRouteCmdInjection(t *testing.T) {
+	defer test.New(t)
+
+	for _, cidr := range []string{
+		"1.2.3.4; rm -rf /",
+		"1.2.3.0/24 dev eth0",
+		"$(reboot)",
+		"-net",
+		"1.2.3.4/24\n",
+		"",
+	} {
+		_, err := genAddRouteCmd("tun0", cidr, 0, nil, 0)
+		test.NotNil(err)
+		_, err = genRemoveRouteCmd(cidr, 0)
+		test.NotNil(err)
+	}
+
+	for _, dev := range []string{
+		"tun0;reboot",
+		"tun0 table 1",
+		"-interface",
+		"`id`",
+		"averyveryverylongname",
+		"",
+	} {
+		_, err := genAddRouteCmd(dev, "10.0.0.0/8", 0, nil, 0)
+		test.NotNil(err)
+	}
+
+	_, err := genAddRouteCmd("utun1", "2001:db8::1/64", 0, nil, 0)
+	test.Nil(err)
+}
+
+func TestRouteContainsCovers(t *testing.T) {
+	defer test.New(t)
+
+	r, _ := newTestRoute(nil)
+	defer r.flow.Close()
+
+	item, err := NewItemCIDR("10.1.0.0/16", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("192.168.1.1", time.Hour))
+	test.Nil(err)
+
+	// exact hit
+	test.True(r.Contains("10.1.0.0/16"))
+	test.True(r.Contains("10.1.2.3/16"))
+	test.True(r.Contains("192.168.1.1"))
+	test.Equal(r.Covers("10.1.0.0/16").CIDR, "10.1.0.0/16")
+
+	// covered but not equal
+	test.False(r.Contains("10.1.2.0/24"))
+	test.Equal(r.Covers("10.1.2.0/24").CIDR, "10.1.0.0/16")
+	test.Equal(r.Covers("10.1.2.3").CIDR, "10.1.0.0/16")
+
+	// not covered
+	test.False(r.Contains("10.0.0.0/8"))
+	test.Nil(r.Covers("10.0.0.0/8"))
+	test.Nil(r.Covers("192.168.1.0/24"))
+
+	test.False(r.Contains("invalid"))
+	test.Nil(r.Covers("invalid"))
+}
+
+func TestRouteLoadDuplicate(t *testing.T) {
+	defer test.New(t)
+
+	dir, err := ioutil.TempDir("", "route")
+	test.Nil(err)
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "route.rules")
+	// two concatenated rule files
+	test.Nil(ioutil.WriteFile(fp, []byte(
+		"10.0.0.0/8\tfirst\n"+
+			"1.1.1.1\tdns\n"+
+			"10.0.0.0/8\tsecond\n"+
+			"10.2.0.0/16\toverlap\n"+
+			"1.1.1.1\tdns\n",
+	), 0644))
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+	conflicts, err := r.load(fp)
+	test.Nil(err)
+	test.Equal(len(conflicts), 1)
+	test.True(errors.Is(conflicts[0], ErrRouteItemContains))
+	test.True(strings.Contains(conflicts[0].Error(), "10.2.0.0/16"))
+
+	items := r.GetItems()
+	test.Equal(cidrs(items), []string{"1.1.1.1/32", "10.0.0.0/8"})
+	test.Equal(items[1].Comment, "second")
+	test.Equal(b.Added(), []string{"10.0.0.0/8", "1.1.1.1/32"})
+
+	// loading again reports the same conflict only
+	conflicts, err = r.load(fp)
+	test.Nil(err)
+	test.Equal(len(conflicts), 1)
+}
+
+func TestNewItemCIDRStrict(t *testing.T) {
+	defer test.New(t)
+
+	_, err := NewItemCIDRStrict("10.0.0.5/24", "")
+	test.True(logex.Equal(err, ErrCIDRHostBits))
+	test.True(strings.Contains(err.Error(), "10.0.0.0/24"))
+
+	for _, cidr := range []string{"10.0.0.0/24", "10.0.0.5/32", "10.0.0.5", "2001:db8::/32"} {
+		item, err := NewItemCIDRStrict(cidr, "")
+		test.Nil(err)
+		test.NotNil(item)
+	}
+	_, err = NewItemCIDRStrict("2001:db8::1/32", "")
+	test.NotNil(err)
+	_, err = NewItemCIDRStrict("invalid/24", "")
+	test.NotNil(err)
+
+	// the lenient one masks off the host bits
+	item, err := NewItemCIDR("10.0.0.5/24", "")
+	test.Nil(err)
+	test.Equal(item.CIDR, "10.0.0.0/24")
+}
+
+func TestRouteLoadStrict(t *testing.T) {
+	defer test.New(t)
+
+	dir, err := ioutil.TempDir("", "route")
+	test.Nil(err)
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "route.rules")
+	test.Nil(ioutil.WriteFile(fp, []byte("10.0.0.5/24\thost\n10.1.0.0/16\tnet\n"), 0644))
+
+	r, _ := newTestRoute(&Config{StrictCIDR: true})
+	defer r.flow.Close()
+	test.Nil(r.Load(fp))
+	test.Equal(cidrs(r.GetItems()), []string{"10.1.0.0/16"})
+
+	r2, _ := newTestRoute(nil)
+	defer r2.flow.Close()
+	test.Nil(r2.Load(fp))
+	test.Equal(cidrs(r2.GetItems()), []string{"10.0.0.0/24", "10.1.0.0/16"})
+}
+
+type captureLogger struct {
+	mutex sync.Mutex
+	logs  []string
+}
+
+func (l *captureLogger) Infof(format string, args ...interface{}) {
+	l.mutex.Lock()
+	l.logs = append(l.logs, fmt.Sprintf(format, args...))
+	l.mutex.Unlock()
+}
+
+func (l *captureLogger) Errorf(format string, args ...interface{}) {
+	l.Infof(format, args...)
+}
+
+func (l *captureLogger) Logs() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.logs...)
+}
+
+func TestRouteLogger(t *testing.T) {
+	defer test.New(t)
+
+	l := &captureLogger{}
+	r, _ := newTestRoute(&Config{Logger: l})
+	defer r.flow.Close()
+
+	_, err := r.AddEphemeralItem(newTestEphemeralItem("1.2.3.4", 10*time.Millisecond))
+	test.Nil(err)
+	test.True(waitFor(func() bool { return len(l.Logs()) > 0 }))
+	test.Equal(l.Logs(), []string{"route '1.2.3.4/32' is expired"})
+}
+
+func TestRouteStats(t *testing.T) {
+	defer test.New(t)
+
+	r, _ := newTestRoute(nil)
+	defer r.flow.Close()
+
+	for _, cidr := range []string{"10.1.0.0/16", "10.2.0.0/16"} {
+		item, err := NewItemCIDR(cidr, "")
+		test.Nil(err)
+		test.Nil(r.AddItem(item))
+	}
+	_, err := r.AddEphemeralItem(newTestEphemeralItem("1.2.3.4", time.Hour))
+	test.Nil(err)
+
+	for i := 0; i < 3; i++ {
+		item, err := r.MatchIP("10.1.2.3")
+		test.Nil(err)
+		test.NotNil(item)
+	}
+	_, err = r.MatchIP("1.2.3.4")
+	test.Nil(err)
+	_, err = r.MatchIP("11.0.0.1")
+	test.Nil(err)
+	// lookups which are not on the forwarding path are not counted
+	test.NotNil(r.Covers("10.2.0.0/24"))
+
+	test.Equal(r.Stats(), map[string]uint64{
+		"10.1.0.0/16": 3,
+		"10.2.0.0/16": 0,
+		"1.2.3.4/32":  1,
+	})
+
+	r.ResetStats()
+	test.Equal(r.Stats()["10.1.0.0/16"], uint64(0))
+
+	// the items which leave drop their hits, the new ones count from zero
+	hit := func(ip string) {
+		_, err := r.MatchIP(ip)
+		test.Nil(err)
+	}
+	hit("10.1.2.3")
+	hit("10.2.2.3")
+	hit("1.2.3.4")
+	test.Nil(r.RemoveItem("10.1.0.0/16"))
+	test.Equal(len(r.RemoveMatching(func(i Item) bool { return i.CIDR == "10.2.0.0/16" })), 0)
+	test.Nil(r.RemoveEphemeralItem("1.2.3.4/32"))
+	r.hitsMutex.Lock()
+	test.Equal(len(r.hits), 0)
+	r.hitsMutex.Unlock()
+
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("5.6.7.8", 20*time.Millisecond))
+	test.Nil(err)
+	hit("5.6.7.8")
+	test.True(waitFor(func() bool { return r.EphemeralCount() == 0 }))
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("5.6.7.8", time.Hour))
+	test.Nil(err)
+	test.Equal(r.Stats(), map[string]uint64{"5.6.7.8/32": 0})
+}
+
+func TestRouteSaveOrder(t *testing.T) {
+	defer test.New(t)
+
+	dir, err := ioutil.TempDir("", "route")
+	test.Nil(err)
+	defer os.RemoveAll(dir)
+
+	cidrs := []string{
+		"2001:db8::/32", "10.0.0.0/16", "8.8.8.8/32", "10.0.0.0/8",
+		"192.168.0.0/16", "1.1.1.0/24", "2001:db8:1::/48",
+	}
+	orders := [][]int{
+		{0, 1, 2, 3, 4, 5, 6},
+		{6, 5, 4, 3, 2, 1, 0},
+		{2, 0, 5, 1, 6, 4, 3},
+	}
+	var outputs []string
+	for idx, order := range orders {
+		r, _ := newTestRoute(nil)
+		for _, i := range order {
+			item, err := NewItemCIDR(cidrs[i], "")
+			test.Nil(err)
+			r.mutex.Lock()
+			r.items.Append(item)
+			r.items.Sort()
+			r.mutex.Unlock()
+		}
+		fp := filepath.Join(dir, fmt.Sprintf("%v.rules", idx))
+		test.Nil(r.Save(fp))
+		data, err := ioutil.ReadFile(fp)
+		test.Nil(err)
+		outputs = append(outputs, string(data))
+		r.flow.Close()
+	}
+	test.Equal(outputs[0], outputs[1])
+	test.Equal(outputs[0], outputs[2])
+	test.Equal(outputs[0], "1.1.1.0/24\t\n8.8.8.8/32\t\n10.0.0.0/8\t\n10.0.0.0/16\t\n"+
+		"192.168.0.0/16\t\n2001:db8::/32\t\n2001:db8:1::/48\t\n")
+}
+
+func TestRouteAddEphemeralCIDR(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+
+	now := time.Now()
+	ei, err := r.AddEphemeralCIDR("1.2.3.4", "dns", time.Hour)
+	test.Nil(err)
+	test.Equal(ei.CIDR, "1.2.3.4/32")
+	test.True(!ei.Expired.Before(now.Add(time.Hour)))
+	test.True(ei.Expired.Before(time.Now().Add(time.Hour + time.Second)))
+
+	eis := r.GetEphemeralItems()
+	test.Equal(len(eis), 1)
+	test.Equal(eis[0].CIDR, "1.2.3.4/32")
+	test.Equal(eis[0].Comment, "dns")
+	test.Equal(eis[0].Expired, ei.Expired)
+	test.Equal(b.Added(), []string{"1.2.3.4/32"})
+
+	_, err = r.AddEphemeralCIDR("1.2.3.5", "", 0)
+	test.True(logex.Equal(err, ErrInvalidTTL))
+	_, err = r.AddEphemeralCIDR("invalid", "", time.Hour)
+	test.NotNil(err)
+	test.Equal(len(r.GetEphemeralItems()), 1)
+}
+
+func TestIfIndex(t *testing.T) {
+	defer test.New(t)
+
+	var mutex sync.Mutex
+	names := map[int]string{3: "utun3"}
+	r, backend := newTestRoute(&Config{
+		IfIndex: 3,
+		ResolveIfIndex: func(index int) (string, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			name, ok := names[index]
+			if !ok {
+				return "", fmt.Errorf("no such interface")
+			}
+			return name, nil
+		},
+		Logger: &captureLogger{},
+	})
+	defer r.flow.Close()
+
+	test.Nil(r.SetRoute("10.0.0.0/8"))
+	mutex.Lock()
+	names[3] = "utun4"
+	mutex.Unlock()
+	test.Nil(r.SetRoute("10.1.0.0/16"))
+
+	// fallback to the last known name
+	mutex.Lock()
+	delete(names, 3)
+	mutex.Unlock()
+	test.Nil(r.SetRoute("10.2.0.0/16"))
+	test.Equal(backend.Devs(), []string{"utun3", "utun4", "utun4"})
+
+	cmd, err := genAddRouteCmd(backend.Devs()[1], "10.1.0.0/16", 0, nil, 0)
+	test.Nil(err)
+	test.True(strings.Contains(strings.Join(cmd, " "), "utun4"))
+
+	// no name to fallback
+	r2 := NewRouteWithConfig(flow.New(), "", &Config{
+		Backend:        backend,
+		Sync:           true,
+		IfIndex:        5,
+		ResolveIfIndex: func(int) (string, error) { return "", fmt.Errorf("no such interface") },
+		Logger:         &captureLogger{},
+	})
+	defer r2.flow.Close()
+	test.NotNil(r2.SetRoute("10.3.0.0/16"))
+	test.Equal(len(backend.Devs()), 3)
+}
+
+func TestRouteSnapshotRestore(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12"} {
+		item, err := NewItemCIDR(cidr, "")
+		test.Nil(err)
+		test.Nil(r.AddItem(item))
+	}
+	_, err := r.AddEphemeralCIDR("1.2.3.4", "dns", time.Hour)
+	test.Nil(err)
+	state := r.Snapshot()
+	test.Equal(state.CIDRs(), []string{"1.2.3.4/32", "10.0.0.0/8", "172.16.0.0/12"})
+
+	// mutate the table
+	test.Nil(r.RemoveItem("10.0.0.0/8"))
+	test.Nil(r.RemoveEphemeralItem("1.2.3.4/32"))
+	item, err := NewItemCIDR("192.168.0.0/16", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	_, err = r.AddEphemeralCIDR("5.6.7.8", "dns", time.Hour)
+	test.Nil(err)
+
+	added, deleted := len(b.Added()), len(b.Deleted())
+	test.Equal(len(r.Restore(state)), 0)
+	test.Equal(b.Deleted()[deleted:], []string{"192.168.0.0/16", "5.6.7.8/32"})
+	test.Equal(b.Added()[added:], []string{"1.2.3.4/32", "10.0.0.0/8"})
+	test.Equal(r.Snapshot().CIDRs(), state.CIDRs())
+	eis := r.GetEphemeralItems()
+	test.Equal(len(eis), 1)
+	test.Equal(eis[0].Comment, "dns")
+	test.Equal(eis[0].Expired, state.EphemeralItems[0].Expired)
+
+	// nothing changed
+	added, deleted = len(b.Added()), len(b.Deleted())
+	test.Equal(len(r.Restore(state)), 0)
+	test.Equal(len(b.Added()), added)
+	test.Equal(len(b.Deleted()), deleted)
+}
+
+func TestRouteMatchAll(t *testing.T) {
+	defer test.New(t)
+
+	r, _ := newTestRoute(nil)
+	defer r.flow.Close()
+
+	item, err := NewItemCIDR("10.1.1.0/24", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	_, err = r.AddEphemeralCIDR("10.1.0.0/16", "", time.Hour)
+	test.Nil(err)
+	item, err = NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+
+	ipnet, err := parseIPNet("10.1.1.1")
+	test.Nil(err)
+	var cidrs []string
+	for _, item := range r.MatchAll(ipnet) {
+		cidrs = append(cidrs, item.CIDR)
+	}
+	test.Equal(cidrs, []string{"10.1.1.0/24", "10.1.0.0/16", "10.0.0.0/8"})
+	test.Equal(r.Match(ipnet).CIDR, "10.1.1.0/24")
+
+	ipnet, err = parseIPNet("10.2.0.1")
+	test.Nil(err)
+	test.Equal(len(r.MatchAll(ipnet)), 1)
+	ipnet, err = parseIPNet("192.168.0.1")
+	test.Nil(err)
+	test.Equal(len(r.MatchAll(ipnet)), 0)
+}
+
+func TestRouteDefaultRoute(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+
+	for _, cidr := range []string{DefaultRouteIPv4, DefaultRouteIPv6} {
+		item, err := NewItemCIDR(cidr, "")
+		test.Nil(err)
+		test.True(item.IsDefault())
+		test.True(logex.Equal(r.AddItem(item), ErrDefaultRoute))
+		_, err = r.AddEphemeralCIDR(cidr, "", time.Hour)
+		test.True(logex.Equal(err, ErrDefaultRoute))
+	}
+	test.Equal(len(b.Added()), 0)
+	test.True(logex.Equal(r.AddDefaultRoute("10.0.0.0/8", ""), ErrNotDefaultRoute))
+
+	test.Nil(r.AddDefaultRoute(DefaultRouteIPv4, "gateway"))
+	test.Equal(b.Added(), []string{DefaultRouteIPv4})
+
+	// the more specific items are still accepted
+	item, err := NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	_, err = r.AddEphemeralCIDR("1.2.3.4", "", time.Hour)
+	test.Nil(err)
+	test.Nil(r.PersistEphemeralItem("1.2.3.4/32"))
+	ipnet, err := parseIPNet("10.1.1.1")
+	test.Nil(err)
+	test.Equal(r.Match(ipnet).CIDR, "10.0.0.0/8")
+	ipnet, err = parseIPNet("8.8.8.8")
+	test.Nil(err)
+	test.Equal(r.Match(ipnet).CIDR, DefaultRouteIPv4)
+
+	test.Nil(r.RemoveDefaultRoute(DefaultRouteIPv4))
+	test.Equal(b.Deleted(), []string{DefaultRouteIPv4})
+	test.True(errors.Is(r.RemoveDefaultRoute(DefaultRouteIPv4), ErrRouteItemNotFound))
+
+	// allowed explicitly
+	r2, _ := newTestRoute(&Config{AllowDefaultRoute: true})
+	defer r2.flow.Close()
+	item, err = NewItemCIDR(DefaultRouteIPv6, "")
+	test.Nil(err)
+	test.Nil(r2.AddItem(item))
+}
+
+func TestRouteForEachItem(t *testing.T) {
+	defer test.New(t)
+
+	r, _ := newTestRoute(nil)
+	defer r.flow.Close()
+
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"} {
+		item, err := NewItemCIDR(cidr, "")
+		test.Nil(err)
+		test.Nil(r.AddItem(item))
+	}
+	var cidrs []string
+	r.ForEachItem(func(i Item) bool {
+		cidrs = append(cidrs, i.CIDR)
+		i.Comment = "changed"
+		return len(cidrs) < 2
+	})
+	test.Equal(cidrs, []string{"10.0.0.0/8", "172.16.0.0/12"})
+	test.Equal(r.GetItems()[0].Comment, "")
+
+	// GetItems returns a copy
+	items := r.GetItems()
+	items[0].Comment = "changed"
+	test.Equal(r.GetItems()[0].Comment, "")
+
+	// iterating while another goroutine changes the items
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			cidr := fmt.Sprintf("100.%v.0.0/16", i)
+			item, err := NewItemCIDR(cidr, "")
+			test.Nil(err)
+			test.Nil(r.AddItem(item))
+			test.Nil(r.RemoveItem(cidr))
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		n := 0
+		r.ForEachItem(func(i Item) bool {
+			n++
+			return true
+		})
+		test.True(n >= 3)
+	}
+}
+
+func TestRouteErrorTypes(t *testing.T) {
+	defer test.New(t)
+
+	r, _ := newTestRoute(nil)
+	defer r.flow.Close()
+
+	item, err := NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+
+	item, err = NewItemCIDR("10.1.0.0/16", "")
+	test.Nil(err)
+	err = r.AddItem(item)
+	var contains *ContainsError
+	test.True(errors.As(err, &contains))
+	test.Equal(contains.CIDR, "10.1.0.0/16")
+	test.Equal(contains.Container, "10.0.0.0/8")
+	test.True(errors.Is(err, ErrRouteItemContains))
+	test.False(errors.Is(err, ErrRouteItemNotFound))
+	test.Equal(err.Error(), "route item '10.1.0.0/16' contains by '10.0.0.0/8'")
+
+	err = r.RemoveItem("10.2.0.0/16")
+	var notFound *NotFoundError
+	test.True(errors.As(err, &notFound))
+	test.Equal(notFound.CIDR, "10.2.0.0/16")
+	test.True(errors.Is(err, ErrRouteItemNotFound))
+}
+
+func TestRouteLoadReaderSaveWriter(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+	rules := bytes.NewBufferString("# comment\n10.0.0.0/8\tlan\n8.8.8.8\tdns\tmanual\n")
+	test.Nil(r.LoadReader(rules))
+	test.Equal(cidrs(r.GetItems()), []string{"8.8.8.8/32", "10.0.0.0/8"})
+	test.Equal(b.Added(), []string{"10.0.0.0/8", "8.8.8.8/32"})
+
+	buf := bytes.NewBuffer(nil)
+	test.Nil(r.SaveWriter(buf))
+	test.Equal(buf.String(), "8.8.8.8/32\tdns\tmanual\n10.0.0.0/8\tlan\n")
+
+	r2, _ := newTestRoute(nil)
+	defer r2.flow.Close()
+	test.Nil(r2.LoadReader(buf))
+	test.Equal(r2.GetItems(), r.GetItems())
+
+	test.NotNil(r2.LoadReader(bytes.NewBufferString("not a cidr\n")))
+}
+
+func TestRouteCommentEscape(t *testing.T) {
+	defer test.New(t)
+
+	r, _ := newTestRoute(nil)
+	defer r.flow.Close()
+	comment := "lan\tsite=hk\nowner=ops \\ C:\\tmp"
+	item, _ := NewItemCIDR("10.0.0.0/8", comment)
+	test.Nil(r.AddItem(item))
+	item, _ = NewItemCIDR("8.8.8.8", "a\tb")
+	item.Source = SourceManual
+	test.Nil(r.AddItem(item))
+
+	buf := bytes.NewBuffer(nil)
+	test.Nil(r.SaveWriter(buf))
+	test.Equal(buf.String(), "8.8.8.8/32\ta\\tb\tmanual\n"+
+		"10.0.0.0/8\tlan\\tsite=hk\\nowner=ops \\\\ C:\\\\tmp\n")
+
+	r2, _ := newTestRoute(nil)
+	defer r2.flow.Close()
+	test.Nil(r2.LoadReader(buf))
+	items := r2.GetItems()
+	test.Equal(len(items), 2)
+	test.Equal(items[0].Comment, "a\tb")
+	test.Equal(items[0].Source, SourceManual)
+	test.Equal(items[1].Comment, comment)
+
+	// the comments written before escaping are kept
+	test.Equal(unescapeComment(`C:\Users\x\`), `C:\Users\x\`)
+	test.Equal(unescapeComment("plain"), "plain")
+}
+
+func TestNewRouteLocked(t *testing.T) {
+	defer test.New(t)
+
+	dir, err := ioutil.TempDir("", "route")
+	test.Nil(err)
+	defer os.RemoveAll(dir)
+	fp := filepath.Join(dir, "utun0.lock")
+
+	f := flow.New()
+	r, err := NewRouteLocked(f, "utun0", fp)
+	test.Nil(err)
+	test.NotNil(r)
+
+	// another daemon of the same device
+	done := make(chan error)
+	go func() {
+		_, err := NewRouteLocked(flow.New(), "utun0", fp)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		test.True(logex.Equal(err, ErrRouteLocked))
+	case <-time.After(time.Second):
+		test.Panic(0, "the second lock is not failed fast")
+	}
+
+	f.Close()
+	var r2 *Route
+	for i := 0; i < 100 && r2 == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		r2, err = NewRouteLocked(flow.New(), "utun0", fp)
+	}
+	test.Nil(err)
+	defer r2.flow.Close()
+
+	// Close release the lock, the flow is still open
+	r2.Close(false)
+	var r3 *Route
+	for i := 0; i < 100 && r3 == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		r3, err = NewRouteLocked(flow.New(), "utun0", fp)
+	}
+	test.Nil(err)
+	r3.flow.Close()
+
+	_, err = NewRouteLocked(flow.New(), "../utun0", "")
+	test.True(logex.Equal(err, ErrInvalidDevName))
+}
+
+func TestShellBackendIdempotent(t *testing.T) {
+	defer test.New(t)
+
+	var execErr error
+	var cmds [][]string
+	backend := ShellBackend{Exec: func(ctx context.Context, argv ...string) error {
+		cmds = append(cmds, argv)
+		return execErr
+	}, Output: listOutput("tun0", "10.0.0.0/8")}
+	ctx := context.Background()
+
+	execErr = fmt.Errorf("ip route add 10.0.0.0/8 dev tun0: exit status 2: RTNETLINK answers: File exists")
+	test.Nil(backend.SetRoute(ctx, "tun0", "10.0.0.0/8"))
+	execErr = fmt.Errorf("route add -net 10.0.0.0/8: exit status 1: add net 10.0.0.0: gateway tun0: File exists")
+	test.Nil(backend.SetRoute(ctx, "tun0", "10.0.0.0/8"))
+	test.True(IsRouteExists(syscall.EEXIST))
+
+	// the route exists through another device
+	err := backend.SetRoute(ctx, "tun1", "10.0.0.0/8")
+	test.True(logex.Equal(err, ErrRouteConflict))
+	err = backend.SetRoute(ctx, "tun0", "172.16.0.0/12")
+	test.True(logex.Equal(err, ErrRouteConflict))
+	cmds = cmds[:2]
+
+	execErr = fmt.Errorf("ip route delete 10.0.0.0/8: exit status 2: RTNETLINK answers: No such process")
+	test.Nil(backend.DeleteRoute(ctx, "10.0.0.0/8"))
+	execErr = fmt.Errorf("route delete -net 10.0.0.0/8: exit status 1: route: writing to routing socket: not in table")
+	test.Nil(backend.DeleteRoute(ctx, "10.0.0.0/8"))
+	test.Equal(len(cmds), 4)
+
+	// the other errors are kept
+	execErr = fmt.Errorf(`exec: "ip": executable file not found in $PATH`)
+	test.NotNil(backend.SetRoute(ctx, "tun0", "10.0.0.0/8"))
+	test.NotNil(backend.DeleteRoute(ctx, "10.0.0.0/8"))
+	execErr = fmt.Errorf("RTNETLINK answers: Operation not permitted")
+	test.NotNil(backend.SetRoute(ctx, "tun0", "10.0.0.0/8"))
+
+	// the route left by the last run
+	execErr = fmt.Errorf("RTNETLINK answers: File exists")
+	r := NewRouteWithConfig(flow.New(), "tun0", &Config{Backend: backend, Sync: true})
+	defer r.flow.Close()
+	item, err := NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+}
+
+func TestRouteMetrics(t *testing.T) {
+	defer test.New(t)
+
+	metrics := &MemMetrics{}
+	r, _ := newTestRoute(&Config{Metrics: metrics})
+	defer r.flow.Close()
+
+	item, err := NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("1.2.3.4", 20*time.Millisecond))
+	test.Nil(err)
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("4.3.2.1", time.Hour))
+	test.Nil(err)
+	added, removed, expired := metrics.Counters()
+	test.Equal([]uint64{added, removed, expired}, []uint64{3, 0, 0})
+	persistent, ephemeral := metrics.Gauges()
+	test.Equal([]int{persistent, ephemeral}, []int{1, 2})
+
+	// covered or extended is not an add
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("10.1.1.1", time.Hour))
+	test.Nil(err)
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("4.3.2.1", 2*time.Hour))
+	test.Nil(err)
+
+	test.True(waitFor(func() bool { return r.EphemeralCount() == 1 }))
+	added, removed, expired = metrics.Counters()
+	test.Equal([]uint64{added, removed, expired}, []uint64{3, 0, 1})
+	persistent, ephemeral = metrics.Gauges()
+	test.Equal([]int{persistent, ephemeral}, []int{1, 1})
+
+	test.Nil(r.RemoveEphemeralItem("4.3.2.1/32"))
+	test.Nil(r.RemoveItem("10.0.0.0/8"))
+	test.NotNil(r.RemoveItem("10.0.0.0/8"))
+	added, removed, expired = metrics.Counters()
+	test.Equal([]uint64{added, removed, expired}, []uint64{3, 2, 1})
+	persistent, ephemeral = metrics.Gauges()
+	test.Equal([]int{persistent, ephemeral}, []int{0, 0})
+}
+
+func TestRouteRemoveItem(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+	item, err := NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("4.3.2.1", time.Hour))
+	test.Nil(err)
+
+	test.Nil(r.RemoveItem("10.0.0.0/8"))
+	test.Equal(len(r.GetItems()), 0)
+	test.Nil(r.RemoveItem("4.3.2.1/32"))
+	test.Equal(r.EphemeralCount(), 0)
+	test.Equal(b.Deleted(), []string{"10.0.0.0/8", "4.3.2.1/32"})
+
+	err = r.RemoveItem("4.3.2.1/32")
+	test.True(errors.Is(err, ErrRouteItemNotFound))
+	err = r.RemoveItem("8.8.8.8/32")
+	test.True(errors.Is(err, ErrRouteItemNotFound))
+	test.Equal(len(b.Deleted()), 2)
+}
+
+func TestRouteReplaceItem(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+	item, err := NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("4.3.2.1", time.Hour))
+	test.Nil(err)
+
+	test.Nil(r.ReplaceItem("10.0.0.1/8", net.ParseIP("192.168.1.1"), 10))
+	test.Nil(r.ReplaceItem("4.3.2.1", nil, 5))
+	test.Equal(b.Replaced(), []string{"10.0.0.0/8 192.168.1.1 10", "4.3.2.1/32 <nil> 5"})
+	test.Equal(len(b.Deleted()), 0)
+	test.Equal(b.Added(), []string{"10.0.0.0/8", "4.3.2.1/32"})
+
+	items := r.GetItems()
+	test.Equal(len(items), 1)
+	test.Equal(items[0].Gateway.String(), "192.168.1.1")
+	test.Equal(items[0].Metric, 10)
+	ephemeral := r.GetEphemeralItems()
+	test.Equal(len(ephemeral), 1)
+	test.Equal(ephemeral[0].Metric, 5)
+
+	err = r.ReplaceItem("8.8.8.8/32", nil, 0)
+	test.True(errors.Is(err, ErrRouteItemNotFound))
+	err = r.ReplaceItem("10.0.0.0/8", nil, -1)
+	test.True(logex.Equal(err, ErrInvalidMetric))
+	err = r.ReplaceItem("10.0.0.0/8", net.ParseIP("2001:db8::1"), 0)
+	test.True(logex.Equal(err, ErrInvalidGateway))
+	test.Equal(len(b.Replaced()), 2)
+	test.Equal(r.GetItems()[0].Metric, 10)
+}
+
+func TestRouteReplaceItemPersist(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+	item, err := NewItemCIDR("10.0.0.0/8", "lan")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	item, err = NewItemCIDR("172.16.0.0/12", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	state := r.Snapshot()
+	test.Nil(r.ReplaceItem("10.0.0.0/8", net.ParseIP("192.168.1.1"), 10))
+	test.Nil(r.ReplaceItem("172.16.0.0/12", nil, 5))
+
+	buf := bytes.NewBuffer(nil)
+	test.Nil(r.SaveWriter(buf))
+	test.Equal(buf.String(), "10.0.0.0/8\tlan\t\tvia 192.168.1.1 metric 10\n"+
+		"172.16.0.0/12\t\t\tmetric 5\n")
+
+	// the loaded routes go through the gateway
+	r2, b2 := newTestRoute(nil)
+	defer r2.flow.Close()
+	saved := buf.String()
+	test.Nil(r2.LoadReader(buf))
+	buf.Reset()
+	test.Nil(r2.SaveWriter(buf))
+	test.Equal(buf.String(), saved)
+	test.Equal(b2.Via(), []string{"10.0.0.0/8 192.168.1.1 10", "172.16.0.0/12 <nil> 5"})
+
+	// the routes going another way are set again
+	replaced := r.Snapshot()
+	added, deleted := len(b.Added()), len(b.Deleted())
+	test.Equal(len(r.Restore(state)), 0)
+	test.Equal(b.Deleted()[deleted:], []string{"10.0.0.0/8", "172.16.0.0/12"})
+	test.Equal(b.Added()[added:], []string{"10.0.0.0/8", "172.16.0.0/12"})
+	test.Equal(len(b.Via()), 0)
+	test.Equal(len(r.Restore(replaced)), 0)
+	test.Equal(b.Via(), []string{"10.0.0.0/8 192.168.1.1 10", "172.16.0.0/12 <nil> 5"})
+
+	for _, line := range []string{
+		"10.0.0.0/8\t\t\tvia",
+		"10.0.0.0/8\t\t\tvia 300.0.0.1",
+		"10.0.0.0/8\t\t\tmetric -1",
+		"10.0.0.0/8\t\t\tvia 2001:db8::1",
+		"10.0.0.0/8\t\t\tdev eth0",
+	} {
+		_, err := parseRuleLine(line, false)
+		test.NotNil(err)
+	}
+}
+
+func TestRouteAudit(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+	for _, cidr := range []string{"10.0.0.0/8", "192.168.0.0/16"} {
+		item, err := NewItemCIDR(cidr, "")
+		test.Nil(err)
+		test.Nil(r.AddItem(item))
+	}
+	_, err := r.AddEphemeralCIDR("8.8.8.8", "", time.Minute)
+	test.Nil(err)
+
+	missing, unknown, err := r.Audit()
+	test.Nil(err)
+	test.Equal(missing, []string{"10.0.0.0/8", "192.168.0.0/16", "8.8.8.8/32"})
+	test.Equal(len(unknown), 0)
+
+	// 192.168.0.0/16 is deleted and 172.16.0.0/12 is added by others
+	b.mutex.Lock()
+	b.kernel = []string{"10.0.0.0/8", "8.8.8.8", "172.16.0.0/12"}
+	b.mutex.Unlock()
+	missing, unknown, err = r.Audit()
+	test.Nil(err)
+	test.Equal(missing, []string{"192.168.0.0/16"})
+	test.Equal(unknown, []string{"172.16.0.0/12"})
+
+	r2, _ := newTestRoute(&Config{
+		Backend:    &fakeBackend{delay: time.Second},
+		CmdTimeout: 20 * time.Millisecond,
+	})
+	defer r2.flow.Close()
+	_, _, err = r2.Audit()
+	test.True(logex.Equal(err, ErrRouteCmdTimeout))
+}
+
+func TestRouteExpiryBatchWindow(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(&Config{ExpiryBatchWindow: 50 * time.Millisecond})
+	defer r.flow.Close()
+	for idx, cidr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		ttl := 10*time.Millisecond + time.Duration(idx)*5*time.Millisecond
+		_, err := r.AddEphemeralItem(newTestEphemeralItem(cidr, ttl))
+		test.Nil(err)
+	}
+	test.True(waitFor(func() bool { return r.EphemeralCount() == 0 }))
+	test.Equal(atomic.LoadUint64(&r.expirePasses), uint64(1))
+	test.Equal(len(b.Deleted()), 3)
+}
+
+func TestRouteMinTTL(t *testing.T) {
+	defer test.New(t)
+
+	r, _ := newTestRoute(&Config{MinTTL: time.Minute})
+	defer r.flow.Close()
+	ei, err := r.AddEphemeralCIDR("10.0.0.1", "", time.Millisecond)
+	test.Nil(err)
+	test.True(ei.RemainingTTL() > 50*time.Second)
+
+	_, err = r.AddEphemeralCIDR("10.0.0.2", "", 0)
+	test.True(logex.Equal(err, ErrInvalidTTL))
+}
+
+func TestRouteVerifyAfterSet(t *testing.T) {
+	defer test.New(t)
+
+	b := &fakeBackend{}
+	// 10.0.0.0/8 is not installed though the command succeeds
+	b.onSet = func(cidr string) error {
+		if cidr != "10.0.0.0/8" {
+			b.mutex.Lock()
+			b.kernel = append(b.kernel, cidr)
+			b.mutex.Unlock()
+		}
+		return nil
+	}
+	r, _ := newTestRoute(&Config{Backend: b, VerifyAfterSet: true})
+	defer r.flow.Close()
+
+	item, err := NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.True(logex.Equal(r.AddItem(item), ErrRouteNotInstalled))
+	test.Equal(len(r.GetItems()), 0)
+
+	item, err = NewItemCIDR("192.168.0.0/16", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	test.Equal(len(r.GetItems()), 1)
+
+	_, err = r.AddEphemeralItem(newTestEphemeralItem("10.0.0.0/8", time.Minute))
+	test.True(logex.Equal(err, ErrRouteNotInstalled))
+	test.Equal(r.EphemeralCount(), 0)
+
+	// in background
+	r2 := NewRouteWithConfig(flow.New(), "utun0", &Config{Backend: b, VerifyAfterSet: true})
+	defer r2.flow.Close()
+	item, err = NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.Nil(r2.AddItem(item))
+	test.True(waitFor(func() bool { return len(r2.GetItems()) == 0 }))
+
+	// only the new item is rolled back, and its hits are dropped
+	b3 := &fakeBackend{}
+	gate := make(chan struct{})
+	var install int32
+	b3.onSet = func(cidr string) error {
+		<-gate
+		b3.mutex.Lock()
+		if atomic.LoadInt32(&install) == 1 {
+			b3.kernel = []string{cidr}
+		} else {
+			b3.kernel = nil
+		}
+		b3.mutex.Unlock()
+		return nil
+	}
+	r3 := NewRouteWithConfig(flow.New(), "utun0", &Config{Backend: b3, VerifyAfterSet: true})
+	defer r3.flow.Close()
+	item, err = NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.Nil(r3.AddItem(item))
+	_, err = r3.MatchIP("10.1.1.1")
+	test.Nil(err)
+	gate <- struct{}{}
+	test.True(waitFor(func() bool { return len(r3.GetItems()) == 0 }))
+
+	atomic.StoreInt32(&install, 1)
+	test.Nil(r3.AddItem(item))
+	gate <- struct{}{}
+	test.True(waitFor(func() bool { return r3.GetItems()[0].Status == StatusApplied }))
+	test.Equal(r3.Stats()["10.0.0.0/8"], uint64(0))
+
+	test.Nil(r3.RemoveItem("10.0.0.0/8"))
+	test.Nil(r3.AddDefaultRoute(DefaultRouteIPv4, ""))
+	gate <- struct{}{}
+	test.True(waitFor(func() bool { return r3.GetItems()[0].Status == StatusApplied }))
+	atomic.StoreInt32(&install, 0)
+	test.Nil(r3.AddDefaultRoute(DefaultRouteIPv4, ""))
+	gate <- struct{}{}
+	test.True(waitFor(func() bool {
+		items := r3.GetItems()
+		return len(items) == 1 && items[0].Status == StatusFailed
+	}))
+}
+
+func TestRouteNextHops(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+
+	item, err := NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	item.NextHops = []NextHop{{Weight: -1}}
+	test.True(logex.Equal(r.AddItem(item), ErrInvalidNextHop))
+	test.Equal(len(r.GetItems()), 0)
+
+	// fakeBackend is single path only
+	item.NextHops = []NextHop{{Weight: 1}}
+	test.True(logex.Equal(r.AddItem(item), ErrMultipathUnsupported))
+	ei := newTestEphemeralItem("192.168.0.0/16", time.Minute)
+	ei.NextHops = []NextHop{{Weight: 1}}
+	_, err = r.AddEphemeralItem(ei)
+	test.True(logex.Equal(err, ErrMultipathUnsupported))
+	test.Equal(len(b.Added()), 0)
+
+	item.NextHops = []NextHop{{Gateway: net.ParseIP("2001:db8::1")}}
+	test.True(logex.Equal(r.AddItem(item), ErrInvalidGateway))
+}
+
+// multipathBackend records the multipath routes like the gateway ones
+type multipathBackend struct {
+	*fakeBackend
+}
+
+func (b multipathBackend) SetMultipathRoute(ctx context.Context, devName, cidr string, hops []NextHop) error {
+	if err := b.SetRoute(ctx, devName, cidr); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	b.via = append(b.via, fmt.Sprintf("%v %v", cidr, hops))
+	b.mutex.Unlock()
+	return nil
+}
+
+func TestRouteNextHopsPersist(t *testing.T) {
+	defer test.New(t)
+
+	newRoute := func() (*Route, *fakeBackend) {
+		b := &fakeBackend{}
+		cfg := &Config{Backend: multipathBackend{b}, Sync: true}
+		return NewRouteWithConfig(flow.New(), "utun0", cfg), b
+	}
+	r, b := newRoute()
+	defer r.flow.Close()
+	item, err := NewItemCIDR("10.0.0.0/8", "lan")
+	test.Nil(err)
+	item.NextHops = []NextHop{
+		{Gateway: net.ParseIP("192.168.1.1"), Weight: 2},
+		{Dev: "eth1"},
+		{},
+	}
+	test.Nil(r.AddItem(item))
+	state := r.Snapshot()
+
+	buf := bytes.NewBuffer(nil)
+	test.Nil(r.SaveWriter(buf))
+	saved := buf.String()
+	test.Equal(saved, "10.0.0.0/8\tlan\t\tnexthop via 192.168.1.1 weight 2 nexthop dev eth1 nexthop\n")
+	r2, b2 := newRoute()
+	defer r2.flow.Close()
+	test.Nil(r2.LoadReader(buf))
+	test.Equal(b2.Via(), b.Via())
+	buf.Reset()
+	test.Nil(r2.SaveWriter(buf))
+	test.Equal(buf.String(), saved)
+
+	// the route is set again once the hops are changed
+	test.Nil(r.RemoveItem("10.0.0.0/8"))
+	item.NextHops = item.NextHops[:1]
+	test.Nil(r.AddItem(item))
+	via := len(b.Via())
+	test.Equal(len(r.Restore(state)), 0)
+	test.Equal(b.Via()[via:], []string{"10.0.0.0/8 [via 192.168.1.1 weight 2 dev eth1 ]"})
+	test.Equal(len(r.Restore(state)), 0)
+	test.Equal(len(b.Via()), via+1)
+
+	for _, line := range []string{
+		"10.0.0.0/8\t\t\tnexthop weight x",
+		"10.0.0.0/8\t\t\tnexthop via",
+		"10.0.0.0/8\t\t\tvia 192.168.1.1 nexthop dev eth1",
+		"10.0.0.0/8\t\t\tnexthop via 2001:db8::1",
+		"10.0.0.0/8\t\t\tnexthop weight 1000",
+	} {
+		_, err := parseRuleLine(line, false)
+		test.NotNil(err)
+	}
+}
+
+func TestRoutePauseExpiry(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+
+	r.PauseExpiry()
+	_, err := r.AddEphemeralCIDR("10.0.0.1", "", 20*time.Millisecond)
+	test.Nil(err)
+	_, err = r.AddEphemeralCIDR("10.0.0.2", "", time.Minute)
+	test.Nil(err)
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(r.EphemeralCount(), 2)
+	test.Equal(len(b.Deleted()), 0)
+
+	r.ResumeExpiry()
+	test.True(waitFor(func() bool { return r.EphemeralCount() == 1 }))
+	test.Equal(b.Deleted(), []string{"10.0.0.1/32"})
+	test.Equal(r.GetEphemeralItems()[0].CIDR, "10.0.0.2/32")
+
+	// the next expiry is recomputed after resumed
+	_, err = r.AddEphemeralCIDR("10.0.0.3", "", 20*time.Millisecond)
+	test.Nil(err)
+	test.True(waitFor(func() bool { return r.EphemeralCount() == 1 }))
+}
+
+func TestRouteAddItemPreserveExceptions(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+
+	item, err := NewItemCIDR("10.1.2.0/24", "exception")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	_, err = r.AddEphemeralCIDR("10.3.0.0/16", "", time.Minute)
+	test.Nil(err)
+	item, err = NewItemCIDR("192.168.0.0/16", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+
+	item, err = NewItemCIDR("10.0.0.0/8", "broad")
+	test.Nil(err)
+	exceptions, err := r.AddItemPreserveExceptions(item)
+	test.Nil(err)
+	test.Equal(exceptions, []string{"10.1.2.0/24", "10.3.0.0/16"})
+	test.Equal(len(b.Deleted()), 0)
+	test.Equal(b.Added(), []string{"10.1.2.0/24", "10.3.0.0/16", "192.168.0.0/16", "10.0.0.0/8"})
+	test.Equal(len(r.GetItems()), 3)
+	test.Equal(r.EphemeralCount(), 1)
+
+	for ip, cidr := range map[string]string{
+		"10.1.2.5": "10.1.2.0/24",
+		"10.1.3.5": "10.0.0.0/8",
+		"10.3.1.1": "10.3.0.0/16",
+	} {
+		got, err := r.MatchIP(ip)
+		test.Nil(err)
+		test.Equal(got.CIDR, cidr)
+	}
+}
+
+func TestRouteClose(t *testing.T) {
+	defer test.New(t)
+
+	r, b := newTestRoute(nil)
+	defer r.flow.Close()
+	item, err := NewItemCIDR("10.0.0.0/8", "")
+	test.Nil(err)
+	test.Nil(r.AddItem(item))
+	_, err = r.AddEphemeralCIDR("192.168.0.1", "", 20*time.Millisecond)
+	test.Nil(err)
+
+	// the loops are exited once Close returns
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			r.Close(false)
+		}()
+	}
+	close(start)
+	closed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		test.Panic(0, "Close is blocked")
+	}
+	test.False(r.Healthy())
+	test.False(r.flow.IsClosed())
+
+	// nothing is expired or flushed
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(r.EphemeralCount(), 1)
+	test.Equal(len(b.Deleted()), 0)
+	r.Close(true)
+	test.Equal(len(b.Deleted()), 0)
+
+	r, b = newTestRoute(nil)
+	defer r.flow.Close()
+	test.Nil(r.AddItem(item))
+	_, err = r.AddEphemeralCIDR("192.168.0.1", "", time.Minute)
+	test.Nil(err)
+	r.Close(true)
+	test.Equal(b.Deleted(), []string{"10.0.0.0/8", "192.168.0.1/32"})
+	test.Equal(len(r.GetItems()), 0)
+	test.Equal(r.EphemeralCount(), 0)
+
+	// nothing would apply the routes
+	test.True(logex.Equal(r.AddItem(item), ErrRouteClosed))
+	_, err = r.AddEphemeralCIDR("192.168.0.1", "", time.Minute)
+	test.True(logex.Equal(err, ErrRouteClosed))
+	test.True(logex.Equal(r.RemoveItem("10.0.0.0/8"), ErrRouteClosed))
+	test.True(logex.Equal(r.ReplaceItem("10.0.0.0/8", nil, 1), ErrRouteClosed))
+	errs := r.Restore(RouteState{Items: Items{*item}})
+	test.Equal(len(errs), 1)
+	test.True(logex.Equal(errs[0], ErrRouteClosed))
+	test.Equal(len(r.GetItems()), 0)
+	test.Equal(len(b.Added()), 2)
+}
+
+func TestRouteCloseFlushAsync(t *testing.T) {
+	defer test.New(t)
+
+	b := &fakeBackend{delay: 10 * time.Millisecond}
+	r := NewRouteWithConfig(flow.New(), "utun0", &Config{Backend: b})
+	defer r.flow.Close()
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12"} {
+		item, err := NewItemCIDR(cidr, "")
+		test.Nil(err)
+		test.Nil(r.AddItem(item))
+	}
+	test.True(waitFor(func() bool { return len(b.Added()) == 2 }))
+
+	// the deletes queued are executed before Close returns
+	r.Close(true)
+	test.Equal(b.Deleted(), []string{"10.0.0.0/8", "172.16.0.0/12"})
+}
@@ -0,0 +1,146 @@
+package route
+
+import (
+	"sort"
+	"time"
+)
+
+// RouteState is a copy of the persistent and ephemeral items, taken by
+// Snapshot and applied by Restore.
+type RouteState struct {
+	Items          Items
+	EphemeralItems []EphemeralItem
+}
+
+// CIDRs returns the sorted CIDRs of all the items in the state
+func (s RouteState) CIDRs() []string {
+	ret := make([]string, 0, len(s.Items)+len(s.EphemeralItems))
+	for _, i := range s.Items {
+		ret = append(ret, i.CIDR)
+	}
+	for _, ei := range s.EphemeralItems {
+		ret = append(ret, ei.CIDR)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+type cidrPath struct {
+	cidr string
+	routePath
+}
+
+// paths returns the paths of all the items sorted by CIDR
+func (s RouteState) paths() []cidrPath {
+	ret := make([]cidrPath, 0, len(s.Items)+len(s.EphemeralItems))
+	for _, i := range s.Items {
+		ret = append(ret, cidrPath{i.CIDR, i.path()})
+	}
+	for _, ei := range s.EphemeralItems {
+		ret = append(ret, cidrPath{ei.CIDR, ei.path()})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].cidr < ret[j].cidr })
+	return ret
+}
+
+// Snapshot returns a copy of the current items
+func (r *Route) Snapshot() RouteState {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.snapshotLocked()
+}
+
+func (r *Route) snapshotLocked() RouteState {
+	state := RouteState{
+		Items:          make(Items, len(*r.items)),
+		EphemeralItems: make([]EphemeralItem, 0, r.ephemeralItems.Len()),
+	}
+	copy(state.Items, *r.items)
+	for elem := r.ephemeralItems.list.Front(); elem != nil; elem = elem.Next() {
+		ei := elem.Value.(*EphemeralItem)
+		item := *ei.Item
+		state.EphemeralItems = append(state.EphemeralItems, EphemeralItem{
+			Item:    &item,
+			Expired: ei.Expired,
+		})
+	}
+	return state
+}
+
+// Restore replace the items by the state, only the routes which are
+// different from the current ones are set or deleted, the ones going
+// another way are set again. the ephemeral items
+// which are expired since the snapshot are not restored.
+func (r *Route) Restore(state RouteState) []error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.closedLocked(); err != nil {
+		return []error{err}
+	}
+
+	now := time.Now()
+	items := make(Items, len(state.Items))
+	copy(items, state.Items)
+	items.Sort()
+	ephemeralItems := NewEphemeralItems()
+	for _, ei := range state.EphemeralItems {
+		if ei.isExpiredAt(now) {
+			continue
+		}
+		item := *ei.Item
+		ephemeralItems.Add(&EphemeralItem{Item: &item, Expired: ei.Expired})
+	}
+
+	current := make(map[string]routePath)
+	for _, path := range r.snapshotLocked().paths() {
+		current[path.cidr] = path.routePath
+	}
+	target := RouteState{Items: items}
+	for elem := ephemeralItems.list.Front(); elem != nil; elem = elem.Next() {
+		target.EphemeralItems = append(target.EphemeralItems, *elem.Value.(*EphemeralItem))
+	}
+
+	r.items = &items
+	r.ephemeralItems = ephemeralItems
+	r.setGaugesLocked()
+	select {
+	case r.newEphemeralItem <- struct{}{}:
+	default:
+	}
+
+	var errs []error
+	var added, changed []string
+	for _, path := range target.paths() {
+		old, ok := current[path.cidr]
+		if !ok {
+			added = append(added, path.cidr)
+			continue
+		}
+		delete(current, path.cidr)
+		if !old.equal(path.routePath) {
+			changed = append(changed, path.cidr)
+		}
+	}
+	removed := make([]string, 0, len(current)+len(changed))
+	for cidr := range current {
+		removed = append(removed, cidr)
+		r.forgetHits(cidr)
+	}
+	sort.Strings(removed)
+	removed = append(removed, changed...)
+	for _, cidr := range removed {
+		if err := r.unapplyRoute(cidr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	paths := make(map[string]routePath)
+	for _, path := range target.paths() {
+		paths[path.cidr] = path.routePath
+	}
+	for _, cidr := range append(added, changed...) {
+		if err := r.applyRoute(cidr, paths[cidr], false); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
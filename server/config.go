@@ -31,6 +31,7 @@ type Config struct {
 	Net      *ip.IPNet `default:"10.8.0.1/24"`
 	Pprof    string    `default:":10060"`
 	DevId    int
+	Checksum bool `desc:"checksum the outgoing packets if the client supports"`
 
 	DBPath string `desc:"filepath to persist user info" default:"nextuser"`
 }
@@ -3,6 +3,7 @@ package server
 import (
 	"github.com/chzyer/logex"
 	"github.com/chzyer/next/mchan"
+	"github.com/chzyer/next/packet"
 	"github.com/chzyer/next/uc"
 )
 
@@ -35,6 +36,8 @@ func (h *HttpApi) Auth(req *mchan.Req) interface{} {
 		u.Net = h.delegate.AllocIP()
 	}
 
+	u.PacketVersion, u.Caps = packet.Negotiate(authReq.PacketVersion, packet.Caps(authReq.Caps))
+
 	logex.Info("login success, fetching datachannel")
 	auth := &uc.AuthResponse{
 		Gateway:     h.delegate.GetGateway().String(),
@@ -44,7 +47,20 @@ func (h *HttpApi) Auth(req *mchan.Req) interface{} {
 		Token:       u.Token,
 		ChannelType: h.delegate.GetChannelType(),
 		DataChannel: h.delegate.GetDataChannel(),
+		Version:     authReq.Version,
+
+		PacketVersion: u.PacketVersion,
+		Caps:          uint32(u.Caps),
+		Nonce:         packet.NewLoginNonce(),
+	}
+	if auth.Version > packet.L2Version {
+		auth.Version = packet.L2Version
+	}
+	// the AEAD needs the keys of the login
+	if len(authReq.Nonce) == 0 {
+		auth.Version = packet.L2VersionCFB
 	}
+	u.Login = packet.NewLogin([]byte(u.Token), authReq.Nonce, auth.Nonce)
 	h.delegate.OnNewUser(int(u.Id))
 	return auth
 }
@@ -92,6 +92,7 @@ func (s *Server) initAndRunTun() error {
 
 func (s *Server) initControllerGroup() {
 	s.controllerGroup = controller.NewGroup(s.flow, s, s.uc, s.tun.WriteChan())
+	s.controllerGroup.SetChecksum(s.cfg.Checksum)
 	go s.controllerGroup.RunDeliver(s.tun.ReadChan())
 }
 
@@ -145,12 +146,15 @@ func (s *Server) GetUserChannelFromDataChannel(id int) (
 	return
 }
 
-func (s *Server) GetUserToken(id int) ([]byte, error) {
+func (s *Server) GetUserLogin(id int) (*packet.Login, error) {
 	u := s.uc.FindId(id)
 	if u == nil {
 		return nil, uc.ErrUserNotFound.Trace()
 	}
-	return []byte(u.Token), nil
+	if u.Login == nil {
+		return packet.NewLogin([]byte(u.Token), nil, nil), nil
+	}
+	return u.Login, nil
 }
 
 func (s *Server) OnDChanUpdate(port []int) {
@@ -6,6 +6,7 @@ import (
 
 	"github.com/chzyer/logex"
 	"github.com/chzyer/next/crypto"
+	"github.com/chzyer/next/packet"
 )
 
 var (
@@ -24,6 +25,16 @@ type AuthRequest struct {
 	UserName string `json:"username"`
 	Token    []byte `json:"token"`
 	IV       []byte `json:"iv"`
+	// Version is the highest L2 version supported by the client, see
+	// packet.L2Version. the old clients leave it zero.
+	Version int `json:"version,omitempty"`
+	// PacketVersion is the highest packet version supported by the client
+	// and Caps are its features, see packet.Negotiate.
+	PacketVersion int    `json:"packetversion,omitempty"`
+	Caps          uint32 `json:"caps,omitempty"`
+	// Nonce is random per login, the L2 keys are derived from the nonces of
+	// both sides, see packet.NewLogin.
+	Nonce []byte `json:"nonce,omitempty"`
 }
 
 // passcode: sha1(password + salt)
@@ -41,6 +52,7 @@ func NewAuthRequest(userName string, timestamp int64, passcode, key []byte) *Aut
 		UserName: userName,
 		Token:    token,
 		IV:       iv,
+		Nonce:    packet.NewLoginNonce(),
 	}
 }
 
@@ -65,4 +77,15 @@ type AuthResponse struct {
 	Token       string `json:"token"`
 	DataChannel int    `json:"datachannel"`
 	ChannelType string `json:"channeltype"`
+	// Version is the L2 version the client should send, the old servers
+	// leave it zero.
+	Version int `json:"version,omitempty"`
+	// PacketVersion and Caps are negotiated by the server, the old servers
+	// leave them zero.
+	PacketVersion int    `json:"packetversion,omitempty"`
+	Caps          uint32 `json:"caps,omitempty"`
+	// Nonce is random per login, the old servers leave it empty
+	Nonce []byte `json:"nonce,omitempty"`
+	// ClientNonce is the Nonce of the request, it's kept by the client
+	ClientNonce []byte `json:"-"`
 }
@@ -136,6 +136,12 @@ type User struct {
 	*UserInfo
 	Net   *ip.IP
 	Token string
+	// PacketVersion and Caps are negotiated by the last login, see
+	// packet.Negotiate
+	PacketVersion int
+	Caps          packet.Caps
+	// Login is the last login, the L2 keys are derived from it
+	Login *packet.Login
 	chan1 packet.Chan
 	chan2 packet.Chan
 }
@@ -1,6 +1,11 @@
 package util
 
-import "io"
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
 
 func ReadFull(r io.Reader, n int) ([]byte, error) {
 	ret := make([]byte, n)
@@ -10,3 +15,30 @@ func ReadFull(r io.Reader, n int) ([]byte, error) {
 	}
 	return ret, nil
 }
+
+// WriteFileAtomic write data to a temp file in the same directory and rename
+// it to fp, so fp is either the old content or the new content.
+func WriteFileAtomic(fp string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(fp), "."+filepath.Base(fp)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, fp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
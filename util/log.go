@@ -0,0 +1,13 @@
+package util
+
+import "github.com/chzyer/logex"
+
+// Logger is the minimal logger accepted by the packages which can be
+// embedded as library.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// DefaultLogger write the logs by logex
+var DefaultLogger Logger = logex.NewLogger(0)
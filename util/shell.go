@@ -1,8 +1,12 @@
 package util
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"os/exec"
+	"strings"
 )
 
 func Shell(s string) error {
@@ -13,3 +17,45 @@ func Shell(s string) error {
 	}
 	return errors.New(s + ": " + string(ret))
 }
+
+// ShellContext run the command like Shell, but the command is killed once the
+// ctx is done. the stderr output is captured into the returned error.
+func ShellContext(ctx context.Context, s string) error {
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.CommandContext(ctx, "/bin/bash", "-c", s)
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return fmt.Errorf("%v: %v: %v", s, err, strings.TrimSpace(stderr.String()))
+}
+
+// ExecContext run the program with args directly without a shell, so the
+// args are never interpreted. the stderr output is captured into the
+// returned error.
+func ExecContext(ctx context.Context, argv ...string) error {
+	_, err := ExecOutputContext(ctx, argv...)
+	return err
+}
+
+// ExecOutputContext is like ExecContext but returns the stdout output
+func ExecOutputContext(ctx context.Context, argv ...string) ([]byte, error) {
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err == nil {
+		return stdout.Bytes(), nil
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return nil, fmt.Errorf("%v: %v: %v", strings.Join(argv, " "), err,
+		strings.TrimSpace(stderr.String()))
+}
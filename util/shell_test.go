@@ -0,0 +1,51 @@
+package util
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chzyer/test"
+)
+
+func TestShellContext(t *testing.T) {
+	defer test.New(t)
+
+	test.Nil(ShellContext(context.Background(), "true"))
+
+	err := ShellContext(context.Background(), "echo oops >&2; exit 1")
+	test.NotNil(err)
+	test.True(strings.Contains(err.Error(), "oops"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	now := time.Now()
+	err = ShellContext(ctx, "sleep 5")
+	test.NotNil(err)
+	test.True(time.Since(now) < time.Second)
+	test.True(strings.Contains(err.Error(), context.DeadlineExceeded.Error()))
+}
+
+func TestExecContext(t *testing.T) {
+	defer test.New(t)
+
+	test.Nil(ExecContext(context.Background(), "true"))
+
+	// the args are not interpreted by a shell
+	err := ExecContext(context.Background(), "ls", "/nonexistent; echo injected")
+	test.NotNil(err)
+	test.False(strings.Contains(err.Error(), "\ninjected"))
+	test.True(strings.Contains(err.Error(), "No such file"))
+}
+
+func TestExecOutputContext(t *testing.T) {
+	defer test.New(t)
+
+	out, err := ExecOutputContext(context.Background(), "echo", "hello")
+	test.Nil(err)
+	test.Equal(string(out), "hello\n")
+
+	_, err = ExecOutputContext(context.Background(), "ls", "/nonexistent")
+	test.True(strings.Contains(err.Error(), "No such file"))
+}